@@ -0,0 +1,368 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/vlado-github/tinydfs/logging"
+	"github.com/vlado-github/tinydfs/messaging"
+	"github.com/vlado-github/tinydfs/persistance"
+)
+
+// Client is a lightweight connection to a TinyDFS cluster.
+// It talks to a single cluster member and fails over to the
+// next member from the network registry if that one is down.
+// Partition key of a context from messaging.WithPartitionKey is
+// sent with Put, Get, Update and Delete calls.
+type Client interface {
+	Put(ctx context.Context, topic string, payload []byte) (uuid.UUID, error)
+	Get(ctx context.Context, topic string, key uuid.UUID) (string, error)
+	Update(ctx context.Context, topic string, key uuid.UUID, text string) error
+	Delete(ctx context.Context, topic string, key uuid.UUID) error
+	Scan(ctx context.Context, topic string) ([]persistance.Record, error)
+	Subscribe(ctx context.Context, topic string) (<-chan messaging.Message, error)
+	PutStream(ctx context.Context, topic string, r io.Reader) (uuid.UUID, error)
+	GetStream(ctx context.Context, topic string, key uuid.UUID) (io.ReadCloser, error)
+
+	GetNetworkRegistry() messaging.NetworkRegistry
+	Close() error
+}
+
+// Options configures timeouts and retries of the client
+type Options struct {
+	Timeout    time.Duration
+	MaxRetries int
+	RetryDelay time.Duration
+	Protocol   string
+}
+
+// ErrClientClosed is returned by calls on a closed client
+var ErrClientClosed = errors.New("Client is closed")
+
+type client struct {
+	options         Options
+	lock            sync.Mutex
+	member          messaging.ConnParams
+	broadcastQueue  messaging.ConnParams
+	rpc             messaging.RpcClient
+	networkRegistry messaging.NetworkRegistry
+	closed          bool
+}
+
+// DefaultOptions returns options used by NewClient
+func DefaultOptions() Options {
+	return Options{
+		Timeout:    messaging.DefaultRpcTimeout,
+		MaxRetries: 3,
+		RetryDelay: 200 * time.Millisecond,
+		Protocol:   "tcp",
+	}
+}
+
+// NewClient connects to a cluster member and discovers the network registry
+func NewClient(member messaging.ConnParams, options Options) (Client, error) {
+	if member.Protocol == "" {
+		member.Protocol = options.Protocol
+	}
+	c := &client{
+		options:         options,
+		member:          member,
+		networkRegistry: messaging.NewNetworkRegistry(),
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	err := c.connect()
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *client) Put(ctx context.Context, topic string, payload []byte) (uuid.UUID, error) {
+	if err := persistance.ValidateMessageTopic(topic); err != nil {
+		return uuid.Nil, err
+	}
+	// key is generated here, so a retried put replaces the same record
+	key := uuid.New()
+	request := messaging.PutRequest{Topic: topic, Key: key, Payload: payload, PartitionKey: messaging.PartitionKeyFromContext(ctx)}
+	err := c.call(ctx, messaging.RPC_CLIENT_PUT, request, nil)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	return key, nil
+}
+
+func (c *client) Get(ctx context.Context, topic string, key uuid.UUID) (string, error) {
+	var value string
+	err := c.call(ctx, messaging.RPC_CLIENT_GET, messaging.KeyRequest{Topic: topic, Key: key, PartitionKey: messaging.PartitionKeyFromContext(ctx)}, &value)
+	return value, err
+}
+
+func (c *client) Update(ctx context.Context, topic string, key uuid.UUID, text string) error {
+	return c.call(ctx, messaging.RPC_CLIENT_UPDATE, messaging.KeyRequest{Topic: topic, Key: key, Text: text, PartitionKey: messaging.PartitionKeyFromContext(ctx)}, nil)
+}
+
+func (c *client) Delete(ctx context.Context, topic string, key uuid.UUID) error {
+	return c.call(ctx, messaging.RPC_CLIENT_DELETE, messaging.KeyRequest{Topic: topic, Key: key, PartitionKey: messaging.PartitionKeyFromContext(ctx)}, nil)
+}
+
+func (c *client) Scan(ctx context.Context, topic string) ([]persistance.Record, error) {
+	var records []persistance.Record
+	err := c.call(ctx, messaging.RPC_CLIENT_SCAN, topic, &records)
+	return records, err
+}
+
+// PutStream uploads payload of any size as sequence of chunks
+// followed by the manifest. Returns the key of the manifest.
+func (c *client) PutStream(ctx context.Context, topic string, r io.Reader) (uuid.UUID, error) {
+	if err := persistance.ValidateTopic(topic); err != nil {
+		return uuid.Nil, err
+	}
+	send := func(topic string, payload []byte) (uuid.UUID, error) {
+		return c.Put(ctx, topic, payload)
+	}
+	manifest, err := messaging.SendChunks(topic, r, send)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	text, err := persistance.EncodeManifest(manifest)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	return c.Put(ctx, topic, []byte(text))
+}
+
+// GetStream reads value of the key, chunks are downloaded
+// one at a time and verified against their checksums
+func (c *client) GetStream(ctx context.Context, topic string, key uuid.UUID) (io.ReadCloser, error) {
+	text, err := c.Get(ctx, topic, key)
+	if err != nil {
+		return nil, err
+	}
+	return messaging.NewStreamReader(text, func(chunkKey uuid.UUID) (string, error) {
+		return c.Get(ctx, persistance.ChunkTopicName(topic), chunkKey)
+	}), nil
+}
+
+// Subscribe streams messages of the topic broadcast by the cluster
+// until the context is done. Broken connection to the broadcast
+// queue is reopened on the queue the cluster currently uses.
+func (c *client) Subscribe(ctx context.Context, topic string) (<-chan messaging.Message, error) {
+	conn, err := c.dialBroadcastQueue(ctx, topic)
+	if err != nil {
+		return nil, err
+	}
+	messages := make(chan messaging.Message)
+	go func() {
+		defer close(messages)
+		stop := context.AfterFunc(ctx, func() { conn.Close() })
+		defer stop()
+		for {
+			decoder := json.NewDecoder(conn)
+			for {
+				var message messaging.Message
+				if decoder.Decode(&message) != nil {
+					break
+				}
+				if message.Topic != topic {
+					continue
+				}
+				select {
+				case messages <- message:
+				case <-ctx.Done():
+					return
+				}
+			}
+			conn.Close()
+			if ctx.Err() != nil {
+				return
+			}
+			logging.AddWarning("[Client] Subscription interrupted, reconnecting.")
+			conn, err = c.dialBroadcastQueue(ctx, topic)
+			if err != nil {
+				logging.AddError("[Client] Subscription closed.", err.Error())
+				return
+			}
+			stop()
+			stop = context.AfterFunc(ctx, func() { conn.Close() })
+		}
+	}()
+	return messages, nil
+}
+
+func (c *client) GetNetworkRegistry() messaging.NetworkRegistry {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.networkRegistry
+}
+
+func (c *client) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.closed = true
+	if c.rpc != nil {
+		return c.rpc.Close()
+	}
+	return nil
+}
+
+// Calls the current member, in case of connection failure
+// retries on the next available member
+func (c *client) call(ctx context.Context, method string, request interface{}, response interface{}) error {
+	var err error
+	for attempt := 0; attempt <= c.options.MaxRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(c.options.RetryDelay):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		var rpc messaging.RpcClient
+		rpc, err = c.getRpcClient()
+		if err == ErrClientClosed {
+			return err
+		}
+		if err != nil {
+			continue
+		}
+		callCtx, cancel := context.WithTimeout(ctx, c.options.Timeout)
+		err = rpc.Call(callCtx, method, request, response)
+		cancel()
+		if !isConnectionError(err) {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		c.failover(rpc)
+	}
+	return err
+}
+
+func (c *client) getRpcClient() (messaging.RpcClient, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return nil, ErrClientClosed
+	}
+	if c.rpc != nil {
+		return c.rpc, nil
+	}
+	err := c.connect()
+	if err != nil {
+		c.networkRegistry.SetQueueUnresponsive(c.member.Ip, c.member.Port)
+		c.nextMember()
+	}
+	return c.rpc, err
+}
+
+// Marks current member unresponsive and moves to the next one
+func (c *client) failover(failed messaging.RpcClient) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.rpc != failed {
+		return
+	}
+	c.rpc.Close()
+	c.rpc = nil
+	c.networkRegistry.SetQueueUnresponsive(c.member.Ip, c.member.Port)
+	c.nextMember()
+}
+
+func (c *client) nextMember() {
+	networkTuple := c.networkRegistry.GetNextQueue()
+	if networkTuple == nil {
+		return
+	}
+	logging.AddTrace("[Client] Try next member:", networkTuple.GetIP(), networkTuple.GetQueuePort())
+	c.member = messaging.ConnParams{
+		Ip:       networkTuple.GetIP(),
+		Port:     networkTuple.GetQueuePort(),
+		Protocol: c.member.Protocol,
+	}
+}
+
+// Connects to the member and refreshes the network registry
+func (c *client) connect() error {
+	rpc, err := messaging.DialRpc(c.member)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.options.Timeout)
+	defer cancel()
+	var members messaging.MembersResponse
+	err = rpc.Call(ctx, messaging.RPC_CLIENT_MEMBERS, nil, &members)
+	if err != nil {
+		rpc.Close()
+		return err
+	}
+	c.rpc = rpc
+	c.broadcastQueue = members.BroadcastQueue
+	if len(members.NetworkRegistry) > 0 {
+		registry := messaging.NewNetworkRegistry()
+		if registry.FromByteArray(members.NetworkRegistry) == nil {
+			c.networkRegistry = registry
+		}
+	}
+	return nil
+}
+
+// Dials the broadcast queue and subscribes the connection to the topic
+func (c *client) dialBroadcastQueue(ctx context.Context, topic string) (net.Conn, error) {
+	var err error
+	for attempt := 0; attempt <= c.options.MaxRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(c.options.RetryDelay):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			// reconnect to learn the queue the cluster failed over to
+			c.lock.Lock()
+			if c.rpc != nil {
+				c.rpc.Close()
+				c.rpc = nil
+			}
+			c.lock.Unlock()
+			_, err = c.getRpcClient()
+			if err != nil {
+				continue
+			}
+		}
+		c.lock.Lock()
+		queue := c.broadcastQueue
+		c.lock.Unlock()
+		var conn net.Conn
+		conn, err = messaging.Dial(ctx, queue)
+		if err != nil {
+			continue
+		}
+		subscribe := messaging.Message{Key: uuid.New(), Topic: messaging.SUBSCRIBE, Payload: []byte(topic)}
+		err = json.NewEncoder(conn).Encode(subscribe)
+		if err == nil {
+			return conn, nil
+		}
+		conn.Close()
+	}
+	return nil, err
+}
+
+// Deadline of a call is not a connection error, the member
+// may still apply the request, so it is not sent to another one.
+func isConnectionError(err error) bool {
+	if err == nil || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return false
+	}
+	if err == messaging.ErrRpcClosed {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
@@ -0,0 +1,170 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/vlado-github/tinydfs/messaging"
+)
+
+// nodes of the tests run on the in-memory network, so no port is bound
+var queueConnParams = messaging.ConnParams{
+	Ip: "localhost", Port: "1", Protocol: messaging.PROTOCOL_MEMORY,
+}
+
+var masterNode messaging.Node
+
+func TestMain(m *testing.M) {
+	// setup
+	dataDir, err := os.MkdirTemp("", "tinydfs-data")
+	if err != nil {
+		panic(err)
+	}
+	os.Setenv(messaging.DataDirEnv, dataDir)
+	masterNode = messaging.NewNode(queueConnParams, queueConnParams, true)
+	go masterNode.Run()
+	time.Sleep(100 * time.Millisecond)
+
+	retCode := m.Run()
+
+	//cleanup
+	masterNode.CloseConn()
+	os.RemoveAll(dataDir)
+	os.Exit(retCode)
+}
+
+func TestClient_PutGetDelete(t *testing.T) {
+	c, err := NewClient(queueConnParams, DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ctx := context.Background()
+	key, err := c.Put(ctx, "TestClient", []byte("Hello world!"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var value string
+	for i := 0; i < 50; i++ {
+		value, err = c.Get(ctx, "TestClient", key)
+		if err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if value != "Hello world!" {
+		t.Fatal(value, err)
+	}
+	records, err := c.Scan(ctx, "TestClient")
+	if err != nil || len(records) == 0 {
+		t.Fail()
+	}
+	err = c.Delete(ctx, "TestClient", key)
+	if err != nil {
+		t.Fail()
+	}
+	_, err = c.Get(ctx, "TestClient", key)
+	if err == nil {
+		t.Fail()
+	}
+}
+
+func TestClient_Subscribe(t *testing.T) {
+	c, err := NewClient(queueConnParams, DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	messages, err := c.Subscribe(ctx, "TestSubscribe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := c.Put(ctx, "TestSubscribe", []byte("Hello subscriber!"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case message := <-messages:
+		if message.Key != key || string(message.Payload) != "Hello subscriber!" {
+			t.Fail()
+		}
+	case <-ctx.Done():
+		t.Fail()
+	}
+}
+
+func TestClient_Unreachable(t *testing.T) {
+	options := DefaultOptions()
+	options.MaxRetries = 1
+	_, err := NewClient(messaging.ConnParams{Ip: "localhost", Port: "2", Protocol: messaging.PROTOCOL_MEMORY}, options)
+	if err == nil {
+		t.Fail()
+	}
+}
+
+func TestClient_PutGetStream(t *testing.T) {
+	c, err := NewClient(queueConnParams, DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ctx := context.Background()
+	data := bytes.Repeat([]byte("0123456789abcdef"), 5000)
+	key, err := c.PutStream(ctx, "TestStream", bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result []byte
+	for i := 0; i < 50; i++ {
+		var reader io.ReadCloser
+		reader, err = c.GetStream(ctx, "TestStream", key)
+		if err == nil {
+			result, err = io.ReadAll(reader)
+			reader.Close()
+			if err == nil {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if !bytes.Equal(result, data) {
+		t.Fatal(len(result), err)
+	}
+}
+
+func TestClient_TimeoutDoesNotResend(t *testing.T) {
+	var calls atomic.Int32
+	masterNode.RegisterRpcHandler("TEST_SLOW", messaging.NewRpcHandler(func(ctx context.Context, _ struct{}) (bool, error) {
+		calls.Add(1)
+		time.Sleep(200 * time.Millisecond)
+		return true, nil
+	}))
+	options := DefaultOptions()
+	options.Timeout = 50 * time.Millisecond
+	options.RetryDelay = 10 * time.Millisecond
+	c, err := NewClient(queueConnParams, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	err = c.(*client).call(context.Background(), "TEST_SLOW", struct{}{}, nil)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Error(err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if calls.Load() != 1 {
+		t.Error("Timed out call was resent", calls.Load())
+	}
+}
@@ -0,0 +1,180 @@
+package grpcgateway
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/vlado-github/tinydfs/internal/gatewaytest"
+	"github.com/vlado-github/tinydfs/messaging"
+	"github.com/vlado-github/tinydfs/persistance"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func startServer(t *testing.T) (*gatewaytest.Backend, *grpc.ClientConn) {
+	b := gatewaytest.NewQueuedBackend(t)
+
+	listener := bufconn.Listen(1 << 20)
+	s := NewServer(b)
+	go s.Serve(listener)
+	t.Cleanup(s.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return b, conn
+}
+
+func TestServer_PutGetUpdateDelete(t *testing.T) {
+	b, conn := startServer(t)
+	c := NewTinyDfsClient(conn)
+	ctx := context.Background()
+
+	put, err := c.Put(ctx, &PutRequest{Topic: "sport", Value: []byte("We're watching a match.")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// puts are acknowledged before the queue delivers them
+	b.Flush()
+	get, err := c.Get(ctx, &GetRequest{Topic: "sport", Key: put.Key})
+	if err != nil || string(get.Value) != "We're watching a match." {
+		t.Fatal(get, err)
+	}
+	_, err = c.Update(ctx, &UpdateRequest{Topic: "sport", Key: put.Key, Value: []byte("Goal!")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	get, err = c.Get(ctx, &GetRequest{Topic: "sport", Key: put.Key})
+	if err != nil || string(get.Value) != "Goal!" {
+		t.Fail()
+	}
+	_, err = c.Delete(ctx, &DeleteRequest{Topic: "sport", Key: put.Key})
+	if err != nil {
+		t.Fail()
+	}
+	_, err = c.Get(ctx, &GetRequest{Topic: "sport", Key: put.Key})
+	if status.Code(err) != codes.NotFound {
+		t.Fail()
+	}
+	_, err = c.Get(ctx, &GetRequest{Topic: "sport", Key: "not-a-uuid"})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fail()
+	}
+}
+
+func TestServer_BackendErrors(t *testing.T) {
+	b, conn := startServer(t)
+	c := NewTinyDfsClient(conn)
+	ctx := context.Background()
+	key := uuid.New().String()
+	cases := []struct {
+		err  error
+		code codes.Code
+	}{
+		{persistance.ErrNotFound, codes.NotFound},
+		{fmt.Errorf("%w, 1 of 3 replicas", messaging.ErrNoQuorum), codes.Unavailable},
+		{context.DeadlineExceeded, codes.DeadlineExceeded},
+		{errors.New("disk failed"), codes.Internal},
+	}
+	for _, test := range cases {
+		b.Fail(test.err)
+		_, err := c.Get(ctx, &GetRequest{Topic: "sport", Key: key})
+		if status.Code(err) != test.code {
+			t.Error("get", test.err, err)
+		}
+		_, err = c.Update(ctx, &UpdateRequest{Topic: "sport", Key: key, Value: []byte("Goal!")})
+		if status.Code(err) != test.code {
+			t.Error("update", test.err, err)
+		}
+		_, err = c.Delete(ctx, &DeleteRequest{Topic: "sport", Key: key})
+		if status.Code(err) != test.code {
+			t.Error("delete", test.err, err)
+		}
+	}
+}
+
+func TestServer_Scan(t *testing.T) {
+	b, conn := startServer(t)
+	c := NewTinyDfsClient(conn)
+	ctx := context.Background()
+	for _, text := range []string{"first", "second", "third"} {
+		c.Put(ctx, &PutRequest{Topic: "news", Value: []byte(text)})
+	}
+	b.Flush()
+
+	stream, err := c.Scan(ctx, &ScanRequest{Topic: "news", From: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []*Record
+	for {
+		record, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, record)
+	}
+	if len(records) != 2 || string(records[0].Value) != "second" || records[1].Offset != 2 {
+		t.Fail()
+	}
+}
+
+func TestServer_Subscribe(t *testing.T) {
+	b, conn := startServer(t)
+	c := NewTinyDfsClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	stream, err := c.Subscribe(ctx, &SubscribeRequest{Topic: "sport"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for b.Subscribers() == 0 {
+			time.Sleep(10 * time.Millisecond)
+		}
+		c.Put(ctx, &PutRequest{Topic: "news", Value: []byte("skipped")})
+		c.Put(ctx, &PutRequest{Topic: "sport", Value: []byte("Goal!")})
+	}()
+	record, err := stream.Recv()
+	if err != nil || string(record.Value) != "Goal!" {
+		t.Fatal(record, err)
+	}
+}
+
+func TestAdmin_ListMembersAndCreateTopic(t *testing.T) {
+	b, conn := startServer(t)
+	c := NewTinyDfsAdminClient(conn)
+	ctx := context.Background()
+
+	members, err := c.ListMembers(ctx, &ListMembersRequest{})
+	if err != nil || len(members.Members) != 1 || members.Members[0].Id != "node-a" || !members.Members[0].Available {
+		t.Fatal(members, err)
+	}
+	_, err = c.CreateTopic(ctx, &CreateTopicRequest{Topic: "sport", Partitions: 4, Replicas: 2})
+	if err != nil || len(b.Topics()) != 1 {
+		t.Fail()
+	}
+	_, err = c.CreateTopic(ctx, &CreateTopicRequest{Topic: "sport"})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fail()
+	}
+}
@@ -0,0 +1,224 @@
+package grpcgateway
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative tinydfs.proto
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"net"
+
+	"github.com/google/uuid"
+	"github.com/vlado-github/tinydfs/logging"
+	"github.com/vlado-github/tinydfs/messaging"
+	"github.com/vlado-github/tinydfs/persistance"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Backend is the part of messaging.Node used by the gateway.
+type Backend interface {
+	SendMessage(message messaging.Message)
+	Get(ctx context.Context, topic string, key uuid.UUID) (string, error)
+	Update(ctx context.Context, topic string, key uuid.UUID, text string) error
+	Delete(ctx context.Context, topic string, key uuid.UUID) error
+	Scan(ctx context.Context, topic string) ([]persistance.Record, error)
+	Subscribe(topic string, handler messaging.MessageHandlerFunc) func()
+	CreateTopic(topic string, partitions int, replicas int)
+	GetNetworkRegistry() messaging.NetworkRegistry
+}
+
+// SubscriptionBuffer is the number of messages buffered
+// for a slow subscriber before messages are dropped
+const SubscriptionBuffer = 256
+
+type server struct {
+	UnimplementedTinyDfsServer
+	UnimplementedTinyDfsAdminServer
+	backend Backend
+}
+
+// NewServer creates gRPC server with TinyDfs and TinyDfsAdmin services
+func NewServer(backend Backend, opts ...grpc.ServerOption) *grpc.Server {
+	s := grpc.NewServer(opts...)
+	srv := &server{backend: backend}
+	RegisterTinyDfsServer(s, srv)
+	RegisterTinyDfsAdminServer(s, srv)
+	return s
+}
+
+// ListenAndServe starts the gRPC server on the address
+func ListenAndServe(address string, backend Backend) error {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		logging.AddError("[Grpc] Error listening:", err.Error())
+		return err
+	}
+	logging.AddInfo("[Grpc] Listening on " + address)
+	return NewServer(backend).Serve(l)
+}
+
+func (s *server) Put(ctx context.Context, in *PutRequest) (*PutResponse, error) {
+	key := uuid.New()
+	if in.Key != "" {
+		var err error
+		key, err = parseKey(in.Key)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := validateTopic(in.Topic); err != nil {
+		return nil, err
+	}
+	s.backend.SendMessage(messaging.Message{Key: key, Topic: in.Topic, Payload: in.Value, PartitionKey: in.PartitionKey})
+	return &PutResponse{Key: key.String()}, nil
+}
+
+func (s *server) Get(ctx context.Context, in *GetRequest) (*GetResponse, error) {
+	if err := validateTopic(in.Topic); err != nil {
+		return nil, err
+	}
+	key, err := parseKey(in.Key)
+	if err != nil {
+		return nil, err
+	}
+	value, err := s.backend.Get(messaging.WithPartitionKey(ctx, in.PartitionKey), in.Topic, key)
+	if err != nil {
+		return nil, backendError(err)
+	}
+	return &GetResponse{Value: []byte(value)}, nil
+}
+
+func (s *server) Update(ctx context.Context, in *UpdateRequest) (*UpdateResponse, error) {
+	if err := validateTopic(in.Topic); err != nil {
+		return nil, err
+	}
+	key, err := parseKey(in.Key)
+	if err != nil {
+		return nil, err
+	}
+	err = s.backend.Update(messaging.WithPartitionKey(ctx, in.PartitionKey), in.Topic, key, string(in.Value))
+	if err != nil {
+		return nil, backendError(err)
+	}
+	return &UpdateResponse{}, nil
+}
+
+func (s *server) Delete(ctx context.Context, in *DeleteRequest) (*DeleteResponse, error) {
+	if err := validateTopic(in.Topic); err != nil {
+		return nil, err
+	}
+	key, err := parseKey(in.Key)
+	if err != nil {
+		return nil, err
+	}
+	err = s.backend.Delete(messaging.WithPartitionKey(ctx, in.PartitionKey), in.Topic, key)
+	if err != nil {
+		return nil, backendError(err)
+	}
+	return &DeleteResponse{}, nil
+}
+
+func (s *server) Scan(in *ScanRequest, stream grpc.ServerStreamingServer[Record]) error {
+	if err := validateTopic(in.Topic); err != nil {
+		return err
+	}
+	if in.From < 0 {
+		return status.Error(codes.InvalidArgument, "Offset is not a valid number")
+	}
+	records, err := s.backend.Scan(stream.Context(), in.Topic)
+	if err != nil {
+		return backendError(err)
+	}
+	for offset := in.From; offset < int64(len(records)); offset++ {
+		record := records[offset]
+		err := stream.Send(&Record{Key: record.Key.String(), Value: []byte(record.Text), Offset: offset})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *server) Subscribe(in *SubscribeRequest, stream grpc.ServerStreamingServer[Record]) error {
+	if err := validateTopic(in.Topic); err != nil {
+		return err
+	}
+	messages := make(chan messaging.Message, SubscriptionBuffer)
+	unsubscribe := s.backend.Subscribe(in.Topic, func(message messaging.Message) {
+		select {
+		case messages <- message:
+		default:
+			logging.AddWarning("[Grpc] Subscriber is too slow, message dropped.", message.Key.String())
+		}
+	})
+	defer unsubscribe()
+	for {
+		select {
+		case message := <-messages:
+			err := stream.Send(&Record{Key: message.Key.String(), Value: message.Payload})
+			if err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
+
+func (s *server) ListMembers(ctx context.Context, in *ListMembersRequest) (*ListMembersResponse, error) {
+	response := &ListMembersResponse{}
+	for _, tuple := range s.backend.GetNetworkRegistry().GetItems() {
+		response.Members = append(response.Members, &Member{
+			Id:        tuple.GetId(),
+			Ip:        tuple.GetIP(),
+			Port:      tuple.GetPort(),
+			QueuePort: tuple.GetQueuePort(),
+			Available: tuple.GetAvailableStatus(),
+		})
+	}
+	return response, nil
+}
+
+func (s *server) CreateTopic(ctx context.Context, in *CreateTopicRequest) (*CreateTopicResponse, error) {
+	if err := validateTopic(in.Topic); err != nil {
+		return nil, err
+	}
+	if in.Partitions <= 0 || in.Replicas <= 0 {
+		return nil, status.Error(codes.InvalidArgument, "Invalid topic specification")
+	}
+	s.backend.CreateTopic(in.Topic, int(in.Partitions), int(in.Replicas))
+	return &CreateTopicResponse{}, nil
+}
+
+func parseKey(value string) (uuid.UUID, error) {
+	key, err := uuid.Parse(value)
+	if err != nil {
+		return uuid.Nil, status.Error(codes.InvalidArgument, "Key is not a valid UUID")
+	}
+	return key, nil
+}
+
+func validateTopic(topic string) error {
+	err := persistance.ValidateTopic(topic)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	return nil
+}
+
+// Converts error of the backend to a status, only missing keys and
+// topics are reported as not found and unreachable owners as unavailable
+func backendError(err error) error {
+	code := codes.Internal
+	switch {
+	case errors.Is(err, persistance.ErrNotFound) || errors.Is(err, fs.ErrNotExist):
+		code = codes.NotFound
+	case errors.Is(err, context.DeadlineExceeded):
+		code = codes.DeadlineExceeded
+	case messaging.IsUnavailable(err):
+		code = codes.Unavailable
+	}
+	return status.Error(code, err.Error())
+}
@@ -0,0 +1,155 @@
+package httpgateway
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/vlado-github/tinydfs/internal/gatewaytest"
+	"github.com/vlado-github/tinydfs/messaging"
+	"github.com/vlado-github/tinydfs/persistance"
+)
+
+func serve(handler http.Handler, method string, target string, body string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(method, target, strings.NewReader(body)))
+	return recorder
+}
+
+func TestHandler_PutGetDelete(t *testing.T) {
+	b := gatewaytest.NewQueuedBackend(t)
+	handler := NewHandler(b)
+	key := uuid.New().String()
+
+	response := serve(handler, http.MethodPut, "/topics/sport/keys/"+key, "We're watching a match.")
+	if response.Code != http.StatusAccepted {
+		t.Fatal(response.Code)
+	}
+	// writes are accepted before the queue delivers them
+	b.Flush()
+	response = serve(handler, http.MethodGet, "/topics/sport/keys/"+key, "")
+	var result KeyResponse
+	json.NewDecoder(response.Body).Decode(&result)
+	if response.Code != http.StatusOK || result.Value != "We're watching a match." {
+		t.Fatal(response.Code, result)
+	}
+	response = serve(handler, http.MethodDelete, "/topics/sport/keys/"+key, "")
+	if response.Code != http.StatusNoContent {
+		t.Fail()
+	}
+	response = serve(handler, http.MethodGet, "/topics/sport/keys/"+key, "")
+	if response.Code != http.StatusNotFound {
+		t.Fail()
+	}
+}
+
+func TestHandler_BackendErrors(t *testing.T) {
+	b := gatewaytest.NewBackend(t)
+	handler := NewHandler(b)
+	key := uuid.New().String()
+	cases := []struct {
+		err    error
+		status int
+	}{
+		{persistance.ErrNotFound, http.StatusNotFound},
+		{&messaging.RpcError{Method: messaging.RPC_READ, Message: persistance.ErrNotFound.Error()}, http.StatusNotFound},
+		{fmt.Errorf("%w, 1 of 3 replicas", messaging.ErrNoQuorum), http.StatusServiceUnavailable},
+		{messaging.ErrRpcClosed, http.StatusServiceUnavailable},
+		{errors.New("disk failed"), http.StatusInternalServerError},
+	}
+	for _, c := range cases {
+		b.Fail(c.err)
+		for _, method := range []string{http.MethodGet, http.MethodDelete} {
+			if response := serve(handler, method, "/topics/sport/keys/"+key, ""); response.Code != c.status {
+				t.Error(method, c.err, response.Code)
+			}
+		}
+		if response := serve(handler, http.MethodGet, "/topics/sport", ""); response.Code != c.status {
+			t.Error("scan", c.err, response.Code)
+		}
+	}
+}
+
+func TestHandler_InvalidKey(t *testing.T) {
+	handler := NewHandler(gatewaytest.NewQueuedBackend(t))
+	response := serve(handler, http.MethodPut, "/topics/sport/keys/not-a-uuid", "text")
+	if response.Code != http.StatusBadRequest {
+		t.Fail()
+	}
+}
+
+func TestHandler_InvalidTopic(t *testing.T) {
+	handler := NewHandler(gatewaytest.NewQueuedBackend(t))
+	for _, topic := range []string{"__chunks_sport", "a%00b", "a%2Fb"} {
+		response := serve(handler, http.MethodPut, "/topics/"+topic+"/keys/"+uuid.New().String(), "text")
+		if response.Code != http.StatusBadRequest {
+			t.Error(topic, response.Code)
+		}
+	}
+}
+
+func TestHandler_BodyTooLarge(t *testing.T) {
+	handler := NewHandler(gatewaytest.NewQueuedBackend(t))
+	body := strings.Repeat("a", MaxBodySize+1)
+	response := serve(handler, http.MethodPut, "/topics/sport/keys/"+uuid.New().String(), body)
+	if response.Code != http.StatusRequestEntityTooLarge {
+		t.Fatal(response.Code)
+	}
+}
+
+func TestHandler_ScanFromOffset(t *testing.T) {
+	b := gatewaytest.NewQueuedBackend(t)
+	handler := NewHandler(b)
+	for _, text := range []string{"first", "second", "third"} {
+		serve(handler, http.MethodPut, "/topics/news/keys/"+uuid.New().String(), text)
+	}
+	b.Flush()
+	response := serve(handler, http.MethodGet, "/topics/news?from=1", "")
+	var result ScanResponse
+	json.NewDecoder(response.Body).Decode(&result)
+	if response.Code != http.StatusOK || len(result.Records) != 2 || result.NextOffset != 3 {
+		t.Fatal(response.Code, result)
+	}
+	if result.Records[0].Text != "second" {
+		t.Fail()
+	}
+	response = serve(handler, http.MethodGet, "/topics/news?from=-1", "")
+	if response.Code != http.StatusBadRequest {
+		t.Fail()
+	}
+}
+
+func TestHandler_Members(t *testing.T) {
+	handler := NewHandler(gatewaytest.NewQueuedBackend(t))
+	response := serve(handler, http.MethodGet, "/cluster/members", "")
+	if response.Code != http.StatusOK || !strings.Contains(response.Body.String(), "node-a") {
+		t.Fail()
+	}
+}
+
+func TestHandler_Decommission(t *testing.T) {
+	b := gatewaytest.NewQueuedBackend(t)
+	if response := serve(NewHandler(b), http.MethodPost, "/admin/decommission", ""); response.Code != http.StatusNotFound {
+		t.Fatal("Public API serves admin endpoints", response.Code)
+	}
+	handler := NewAdminHandler(b)
+	response := serve(handler, http.MethodGet, "/admin/decommission", "")
+	var status messaging.DecommissionStatus
+	json.NewDecoder(response.Body).Decode(&status)
+	if response.Code != http.StatusOK || status.State != messaging.DECOMMISSION_ACTIVE {
+		t.Fatal(response.Code, status)
+	}
+	response = serve(handler, http.MethodPost, "/admin/decommission", "")
+	if response.Code != http.StatusAccepted {
+		t.Fatal(response.Code)
+	}
+	response = serve(handler, http.MethodPost, "/admin/decommission", "")
+	if response.Code != http.StatusConflict {
+		t.Fatal(response.Code)
+	}
+}
@@ -0,0 +1,193 @@
+package httpgateway
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/google/uuid"
+	"github.com/vlado-github/tinydfs/logging"
+	"github.com/vlado-github/tinydfs/messaging"
+	"github.com/vlado-github/tinydfs/persistance"
+)
+
+// Backend is the part of messaging.Node used by the gateway.
+// Writes go through the messaging path, reads are served
+// from the FileManager of the node that owns the topic.
+type Backend interface {
+	SendMessage(message messaging.Message)
+	Get(ctx context.Context, topic string, key uuid.UUID) (string, error)
+	Delete(ctx context.Context, topic string, key uuid.UUID) error
+	Scan(ctx context.Context, topic string) ([]persistance.Record, error)
+	GetNetworkRegistry() messaging.NetworkRegistry
+}
+
+// AdminBackend is the part of messaging.Node used by the admin API
+type AdminBackend interface {
+	StartDecommission() error
+	GetDecommissionStatus() messaging.DecommissionStatus
+}
+
+// KeyResponse is returned by key endpoints
+type KeyResponse struct {
+	Topic string
+	Key   uuid.UUID
+	Value string `json:",omitempty"`
+}
+
+// ScanResponse is returned by the topic endpoint. NextOffset
+// is used as the from parameter of the next request.
+type ScanResponse struct {
+	Topic      string
+	Records    []persistance.Record
+	NextOffset int
+}
+
+// ErrorResponse is returned for failed requests
+type ErrorResponse struct {
+	Error string
+}
+
+type server struct {
+	backend Backend
+}
+
+// NewHandler creates HTTP handler of the REST API
+func NewHandler(backend Backend) http.Handler {
+	s := &server{backend: backend}
+	mux := http.NewServeMux()
+	mux.HandleFunc("PUT /topics/{topic}/keys/{key}", s.putKey)
+	mux.HandleFunc("GET /topics/{topic}/keys/{key}", s.getKey)
+	mux.HandleFunc("DELETE /topics/{topic}/keys/{key}", s.deleteKey)
+	mux.HandleFunc("GET /topics/{topic}", s.scanTopic)
+	mux.HandleFunc("GET /cluster/members", s.getMembers)
+	return mux
+}
+
+type adminServer struct {
+	backend AdminBackend
+}
+
+// NewAdminHandler creates HTTP handler of the admin API, it is served
+// on its own listener so the public API can not decommission the node
+func NewAdminHandler(backend AdminBackend) http.Handler {
+	s := &adminServer{backend: backend}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /admin/decommission", s.getDecommission)
+	mux.HandleFunc("POST /admin/decommission", s.startDecommission)
+	return mux
+}
+
+// ListenAndServe starts the REST API on the address
+func ListenAndServe(address string, backend Backend) error {
+	logging.AddInfo("[Http] Listening on " + address)
+	err := http.ListenAndServe(address, NewHandler(backend))
+	if err != nil {
+		logging.AddError("[Http] Error listening:", err.Error())
+	}
+	return err
+}
+
+// ListenAndServeAdmin starts the admin API on the address
+func ListenAndServeAdmin(address string, backend AdminBackend) error {
+	logging.AddInfo("[Http] Admin API listening on " + address)
+	err := http.ListenAndServe(address, NewAdminHandler(backend))
+	if err != nil {
+		logging.AddError("[Http] Error listening:", err.Error())
+	}
+	return err
+}
+
+func (s *server) putKey(w http.ResponseWriter, r *http.Request) {
+	topic, key, ok := parseKey(w, r)
+	if !ok {
+		return
+	}
+	payload, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+	s.backend.SendMessage(messaging.Message{Key: key, Topic: topic, Payload: payload})
+	writeJSON(w, http.StatusAccepted, KeyResponse{Topic: topic, Key: key})
+}
+
+func (s *server) getKey(w http.ResponseWriter, r *http.Request) {
+	topic, key, ok := parseKey(w, r)
+	if !ok {
+		return
+	}
+	value, err := s.backend.Get(r.Context(), topic, key)
+	if err != nil {
+		writeBackendError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, KeyResponse{Topic: topic, Key: key, Value: value})
+}
+
+func (s *server) deleteKey(w http.ResponseWriter, r *http.Request) {
+	topic, key, ok := parseKey(w, r)
+	if !ok {
+		return
+	}
+	err := s.backend.Delete(r.Context(), topic, key)
+	if err != nil {
+		writeBackendError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *server) scanTopic(w http.ResponseWriter, r *http.Request) {
+	topic, ok := parseTopic(w, r)
+	if !ok {
+		return
+	}
+	from := 0
+	if value := r.URL.Query().Get("from"); value != "" {
+		var err error
+		from, err = strconv.Atoi(value)
+		if err != nil || from < 0 {
+			writeError(w, http.StatusBadRequest, errInvalidOffset)
+			return
+		}
+	}
+	records, err := s.backend.Scan(r.Context(), topic)
+	if err != nil {
+		writeBackendError(w, err)
+		return
+	}
+	if from > len(records) {
+		from = len(records)
+	}
+	writeJSON(w, http.StatusOK, ScanResponse{Topic: topic, Records: records[from:], NextOffset: len(records)})
+}
+
+func (s *server) getMembers(w http.ResponseWriter, r *http.Request) {
+	members, err := s.backend.GetNetworkRegistry().ToByteArray()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(members)
+}
+
+func (s *adminServer) getDecommission(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.backend.GetDecommissionStatus())
+}
+
+// Starts the decommission in the background, progress is polled with GET
+func (s *adminServer) startDecommission(w http.ResponseWriter, r *http.Request) {
+	err := s.backend.StartDecommission()
+	if errors.Is(err, messaging.ErrDecommissionStarted) {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, s.backend.GetDecommissionStatus())
+}
@@ -0,0 +1,84 @@
+package httpgateway
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/vlado-github/tinydfs/logging"
+	"github.com/vlado-github/tinydfs/messaging"
+	"github.com/vlado-github/tinydfs/persistance"
+)
+
+// MaxBodySize limits payload of a single write
+const MaxBodySize = 1 << 20
+
+var errInvalidKey = errors.New("Key is not a valid UUID")
+var errInvalidOffset = errors.New("Offset is not a valid number")
+
+func parseKey(w http.ResponseWriter, r *http.Request) (string, uuid.UUID, bool) {
+	topic, ok := parseTopic(w, r)
+	if !ok {
+		return "", uuid.Nil, false
+	}
+	key, err := uuid.Parse(r.PathValue("key"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errInvalidKey)
+		return "", uuid.Nil, false
+	}
+	return topic, key, true
+}
+
+func parseTopic(w http.ResponseWriter, r *http.Request) (string, bool) {
+	topic := r.PathValue("topic")
+	err := persistance.ValidateTopic(topic)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return "", false
+	}
+	return topic, true
+}
+
+// Reads the body, larger bodies than MaxBodySize are rejected with 413
+func readBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	defer r.Body.Close()
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, MaxBodySize))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeError(w, http.StatusRequestEntityTooLarge, err)
+		} else {
+			writeError(w, http.StatusBadRequest, err)
+		}
+		return nil, false
+	}
+	return body, true
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(body)
+	if err != nil {
+		logging.AddError("[Http] Encoding response failed.", err.Error())
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, ErrorResponse{Error: err.Error()})
+}
+
+// Writes error of the backend, only missing keys and topics are
+// reported as not found and unreachable owners as unavailable
+func writeBackendError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	if errors.Is(err, persistance.ErrNotFound) || errors.Is(err, fs.ErrNotExist) {
+		status = http.StatusNotFound
+	} else if messaging.IsUnavailable(err) {
+		status = http.StatusServiceUnavailable
+	}
+	writeError(w, status, err)
+}
@@ -0,0 +1,192 @@
+// Package gatewaytest provides the node backend used by tests of the gateways.
+package gatewaytest
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/vlado-github/tinydfs/messaging"
+	"github.com/vlado-github/tinydfs/persistance"
+)
+
+// QueueDelay is how long a sent message takes to reach the
+// storage in a backend created with NewQueuedBackend
+const QueueDelay = 20 * time.Millisecond
+
+// Backend stores records in the FileManager of a single replica.
+// Writes of SendMessage are applied in order after the delay, as the
+// queue does before a message reaches the owners of the topic, other
+// writes are synchronous.
+type Backend struct {
+	fm           persistance.FileManager
+	registry     messaging.NetworkRegistry
+	delay        time.Duration
+	messages     chan queuedMessage
+	pending      sync.WaitGroup
+	lock         sync.Mutex
+	subscribers  []messaging.MessageHandlerFunc
+	topics       []string
+	decommission messaging.DecommissionStatus
+	err          error
+}
+
+type queuedMessage struct {
+	message messaging.Message
+	due     time.Time
+}
+
+// NewBackend creates backend that applies messages as they are sent
+func NewBackend(t testing.TB) *Backend {
+	return newBackend(t, 0)
+}
+
+// NewQueuedBackend creates backend that applies messages after QueueDelay
+func NewQueuedBackend(t testing.TB) *Backend {
+	return newBackend(t, QueueDelay)
+}
+
+func newBackend(t testing.TB, delay time.Duration) *Backend {
+	registry := messaging.NewNetworkRegistry()
+	registry.AddItem(messaging.NewNetworkTuple("node-a", "localhost", "4001", "5001"))
+	b := &Backend{
+		fm:           persistance.NewFileManager(t.TempDir()),
+		registry:     registry,
+		delay:        delay,
+		messages:     make(chan queuedMessage, 1024),
+		decommission: messaging.DecommissionStatus{State: messaging.DECOMMISSION_ACTIVE},
+	}
+	go b.deliver()
+	// messages are applied before the data directory is removed
+	t.Cleanup(func() {
+		b.Flush()
+		close(b.messages)
+	})
+	return b
+}
+
+func (b *Backend) deliver() {
+	for queued := range b.messages {
+		time.Sleep(time.Until(queued.due))
+		message := queued.message
+		b.fm.Write(persistance.Command{Key: message.Key, Topic: message.Topic, Text: string(message.Payload)})
+		b.lock.Lock()
+		subscribers := append([]messaging.MessageHandlerFunc(nil), b.subscribers...)
+		b.lock.Unlock()
+		for _, handler := range subscribers {
+			handler(message)
+		}
+		b.pending.Done()
+	}
+}
+
+// Flush waits until all sent messages are applied
+func (b *Backend) Flush() {
+	b.pending.Wait()
+}
+
+func (b *Backend) SendMessage(message messaging.Message) {
+	b.pending.Add(1)
+	b.messages <- queuedMessage{message: message, due: time.Now().Add(b.delay)}
+}
+
+// Fail makes Get, Put, Update, Delete and Scan return the error, nil restores them
+func (b *Backend) Fail(err error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.err = err
+}
+
+func (b *Backend) failure() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.err
+}
+
+func (b *Backend) Get(ctx context.Context, topic string, key uuid.UUID) (string, error) {
+	if err := b.failure(); err != nil {
+		return "", err
+	}
+	return b.fm.Read(persistance.Query{Key: key, Topic: topic})
+}
+
+func (b *Backend) Put(ctx context.Context, topic string, key uuid.UUID, text string, headers map[string]string) error {
+	if err := b.failure(); err != nil {
+		return err
+	}
+	return b.fm.Put(persistance.Command{Key: key, Topic: topic, Text: text, Headers: headers})
+}
+
+func (b *Backend) Update(ctx context.Context, topic string, key uuid.UUID, text string) error {
+	if err := b.failure(); err != nil {
+		return err
+	}
+	return b.fm.Update(persistance.Command{Key: key, Topic: topic, Text: text})
+}
+
+func (b *Backend) Delete(ctx context.Context, topic string, key uuid.UUID) error {
+	if err := b.failure(); err != nil {
+		return err
+	}
+	return b.fm.Delete(persistance.Command{Key: key, Topic: topic})
+}
+
+func (b *Backend) Scan(ctx context.Context, topic string) ([]persistance.Record, error) {
+	if err := b.failure(); err != nil {
+		return nil, err
+	}
+	return b.fm.Scan(topic)
+}
+
+func (b *Backend) Subscribe(topic string, handler messaging.MessageHandlerFunc) func() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.subscribers = append(b.subscribers, func(message messaging.Message) {
+		if message.Topic == topic {
+			handler(message)
+		}
+	})
+	return func() {}
+}
+
+// Subscribers returns the number of subscriptions
+func (b *Backend) Subscribers() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return len(b.subscribers)
+}
+
+func (b *Backend) CreateTopic(topic string, partitions int, replicas int) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.topics = append(b.topics, topic)
+}
+
+// Topics returns topics created with CreateTopic
+func (b *Backend) Topics() []string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return append([]string(nil), b.topics...)
+}
+
+func (b *Backend) GetNetworkRegistry() messaging.NetworkRegistry {
+	return b.registry
+}
+
+func (b *Backend) StartDecommission() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.decommission.State != messaging.DECOMMISSION_ACTIVE {
+		return messaging.ErrDecommissionStarted
+	}
+	b.decommission = messaging.DecommissionStatus{State: messaging.DECOMMISSION_LEAVING}
+	return nil
+}
+
+func (b *Backend) GetDecommissionStatus() messaging.DecommissionStatus {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.decommission
+}
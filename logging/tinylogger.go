@@ -27,8 +27,20 @@ type Configuration struct {
 	verbose      VerbosityLevelType
 }
 
+// LogDirEnv overrides the default directory of log files
+const LogDirEnv = "TINYDFS_LOG_DIR"
+
 // Config contains info on logger configuration
-var config = &Configuration{verbose: ALL, pathToLogDir: "."}
+var config = &Configuration{verbose: ALL, pathToLogDir: defaultLogDir()}
+
+// Logs go to the temp directory unless configured, so runs of
+// tests do not write into package directories
+func defaultLogDir() string {
+	if dir := os.Getenv(LogDirEnv); dir != "" {
+		return dir
+	}
+	return path.Join(os.TempDir(), "tinydfs-log")
+}
 
 type tinylogger struct {
 	Trace   *log.Logger
@@ -74,27 +86,28 @@ func getInstance() *tinylogger {
 	return instance
 }
 
+// Values of a log line are printed as one bracketed list
 func AddTrace(v ...interface{}) {
 	tl := getInstance()
-	tl.Trace.Println(v)
+	tl.Trace.Println(fmt.Sprintf("%v", v))
 	postLog(TRACE, "TRACE: ", v)
 }
 
 func AddInfo(v ...interface{}) {
 	tl := getInstance()
-	tl.Info.Println(v)
+	tl.Info.Println(fmt.Sprintf("%v", v))
 	postLog(INFO, "INFO:", v)
 }
 
 func AddWarning(v ...interface{}) {
 	tl := getInstance()
-	tl.Warning.Println(v)
+	tl.Warning.Println(fmt.Sprintf("%v", v))
 	postLog(WARNING, "WARN: ", v)
 }
 
 func AddError(v ...interface{}) {
 	tl := getInstance()
-	tl.Error.Println(v)
+	tl.Error.Println(fmt.Sprintf("%v", v))
 	postLog(ERROR, "ERROR: ", v)
 }
 
@@ -127,8 +140,8 @@ func createDestinationFile(filename string) *os.File {
 
 func postLog(verbosityLevel VerbosityLevelType, logText ...interface{}) {
 	if config.verbose == ALL {
-		fmt.Println(logText)
+		fmt.Println(fmt.Sprintf("%v", logText))
 	} else if verbosityLevel == config.verbose || verbosityLevel == ERROR {
-		fmt.Println(logText)
+		fmt.Println(fmt.Sprintf("%v", logText))
 	}
 }
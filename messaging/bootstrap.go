@@ -0,0 +1,322 @@
+package messaging
+
+import (
+	"context"
+	"errors"
+	"hash/crc32"
+	"io/fs"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/vlado-github/tinydfs/logging"
+	"github.com/vlado-github/tinydfs/persistance"
+)
+
+const (
+	RPC_TOPIC_MANIFEST string = "TOPIC_MANIFEST"
+	RPC_TOPIC_CHUNK    string = "TOPIC_CHUNK"
+	RPC_BLOB           string = "BLOB"
+)
+
+// BootstrapChunkSize is the largest part of a topic file sent in one call
+const BootstrapChunkSize = 1 << 20
+
+// BootstrapRetries is how many times a failed chunk is requested again
+// before the transfer moves to another replica
+const BootstrapRetries = 3
+
+// BootstrapTimeout limits the transfer of all topics to a joining node
+const BootstrapTimeout = 10 * time.Minute
+
+// Joining node waits this long for the network registry and partition map
+const bootstrapWaitTimeout = 5 * time.Second
+
+var ErrChunkChecksum = errors.New("Topic chunk does not match its checksum")
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// TopicChunkRequest asks for a part of a topic file
+type TopicChunkRequest struct {
+	Topic  string
+	Offset int64
+	Length int
+}
+
+// TopicChunk is a part of a topic file with the CRC32C of its data
+// and the size of the whole file when it was read
+type TopicChunk struct {
+	Data     []byte
+	Checksum uint32
+	Size     int64
+}
+
+// Source of a topic transfer
+type topicSource struct {
+	nodeID string
+	topic  persistance.TopicSnapshot
+}
+
+// Registers remote calls serving topic files to joining nodes
+func (n *node) registerBootstrapHandlers() {
+	n.RegisterRpcHandler(RPC_TOPIC_MANIFEST, NewRpcHandler(func(ctx context.Context, _ struct{}) ([]persistance.TopicSnapshot, error) {
+		return n.fileManager.Manifest()
+	}))
+	n.RegisterRpcHandler(RPC_TOPIC_CHUNK, NewRpcHandler(func(ctx context.Context, request TopicChunkRequest) (TopicChunk, error) {
+		length := request.Length
+		if length <= 0 || length > BootstrapChunkSize {
+			length = BootstrapChunkSize
+		}
+		data, size, err := n.fileManager.ReadRange(request.Topic, request.Offset, length)
+		if errors.Is(err, fs.ErrNotExist) && request.Offset == 0 {
+			// partition without records, the receiver creates an empty file
+			return TopicChunk{Data: []byte{}}, nil
+		}
+		if err != nil {
+			return TopicChunk{}, err
+		}
+		return TopicChunk{Data: data, Checksum: crc32.Checksum(data, castagnoli), Size: size}, nil
+	}))
+	n.RegisterRpcHandler(RPC_BLOB, NewRpcHandler(func(ctx context.Context, hash string) ([]byte, error) {
+		return n.fileManager.Blobs().Get(hash)
+	}))
+}
+
+// Copies topic files stored by the node from other replicas. Messages
+// received meanwhile are kept and stored after the transfer, then the
+// node switches to live replication.
+func (n *node) bootstrap() {
+	ctx, cancel := context.WithTimeout(context.Background(), BootstrapTimeout)
+	defer cancel()
+	defer n.finishBootstrap()
+	if !n.waitForCluster(ctx) {
+		logging.AddWarning("[Bootstrap] Cluster state not received, topics are not transferred.")
+		return
+	}
+	sources := n.collectTopicSources(ctx)
+	transferred := 0
+	for topic, candidates := range sources {
+		if !n.storesTopic(topic) {
+			continue
+		}
+		err := n.transferTopic(ctx, candidates)
+		if err != nil {
+			logging.AddError("[Bootstrap] Topic not transferred.", topic, err.Error())
+			continue
+		}
+		transferred++
+	}
+	err := n.fileManager.RebuildBlobRefs()
+	if err != nil {
+		logging.AddError("[Bootstrap] Blob references not rebuilt.", err.Error())
+	}
+	logging.AddInfo("[Bootstrap] Transferred", transferred, "topics.")
+}
+
+// Waits until the node is in the network registry and knows partitions
+func (n *node) waitForCluster(ctx context.Context) bool {
+	ctx, cancel := context.WithTimeout(ctx, bootstrapWaitTimeout)
+	defer cancel()
+	for {
+		registered, _ := n.networkRegistry.GetItemById(n.GetID().String())
+		if registered != nil && n.partitionsReceived.Load() {
+			return true
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+}
+
+// Asks all peers for their topic manifests, the largest copy
+// of every topic is tried first
+func (n *node) collectTopicSources(ctx context.Context) map[string][]topicSource {
+	sources := make(map[string][]topicSource)
+	for _, nodeID := range n.getAllOwners() {
+		if nodeID == n.GetID().String() {
+			continue
+		}
+		// an unresponsive peer does not hold up the transfer from the others
+		callCtx, cancel := context.WithTimeout(ctx, DefaultRpcTimeout)
+		var manifest []persistance.TopicSnapshot
+		err := n.Call(callCtx, nodeID, RPC_TOPIC_MANIFEST, struct{}{}, &manifest)
+		cancel()
+		if err != nil {
+			logging.AddWarning("[Bootstrap] Manifest not received.", nodeID, err.Error())
+			continue
+		}
+		for _, topic := range manifest {
+			sources[topic.Topic] = append(sources[topic.Topic], topicSource{nodeID: nodeID, topic: topic})
+		}
+	}
+	for _, candidates := range sources {
+		sort.SliceStable(candidates, func(i, j int) bool {
+			return candidates[i].topic.Offset > candidates[j].topic.Offset
+		})
+	}
+	return sources
+}
+
+// Streams the topic file from the first source that completes the transfer
+func (n *node) transferTopic(ctx context.Context, candidates []topicSource) error {
+	err := ErrNoOwner
+	for _, source := range candidates {
+		err = n.transferFrom(ctx, source)
+		if err == nil {
+			return nil
+		}
+		logging.AddWarning("[Bootstrap] Transfer failed.", source.topic.Topic, source.nodeID, err.Error())
+	}
+	return err
+}
+
+// Copies chunks until the end of the source file, starting after the
+// local prefix that matches the source. Failed chunks are requested again
+// from the same offset, the manifest checksum is verified once the
+// transfer passes the manifest offset.
+func (n *node) transferFrom(ctx context.Context, source topicSource) error {
+	topic := source.topic.Topic
+	offset := n.resumeOffset(ctx, source)
+	if offset > 0 {
+		logging.AddInfo("[Bootstrap] Transfer resumed.", topic, offset)
+	} else if _, size, err := n.fileManager.ReadRange(topic, 0, 0); err == nil && size > 0 {
+		// the file of a restarted node is not a prefix of the source,
+		// a copy would drop the records only this node stored
+		merged, err := n.mergeMissingRecords(ctx, source.nodeID, topic)
+		if err != nil {
+			return err
+		}
+		logging.AddInfo("[Bootstrap] Missing records merged.", topic, merged)
+		return n.transferBlobs(ctx, source)
+	}
+	failures := 0
+	for {
+		chunk, err := n.copyChunk(ctx, source.nodeID, topic, offset)
+		if err != nil {
+			failures++
+			if failures > BootstrapRetries || ctx.Err() != nil {
+				return err
+			}
+			continue
+		}
+		failures = 0
+		offset += int64(len(chunk.Data))
+		if offset >= chunk.Size {
+			break
+		}
+	}
+	checksum, err := n.fileManager.PrefixChecksum(topic, source.topic.Offset)
+	if err != nil {
+		return err
+	}
+	if checksum != source.topic.Checksum {
+		return ErrChunkChecksum
+	}
+	return n.transferBlobs(ctx, source)
+}
+
+// Returns the size of the local topic file if it is a prefix of the source
+// file, otherwise 0. The prefix is compared with the manifest checksum, or
+// with the checksum of the source if the sizes differ.
+func (n *node) resumeOffset(ctx context.Context, source topicSource) int64 {
+	topic := source.topic.Topic
+	_, size, err := n.fileManager.ReadRange(topic, 0, 0)
+	if err != nil || size == 0 {
+		return 0
+	}
+	local, err := n.fileManager.PrefixChecksum(topic, size)
+	if err != nil {
+		return 0
+	}
+	remote := source.topic.Checksum
+	if size != source.topic.Offset {
+		err = n.Call(ctx, source.nodeID, RPC_REBALANCE_CHECKSUM, ChecksumRequest{Topic: topic, Offset: size}, &remote)
+		if err != nil {
+			return 0
+		}
+	}
+	if local != remote {
+		return 0
+	}
+	return size
+}
+
+// Writes records of the peer whose keys the local topic does not have
+func (n *node) mergeMissingRecords(ctx context.Context, nodeID string, topic string) (int, error) {
+	var records []persistance.Record
+	err := n.Call(ctx, nodeID, RPC_SCAN, topic, &records)
+	if err != nil {
+		return 0, err
+	}
+	merged := 0
+	for _, record := range records {
+		query := persistance.Query{Key: record.Key, Topic: topic}
+		if _, err := n.fileManager.Read(query); err == nil || record.Key == uuid.Nil {
+			continue
+		}
+		err = n.fileManager.Write(persistance.Command{
+			Key:       record.Key,
+			Topic:     topic,
+			Text:      record.Text,
+			Headers:   record.Headers,
+			Timestamp: record.Timestamp,
+		})
+		if err != nil {
+			return merged, err
+		}
+		merged++
+	}
+	return merged, nil
+}
+
+// Copies one chunk of the topic file of the peer to the same offset of the local file
+func (n *node) copyChunk(ctx context.Context, nodeID string, topic string, offset int64) (TopicChunk, error) {
+	request := TopicChunkRequest{Topic: topic, Offset: offset, Length: BootstrapChunkSize}
+	var chunk TopicChunk
+	err := n.Call(ctx, nodeID, RPC_TOPIC_CHUNK, request, &chunk)
+	if err != nil {
+		return chunk, err
+	}
+	if crc32.Checksum(chunk.Data, castagnoli) != chunk.Checksum {
+		return chunk, ErrChunkChecksum
+	}
+	return chunk, n.fileManager.AppendRange(topic, offset, chunk.Data)
+}
+
+// Fetches blobs referenced by the transferred records
+func (n *node) transferBlobs(ctx context.Context, source topicSource) error {
+	missing, err := n.fileManager.MissingBlobs(source.topic.Topic)
+	if err != nil {
+		return err
+	}
+	for _, hash := range missing {
+		var data []byte
+		err = n.Call(ctx, source.nodeID, RPC_BLOB, hash, &data)
+		if err != nil {
+			return err
+		}
+		if persistance.BlobHash(data) != hash {
+			return persistance.ErrBlobCorrupted
+		}
+		_, err = n.fileManager.Blobs().Put(data)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stores messages received during the transfer and switches to live replication.
+// Messages already copied with the topic files are skipped.
+func (n *node) finishBootstrap() {
+	n.bootstrapLock.Lock()
+	defer n.bootstrapLock.Unlock()
+	for _, message := range n.pendingMessages {
+		n.writeMessage(message, true)
+	}
+	logging.AddInfo("[Bootstrap] Live replication started,", len(n.pendingMessages), "pending messages.")
+	n.pendingMessages = nil
+	n.bootstrapping = false
+}
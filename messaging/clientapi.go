@@ -0,0 +1,79 @@
+package messaging
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/google/uuid"
+	"github.com/vlado-github/tinydfs/persistance"
+)
+
+// Remote calls served to clients that are not nodes of the cluster.
+// In contrast to READ, UPDATE, DELETE and SCAN, these calls are
+// routed by the node to the owners of a topic.
+const (
+	RPC_CLIENT_PUT     string = "CLIENT_PUT"
+	RPC_CLIENT_GET     string = "CLIENT_GET"
+	RPC_CLIENT_UPDATE  string = "CLIENT_UPDATE"
+	RPC_CLIENT_DELETE  string = "CLIENT_DELETE"
+	RPC_CLIENT_SCAN    string = "CLIENT_SCAN"
+	RPC_CLIENT_MEMBERS string = "CLIENT_MEMBERS"
+)
+
+// PutRequest is a request of the CLIENT_PUT call. Key is generated
+// by the node if empty, clients set it to retry the call safely.
+type PutRequest struct {
+	Topic        string
+	Key          uuid.UUID
+	Payload      []byte
+	PartitionKey string `json:",omitempty"`
+}
+
+// KeyRequest is a request of CLIENT_GET, CLIENT_UPDATE and CLIENT_DELETE calls,
+// PartitionKey has to match the one the key was written with.
+type KeyRequest struct {
+	Topic        string
+	Key          uuid.UUID
+	Text         string `json:",omitempty"`
+	PartitionKey string `json:",omitempty"`
+}
+
+// MembersResponse is a response of the CLIENT_MEMBERS call
+type MembersResponse struct {
+	BroadcastQueue  ConnParams
+	NetworkRegistry json.RawMessage
+}
+
+func (n *node) registerClientHandlers() {
+	n.RegisterRpcHandler(RPC_CLIENT_PUT, NewRpcHandler(func(ctx context.Context, request PutRequest) (uuid.UUID, error) {
+		if err := persistance.ValidateMessageTopic(request.Topic); err != nil {
+			return uuid.Nil, err
+		}
+		key := request.Key
+		if key == uuid.Nil {
+			key = uuid.New()
+		}
+		message := Message{Key: key, Topic: request.Topic, Payload: request.Payload, PartitionKey: request.PartitionKey}
+		n.SendMessage(message)
+		return message.Key, nil
+	}))
+	n.RegisterRpcHandler(RPC_CLIENT_GET, NewRpcHandler(func(ctx context.Context, request KeyRequest) (string, error) {
+		return n.Get(WithPartitionKey(ctx, request.PartitionKey), request.Topic, request.Key)
+	}))
+	n.RegisterRpcHandler(RPC_CLIENT_UPDATE, NewRpcHandler(func(ctx context.Context, request KeyRequest) (bool, error) {
+		return true, n.Update(WithPartitionKey(ctx, request.PartitionKey), request.Topic, request.Key, request.Text)
+	}))
+	n.RegisterRpcHandler(RPC_CLIENT_DELETE, NewRpcHandler(func(ctx context.Context, request KeyRequest) (bool, error) {
+		return true, n.Delete(WithPartitionKey(ctx, request.PartitionKey), request.Topic, request.Key)
+	}))
+	n.RegisterRpcHandler(RPC_CLIENT_SCAN, NewRpcHandler(func(ctx context.Context, topic string) ([]persistance.Record, error) {
+		return n.Scan(ctx, topic)
+	}))
+	n.RegisterRpcHandler(RPC_CLIENT_MEMBERS, NewRpcHandler(func(ctx context.Context, _ struct{}) (MembersResponse, error) {
+		registry, err := n.networkRegistry.ToByteArray()
+		if err != nil {
+			return MembersResponse{}, err
+		}
+		return MembersResponse{BroadcastQueue: n.getBroadcastQueue(), NetworkRegistry: registry}, nil
+	}))
+}
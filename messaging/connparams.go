@@ -1,8 +1,25 @@
 package messaging
 
-// ConnParams specifies tcp/ip connection parameters
+import (
+	"net"
+	"path/filepath"
+)
+
+// ConnParams specifies connection parameters. Unix sockets use Port
+// for the socket file and Ip for its directory, which may be empty.
 type ConnParams struct {
 	Ip       string
 	Port     string
 	Protocol string
+	// AdvertiseIp is the address other nodes connect to, when empty
+	// they use the address the master sees the node connecting from
+	AdvertiseIp string
+}
+
+// Address joins IP and port, IPv6 addresses are put in brackets
+func (c ConnParams) Address() string {
+	if c.Protocol == PROTOCOL_UNIX {
+		return filepath.Join(c.Ip, c.Port)
+	}
+	return net.JoinHostPort(c.Ip, c.Port)
 }
@@ -0,0 +1,270 @@
+package messaging
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/vlado-github/tinydfs/logging"
+	"github.com/vlado-github/tinydfs/persistance"
+)
+
+const (
+	RPC_NODE_LEAVING string = "NODE_LEAVING"
+	RPC_HANDOFF      string = "HANDOFF"
+)
+
+// States of a decommission
+const (
+	DECOMMISSION_ACTIVE  string = "ACTIVE"
+	DECOMMISSION_LEAVING string = "LEAVING"
+	DECOMMISSION_HANDOFF string = "HANDOFF"
+	DECOMMISSION_DONE    string = "DONE"
+	DECOMMISSION_FAILED  string = "FAILED"
+)
+
+// DecommissionTimeout limits the hand-off of all topics of a leaving node
+const DecommissionTimeout = 10 * time.Minute
+
+var ErrDecommissionStarted = errors.New("Decommission already started")
+var ErrNoHandoffTarget = errors.New("No node can take over the topic")
+var ErrHandoffQuorum = errors.New("Hand-off was not acknowledged by a quorum of replicas")
+
+// DecommissionStatus reports progress of a leaving node
+type DecommissionStatus struct {
+	State     string
+	Topics    int
+	HandedOff int
+	// Unacked lists topic@node hand-offs that were not acknowledged
+	Unacked []string `json:",omitempty"`
+	Error   string   `json:",omitempty"`
+}
+
+// HandoffRequest asks a member to take over a topic of the leaving node
+type HandoffRequest struct {
+	SourceID string
+	Topic    persistance.TopicSnapshot
+}
+
+// HandoffAck confirms that the member stores the topic
+type HandoffAck struct {
+	Topic   string
+	Records int
+}
+
+func (n *node) registerDecommissionHandlers() {
+	n.RegisterRpcHandler(RPC_NODE_LEAVING, NewRpcHandler(func(ctx context.Context, nodeID string) ([]byte, error) {
+		return n.queue.SetNodeLeaving(nodeID)
+	}))
+	n.RegisterRpcHandler(RPC_HANDOFF, NewRpcHandler(func(ctx context.Context, request HandoffRequest) (HandoffAck, error) {
+		return n.acceptHandoff(ctx, request)
+	}))
+}
+
+// Decommission removes the node from the cluster. The node is marked leaving,
+// its partitions are moved to other nodes, its topic files are streamed to
+// the remaining members and after their acks the connection is closed.
+func (n *node) Decommission(ctx context.Context) error {
+	if err := n.beginDecommission(); err != nil {
+		return err
+	}
+	return n.decommission(ctx)
+}
+
+// StartDecommission runs the decommission in the background,
+// progress is reported by GetDecommissionStatus
+func (n *node) StartDecommission() error {
+	if err := n.beginDecommission(); err != nil {
+		return err
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), DecommissionTimeout)
+		defer cancel()
+		n.decommission(ctx)
+	}()
+	return nil
+}
+
+// Marks the node leaving, only one decommission runs at a time
+func (n *node) beginDecommission() error {
+	n.decommissionLock.Lock()
+	defer n.decommissionLock.Unlock()
+	state := n.decommissionStatus.State
+	if state != DECOMMISSION_ACTIVE && state != DECOMMISSION_FAILED {
+		return ErrDecommissionStarted
+	}
+	n.decommissionStatus = DecommissionStatus{State: DECOMMISSION_LEAVING}
+	return nil
+}
+
+func (n *node) decommission(ctx context.Context) error {
+	logging.AddInfo("[Decommission] Node is leaving.", n.GetID().String())
+
+	var partitions []byte
+	err := n.callMaster(RPC_NODE_LEAVING, n.GetID().String(), &partitions)
+	if err == nil {
+		// new placement is used right away, so moved partitions are not stored anymore
+		err = n.partitionMap.FromByteArray(partitions)
+	}
+	if err != nil {
+		return n.failDecommission(err)
+	}
+	manifest, err := n.fileManager.Manifest()
+	if err != nil {
+		return n.failDecommission(err)
+	}
+	n.updateDecommission(func(status *DecommissionStatus) {
+		status.State = DECOMMISSION_HANDOFF
+		status.Topics = len(manifest)
+	})
+
+	// topics are handed off concurrently, so an unresponsive member
+	// delays the decommission once instead of once per topic
+	failed := 0
+	var wg sync.WaitGroup
+	for _, topic := range manifest {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unacked, err := n.handoffTopic(ctx, topic)
+			n.updateDecommission(func(status *DecommissionStatus) {
+				status.Unacked = append(status.Unacked, unacked...)
+				if err == nil {
+					status.HandedOff++
+				} else {
+					failed++
+				}
+			})
+			if err != nil {
+				logging.AddError("[Decommission] Topic not handed off.", topic.Topic, err.Error())
+			}
+		}()
+	}
+	wg.Wait()
+	if failed > 0 {
+		return n.failDecommission(fmt.Errorf("%d topics not handed off", failed))
+	}
+	n.updateDecommission(func(status *DecommissionStatus) {
+		status.State = DECOMMISSION_DONE
+	})
+	logging.AddInfo("[Decommission] All topics handed off.", len(manifest))
+	return n.CloseConn()
+}
+
+// GetDecommissionStatus returns progress of the decommission
+func (n *node) GetDecommissionStatus() DecommissionStatus {
+	n.decommissionLock.Lock()
+	defer n.decommissionLock.Unlock()
+	status := n.decommissionStatus
+	status.Unacked = append([]string{}, status.Unacked...)
+	return status
+}
+
+func (n *node) updateDecommission(update func(status *DecommissionStatus)) {
+	n.decommissionLock.Lock()
+	defer n.decommissionLock.Unlock()
+	update(&n.decommissionStatus)
+}
+
+func (n *node) failDecommission(err error) error {
+	n.updateDecommission(func(status *DecommissionStatus) {
+		status.State = DECOMMISSION_FAILED
+		status.Error = err.Error()
+	})
+	logging.AddError("[Decommission] Failed.", err.Error())
+	return err
+}
+
+// Asks every remaining owner of the topic to take it over at once. The topic
+// is handed off once all owners ack, or a quorum of the replication factor
+// for partitioned topics. Members that did not ack are returned.
+func (n *node) handoffTopic(ctx context.Context, topic persistance.TopicSnapshot) ([]string, error) {
+	targets := n.handoffTargets(topic.Topic)
+	if len(targets) == 0 {
+		return nil, ErrNoHandoffTarget
+	}
+	request := HandoffRequest{SourceID: n.GetID().String(), Topic: topic}
+	errs := make([]error, len(targets))
+	var wg sync.WaitGroup
+	for i, nodeID := range targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var ack HandoffAck
+			errs[i] = n.Call(ctx, nodeID, RPC_HANDOFF, request, &ack)
+		}()
+	}
+	wg.Wait()
+	unacked := []string{}
+	acked := 0
+	for i, nodeID := range targets {
+		if errs[i] != nil {
+			logging.AddWarning("[Decommission] Hand-off not acknowledged.", topic.Topic, nodeID, errs[i].Error())
+			unacked = append(unacked, topic.Topic+"@"+nodeID)
+			continue
+		}
+		acked++
+	}
+	if acked < n.handoffQuorum(topic.Topic, len(targets)) {
+		return unacked, ErrHandoffQuorum
+	}
+	return unacked, nil
+}
+
+// Number of acks a hand-off needs, a majority of the replication
+// factor of partitioned topics, otherwise all targets
+func (n *node) handoffQuorum(storageTopic string, targets int) int {
+	topic, _, ok := ParsePartitionTopicName(storageTopic)
+	if !ok {
+		return targets
+	}
+	tp, ok := n.partitionMap.GetTopic(topic)
+	if !ok || tp.Replicas <= 0 {
+		return targets
+	}
+	quorum := tp.Replicas/2 + 1
+	if quorum > targets {
+		return targets
+	}
+	return quorum
+}
+
+// Members that store the topic after the node leaves
+func (n *node) handoffTargets(storageTopic string) []string {
+	targets := []string{}
+	for _, nodeID := range n.getReplicas(storageTopic) {
+		if nodeID == n.GetID().String() {
+			continue
+		}
+		networkTuple, _ := n.networkRegistry.GetItemById(nodeID)
+		if networkTuple != nil && !networkTuple.GetLeavingStatus() {
+			targets = append(targets, nodeID)
+		}
+	}
+	return targets
+}
+
+// Takes over a topic of the leaving node. A topic the node does not store
+// yet is streamed as a file, otherwise records missing locally are copied.
+func (n *node) acceptHandoff(ctx context.Context, request HandoffRequest) (HandoffAck, error) {
+	ack := HandoffAck{Topic: request.Topic.Topic}
+	topics, err := n.fileManager.Topics()
+	if err != nil {
+		return ack, err
+	}
+	if !containsID(topics, request.Topic.Topic) {
+		err = n.transferFrom(ctx, topicSource{nodeID: request.SourceID, topic: request.Topic})
+		if err != nil {
+			return ack, err
+		}
+		return ack, n.fileManager.RebuildBlobRefs()
+	}
+	ack.Records, err = n.mergeMissingRecords(ctx, request.SourceID, request.Topic.Topic)
+	if err != nil {
+		return ack, err
+	}
+	logging.AddInfo("[Decommission] Topic taken over.", request.Topic.Topic, ack.Records, "records")
+	return ack, nil
+}
@@ -0,0 +1,164 @@
+package messaging
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/vlado-github/tinydfs/logging"
+)
+
+// DefaultClusterID is announced when discovery has no cluster ID
+const DefaultClusterID = "tinydfs"
+
+// DefaultDiscoveryInterval is how often joined nodes announce themselves
+const DefaultDiscoveryInterval = time.Second
+
+// DefaultDiscoveryTimeout is how long a starting node listens for announcements
+const DefaultDiscoveryTimeout = 3 * time.Second
+
+var ErrNoMemberDiscovered = errors.New("No member of the cluster was discovered")
+
+// DiscoveryParams configures announcements of cluster members. Group is a
+// UDP address, a multicast group (e.g. 239.255.42.99:9999), a broadcast
+// address or a single host (e.g. 127.0.0.1:9999 on the loopback interface).
+type DiscoveryParams struct {
+	Group     string
+	ClusterID string
+	// Interface joins the multicast group on the named interface, default is chosen by the system
+	Interface string
+	Interval  time.Duration
+	Timeout   time.Duration
+}
+
+// Announcement is sent by every joined node to the discovery group
+type Announcement struct {
+	ClusterID string
+	NodeID    string
+	Ip        string
+	QueuePort string
+}
+
+// NewDiscoveringNode creates a node that joins the cluster through a member announced
+// on the discovery group. If bootstrapCluster is set and no member is discovered,
+// the node starts a new cluster with itself as the master.
+func NewDiscoveringNode(exchangeQueueConn ConnParams, discovery DiscoveryParams, bootstrapCluster bool, persistanceEnabled bool) Node {
+	if discovery.ClusterID == "" {
+		discovery.ClusterID = DefaultClusterID
+	}
+	if discovery.Interval <= 0 {
+		discovery.Interval = DefaultDiscoveryInterval
+	}
+	if discovery.Timeout <= 0 {
+		discovery.Timeout = DefaultDiscoveryTimeout
+	}
+	n := newNode(exchangeQueueConn, ConnParams{}, persistanceEnabled, bootstrapCluster)
+	n.discovery = &discovery
+	n.bootstrapCluster = bootstrapCluster
+	return n
+}
+
+// Listens for announcements of the cluster and joins through the first member that answers
+func (n *node) discoverCluster() error {
+	group, err := net.ResolveUDPAddr("udp", n.discovery.Group)
+	if err != nil {
+		return err
+	}
+	conn, err := listenDiscovery(group, n.discovery.Interface)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(n.discovery.Timeout))
+
+	buffer := make([]byte, 1500)
+	for {
+		size, sender, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			break
+		}
+		var announcement Announcement
+		if err := json.Unmarshal(buffer[:size], &announcement); err != nil {
+			logging.AddWarning("[Discovery] Invalid announcement.", sender.String(), err.Error())
+			continue
+		}
+		if announcement.ClusterID != n.discovery.ClusterID || announcement.NodeID == n.GetID().String() {
+			continue
+		}
+		ip := announcement.Ip
+		if ip == "" || net.ParseIP(ip).IsUnspecified() {
+			ip = sender.IP.String()
+		}
+		seed := ConnParams{Ip: ip, Port: announcement.QueuePort, Protocol: n.exchangeQueueConnParams.Protocol}
+		if n.joinThrough(seed) == nil {
+			return nil
+		}
+	}
+	if !n.bootstrapCluster {
+		return ErrNoMemberDiscovered
+	}
+	logging.AddWarning("[Discovery] No member discovered, bootstrapping a new cluster.")
+	n.setBroadcastQueue(n.exchangeQueueConnParams)
+	return nil
+}
+
+// Announces the node to the discovery group until the node is closed
+func (n *node) announce() {
+	group, err := net.ResolveUDPAddr("udp", n.discovery.Group)
+	if err != nil {
+		logging.AddError("[Discovery] Invalid group.", n.discovery.Group, err.Error())
+		return
+	}
+	// unconnected socket, so nobody listening is not reported as an error
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		logging.AddError("[Discovery] Announcing failed.", err.Error())
+		return
+	}
+	defer conn.Close()
+	ip := n.exchangeQueueConnParams.AdvertiseIp
+	if ip == "" {
+		ip = n.exchangeQueueConnParams.Ip
+	}
+	payload, err := json.Marshal(Announcement{
+		ClusterID: n.discovery.ClusterID,
+		NodeID:    n.GetID().String(),
+		Ip:        ip,
+		QueuePort: n.exchangeQueueConnParams.Port,
+	})
+	if err != nil {
+		logging.AddError("Json serialization failed.", err.Error())
+		return
+	}
+	ticker := time.NewTicker(n.discovery.Interval)
+	defer ticker.Stop()
+	for {
+		if _, err := conn.WriteToUDP(payload, group); err != nil {
+			logging.AddTrace("[Discovery] Announcement not sent.", err.Error())
+		}
+		select {
+		case <-n.closed:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Joins the multicast group, other groups are listened on their port
+func listenDiscovery(group *net.UDPAddr, interfaceName string) (*net.UDPConn, error) {
+	if group.IP.IsMulticast() {
+		var ifi *net.Interface
+		if interfaceName != "" {
+			var err error
+			if ifi, err = net.InterfaceByName(interfaceName); err != nil {
+				return nil, err
+			}
+		}
+		return net.ListenMulticastUDP("udp", ifi, group)
+	}
+	if group.IP.Equal(net.IPv4bcast) {
+		return net.ListenUDP("udp", &net.UDPAddr{Port: group.Port})
+	}
+	return net.ListenUDP("udp", group)
+}
@@ -0,0 +1,425 @@
+package messaging
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ErrPartitioned = errors.New("Nodes are partitioned")
+
+// Faults injected into messages sent from one node to another. Every Write
+// of a connection is treated as a message, the queue writes each JSON
+// message at once.
+type Faults struct {
+	Latency time.Duration
+	// Jitter adds a random delay up to its value, order of messages is kept
+	Jitter        time.Duration
+	DropRate      float64
+	DuplicateRate float64
+	// ReorderRate is the share of messages delayed behind the following ones
+	ReorderRate  float64
+	ReorderDelay time.Duration
+}
+
+type faultLink struct {
+	from string
+	to   string
+}
+
+// FaultNetwork wraps a transport and injects faults between named nodes.
+// Nodes are told apart by port, as on a single host. Random decisions
+// come from the seed, so scenarios are repeatable.
+type FaultNetwork struct {
+	base      Transport
+	id        int64
+	lock      sync.Mutex
+	random    *rand.Rand
+	names     map[string]string
+	defaults  Faults
+	links     map[faultLink]Faults
+	blocked   map[faultLink]bool
+	conns     map[*faultConn]bool
+	protocols map[string]bool
+}
+
+var faultNetworks atomic.Int64
+
+// NewFaultNetwork creates a network of nodes on top of the base transport
+func NewFaultNetwork(base Transport, seed int64) *FaultNetwork {
+	return &FaultNetwork{
+		base:      base,
+		id:        faultNetworks.Add(1),
+		random:    rand.New(rand.NewSource(seed)),
+		names:     make(map[string]string),
+		links:     make(map[faultLink]Faults),
+		blocked:   make(map[faultLink]bool),
+		conns:     make(map[*faultConn]bool),
+		protocols: make(map[string]bool),
+	}
+}
+
+// Transport returns the view of the named node on the network
+func (f *FaultNetwork) Transport(name string) Transport {
+	return &faultTransport{network: f, name: name}
+}
+
+// Protocol registers the transport of the named node and returns its protocol.
+// Close unregisters it.
+func (f *FaultNetwork) Protocol(name string) string {
+	protocol := fmt.Sprintf("fault%d-%s", f.id, name)
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if !f.protocols[protocol] {
+		RegisterTransport(protocol, f.Transport(name))
+		f.protocols[protocol] = true
+	}
+	return protocol
+}
+
+// Close unregisters protocols of the nodes
+func (f *FaultNetwork) Close() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for protocol := range f.protocols {
+		UnregisterTransport(protocol)
+	}
+	f.protocols = make(map[string]bool)
+}
+
+// SetDefaultFaults changes faults of links without own faults
+func (f *FaultNetwork) SetDefaultFaults(faults Faults) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.defaults = faults
+}
+
+// SetFaults changes faults of messages from one node to another
+func (f *FaultNetwork) SetFaults(from string, to string, faults Faults) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.links[faultLink{from, to}] = faults
+}
+
+// Partition cuts nodes of every group off from nodes of the other groups.
+// Open connections between them are closed, new ones are refused.
+func (f *FaultNetwork) Partition(groups ...[]string) {
+	f.lock.Lock()
+	for i, group := range groups {
+		for j, other := range groups {
+			if i == j {
+				continue
+			}
+			for _, from := range group {
+				for _, to := range other {
+					f.blocked[faultLink{from, to}] = true
+				}
+			}
+		}
+	}
+	var severed []*faultConn
+	for conn := range f.conns {
+		from, to := f.names[conn.local], f.names[conn.remote]
+		if f.blocked[faultLink{from, to}] {
+			severed = append(severed, conn)
+		}
+	}
+	f.lock.Unlock()
+	for _, conn := range severed {
+		conn.Close()
+	}
+}
+
+// Block drops messages from one node to another, the other direction keeps
+// working. Open connections stay open, new ones are refused.
+func (f *FaultNetwork) Block(from string, to string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.blocked[faultLink{from, to}] = true
+}
+
+// Heal removes all partitions and blocks
+func (f *FaultNetwork) Heal() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.blocked = make(map[faultLink]bool)
+}
+
+// Returns faults of the link, messages of a node to itself are never faulted
+func (f *FaultNetwork) faultsOf(from string, to string) (Faults, bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if from == to {
+		return Faults{}, false
+	}
+	link := faultLink{from, to}
+	if faults, ok := f.links[link]; ok {
+		return faults, f.blocked[link]
+	}
+	return f.defaults, f.blocked[link]
+}
+
+func (f *FaultNetwork) isBlocked(from string, to string) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return from != to && (f.blocked[faultLink{from, to}] || f.blocked[faultLink{to, from}])
+}
+
+// Returns true with the probability of the rate
+func (f *FaultNetwork) roll(rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.random.Float64() < rate
+}
+
+func (f *FaultNetwork) jitter(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return time.Duration(f.random.Int63n(int64(max)))
+}
+
+func (f *FaultNetwork) name(port string) string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.names[port]
+}
+
+func (f *FaultNetwork) register(addr net.Addr, name string) string {
+	_, port, _ := net.SplitHostPort(addr.String())
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.names[port] = name
+	return port
+}
+
+func (f *FaultNetwork) track(conn *faultConn, open bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if open {
+		f.conns[conn] = true
+	} else {
+		delete(f.conns, conn)
+	}
+}
+
+// faultTransport listens and dials on behalf of a named node
+type faultTransport struct {
+	network *FaultNetwork
+	name    string
+}
+
+func (t *faultTransport) Listen(address string) (net.Listener, error) {
+	l, err := t.network.base.Listen(address)
+	if err != nil {
+		return nil, err
+	}
+	port := t.network.register(l.Addr(), t.name)
+	return &faultListener{Listener: l, network: t.network, port: port}, nil
+}
+
+func (t *faultTransport) Dial(ctx context.Context, address string) (net.Conn, error) {
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if t.network.isBlocked(t.name, t.network.name(port)) {
+		return nil, ErrPartitioned
+	}
+	conn, err := t.network.base.Dial(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	local := t.network.register(conn.LocalAddr(), t.name)
+	return newFaultConn(conn, t.network, local, port), nil
+}
+
+type faultListener struct {
+	net.Listener
+	network *FaultNetwork
+	port    string
+}
+
+func (l *faultListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	_, remote, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	return newFaultConn(conn, l.network, l.port, remote), nil
+}
+
+type faultMessage struct {
+	data []byte
+	at   time.Time
+}
+
+// faultConn delivers written messages in the background, so they
+// can be delayed, dropped, duplicated and reordered
+type faultConn struct {
+	net.Conn
+	network   *FaultNetwork
+	local     string
+	remote    string
+	lock      sync.Mutex
+	queue     []faultMessage
+	lastAt    time.Time
+	wake      chan struct{}
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newFaultConn(conn net.Conn, network *FaultNetwork, local string, remote string) *faultConn {
+	c := &faultConn{
+		Conn:    conn,
+		network: network,
+		local:   local,
+		remote:  remote,
+		wake:    make(chan struct{}, 1),
+		closed:  make(chan struct{}),
+	}
+	network.track(c, true)
+	go c.deliver()
+	return c
+}
+
+func (c *faultConn) Write(p []byte) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	// names are resolved late, the dialing side registers after the accept
+	faults, blocked := c.network.faultsOf(c.network.name(c.local), c.network.name(c.remote))
+	if blocked || c.network.roll(faults.DropRate) {
+		return len(p), nil
+	}
+	copies := 1
+	if c.network.roll(faults.DuplicateRate) {
+		copies = 2
+	}
+	data := append([]byte(nil), p...)
+
+	c.lock.Lock()
+	for i := 0; i < copies; i++ {
+		at := time.Now().Add(faults.Latency + c.network.jitter(faults.Jitter))
+		if at.Before(c.lastAt) {
+			at = c.lastAt
+		}
+		if c.network.roll(faults.ReorderRate) {
+			at = at.Add(faults.Latency + faults.Jitter + faults.ReorderDelay + time.Millisecond)
+		} else {
+			c.lastAt = at
+		}
+		index := sort.Search(len(c.queue), func(i int) bool {
+			return c.queue[i].at.After(at)
+		})
+		c.queue = append(c.queue, faultMessage{})
+		copy(c.queue[index+1:], c.queue[index:])
+		c.queue[index] = faultMessage{data: data, at: at}
+	}
+	c.lock.Unlock()
+
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+	return len(p), nil
+}
+
+// Writes messages to the wrapped connection once they are due
+func (c *faultConn) deliver() {
+	for {
+		c.lock.Lock()
+		var wait time.Duration
+		if len(c.queue) > 0 {
+			wait = time.Until(c.queue[0].at)
+			if wait <= 0 {
+				message := c.queue[0]
+				c.queue = c.queue[1:]
+				c.lock.Unlock()
+				c.Conn.Write(message.data)
+				continue
+			}
+		}
+		c.lock.Unlock()
+
+		var timer *time.Timer
+		var due <-chan time.Time
+		if wait > 0 {
+			timer = time.NewTimer(wait)
+			due = timer.C
+		}
+		select {
+		case <-c.wake:
+		case <-due:
+		case <-c.closed:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		select {
+		case <-c.closed:
+			return
+		default:
+		}
+	}
+}
+
+// Messages not delivered yet are lost, as with a reset connection
+func (c *faultConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.network.track(c, false)
+	})
+	return c.Conn.Close()
+}
+
+// ScenarioStep changes faults of the network and checks the cluster
+type ScenarioStep struct {
+	Name  string
+	Apply func(network *FaultNetwork)
+	// Check is retried until it returns nil or the timeout passes
+	Check   func() error
+	Timeout time.Duration
+}
+
+// DefaultScenarioTimeout limits checks of steps without a timeout
+const DefaultScenarioTimeout = 10 * time.Second
+
+// RunScenario applies the steps in order and returns the error of the first failed check
+func (f *FaultNetwork) RunScenario(steps []ScenarioStep) error {
+	for _, step := range steps {
+		if step.Apply != nil {
+			step.Apply(f)
+		}
+		if step.Check == nil {
+			continue
+		}
+		timeout := step.Timeout
+		if timeout <= 0 {
+			timeout = DefaultScenarioTimeout
+		}
+		deadline := time.Now().Add(timeout)
+		err := step.Check()
+		for err != nil && time.Now().Before(deadline) {
+			time.Sleep(20 * time.Millisecond)
+			err = step.Check()
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", step.Name, err)
+		}
+	}
+	return nil
+}
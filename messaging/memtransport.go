@@ -0,0 +1,245 @@
+package messaging
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// first port given to listeners on port 0 and to dialing connections
+const memoryEphemeralPort = 49152
+
+var ErrConnectionRefused = errors.New("Connection refused, nothing listens on the address")
+var ErrAddressInUse = errors.New("Address already in use")
+
+// memoryTransport is a network inside of the process. It behaves like a
+// single host: listeners are found by port and the host part is ignored.
+// Writes never block, so nodes of one process can run deterministically
+// without binding real ports.
+type memoryTransport struct {
+	lock      sync.Mutex
+	listeners map[string]*memoryListener
+	nextPort  int
+}
+
+// NewMemoryTransport creates a new in-memory network, register it with
+// RegisterTransport to keep clusters of a process apart
+func NewMemoryTransport() Transport {
+	return &memoryTransport{
+		listeners: make(map[string]*memoryListener),
+		nextPort:  memoryEphemeralPort,
+	}
+}
+
+func (t *memoryTransport) Listen(address string) (net.Listener, error) {
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if port == "" || port == "0" {
+		port = t.ephemeralPort()
+	}
+	if _, ok := t.listeners[port]; ok {
+		return nil, ErrAddressInUse
+	}
+	l := &memoryListener{
+		transport: t,
+		port:      port,
+		addr:      memoryAddr(net.JoinHostPort("127.0.0.1", port)),
+		conns:     make(chan net.Conn),
+		closed:    make(chan struct{}),
+	}
+	t.listeners[port] = l
+	return l, nil
+}
+
+func (t *memoryTransport) Dial(ctx context.Context, address string) (net.Conn, error) {
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	t.lock.Lock()
+	l, ok := t.listeners[port]
+	local := memoryAddr(net.JoinHostPort("127.0.0.1", t.ephemeralPort()))
+	t.lock.Unlock()
+	if !ok {
+		return nil, ErrConnectionRefused
+	}
+
+	toServer, toClient := newMemoryBuffer(), newMemoryBuffer()
+	client := &memoryConn{in: toClient, out: toServer, local: local, remote: l.addr}
+	server := &memoryConn{in: toServer, out: toClient, local: l.addr, remote: local}
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.closed:
+		return nil, ErrConnectionRefused
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (t *memoryTransport) ephemeralPort() string {
+	port := strconv.Itoa(t.nextPort)
+	t.nextPort++
+	return port
+}
+
+type memoryAddr string
+
+func (a memoryAddr) Network() string {
+	return PROTOCOL_MEMORY
+}
+
+func (a memoryAddr) String() string {
+	return string(a)
+}
+
+type memoryListener struct {
+	transport *memoryTransport
+	port      string
+	addr      memoryAddr
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *memoryListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *memoryListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		l.transport.lock.Lock()
+		delete(l.transport.listeners, l.port)
+		l.transport.lock.Unlock()
+	})
+	return nil
+}
+
+func (l *memoryListener) Addr() net.Addr {
+	return l.addr
+}
+
+// memoryConn reads what the other side wrote to its buffer
+type memoryConn struct {
+	in     *memoryBuffer
+	out    *memoryBuffer
+	local  memoryAddr
+	remote memoryAddr
+}
+
+func (c *memoryConn) Read(p []byte) (int, error) {
+	return c.in.read(p)
+}
+
+func (c *memoryConn) Write(p []byte) (int, error) {
+	return c.out.write(p)
+}
+
+func (c *memoryConn) Close() error {
+	c.in.close()
+	c.out.close()
+	return nil
+}
+
+func (c *memoryConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *memoryConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *memoryConn) SetDeadline(t time.Time) error {
+	return c.in.setDeadline(t)
+}
+
+func (c *memoryConn) SetReadDeadline(t time.Time) error {
+	return c.in.setDeadline(t)
+}
+
+// Writes do not block, so write deadlines never expire
+func (c *memoryConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// memoryBuffer is one direction of a connection without size limit
+type memoryBuffer struct {
+	lock     sync.Mutex
+	cond     *sync.Cond
+	data     bytes.Buffer
+	closed   bool
+	deadline time.Time
+	timer    *time.Timer
+}
+
+func newMemoryBuffer() *memoryBuffer {
+	b := &memoryBuffer{}
+	b.cond = sync.NewCond(&b.lock)
+	return b
+}
+
+func (b *memoryBuffer) read(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for b.data.Len() == 0 {
+		if b.closed {
+			return 0, io.EOF
+		}
+		if !b.deadline.IsZero() && !time.Now().Before(b.deadline) {
+			return 0, os.ErrDeadlineExceeded
+		}
+		b.cond.Wait()
+	}
+	return b.data.Read(p)
+}
+
+func (b *memoryBuffer) write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.closed {
+		return 0, io.ErrClosedPipe
+	}
+	b.cond.Broadcast()
+	return b.data.Write(p)
+}
+
+func (b *memoryBuffer) close() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.closed = true
+	b.cond.Broadcast()
+}
+
+func (b *memoryBuffer) setDeadline(t time.Time) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.deadline = t
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+	if !t.IsZero() {
+		b.timer = time.AfterFunc(time.Until(t), func() {
+			b.lock.Lock()
+			b.cond.Broadcast()
+			b.lock.Unlock()
+		})
+	}
+	b.cond.Broadcast()
+	return nil
+}
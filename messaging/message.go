@@ -1,10 +1,37 @@
 package messaging
 
-import "github.com/google/uuid"
+import (
+	"context"
+
+	"github.com/google/uuid"
+)
+
+// PartitionKeyHeader keeps the partition key of a stored message
+const PartitionKeyHeader = "partition-key"
 
 // Message used in protocol with unique identifier
 type Message struct {
 	Key     uuid.UUID
 	Topic   string
 	Payload []byte
+	// PartitionKey is hashed to select a partition of the topic,
+	// if empty the message key is used instead.
+	PartitionKey string `json:",omitempty"`
+	// Partition is set to route a message to the explicit partition.
+	Partition *int `json:",omitempty"`
+}
+
+type partitionKeyContext struct{}
+
+// WithPartitionKey returns context that routes Get, Put, Update and Delete
+// of the key to the partition selected by the partition key. Keys written
+// with a partition key are found only in that partition.
+func WithPartitionKey(ctx context.Context, partitionKey string) context.Context {
+	return context.WithValue(ctx, partitionKeyContext{}, partitionKey)
+}
+
+// PartitionKeyFromContext returns partition key of the context, or empty string
+func PartitionKeyFromContext(ctx context.Context) string {
+	partitionKey, _ := ctx.Value(partitionKeyContext{}).(string)
+	return partitionKey
 }
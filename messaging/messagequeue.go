@@ -3,6 +3,7 @@ package messaging
 import (
 	"encoding/json"
 	"github.com/vlado-github/tinydfs/logging"
+	"github.com/vlado-github/tinydfs/persistance"
 
 	"net"
 	"os"
@@ -17,60 +18,81 @@ type MessageQueue interface {
 	Run()
 	Status()
 	Close() error
+	SetNodeLeaving(nodeID string) ([]byte, error)
+	MoveReplica(topic string, partition int, from string, to string) error
+	GetNetworkRegistry() NetworkRegistry
+	GetPartitionMap() PartitionMap
+	Broadcast(topic string, payload []byte)
 
 	RegisterHandler(HandlerType, MsgQueueHandlerFunc)
+	RegisterRpcHandler(method string, handler RpcHandlerFunc)
 }
 
 type messagequeue struct {
-	connParams        ConnParams
-	pool              Pool
-	messageBuffer     map[string]Message
-	onMessageReceived MsgQueueHandlerFunc
-	networkRegistry   NetworkRegistry
+	connParams             ConnParams
+	pool                   *Pool
+	members                map[string]string
+	subscriptions          map[string]string
+	membersLock            sync.Mutex
+	messageBuffer          map[string]Message
+	onMessageReceived      MsgQueueHandlerFunc
+	networkChangedHandlers []MsgQueueHandlerFunc
+	handlersLock           sync.Mutex
+	networkRegistry        NetworkRegistry
+	partitionMap           PartitionMap
+	rpc                    *rpcserver
 }
 
 var mutex = &sync.Mutex{}
 
 // NewQueue creates new instance of the message queue
+// with message buffer, connection pool and network registry
 func NewQueue(conn ConnParams) MessageQueue {
 	return &messagequeue{
 		connParams:        conn,
+		pool:              NewPool(),
+		members:           make(map[string]string),
+		subscriptions:     make(map[string]string),
+		messageBuffer:     make(map[string]Message),
 		onMessageReceived: NewMsgQueueHandlerFunc(),
+		networkRegistry:   NewNetworkRegistry(),
+		partitionMap:      NewPartitionMap(),
+		rpc:               newRpcServer(),
 	}
 }
 
-// Cretes instance of message buffer, connection pool and network registry
-func (queue *messagequeue) init() {
-	queue.messageBuffer = make(map[string]Message)
-	queue.pool.conns = make(map[string]net.Conn)
-	queue.networkRegistry = NewNetworkRegistry()
+// NewPersistentQueue creates a queue that keeps its network registry in the file,
+// so epochs keep increasing after a restart of the master
+func NewPersistentQueue(conn ConnParams, registryFile string) MessageQueue {
+	queue := NewQueue(conn).(*messagequeue)
+	queue.networkRegistry = NewPersistentNetworkRegistry(registryFile)
+	return queue
 }
 
 // Starts the queue and listens for incoming connections
 func (queue *messagequeue) Run() {
-	queue.init()
-
-	l, err := net.Listen(queue.connParams.Protocol, queue.connParams.Ip+":"+queue.connParams.Port)
+	l, err := Listen(queue.connParams)
 	if err != nil {
 		logging.AddError("[Queue] Error listening:", err.Error())
 		os.Exit(1)
 	}
 	defer l.Close()
 
-	logging.AddInfo("[Queue] Listening on " + queue.connParams.Ip + ":" + queue.connParams.Port)
+	logging.AddInfo("[Queue] Listening on " + queue.connParams.Address())
+	go queue.sendingMessages()
 	for {
 		// Listen for an incoming connection.
 		conn, err := l.Accept()
-		var poolKey = uuid.New().String()
-		queue.pool.conns[poolKey] = conn
 		if err != nil {
 			logging.AddError("[Queue] Error accepting: ", err.Error())
 			os.Exit(1)
 		}
-		queue.onNewConnection(conn)
+		// connections join the broadcast pool once they answer the ack
+		// as a node or subscribe, RPC connections stay out of it
+		var poolKey = uuid.New().String()
+		queue.onNewConnection(conn, poolKey)
 
 		go queue.receiveMessage(conn, poolKey)
-		go queue.sendingMessages()
 	}
 }
 
@@ -83,17 +105,29 @@ func (queue *messagequeue) receiveMessage(conn net.Conn, poolKey string) {
 		if err != nil {
 			logging.AddInfo("[Queue] Connection closed.")
 			conn.Close()
-			delete(queue.pool.conns, poolKey)
-			queue.removeFromNetworkRegistry(conn)
+			queue.pool.Remove(poolKey)
+			queue.removeFromNetworkRegistry(poolKey)
 			break
 		}
 
 		if message.Topic == CONN_ACK_REPLY {
 			logging.AddInfo("[Queue] Message Received:", message.Topic, string(message.Payload))
-			queue.onNewNetworkNode(message)
+			queue.onNewNetworkNode(conn, poolKey, message)
+		} else if message.Topic == SUBSCRIBE {
+			queue.onSubscribe(conn, poolKey, message)
+		} else if message.Topic == RPC_REQUEST {
+			go queue.onRpcRequest(conn, message)
+		} else if message.Topic == RPC_CANCEL {
+			queue.rpc.cancel(message)
+		} else if message.Topic == CREATE_TOPIC {
+			logging.AddInfo("[Queue] Message Received:", message.Topic, string(message.Payload))
+			queue.onCreateTopic(message)
+		} else if err := persistance.ValidateMessageTopic(message.Topic); err != nil {
+			logging.AddWarning("[Queue] Message rejected.", err.Error())
 		} else {
-			key := queue.addMessage(message)
-			logging.AddInfo("[Queue] Message Received:", string(queue.messageBuffer[key].Payload))
+			queue.assignPartition(&message)
+			queue.addMessage(message)
+			logging.AddInfo("[Queue] Message Received:", string(message.Payload))
 		}
 	}
 }
@@ -112,8 +146,8 @@ func (queue *messagequeue) sendingMessages() {
 	for {
 		mutex.Lock()
 		for index, message := range queue.messageBuffer {
-			for _, conn := range queue.pool.conns {
-				if conn != nil {
+			for poolKey, conn := range queue.pool.Snapshot() {
+				if conn != nil && queue.accepts(poolKey, message) {
 					encoder := json.NewEncoder(conn)
 					encodeMessage(&message, encoder)
 					logging.AddInfo("[Queue] Sending: ", string(message.Payload)+"\n")
@@ -127,38 +161,45 @@ func (queue *messagequeue) sendingMessages() {
 
 // Prints current network status
 func (queue *messagequeue) Status() {
-	logging.AddInfo("[Queue] Total connections:", len(queue.pool.conns))
+	logging.AddInfo("[Queue] Total connections:", queue.pool.Len())
 	networkList, _ := queue.networkRegistry.ToString()
 	logging.AddInfo("[Queue] NetworkRegistry: ", networkList)
 }
 
 // Closes all connections to nodes
 func (queue *messagequeue) Close() error {
-	for _, conn := range queue.pool.conns {
-		if conn != nil {
-			err := conn.Close()
-			return err
+	var err error
+	for _, conn := range queue.pool.Snapshot() {
+		if closeErr := conn.Close(); err == nil {
+			err = closeErr
 		}
 	}
-	return nil
+	return err
 }
 
 // Sends connection ack message to node
-func (queue *messagequeue) onNewConnection(conn net.Conn) {
+func (queue *messagequeue) onNewConnection(conn net.Conn, poolKey string) {
 	logging.AddInfo("[Queue] Client Connected...")
-	var message = Message{Key: uuid.New(), Topic: CONN_ACK, Payload: []byte(conn.RemoteAddr().String())}
+	var message = Message{Key: uuid.New(), Topic: CONN_ACK, Payload: []byte(remoteAddress(conn, poolKey))}
 	encoder := json.NewEncoder(conn)
 	encodeMessage(&message, encoder)
 }
 
-// Adds new node info to network registry
-func (queue *messagequeue) onNewNetworkNode(message Message) {
-	var networkTuple *networktuple
-	err := json.Unmarshal(message.Payload, &networkTuple)
+// Adds new node info to network registry and its connection to the broadcast pool
+func (queue *messagequeue) onNewNetworkNode(conn net.Conn, poolKey string, message Message) {
+	var reply connAckReply
+	err := json.Unmarshal(message.Payload, &reply)
 	if err != nil {
 		logging.AddError("Message has invalid format.", err.Error())
+		return
 	}
-	queue.networkRegistry.AddItem(networkTuple)
+	queue.membersLock.Lock()
+	queue.members[poolKey] = reply.networktuple.GetId()
+	queue.membersLock.Unlock()
+	queue.pool.Add(poolKey, conn)
+	// epochs stay monotonic when the queue takes over from another master
+	queue.networkRegistry.RaiseEpoch(reply.Epoch)
+	queue.networkRegistry.AddItem(&reply.networktuple)
 	queue.onNetworkChanged()
 }
 
@@ -172,23 +213,176 @@ func (queue *messagequeue) onNetworkChanged() {
 	logging.AddInfo(string(payload))
 	var message = Message{Key: uuid.New(), Topic: NETWORK_CHANGED, Payload: payload}
 	queue.addMessage(message)
+	queue.onPartitionsChanged()
+	queue.handlersLock.Lock()
+	handlers := queue.networkChangedHandlers
+	queue.handlersLock.Unlock()
+	for _, handler := range handlers {
+		handler(queue)
+	}
+}
+
+// Places partitions of a new topic on nodes from network registry
+func (queue *messagequeue) onCreateTopic(message Message) {
+	var spec TopicSpec
+	err := json.Unmarshal(message.Payload, &spec)
+	if err != nil {
+		logging.AddError("Message has invalid format.", err.Error())
+		return
+	}
+	_, err = queue.partitionMap.AddTopic(spec, queue.networkRegistry)
+	if err != nil {
+		logging.AddError("[Queue] Topic not created.", spec.Topic, err.Error())
+		return
+	}
+	queue.onPartitionsChanged()
+}
+
+// Notifies all nodes in network about partition map
+func (queue *messagequeue) onPartitionsChanged() {
+	payload, err := queue.partitionMap.ToByteArray()
+	if err != nil {
+		logging.AddError("Json serialization failed.", err.Error())
+		return
+	}
+	var message = Message{Key: uuid.New(), Topic: PARTITIONS_CHANGED, Payload: payload}
+	queue.addMessage(message)
+}
+
+// Handles RPC request and replies on the same connection
+func (queue *messagequeue) onRpcRequest(conn net.Conn, message Message) {
+	response := queue.rpc.handle(message)
+	mutex.Lock()
+	defer mutex.Unlock()
+	encoder := json.NewEncoder(conn)
+	encodeMessage(&response, encoder)
+}
+
+// Resolves the partition of a message, so that all nodes
+// store the message in the same partition
+func (queue *messagequeue) assignPartition(message *Message) {
+	partition := queue.partitionMap.GetPartition(*message)
+	if partition >= 0 {
+		message.Partition = &partition
+	}
+}
+
+// SetNodeLeaving marks the node as leaving and moves its partition replicas
+// to other nodes. Returns the new partition map.
+func (queue *messagequeue) SetNodeLeaving(nodeID string) ([]byte, error) {
+	if !queue.networkRegistry.SetItemLeaving(nodeID) {
+		return nil, ErrNodeNotFound
+	}
+	moved := queue.partitionMap.ReplaceNode(nodeID, queue.networkRegistry)
+	payload, err := queue.partitionMap.ToByteArray()
+	logging.AddInfo("[Queue] Node is leaving.", nodeID, moved, "replicas moved")
+	queue.onNetworkChanged()
+	return payload, err
+}
+
+// MoveReplica hands a partition replica over to another node
+// and notifies all nodes about the new placement
+func (queue *messagequeue) MoveReplica(topic string, partition int, from string, to string) error {
+	moved := queue.partitionMap.MoveReplica(topic, partition, from, to)
+	if !moved {
+		return ErrReplicaNotFound
+	}
+	logging.AddInfo("[Queue] Replica moved.", PartitionTopicName(topic, partition), from, to)
+	queue.onPartitionsChanged()
+	return nil
+}
+
+// Broadcast sends an internal message to all connected nodes
+func (queue *messagequeue) Broadcast(topic string, payload []byte) {
+	queue.addMessage(Message{Key: uuid.New(), Topic: topic, Payload: payload})
 }
 
-// Remove closed node from network registry
-func (queue *messagequeue) removeFromNetworkRegistry(conn net.Conn) {
-	_, port, _ := net.SplitHostPort(conn.RemoteAddr().String())
-	networkItem, index := queue.networkRegistry.GetItemByRemoteAddPort(port)
-	if networkItem != nil {
-		queue.networkRegistry.RemoveItem(index)
+// GetNetworkRegistry returns a copy of the network registry of the queue
+func (queue *messagequeue) GetNetworkRegistry() NetworkRegistry {
+	registry := NewNetworkRegistry()
+	payload, err := queue.networkRegistry.ToByteArray()
+	if err == nil {
+		registry.FromByteArray(payload)
 	}
+	return registry
+}
+
+// GetPartitionMap returns a copy of the partition map of the queue
+func (queue *messagequeue) GetPartitionMap() PartitionMap {
+	partitionMap := NewPartitionMap()
+	payload, err := queue.partitionMap.ToByteArray()
+	if err == nil {
+		partitionMap.FromByteArray(payload)
+	}
+	return partitionMap
+}
+
+// Adds a client connection to the broadcast pool, it receives messages of the topic only
+func (queue *messagequeue) onSubscribe(conn net.Conn, poolKey string, message Message) {
+	queue.membersLock.Lock()
+	queue.subscriptions[poolKey] = string(message.Payload)
+	queue.membersLock.Unlock()
+	queue.pool.Add(poolKey, conn)
+}
+
+// Nodes receive all messages, subscribers messages of their topic
+func (queue *messagequeue) accepts(poolKey string, message Message) bool {
+	queue.membersLock.Lock()
+	defer queue.membersLock.Unlock()
+	topic, ok := queue.subscriptions[poolKey]
+	return !ok || topic == message.Topic
+}
+
+// Removes the node of a closed connection from network registry, unless
+// the node is still connected on another one. Closed connections of
+// clients do not change the network.
+func (queue *messagequeue) removeFromNetworkRegistry(poolKey string) {
+	queue.membersLock.Lock()
+	delete(queue.subscriptions, poolKey)
+	nodeID, ok := queue.members[poolKey]
+	delete(queue.members, poolKey)
+	for _, id := range queue.members {
+		if id == nodeID {
+			ok = false
+		}
+	}
+	queue.membersLock.Unlock()
+	if !ok {
+		return
+	}
+	queue.networkRegistry.RemoveItemById(nodeID)
 	queue.onNetworkChanged()
 }
 
+// Address of the node on the connection. Connections without a host:port
+// address (e.g. unix sockets) are told apart by their pool key.
+func remoteAddress(conn net.Conn, poolKey string) string {
+	if addr := conn.RemoteAddr(); addr != nil {
+		if host, port, err := net.SplitHostPort(addr.String()); err == nil && port != "" {
+			return net.JoinHostPort(host, port)
+		}
+	}
+	return net.JoinHostPort("", poolKey)
+}
+
+// Registers handler of the queue event, handlers run in order of registration
 func (queue *messagequeue) RegisterHandler(handlerType HandlerType, handlerFunc MsgQueueHandlerFunc) {
 	switch handlerType {
+	case NETWORKCHANGED:
+		{
+			queue.handlersLock.Lock()
+			queue.networkChangedHandlers = append(queue.networkChangedHandlers, handlerFunc)
+			queue.handlersLock.Unlock()
+			break
+		}
 	default:
 		{
 			break
 		}
 	}
 }
+
+// Registers handler of RPC method served by the queue
+func (queue *messagequeue) RegisterRpcHandler(method string, handler RpcHandlerFunc) {
+	queue.rpc.register(method, handler)
+}
@@ -1,7 +1,15 @@
 package messaging
 
 const (
-	CONN_ACK        string = "CONN_ACK"
-	CONN_ACK_REPLY  string = "CONN_ACK_REPLY"
-	NETWORK_CHANGED string = "NETWORK_CHANGED"
+	CONN_ACK           string = "CONN_ACK"
+	CONN_ACK_REPLY     string = "CONN_ACK_REPLY"
+	NETWORK_CHANGED    string = "NETWORK_CHANGED"
+	CREATE_TOPIC       string = "CREATE_TOPIC"
+	PARTITIONS_CHANGED string = "PARTITIONS_CHANGED"
+	REBALANCE_CHANGED  string = "REBALANCE_CHANGED"
+	NAMESPACE_CHANGED  string = "NAMESPACE_CHANGED"
+	SUBSCRIBE          string = "SUBSCRIBE"
+	RPC_REQUEST        string = "RPC_REQUEST"
+	RPC_RESPONSE       string = "RPC_RESPONSE"
+	RPC_CANCEL         string = "RPC_CANCEL"
 )
@@ -1,35 +1,63 @@
 package messaging
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net"
 	"os"
+	"path"
 	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/google/uuid"
+	"github.com/vlado-github/tinydfs/namespace"
+	"github.com/vlado-github/tinydfs/persistance"
 )
 
+// nodes of the tests run on the in-memory network, so no port is bound
 var queueConnParams = ConnParams{
-	"localhost", "3333", "tcp",
+	Ip: "localhost", Port: "1", Protocol: PROTOCOL_MEMORY,
 }
 
+var nodeConnParams = ConnParams{
+	Ip: "localhost", Port: "0", Protocol: PROTOCOL_MEMORY,
+}
+
+var masterNode Node
+
 func init() {
 	runtime.LockOSThread()
 }
 
 func TestMain(m *testing.M) {
 	// setup
-	var masterNode = NewNode(queueConnParams, true)
+	dataDir, err := os.MkdirTemp("", "tinydfs-data")
+	if err != nil {
+		panic(err)
+	}
+	os.Setenv(DataDirEnv, dataDir)
+	masterNode = NewNode(queueConnParams, queueConnParams, true)
 	go masterNode.Run()
-	go func() {
-		retCode := m.Run()
-		//cleanup
-		masterNode.CloseConn()
-		os.Exit(retCode)
-	}()
+	time.Sleep(100 * time.Millisecond)
+
+	retCode := m.Run()
+
+	//cleanup
+	masterNode.CloseConn()
+	os.RemoveAll(dataDir)
+	os.Exit(retCode)
 }
 
 func TestConnectingToQueue(t *testing.T) {
-	var node = NewNode(queueConnParams, false)
+	var node = NewNode(nodeConnParams, queueConnParams, false)
 	err := node.Run()
 	if err != nil {
 		t.Fail()
@@ -37,17 +65,17 @@ func TestConnectingToQueue(t *testing.T) {
 }
 
 func TestSendingToQueue(t *testing.T) {
-	var node = NewNode(queueConnParams, false)
+	var node = NewNode(nodeConnParams, queueConnParams, false)
 	err := node.Run()
 	if err != nil {
 		t.Fail()
 	}
-	var message = Message{Key: uuid.New(), Topic: "Test", Text: "Hello world!"}
+	var message = Message{Key: uuid.New(), Topic: "Test", Payload: []byte("Hello world!")}
 	node.SendMessage(message)
 }
 
 func TestCloseNode(t *testing.T) {
-	var node = NewNode(queueConnParams, false)
+	var node = NewNode(nodeConnParams, queueConnParams, false)
 	err := node.Run()
 	if err != nil {
 		t.Fail()
@@ -57,3 +85,1264 @@ func TestCloseNode(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestPartitionMap_AddTopic(t *testing.T) {
+	registry := NewNetworkRegistry()
+	registry.AddItem(NewNetworkTuple("node-a", "localhost", "4001", "5001"))
+	registry.AddItem(NewNetworkTuple("node-b", "localhost", "4002", "5002"))
+	registry.AddItem(NewNetworkTuple("node-c", "localhost", "4003", "5003"))
+
+	partitionMap := NewPartitionMap()
+	topic, err := partitionMap.AddTopic(TopicSpec{Topic: "sport", Partitions: 4, Replicas: 2}, registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(topic.Partitions) != 4 {
+		t.Fail()
+	}
+	for p := range topic.Partitions {
+		if len(topic.Partitions[p]) != 2 || topic.Partitions[p][0] == topic.Partitions[p][1] {
+			t.Fail()
+		}
+	}
+	if !partitionMap.IsReplica("sport", 0, "node-a") || partitionMap.IsReplica("sport", 0, "node-c") {
+		t.Fail()
+	}
+}
+
+func TestPartitionMap_ReplaceNode(t *testing.T) {
+	registry := NewNetworkRegistry()
+	registry.AddItem(NewNetworkTuple("node-a", "localhost", "4001", "5001"))
+	registry.AddItem(NewNetworkTuple("node-b", "localhost", "4002", "5002"))
+	registry.AddItem(NewNetworkTuple("node-c", "localhost", "4003", "5003"))
+	partitionMap := NewPartitionMap()
+	partitionMap.AddTopic(TopicSpec{Topic: "sport", Partitions: 3, Replicas: 2}, registry)
+
+	leaving, _ := registry.GetItemById("node-a")
+	leaving.SetIsLeaving(true)
+	if moved := partitionMap.ReplaceNode("node-a", registry); moved != 2 {
+		t.Fatal(moved)
+	}
+	for p := 0; p < 3; p++ {
+		if partitionMap.IsReplica("sport", p, "node-a") {
+			t.Error("Partition left on the leaving node", p)
+		}
+	}
+	topic, _ := partitionMap.AddTopic(TopicSpec{Topic: "news", Partitions: 2, Replicas: 1}, registry)
+	for _, replicas := range topic.Partitions {
+		if replicas[0] == "node-a" {
+			t.Error("New partition placed on the leaving node")
+		}
+	}
+}
+
+func TestPartitionMap_GetPartition(t *testing.T) {
+	registry := NewNetworkRegistry()
+	registry.AddItem(NewNetworkTuple("node-a", "localhost", "4001", "5001"))
+	partitionMap := NewPartitionMap()
+	partitionMap.AddTopic(TopicSpec{Topic: "sport", Partitions: 8, Replicas: 1}, registry)
+
+	first := partitionMap.GetPartition(Message{Key: uuid.New(), Topic: "sport", PartitionKey: "match"})
+	second := partitionMap.GetPartition(Message{Key: uuid.New(), Topic: "sport", PartitionKey: "match"})
+	if first < 0 || first != second {
+		t.Fail()
+	}
+	explicit := 5
+	if partitionMap.GetPartition(Message{Key: uuid.New(), Topic: "sport", Partition: &explicit}) != 5 {
+		t.Fail()
+	}
+	if partitionMap.GetPartition(Message{Key: uuid.New(), Topic: "news"}) != -1 {
+		t.Fail()
+	}
+
+	data, err := partitionMap.ToByteArray()
+	if err != nil {
+		t.Fatal(err)
+	}
+	copied := NewPartitionMap()
+	if copied.FromByteArray(data) != nil {
+		t.Fail()
+	}
+	if _, ok := copied.GetTopic("sport"); !ok {
+		t.Fail()
+	}
+}
+
+func TestNetworkRegistry_Epochs(t *testing.T) {
+	pathToFile := path.Join(t.TempDir(), NetworkRegistryFile)
+	registry := NewPersistentNetworkRegistry(pathToFile)
+	registry.AddItem(NewNetworkTuple("node-a", "localhost", "4001", "5001"))
+	registry.AddItem(NewNetworkTuple("node-b", "localhost", "4002", "5002"))
+	older, _ := registry.ToByteArray()
+	_, index := registry.GetItemById("node-a")
+	registry.RemoveItem(index)
+	if registry.GetEpoch() != 3 {
+		t.Fatal(registry.GetEpoch())
+	}
+	newer, _ := registry.ToByteArray()
+
+	view := NewNetworkRegistry()
+	events := []string{}
+	view.RegisterEventHandler(func(event NetworkEvent) {
+		events = append(events, event.Type+" "+event.Node.GetId())
+	})
+	if err := view.FromByteArray(older); err != nil {
+		t.Fatal(err)
+	}
+	if err := view.FromByteArray(newer); err != nil {
+		t.Fatal(err)
+	}
+	if err := view.FromByteArray(older); err != ErrStaleEpoch || len(view.GetItems()) != 1 {
+		t.Error("Stale update applied", err)
+	}
+	if strings.Join(events, ",") != "NODE_JOINED node-a,NODE_JOINED node-b,NODE_LEFT node-a" {
+		t.Error(events)
+	}
+
+	loaded := NewPersistentNetworkRegistry(pathToFile)
+	if loaded.GetEpoch() != 3 || len(loaded.GetItems()) != 1 {
+		t.Error(loaded.ToString())
+	}
+	legacy := NewNetworkRegistry()
+	if err := legacy.FromByteArray([]byte(`[{"Id":"node-c","IsAvailable":true}]`)); err != nil || len(legacy.GetItems()) != 1 {
+		t.Error(err)
+	}
+}
+
+func TestQueue_EpochContinuesAfterFailover(t *testing.T) {
+	queue := NewQueue(ConnParams{Ip: "localhost", Port: "0", Protocol: PROTOCOL_MEMORY}).(*messagequeue)
+	reply := connAckReply{networktuple: *NewNetworkTuple("node-a", "localhost", "4001", "5001").(*networktuple), Epoch: 41}
+	payload, _ := json.Marshal(reply)
+	client, server := net.Pipe()
+	defer client.Close()
+	queue.onNewNetworkNode(server, "pool-key", Message{Key: uuid.New(), Topic: CONN_ACK_REPLY, Payload: payload})
+	if queue.networkRegistry.GetEpoch() != 42 {
+		t.Fatal(queue.networkRegistry.GetEpoch())
+	}
+	queue.networkRegistry.RaiseEpoch(7)
+	if queue.networkRegistry.GetEpoch() != 42 {
+		t.Error("Epoch lowered", queue.networkRegistry.GetEpoch())
+	}
+}
+
+func TestQueue_TracksNodesByConnection(t *testing.T) {
+	queue := NewQueue(ConnParams{Ip: "localhost", Port: "0", Protocol: PROTOCOL_MEMORY}).(*messagequeue)
+	changes := 0
+	queue.RegisterHandler(NETWORKCHANGED, func(MessageQueue) { changes++ })
+	reply := connAckReply{networktuple: *NewNetworkTuple("node-a", "localhost", "4001", "5001").(*networktuple)}
+	payload, _ := json.Marshal(reply)
+	nodeClient, nodeServer := net.Pipe()
+	defer nodeClient.Close()
+	queue.onNewNetworkNode(nodeServer, "node-conn", Message{Key: uuid.New(), Topic: CONN_ACK_REPLY, Payload: payload})
+	queue.onSubscribe(nil, "subscriber-conn", Message{Key: uuid.New(), Topic: SUBSCRIBE, Payload: []byte("files")})
+	if queue.pool.Len() != 2 || queue.accepts("subscriber-conn", Message{Topic: "other"}) || !queue.accepts("node-conn", Message{Topic: "other"}) {
+		t.Fatal("Unexpected broadcast pool", queue.pool.Len())
+	}
+	changes = 0
+
+	queue.removeFromNetworkRegistry("rpc-conn")
+	queue.removeFromNetworkRegistry("subscriber-conn")
+	if changes != 0 || len(queue.networkRegistry.GetItems()) != 1 {
+		t.Error("Client connection changed the network", changes)
+	}
+	queue.removeFromNetworkRegistry("node-conn")
+	if changes != 1 || len(queue.networkRegistry.GetItems()) != 0 {
+		t.Error("Node not removed", changes, len(queue.networkRegistry.GetItems()))
+	}
+}
+
+func TestQueue_RunsAllNetworkChangedHandlers(t *testing.T) {
+	queue := NewQueue(ConnParams{Ip: "localhost", Port: "0", Protocol: PROTOCOL_MEMORY})
+	calls := []string{}
+	queue.RegisterHandler(NETWORKCHANGED, func(MessageQueue) { calls = append(calls, "internal") })
+	queue.RegisterHandler(NETWORKCHANGED, func(MessageQueue) { calls = append(calls, "user") })
+	queue.(*messagequeue).onNetworkChanged()
+	if strings.Join(calls, ",") != "internal,user" {
+		t.Error(calls)
+	}
+}
+
+func TestNode_KeepsIdentityAfterRestart(t *testing.T) {
+	params := ConnParams{Ip: "localhost", Port: "3399", Protocol: PROTOCOL_MEMORY}
+	first := newNode(params, queueConnParams, true, false)
+	restarted := newNode(params, queueConnParams, true, false)
+	if first.GetID() != restarted.GetID() || first.dataDir != restarted.dataDir {
+		t.Error(first.GetID(), restarted.GetID())
+	}
+	if other := newNode(nodeConnParams, queueConnParams, true, false); other.dataDir == first.dataDir {
+		t.Error("Nodes on ephemeral ports share data directory")
+	}
+	// the same port on another interface is another node
+	sharedPort := ConnParams{Ip: "127.0.0.2", Port: params.Port, Protocol: params.Protocol}
+	if other := newNode(sharedPort, queueConnParams, true, false); other.GetID() == first.GetID() || other.dataDir == first.dataDir {
+		t.Error("Nodes on the same port share identity", other.dataDir)
+	}
+}
+
+func TestNode_MigratesPortDataDirectory(t *testing.T) {
+	t.Setenv(DataDirEnv, t.TempDir())
+	legacyDir := path.Join(os.Getenv(DataDirEnv), "node-3398")
+	os.MkdirAll(legacyDir, os.ModePerm)
+	id := uuid.New()
+	os.WriteFile(path.Join(legacyDir, NodeIDFile), []byte(id.String()), 0660)
+	migrated := newNode(ConnParams{Ip: "localhost", Port: "3398", Protocol: PROTOCOL_MEMORY}, queueConnParams, true, false)
+	if migrated.GetID() != id {
+		t.Error(migrated.GetID(), id)
+	}
+	if _, err := os.Stat(legacyDir); !errors.Is(err, fs.ErrNotExist) {
+		t.Error(err)
+	}
+}
+
+func TestNetworkRegistry_ConcurrentJoinsAndLeaves(t *testing.T) {
+	registry := NewNetworkRegistry()
+	var joined, left atomic.Int32
+	registry.RegisterEventHandler(func(event NetworkEvent) {
+		if event.Type == NODE_JOINED {
+			joined.Add(1)
+		} else if event.Type == NODE_LEFT {
+			left.Add(1)
+		}
+	})
+	view := NewNetworkRegistry()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		id := "node-" + strconv.Itoa(i)
+		port := strconv.Itoa(4000 + i)
+		go func() {
+			defer wg.Done()
+			registry.AddItem(NewNetworkTuple(id, "localhost", port, port))
+			if i%2 == 0 {
+				registry.RemoveItemById(id)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for _, item := range registry.GetItems() {
+				item.GetId()
+			}
+			registry.GetItemById(id)
+			registry.GetNextQueue()
+			if payload, err := registry.ToByteArray(); err == nil {
+				view.FromByteArray(payload)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(registry.GetItems()) != 10 || joined.Load() != 20 || left.Load() != 10 {
+		t.Error(len(registry.GetItems()), joined.Load(), left.Load())
+	}
+	if registry.GetEpoch() != 30 {
+		t.Error(registry.GetEpoch())
+	}
+}
+
+func TestPool_Concurrent(t *testing.T) {
+	pool := NewPool()
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		key := strconv.Itoa(i)
+		go func() {
+			defer wg.Done()
+			client, server := net.Pipe()
+			defer server.Close()
+			pool.Add(key, client)
+			if i%2 == 0 {
+				pool.Remove(key)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for range pool.Snapshot() {
+			}
+		}()
+	}
+	wg.Wait()
+	if pool.Len() != 10 {
+		t.Error(pool.Len())
+	}
+}
+
+func TestPlanRebalance(t *testing.T) {
+	oldView := NewNetworkRegistry()
+	oldView.AddItem(NewNetworkTuple("node-a", "localhost", "4001", "5001"))
+	oldView.AddItem(NewNetworkTuple("node-b", "localhost", "4002", "5002"))
+	partitionMap := NewPartitionMap()
+	partitionMap.AddTopic(TopicSpec{Topic: "sport", Partitions: 3, Replicas: 2}, oldView)
+
+	newView := NewNetworkRegistry()
+	newView.AddItem(NewNetworkTuple("node-a", "localhost", "4001", "5001"))
+	newView.AddItem(NewNetworkTuple("node-b", "localhost", "4002", "5002"))
+	newView.AddItem(NewNetworkTuple("node-c", "localhost", "4003", "5003"))
+	moves := PlanRebalance(partitionMap.GetTopics(), oldView, newView)
+	if len(moves) != 2 {
+		t.Fatal(moves)
+	}
+	for _, move := range moves {
+		if move.To != "node-c" || move.Source != move.From || partitionMap.IsReplica("sport", move.Partition, "node-c") {
+			t.Error(move)
+		}
+		partitionMap.MoveReplica(move.Topic, move.Partition, move.From, move.To)
+	}
+	if moves[0].Partition == moves[1].Partition {
+		t.Error("Partition moved twice", moves)
+	}
+
+	// replicas of a node that left are copied from the remaining replica
+	leftView := NewNetworkRegistry()
+	leftView.AddItem(NewNetworkTuple("node-a", "localhost", "4001", "5001"))
+	leftView.AddItem(NewNetworkTuple("node-c", "localhost", "4003", "5003"))
+	moves = PlanRebalance(partitionMap.GetTopics(), newView, leftView)
+	for _, move := range moves {
+		if move.From != "node-b" || move.Source == "node-b" || move.To == "node-b" {
+			t.Error(move)
+		}
+		partitionMap.MoveReplica(move.Topic, move.Partition, move.From, move.To)
+	}
+	if moves := PlanRebalance(partitionMap.GetTopics(), leftView, leftView); len(moves) != 0 {
+		t.Error("Unchanged view moved replicas", moves)
+	}
+}
+
+func TestRpc_Call(t *testing.T) {
+	masterNode.RegisterRpcHandler("ECHO", NewRpcHandler(func(ctx context.Context, text string) (string, error) {
+		return "echo: " + text, nil
+	}))
+	client, err := DialRpc(queueConnParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	var reply string
+	err = client.Call(context.Background(), "ECHO", "hello", &reply)
+	if err != nil || reply != "echo: hello" {
+		t.Fail()
+	}
+	var status NodeStatus
+	err = client.Call(context.Background(), RPC_STATUS, nil, &status)
+	if err != nil || status.ID != masterNode.GetID().String() {
+		t.Fail()
+	}
+	err = client.Call(context.Background(), "MISSING", nil, nil)
+	if err != ErrRpcMethodNotFound {
+		t.Fail()
+	}
+}
+
+func TestRpc_Timeout(t *testing.T) {
+	cancelled := make(chan bool, 1)
+	masterNode.RegisterRpcHandler("SLOW", NewRpcHandler(func(ctx context.Context, _ struct{}) (bool, error) {
+		<-ctx.Done()
+		cancelled <- true
+		return false, ctx.Err()
+	}))
+	client, err := DialRpc(queueConnParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = client.Call(ctx, "SLOW", nil, nil)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fail()
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fail()
+	}
+}
+
+func TestNode_GetUpdateScan(t *testing.T) {
+	master, members := startMemoryCluster(t, 1)
+	node := members[0]
+	var message = Message{Key: uuid.New(), Topic: "TestOperations", Payload: []byte("Hello world!")}
+	node.SendMessage(message)
+
+	// updates need a quorum, so both owners store the message first
+	query := persistance.Query{Key: message.Key, Topic: message.Topic}
+	stored := func() bool {
+		_, errMaster := master.fileManager.Read(query)
+		_, errNode := node.fileManager.Read(query)
+		return errMaster == nil && errNode == nil
+	}
+	for i := 0; i < 50 && !stored(); i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	ctx := context.Background()
+	value, err := master.Get(ctx, message.Topic, message.Key)
+	if value != "Hello world!" {
+		t.Fatal(value, err)
+	}
+	err = master.Update(ctx, message.Topic, message.Key, "Bye!")
+	if err != nil {
+		t.Error(err)
+	}
+	records, err := master.Scan(ctx, message.Topic)
+	if err != nil || len(records) == 0 {
+		t.Fail()
+	}
+}
+
+func TestNode_Namespace(t *testing.T) {
+	n := NewNode(nodeConnParams, queueConnParams, false)
+	ns := n.GetNamespace()
+	if _, err := ns.Mkdir("/shared", "tester"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ns.Mkdir("/shared", "tester"); err != namespace.ErrExists {
+		t.Error(err)
+	}
+	if _, err := ns.Create("/shared/report", "tester", 1); err != nil {
+		t.Fatal(err)
+	}
+	list, err := masterNode.GetNamespace().List("/shared")
+	if err != nil || len(list) != 1 || list[0].Name != "report" {
+		t.Error(list, err)
+	}
+}
+
+func TestNode_NamespaceReplicated(t *testing.T) {
+	master, members := startMemoryCluster(t, 2)
+	member := members[0]
+	info, err := member.GetNamespace().Create("/report", "tester", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	member.SendMessage(Message{Key: uuid.New(), Topic: info.Topic, Payload: []byte("Hello namespace!")})
+	replicated := func() bool {
+		local, err := members[1].namespace.Stat("/report")
+		return err == nil && local.Size == int64(len("Hello namespace!"))
+	}
+	for i := 0; i < 250 && !replicated(); i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if !replicated() {
+		t.Error("namespace change not replicated")
+	}
+	topic, ok := master.partitionMap.GetTopic(info.Topic)
+	if !ok || topic.Replicas != 1 {
+		t.Error(topic, ok)
+	}
+}
+
+func TestNode_ScrubRepairsRecord(t *testing.T) {
+	master, members := startMemoryCluster(t, 1)
+	replica := members[0]
+	message := Message{Key: uuid.New(), Topic: "TestScrub", Payload: []byte("Hello scrubber!"), PartitionKey: "scrub"}
+	query := persistance.Query{Key: message.Key, Topic: message.Topic}
+	stored := func() bool {
+		_, errMaster := master.fileManager.Read(query)
+		_, errReplica := replica.fileManager.Read(query)
+		registered, _ := master.networkRegistry.GetItemById(replica.GetID().String())
+		return errMaster == nil && errReplica == nil && registered != nil
+	}
+	replica.SendMessage(message)
+	for i := 0; i < 50 && !stored(); i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	pathToFile := path.Join(master.dataDir, persistance.TopicFileName(message.Topic))
+	content, err := os.ReadFile(pathToFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(pathToFile, bytes.Replace(content, []byte("Hello"), []byte("Hellp"), 1), 0660)
+	if _, err := master.fileManager.Read(query); !errors.Is(err, persistance.ErrRecordCorrupted) {
+		t.Fatal(err)
+	}
+
+	report := master.Scrub(context.Background())
+	if len(report.Corrupted) != 1 || report.Repaired != 1 {
+		t.Fatal(report)
+	}
+	repaired, err := master.fileManager.ReadRecord(query)
+	if err != nil || repaired.Text != "Hello scrubber!" {
+		t.Error(repaired, err)
+	}
+	copied, _ := replica.fileManager.ReadRecord(query)
+	if !repaired.Timestamp.Equal(copied.Timestamp) || repaired.Headers[PartitionKeyHeader] != "scrub" {
+		t.Error(repaired, copied)
+	}
+}
+
+func TestNode_RestoreCatchesUp(t *testing.T) {
+	master, members := startMemoryCluster(t, 1)
+	replica := members[0]
+	stored := func(message Message) bool {
+		query := persistance.Query{Key: message.Key, Topic: message.Topic}
+		_, errMaster := master.fileManager.Read(query)
+		_, errReplica := replica.fileManager.Read(query)
+		registered, _ := master.networkRegistry.GetItemById(replica.GetID().String())
+		return errMaster == nil && errReplica == nil && registered != nil
+	}
+	send := func(message Message) {
+		replica.SendMessage(message)
+		for i := 0; i < 50 && !stored(message); i++ {
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+	before := Message{Key: uuid.New(), Topic: "TestRestore", Payload: []byte("before snapshot")}
+	send(before)
+	dest := path.Join(t.TempDir(), "snapshot.tar")
+	if _, err := master.Snapshot(dest); err != nil {
+		t.Fatal(err)
+	}
+	after := Message{Key: uuid.New(), Topic: "TestRestore", Payload: []byte("after snapshot")}
+	send(after)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := replica.Delete(ctx, before.Topic, before.Key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := master.Restore(ctx, dest); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := master.fileManager.Read(persistance.Query{Key: after.Key, Topic: after.Topic}); err != nil || value != "after snapshot" {
+		t.Error(value, err)
+	}
+	if _, err := master.fileManager.Read(persistance.Query{Key: before.Key, Topic: before.Topic}); err == nil {
+		t.Error("Deleted record restored")
+	}
+}
+
+func TestNode_BootstrapTransfersTopics(t *testing.T) {
+	master := masterNode.(*node)
+	small := persistance.Command{Key: uuid.New(), Topic: "TestBootstrap", Text: "written before join"}
+	large := persistance.Command{Key: uuid.New(), Topic: "TestBootstrap", Text: strings.Repeat("bootstrap ", persistance.DedupThreshold)}
+	master.fileManager.Write(small)
+	master.fileManager.Write(large)
+
+	joining := NewNode(nodeConnParams, queueConnParams, false).(*node)
+	if err := joining.Run(); err != nil {
+		t.Fatal(err)
+	}
+	defer joining.CloseConn()
+	waitForBootstrap(joining)
+	for _, command := range []persistance.Command{small, large} {
+		value, err := joining.fileManager.Read(persistance.Query{Key: command.Key, Topic: command.Topic})
+		if err != nil || value != command.Text {
+			t.Error(command.Key, err)
+		}
+	}
+}
+
+func TestNode_TransferResumesFromLocalPrefix(t *testing.T) {
+	master, members := startMemoryCluster(t, 1)
+	member := members[0]
+	first := persistance.Command{Key: uuid.New(), Topic: "TestResume", Text: "copied before"}
+	second := persistance.Command{Key: uuid.New(), Topic: "TestResume", Text: "copied after"}
+	master.fileManager.Write(first)
+	prefix, _, err := master.fileManager.ReadRange(first.Topic, 0, BootstrapChunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	master.fileManager.Write(second)
+	source := topicSource{nodeID: master.GetID().String()}
+	manifest, _ := master.fileManager.Manifest()
+	for _, topic := range manifest {
+		if topic.Topic == first.Topic {
+			source.topic = topic
+		}
+	}
+	if source.topic.Offset <= int64(len(prefix)) {
+		t.Fatal(source.topic)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := member.fileManager.AppendRange(first.Topic, 0, prefix); err != nil {
+		t.Fatal(err)
+	}
+	if offset := member.resumeOffset(ctx, source); offset != int64(len(prefix)) {
+		t.Error(offset)
+	}
+	if err := member.transferFrom(ctx, source); err != nil {
+		t.Fatal(err)
+	}
+	for _, command := range []persistance.Command{first, second} {
+		value, err := member.fileManager.Read(persistance.Query{Key: command.Key, Topic: command.Topic})
+		if err != nil || value != command.Text {
+			t.Error(command.Key, err)
+		}
+	}
+
+	// a local prefix that differs from the source is copied again
+	damaged := append([]byte{}, prefix...)
+	damaged[len(damaged)-1] ^= 0xff
+	member.fileManager.AppendRange(first.Topic, 0, damaged)
+	if offset := member.resumeOffset(ctx, source); offset != 0 {
+		t.Error(offset)
+	}
+}
+
+func TestNode_TransferKeepsLocalRecords(t *testing.T) {
+	master, members := startMemoryCluster(t, 1)
+	member := members[0]
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	source := func(topic string) topicSource {
+		manifest, _ := master.fileManager.Manifest()
+		for _, snapshot := range manifest {
+			if snapshot.Topic == topic {
+				return topicSource{nodeID: master.GetID().String(), topic: snapshot}
+			}
+		}
+		t.Fatal("Topic not in manifest", topic)
+		return topicSource{}
+	}
+	read := func(command persistance.Command) {
+		if value, err := member.fileManager.Read(persistance.Query{Key: command.Key, Topic: command.Topic}); value != command.Text {
+			t.Error(command.Topic, command.Text, err)
+		}
+	}
+
+	// both nodes stored records the other one missed
+	shared := persistance.Command{Key: uuid.New(), Topic: "TestRestartDiverged", Text: "on both nodes"}
+	remoteOnly := persistance.Command{Key: uuid.New(), Topic: shared.Topic, Text: "missed while down"}
+	localOnly := persistance.Command{Key: uuid.New(), Topic: shared.Topic, Text: "only on the restarted node"}
+	master.fileManager.Write(shared)
+	master.fileManager.Write(remoteOnly)
+	member.fileManager.Write(localOnly)
+	member.fileManager.Write(shared)
+	if err := member.transferFrom(ctx, source(shared.Topic)); err != nil {
+		t.Fatal(err)
+	}
+	read(shared)
+	read(remoteOnly)
+	read(localOnly)
+
+	// the local file extends the file of the source
+	shared = persistance.Command{Key: uuid.New(), Topic: "TestRestartLonger", Text: "on both nodes"}
+	localOnly = persistance.Command{Key: uuid.New(), Topic: shared.Topic, Text: "only on the restarted node"}
+	master.fileManager.Write(shared)
+	prefix, _, _ := master.fileManager.ReadRange(shared.Topic, 0, BootstrapChunkSize)
+	member.fileManager.AppendRange(shared.Topic, 0, prefix)
+	member.fileManager.Write(localOnly)
+	if err := member.transferFrom(ctx, source(shared.Topic)); err != nil {
+		t.Fatal(err)
+	}
+	read(shared)
+	read(localOnly)
+}
+
+func TestNode_MergeRecordsUsesOffsets(t *testing.T) {
+	master, _ := startMemoryCluster(t, 1)
+	topic := "TestMerge"
+	changed := persistance.Command{Key: uuid.New(), Topic: topic, Text: "in snapshot"}
+	deleted := persistance.Command{Key: uuid.New(), Topic: topic, Text: "deleted after snapshot"}
+	live := persistance.Command{Key: uuid.New(), Topic: topic, Text: "written after restore"}
+	master.fileManager.Write(changed)
+	master.fileManager.Write(deleted)
+	_, covered, err := master.fileManager.ReadRange(topic, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	master.fileManager.Write(live)
+
+	// the clock of the replica is behind, the change still wins over the snapshot
+	remote := []persistance.Record{{Key: changed.Key, Text: "changed on replica", Timestamp: time.Now().Add(-time.Hour)}}
+	// a single answer of two other replicas is not enough to delete a key
+	if _, err := master.mergeRecords(topic, [][]persistance.Record{remote}, covered, 2); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := master.fileManager.Read(persistance.Query{Key: deleted.Key, Topic: topic}); err != nil || value != deleted.Text {
+		t.Error("Key deleted without a quorum", value, err)
+	}
+	if _, err := master.mergeRecords(topic, [][]persistance.Record{remote}, covered, 1); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[uuid.UUID]string{changed.Key: "changed on replica", live.Key: live.Text}
+	records, _ := master.fileManager.Scan(topic)
+	if len(records) != len(expected) {
+		t.Error(records)
+	}
+	for _, record := range records {
+		if expected[record.Key] != record.Text {
+			t.Error(record)
+		}
+	}
+}
+
+// Waits until the node copied topics of earlier tests and replicates live
+func waitForBootstrap(n *node) {
+	bootstrapping := func() bool {
+		n.bootstrapLock.Lock()
+		defer n.bootstrapLock.Unlock()
+		return n.bootstrapping
+	}
+	for i := 0; i < 250 && bootstrapping(); i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// Registers a new in-memory network for the test, it is unregistered
+// once nodes of the test are closed
+func registerMemoryTransport(t *testing.T) string {
+	protocol := "mem-" + t.Name()
+	RegisterTransport(protocol, NewMemoryTransport())
+	t.Cleanup(func() { UnregisterTransport(protocol) })
+	return protocol
+}
+
+// Starts a master and members on a new in-memory network. Members listen
+// on fixed ports, so nodes can call each other.
+func startMemoryCluster(t *testing.T, members int) (*node, []*node) {
+	// nodes on fixed ports keep their data directory, so every test gets its own
+	t.Setenv(DataDirEnv, t.TempDir())
+	protocol := registerMemoryTransport(t)
+	queue := ConnParams{Ip: "127.0.0.1", Port: "1", Protocol: protocol}
+	master := NewNode(queue, queue, false).(*node)
+	go master.Run()
+	t.Cleanup(func() { master.CloseConn() })
+	waitForListener(queue)
+	var result []*node
+	for i := 0; i < members; i++ {
+		member := NewNode(ConnParams{Ip: "127.0.0.1", Port: strconv.Itoa(i + 2), Protocol: protocol}, queue, false).(*node)
+		if err := member.Run(); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { member.CloseConn() })
+		waitForMember(master.GetNetworkRegistry(), member.GetID().String())
+		waitForMember(member.GetNetworkRegistry(), master.GetID().String())
+		waitForBootstrap(member)
+		result = append(result, member)
+	}
+	return master, result
+}
+
+func TestNode_UpdateRequiresQuorum(t *testing.T) {
+	master, _ := startMemoryCluster(t, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// only one of the two owners stores the key
+	command := persistance.Command{Key: uuid.New(), Topic: "TestQuorum", Text: "Hello quorum!"}
+	if err := master.fileManager.Write(command); err != nil {
+		t.Fatal(err)
+	}
+	if err := master.Update(ctx, command.Topic, command.Key, "Bye!"); !errors.Is(err, ErrNoQuorum) {
+		t.Error(err)
+	}
+	if err := master.Delete(ctx, command.Topic, command.Key); !errors.Is(err, ErrNoQuorum) {
+		t.Error(err)
+	}
+}
+
+func TestNode_ReadsKeyOfPartitionKey(t *testing.T) {
+	master, members := startMemoryCluster(t, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	master.CreateTopic("TestPartitionKey", 8, 2)
+	for _, n := range []*node{master, members[0]} {
+		for i := 0; i < 100; i++ {
+			if _, ok := n.partitionMap.GetTopic("TestPartitionKey"); ok {
+				break
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+	// the key alone hashes to another partition than the partition key
+	message := Message{Topic: "TestPartitionKey", Payload: []byte("Hello partition!"), PartitionKey: "match"}
+	for message.Key = uuid.New(); master.partitionMap.GetPartition(Message{Key: message.Key, Topic: message.Topic}) == master.partitionMap.GetPartition(message); message.Key = uuid.New() {
+	}
+	members[0].SendMessage(message)
+	keyCtx := WithPartitionKey(ctx, "match")
+	var value string
+	var err error
+	for i := 0; i < 100; i++ {
+		if value, err = master.Get(keyCtx, message.Topic, message.Key); err == nil {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if value != "Hello partition!" {
+		t.Fatal(value, err)
+	}
+	if err := members[0].Update(keyCtx, message.Topic, message.Key, "Bye partition!"); err != nil {
+		t.Error(err)
+	}
+	if value, err := members[0].Get(keyCtx, message.Topic, message.Key); value != "Bye partition!" {
+		t.Error(value, err)
+	}
+	if err := master.Delete(keyCtx, message.Topic, message.Key); err != nil {
+		t.Error(err)
+	}
+	if _, err := master.Get(keyCtx, message.Topic, message.Key); err == nil {
+		t.Error("Deleted key is readable")
+	}
+	if err := master.Update(ctx, "bad#topic", message.Key, "text"); err == nil {
+		t.Error("Update accepted invalid topic")
+	}
+}
+
+func TestNode_PutReplacesOnAllOwners(t *testing.T) {
+	master, members := startMemoryCluster(t, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	key := uuid.New()
+	for _, text := range []string{"first", "second"} {
+		if err := members[0].Put(ctx, "TestPut", key, text, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, n := range []*node{master, members[0]} {
+		records, err := n.fileManager.Scan("TestPut")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(records) != 1 || records[0].Text != "second" {
+			t.Error(records)
+		}
+	}
+}
+
+func TestNode_DecommissionHandsOffTopics(t *testing.T) {
+	master, members := startMemoryCluster(t, 1)
+	leaving := members[0]
+	shared := persistance.Command{Key: uuid.New(), Topic: "TestDecommission", Text: "stored by the leaving node"}
+	moved := persistance.Command{Key: uuid.New(), Topic: "TestDecommissionOnly", Text: "stored only by the leaving node"}
+	master.fileManager.Write(persistance.Command{Key: uuid.New(), Topic: shared.Topic, Text: "stored by the master"})
+	leaving.fileManager.Write(shared)
+	leaving.fileManager.Write(moved)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := leaving.Decommission(ctx); err != nil {
+		t.Fatal(err, leaving.GetDecommissionStatus())
+	}
+	if status := leaving.GetDecommissionStatus(); status.State != DECOMMISSION_DONE || status.HandedOff != status.Topics {
+		t.Error(status)
+	}
+	for _, command := range []persistance.Command{shared, moved} {
+		value, err := master.fileManager.Read(persistance.Query{Key: command.Key, Topic: command.Topic})
+		if err != nil || value != command.Text {
+			t.Error(command.Topic, value, err)
+		}
+	}
+}
+
+func TestNode_DecommissionStartsOnce(t *testing.T) {
+	n := newNode(nodeConnParams, queueConnParams, false, false)
+	var started atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if n.beginDecommission() == nil {
+				started.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if started.Load() != 1 {
+		t.Error(started.Load())
+	}
+}
+
+func TestNode_HandoffQuorum(t *testing.T) {
+	n := newNode(nodeConnParams, queueConnParams, false, false)
+	registry := NewNetworkRegistry()
+	for _, id := range []string{"node-a", "node-b", "node-c"} {
+		registry.AddItem(NewNetworkTuple(id, "localhost", "0", "0"))
+	}
+	n.partitionMap.AddTopic(TopicSpec{Topic: "quorum", Partitions: 1, Replicas: 3}, registry)
+	if quorum := n.handoffQuorum(PartitionTopicName("quorum", 0), 3); quorum != 2 {
+		t.Error(quorum)
+	}
+	if quorum := n.handoffQuorum(PartitionTopicName("quorum", 0), 1); quorum != 1 {
+		t.Error(quorum)
+	}
+	if quorum := n.handoffQuorum("unpartitioned", 4); quorum != 4 {
+		t.Error(quorum)
+	}
+}
+
+func TestNode_RebalanceMovesPartition(t *testing.T) {
+	master, members := startMemoryCluster(t, 1)
+	joining := members[0]
+	queue := master.queue.(*messagequeue)
+	masterID := master.GetID().String()
+	joiningID := joining.GetID().String()
+	registry := NewNetworkRegistry()
+	registry.AddItem(NewNetworkTuple(masterID, "localhost", "0", master.exchangeQueueConnParams.Port))
+	queue.partitionMap.AddTopic(TopicSpec{Topic: "TestRebalance", Partitions: 1, Replicas: 1}, registry)
+	queue.onPartitionsChanged()
+	command := persistance.Command{Key: uuid.New(), Topic: PartitionTopicName("TestRebalance", 0), Text: "moved to the joining node"}
+	master.fileManager.Write(command)
+
+	master.rebalancer.add([]PartitionMove{{Topic: "TestRebalance", Partition: 0, From: masterID, To: joiningID, Source: masterID, State: MOVE_PENDING, Created: time.Now().UTC()}})
+	moved := func() bool {
+		master.rebalancer.lock.Lock()
+		defer master.rebalancer.lock.Unlock()
+		return len(master.rebalancer.moves) == 0
+	}
+	for i := 0; i < 500 && !moved(); i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if !queue.GetPartitionMap().IsReplica("TestRebalance", 0, joiningID) {
+		t.Fatal("Placement not switched")
+	}
+	value, err := joining.fileManager.Read(persistance.Query{Key: command.Key, Topic: command.Topic})
+	if err != nil || value != command.Text {
+		t.Error(value, err)
+	}
+	// moves are replicated, so any node resumes them after failover
+	statePath := path.Join(joining.dataDir, RebalanceStateFile)
+	_, err = os.Stat(statePath)
+	for i := 0; i < 50 && err != nil; i++ {
+		time.Sleep(20 * time.Millisecond)
+		_, err = os.Stat(statePath)
+	}
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestNode_RebalanceSyncsBeforeSwitch(t *testing.T) {
+	master, members := startMemoryCluster(t, 1)
+	joining := members[0]
+	queue := master.queue.(*messagequeue)
+	masterID := master.GetID().String()
+	joiningID := joining.GetID().String()
+	registry := NewNetworkRegistry()
+	registry.AddItem(NewNetworkTuple(masterID, "localhost", "0", master.exchangeQueueConnParams.Port))
+	queue.partitionMap.AddTopic(TopicSpec{Topic: "TestRebalanceSync", Partitions: 1, Replicas: 1}, registry)
+	queue.onPartitionsChanged()
+	storageTopic := PartitionTopicName("TestRebalanceSync", 0)
+	master.fileManager.Write(persistance.Command{Key: uuid.New(), Topic: storageTopic, Text: "copied"})
+
+	// the old owner takes a write while the range is copied
+	during := persistance.Command{Key: uuid.New(), Topic: storageTopic, Text: "written during the copy"}
+	joining.RegisterRpcHandler(RPC_REBALANCE_RANGE, NewRpcHandler(func(ctx context.Context, request RangeRequest) (RangeProgress, error) {
+		progress, err := joining.copyRange(ctx, request)
+		if _, found := master.fileManager.Read(persistance.Query{Key: during.Key, Topic: storageTopic}); found != nil {
+			master.fileManager.Write(during)
+		}
+		return progress, err
+	}))
+	var switchedBeforeSync atomic.Bool
+	joining.RegisterRpcHandler(RPC_REBALANCE_SYNC, NewRpcHandler(func(ctx context.Context, request SyncRequest) (int, error) {
+		switchedBeforeSync.Store(queue.GetPartitionMap().IsReplica("TestRebalanceSync", 0, joiningID))
+		return joining.syncPartition(ctx, request)
+	}))
+
+	master.rebalancer.add([]PartitionMove{{Topic: "TestRebalanceSync", Partition: 0, From: masterID, To: joiningID, Source: masterID, State: MOVE_PENDING, Created: time.Now().UTC()}})
+	for i := 0; i < 500 && !queue.GetPartitionMap().IsReplica("TestRebalanceSync", 0, joiningID); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !queue.GetPartitionMap().IsReplica("TestRebalanceSync", 0, joiningID) {
+		t.Fatal("Placement not switched")
+	}
+	if switchedBeforeSync.Load() {
+		t.Error("Placement switched before the sync")
+	}
+	value, err := joining.fileManager.Read(persistance.Query{Key: during.Key, Topic: storageTopic})
+	if err != nil || value != during.Text {
+		t.Error(value, err)
+	}
+}
+
+func TestNode_JoinThroughSeeds(t *testing.T) {
+	master, members := startMemoryCluster(t, 1)
+	seed := members[0]
+	waitForMember(seed.GetNetworkRegistry(), seed.GetID().String())
+
+	// nothing listens on the first seed
+	protocol := seed.exchangeQueueConnParams.Protocol
+	seeds := []ConnParams{{Ip: "localhost", Port: "99", Protocol: protocol}, seed.exchangeQueueConnParams}
+	joining := NewSeededNode(ConnParams{Ip: "localhost", Port: "3", Protocol: protocol}, seeds, false, false).(*node)
+	if err := joining.Run(); err != nil {
+		t.Fatal(err)
+	}
+	defer joining.CloseConn()
+	if joining.getBroadcastQueue() != master.exchangeQueueConnParams {
+		t.Error(joining.getBroadcastQueue())
+	}
+	if item, _ := joining.GetNetworkRegistry().GetItemById(seed.GetID().String()); item == nil {
+		t.Error("Network registry not learned from the seed")
+	}
+	if !waitForMember(master.GetNetworkRegistry(), joining.GetID().String()) {
+		t.Error("Node not registered by the master")
+	}
+}
+
+func TestNode_SeedsWithoutAnswer(t *testing.T) {
+	t.Setenv(DataDirEnv, t.TempDir())
+	protocol := registerMemoryTransport(t)
+	seeds := []ConnParams{{Ip: "localhost", Port: "1", Protocol: protocol}}
+	lonely := NewSeededNode(ConnParams{Ip: "localhost", Port: "0", Protocol: protocol}, seeds, false, false)
+	if err := lonely.Run(); err != ErrNoSeedAnswered {
+		t.Error(err)
+	}
+
+	founder := NewSeededNode(ConnParams{Ip: "localhost", Port: "2", Protocol: protocol}, seeds, true, false).(*node)
+	if err := founder.Run(); err != nil {
+		t.Fatal(err)
+	}
+	defer founder.CloseConn()
+	if !founder.isMaster() {
+		t.Error(founder.getBroadcastQueue())
+	}
+}
+
+func TestNode_DiscoverCluster(t *testing.T) {
+	t.Setenv(DataDirEnv, t.TempDir())
+	protocol := registerMemoryTransport(t)
+	// announcements are sent over UDP, the loopback interface has
+	// no multicast, so the group is a single host
+	discovery := DiscoveryParams{Group: "127.0.0.1:3344", ClusterID: "TestDiscovery", Interval: 50 * time.Millisecond, Timeout: 200 * time.Millisecond}
+	founder := NewDiscoveringNode(ConnParams{Ip: "localhost", Port: "1", Protocol: protocol}, discovery, true, false).(*node)
+	if err := founder.Run(); err != nil {
+		t.Fatal(err)
+	}
+	defer founder.CloseConn()
+	if !founder.isMaster() {
+		t.Fatal(founder.getBroadcastQueue())
+	}
+
+	other := discovery
+	other.ClusterID = "OtherCluster"
+	if err := NewDiscoveringNode(ConnParams{Ip: "localhost", Port: "0", Protocol: protocol}, other, false, false).Run(); err != ErrNoMemberDiscovered {
+		t.Error(err)
+	}
+
+	discovery.Timeout = 5 * time.Second
+	joining := NewDiscoveringNode(ConnParams{Ip: "localhost", Port: "2", Protocol: protocol}, discovery, false, false).(*node)
+	if err := joining.Run(); err != nil {
+		t.Fatal(err)
+	}
+	defer joining.CloseConn()
+	if joining.getBroadcastQueue().Port != "1" {
+		t.Error(joining.getBroadcastQueue())
+	}
+	if !waitForMember(founder.GetNetworkRegistry(), joining.GetID().String()) {
+		t.Error("Node not registered by the founder")
+	}
+}
+
+func TestNode_AdvertiseIPv6(t *testing.T) {
+	master, _ := startMemoryCluster(t, 0)
+	// the master sees 127.0.0.1, the node advertises its IPv6 queue
+	params := ConnParams{Ip: "::1", Port: "2", Protocol: master.exchangeQueueConnParams.Protocol, AdvertiseIp: "0:0::1"}
+	advertising := NewNode(params, master.exchangeQueueConnParams, false)
+	if err := advertising.Run(); err != nil {
+		t.Fatal(err)
+	}
+	defer advertising.CloseConn()
+	id := advertising.GetID().String()
+	if !waitForMember(master.GetNetworkRegistry(), id) {
+		t.Fatal("Node not registered by the master")
+	}
+	item, _ := master.GetNetworkRegistry().GetItemById(id)
+	if item.GetIP() != "::1" {
+		t.Error(item.GetIP())
+	}
+	var status NodeStatus
+	err := master.Call(context.Background(), id, RPC_STATUS, struct{}{}, &status)
+	if err != nil || status.ID != id {
+		t.Error(status, err)
+	}
+}
+
+func TestTransport_Unregister(t *testing.T) {
+	network := NewFaultNetwork(NewMemoryTransport(), 1)
+	protocol := network.Protocol("a")
+	if _, err := GetTransport(protocol); err != nil {
+		t.Fatal(err)
+	}
+	network.Close()
+	if _, err := GetTransport(protocol); err != ErrUnknownProtocol {
+		t.Error(err)
+	}
+}
+
+func TestTransport_Memory(t *testing.T) {
+	protocol := registerMemoryTransport(t)
+	queue := ConnParams{Ip: "localhost", Port: "1", Protocol: protocol}
+	master := NewNode(queue, queue, false)
+	go master.Run()
+	defer master.CloseConn()
+	waitForListener(queue)
+	member := NewNode(ConnParams{Ip: "localhost", Port: "2", Protocol: protocol}, queue, false)
+	if err := member.Run(); err != nil {
+		t.Fatal(err)
+	}
+	defer member.CloseConn()
+	id := member.GetID().String()
+	if !waitForMember(master.GetNetworkRegistry(), id) {
+		t.Fatal("Node not registered by the master")
+	}
+
+	var status NodeStatus
+	if err := master.Call(context.Background(), id, RPC_STATUS, struct{}{}, &status); err != nil || status.ID != id {
+		t.Error(status, err)
+	}
+	received := make(chan string, 1)
+	member.Subscribe("TestMemory", func(message Message) {
+		received <- string(message.Payload)
+	})
+	member.SendMessage(Message{Key: uuid.New(), Topic: "TestMemory", Payload: []byte("in memory")})
+	select {
+	case payload := <-received:
+		if payload != "in memory" {
+			t.Error(payload)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Message not broadcast")
+	}
+}
+
+func TestTransport_Unix(t *testing.T) {
+	dir := t.TempDir()
+	queue := ConnParams{Port: path.Join(dir, "master.sock"), Protocol: PROTOCOL_UNIX}
+	master := NewNode(queue, queue, false)
+	go master.Run()
+	defer master.CloseConn()
+	waitForListener(queue)
+	member := NewNode(ConnParams{Ip: dir, Port: "member.sock", Protocol: PROTOCOL_UNIX, AdvertiseIp: dir}, queue, false)
+	if err := member.Run(); err != nil {
+		t.Fatal(err)
+	}
+	defer member.CloseConn()
+	id := member.GetID().String()
+	if !waitForMember(master.GetNetworkRegistry(), id) {
+		t.Fatal("Node not registered by the master")
+	}
+	var status NodeStatus
+	if err := master.Call(context.Background(), id, RPC_STATUS, struct{}{}, &status); err != nil || status.ID != id {
+		t.Error(status, err)
+	}
+}
+
+// Starts master "m" and nodes "a", "b" on the fault network
+func startFaultCluster(t *testing.T, network *FaultNetwork) (*node, *node, *node) {
+	t.Setenv(DataDirEnv, t.TempDir())
+	// registered first, so it runs after the nodes are closed
+	t.Cleanup(network.Close)
+	queue := ConnParams{Ip: "127.0.0.1", Port: "1", Protocol: network.Protocol("m")}
+	master := NewNode(queue, queue, false).(*node)
+	go master.Run()
+	t.Cleanup(func() { master.CloseConn() })
+	waitForListener(queue)
+	var members []*node
+	for i, name := range []string{"a", "b"} {
+		member := NewNode(ConnParams{Ip: "127.0.0.1", Port: strconv.Itoa(i + 2), Protocol: network.Protocol(name)}, ConnParams{Ip: "127.0.0.1", Port: "1", Protocol: network.Protocol(name)}, false).(*node)
+		if err := member.Run(); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { member.CloseConn() })
+		waitForMember(master.GetNetworkRegistry(), member.GetID().String())
+		waitForBootstrap(member)
+		members = append(members, member)
+	}
+	return master, members[0], members[1]
+}
+
+func TestFaultTransport_Failover(t *testing.T) {
+	network := NewFaultNetwork(NewMemoryTransport(), 1)
+	_, a, b := startFaultCluster(t, network)
+
+	err := network.RunScenario([]ScenarioStep{{
+		Name: "master partitioned",
+		Apply: func(network *FaultNetwork) {
+			network.Partition([]string{"m"}, []string{"a", "b"})
+		},
+		Check: func() error {
+			// retryNextQueue moves both nodes to the same next queue
+			if a.getBroadcastQueue().Port == "1" || a.getBroadcastQueue().Port != b.getBroadcastQueue().Port {
+				return errors.New(a.getBroadcastQueue().Port + " " + b.getBroadcastQueue().Port)
+			}
+			items := b.GetNetworkRegistry().GetItems()
+			if len(items) != 2 {
+				return errors.New("Registry of the new queue has " + strconv.Itoa(len(items)) + " nodes")
+			}
+			return nil
+		},
+	}})
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFaultTransport_Replication(t *testing.T) {
+	network := NewFaultNetwork(NewMemoryTransport(), 2)
+	_, a, b := startFaultCluster(t, network)
+	received := make(chan string, 100)
+	a.Subscribe("TestFaults", func(message Message) {
+		received <- string(message.Payload)
+	})
+	countKeys := func(n *node) int {
+		records, _ := n.fileManager.Scan("TestFaults")
+		keys := make(map[uuid.UUID]bool)
+		for _, record := range records {
+			keys[record.Key] = true
+		}
+		return len(keys)
+	}
+	lost := uuid.New()
+
+	err := network.RunScenario([]ScenarioStep{{
+		Name: "slow network",
+		Apply: func(network *FaultNetwork) {
+			network.SetDefaultFaults(Faults{Latency: 2 * time.Millisecond, Jitter: 5 * time.Millisecond, DuplicateRate: 0.3, ReorderRate: 0.3})
+			for i := 0; i < 20; i++ {
+				a.SendMessage(Message{Key: uuid.New(), Topic: "TestFaults", Payload: []byte(strconv.Itoa(i))})
+			}
+		},
+		Check: func() error {
+			if count := countKeys(b); count != 20 {
+				return errors.New("Replicated " + strconv.Itoa(count) + " of 20 records")
+			}
+			return nil
+		},
+	}, {
+		Name: "node cut off from master in one direction",
+		Apply: func(network *FaultNetwork) {
+			network.Block("a", "m")
+			a.SendMessage(Message{Key: lost, Topic: "TestFaults", Payload: []byte("lost")})
+			b.SendMessage(Message{Key: uuid.New(), Topic: "TestFaults", Payload: []byte("seen")})
+		},
+		Check: func() error {
+			for len(received) > 0 {
+				if <-received == "seen" {
+					return nil
+				}
+			}
+			return errors.New("Message of the master not received")
+		},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.fileManager.Read(persistance.Query{Key: lost, Topic: "TestFaults"}); err == nil {
+		t.Error("Blocked message replicated")
+	}
+}
+
+func waitForListener(params ConnParams) {
+	for i := 0; i < 250; i++ {
+		if conn, err := Dial(context.Background(), params); err == nil {
+			conn.Close()
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func waitForMember(registry NetworkRegistry, id string) bool {
+	for i := 0; i < 250; i++ {
+		if item, _ := registry.GetItemById(id); item != nil {
+			return true
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return false
+}
@@ -0,0 +1,214 @@
+package messaging
+
+import (
+	"context"
+	"errors"
+	"path"
+	"time"
+
+	"github.com/vlado-github/tinydfs/logging"
+	"github.com/vlado-github/tinydfs/namespace"
+)
+
+// Remote calls of the namespace, served by the master node
+// (i.e. the node running the broadcast queue).
+const (
+	RPC_NS_MKDIR    string = "NS_MKDIR"
+	RPC_NS_CREATE   string = "NS_CREATE"
+	RPC_NS_STAT     string = "NS_STAT"
+	RPC_NS_LIST     string = "NS_LIST"
+	RPC_NS_RENAME   string = "NS_RENAME"
+	RPC_NS_SET_SIZE string = "NS_SET_SIZE"
+	RPC_NS_REMOVE   string = "NS_REMOVE"
+)
+
+// NamespaceTimeout limits a single call to the master namespace
+const NamespaceTimeout = 5 * time.Second
+
+// NamespaceRequest is a request of the NS_* calls
+type NamespaceRequest struct {
+	Path     string
+	NewPath  string `json:",omitempty"`
+	Owner    string `json:",omitempty"`
+	Replicas int    `json:",omitempty"`
+	Size     int64  `json:",omitempty"`
+}
+
+// Changes are applied by the master and broadcast to all nodes
+func (n *node) registerNamespaceHandlers() {
+	n.RegisterRpcHandler(RPC_NS_MKDIR, NewRpcHandler(func(ctx context.Context, request NamespaceRequest) (namespace.FileInfo, error) {
+		info, err := n.namespace.Mkdir(request.Path, request.Owner)
+		n.onNamespaceUpdated(err)
+		return info, err
+	}))
+	n.RegisterRpcHandler(RPC_NS_CREATE, NewRpcHandler(func(ctx context.Context, request NamespaceRequest) (namespace.FileInfo, error) {
+		info, err := n.namespace.Create(request.Path, request.Owner, request.Replicas)
+		if err == nil && info.Replicas > 0 {
+			// content of the file is kept by as many nodes as it has replicas
+			n.CreateTopic(info.Topic, 1, info.Replicas)
+		}
+		n.onNamespaceUpdated(err)
+		return info, err
+	}))
+	n.RegisterRpcHandler(RPC_NS_STAT, NewRpcHandler(func(ctx context.Context, request NamespaceRequest) (namespace.FileInfo, error) {
+		return n.namespace.Stat(request.Path)
+	}))
+	n.RegisterRpcHandler(RPC_NS_LIST, NewRpcHandler(func(ctx context.Context, request NamespaceRequest) ([]namespace.FileInfo, error) {
+		return n.namespace.List(request.Path)
+	}))
+	n.RegisterRpcHandler(RPC_NS_RENAME, NewRpcHandler(func(ctx context.Context, request NamespaceRequest) (bool, error) {
+		err := n.namespace.Rename(request.Path, request.NewPath)
+		n.onNamespaceUpdated(err)
+		return true, err
+	}))
+	n.RegisterRpcHandler(RPC_NS_SET_SIZE, NewRpcHandler(func(ctx context.Context, request NamespaceRequest) (bool, error) {
+		err := n.namespace.SetSize(request.Path, request.Size)
+		n.onNamespaceUpdated(err)
+		return true, err
+	}))
+	n.RegisterRpcHandler(RPC_NS_REMOVE, NewRpcHandler(func(ctx context.Context, request NamespaceRequest) (bool, error) {
+		err := n.namespace.Remove(request.Path)
+		n.onNamespaceUpdated(err)
+		return true, err
+	}))
+}
+
+func (n *node) onNamespaceUpdated(err error) {
+	if err == nil {
+		n.broadcastNamespace()
+	}
+}
+
+// Sends the namespace of the master to all nodes
+func (n *node) broadcastNamespace() {
+	if !n.isMaster() {
+		return
+	}
+	payload, err := n.namespace.ToByteArray()
+	if err != nil {
+		logging.AddError("Json serialization failed.", err.Error())
+		return
+	}
+	n.queue.Broadcast(NAMESPACE_CHANGED, payload)
+}
+
+// Keeps the namespace replicated by the master, so the node
+// serves it if it becomes the master
+func (n *node) onNamespaceChanged(message Message) {
+	if n.isMaster() {
+		return
+	}
+	if err := n.namespace.FromByteArray(message.Payload); err != nil {
+		logging.AddError("OnNamespaceChanged invalid message format.", err.Error())
+	}
+}
+
+// Records the size of a file when the master receives content of its topic
+func (n *node) onFileWritten(message Message) {
+	if !n.isMaster() {
+		return
+	}
+	info, ok := n.namespace.FindTopic(message.Topic)
+	if !ok {
+		return
+	}
+	err := n.namespace.SetSize(info.Path, info.Size+int64(len(message.Payload)))
+	n.onNamespaceUpdated(err)
+}
+
+// Returns the namespace of the cluster, operations are
+// forwarded to the master node
+func (n *node) GetNamespace() namespace.Namespace {
+	return &remoteNamespace{n: n}
+}
+
+// Calls remote method on the node running the broadcast queue
+func (n *node) callMaster(method string, request interface{}, response interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), NamespaceTimeout)
+	defer cancel()
+	params := n.getBroadcastQueue()
+	clientID := "master:" + params.Address()
+	n.rpcLock.Lock()
+	client, ok := n.rpcClients[clientID]
+	if !ok {
+		var err error
+		client, err = DialRpc(params)
+		if err != nil {
+			n.rpcLock.Unlock()
+			return err
+		}
+		n.rpcClients[clientID] = client
+	}
+	n.rpcLock.Unlock()
+
+	err := client.Call(ctx, method, request, response)
+	if err == ErrRpcClosed {
+		n.rpcLock.Lock()
+		delete(n.rpcClients, clientID)
+		n.rpcLock.Unlock()
+	}
+	var rpcErr *RpcError
+	if errors.As(err, &rpcErr) {
+		if known := namespace.KnownError(rpcErr.Message); known != nil {
+			return known
+		}
+	}
+	return err
+}
+
+// remoteNamespace implements namespace.Namespace with calls to the master
+type remoteNamespace struct {
+	n *node
+}
+
+func (rn *remoteNamespace) Mkdir(p string, owner string) (namespace.FileInfo, error) {
+	var info namespace.FileInfo
+	err := rn.n.callMaster(RPC_NS_MKDIR, NamespaceRequest{Path: p, Owner: owner}, &info)
+	return info, err
+}
+
+func (rn *remoteNamespace) Create(p string, owner string, replicas int) (namespace.FileInfo, error) {
+	var info namespace.FileInfo
+	err := rn.n.callMaster(RPC_NS_CREATE, NamespaceRequest{Path: p, Owner: owner, Replicas: replicas}, &info)
+	return info, err
+}
+
+func (rn *remoteNamespace) Stat(p string) (namespace.FileInfo, error) {
+	var info namespace.FileInfo
+	err := rn.n.callMaster(RPC_NS_STAT, NamespaceRequest{Path: p}, &info)
+	return info, err
+}
+
+func (rn *remoteNamespace) List(p string) ([]namespace.FileInfo, error) {
+	var infos []namespace.FileInfo
+	err := rn.n.callMaster(RPC_NS_LIST, NamespaceRequest{Path: p}, &infos)
+	return infos, err
+}
+
+func (rn *remoteNamespace) Rename(oldPath string, newPath string) error {
+	return rn.n.callMaster(RPC_NS_RENAME, NamespaceRequest{Path: oldPath, NewPath: newPath}, nil)
+}
+
+func (rn *remoteNamespace) Move(p string, dir string) error {
+	p, err := namespace.CleanPath(p)
+	if err != nil {
+		return err
+	}
+	dir, err = namespace.CleanPath(dir)
+	if err != nil {
+		return err
+	}
+	return rn.Rename(p, path.Join(dir, path.Base(p)))
+}
+
+func (rn *remoteNamespace) SetSize(p string, size int64) error {
+	return rn.n.callMaster(RPC_NS_SET_SIZE, NamespaceRequest{Path: p, Size: size}, nil)
+}
+
+func (rn *remoteNamespace) Remove(p string) error {
+	return rn.n.callMaster(RPC_NS_REMOVE, NamespaceRequest{Path: p}, nil)
+}
+
+func (rn *remoteNamespace) Close() error {
+	return nil
+}
@@ -1,28 +1,70 @@
 package messaging
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"github.com/vlado-github/tinydfs/logging"
+	"os"
 	"sort"
+	"sync"
 )
 
-// NetworkRegistry is a collection of TinyDFS IPs and ports
+// ErrNodeNotFound is returned for IDs missing in the network registry
+var ErrNodeNotFound = errors.New("Node not found in network registry")
+
+// ErrStaleEpoch is returned for registry updates older than the current view
+var ErrStaleEpoch = errors.New("Network registry update is older than the current epoch")
+
+// NetworkRegistryFile keeps the registry in the data directory,
+// the reserved prefix keeps it out of the topic files
+const NetworkRegistryFile = "__registry"
+
+// Types of network events
+const (
+	NODE_JOINED string = "NODE_JOINED"
+	NODE_LEFT   string = "NODE_LEFT"
+)
+
+// NetworkEvent reports a node that joined or left the registry
+type NetworkEvent struct {
+	Type  string
+	Node  NetworkTuple
+	Epoch uint64
+}
+
+// NetworkEventHandlerFunc is called for every join and leave of a node
+type NetworkEventHandlerFunc func(event NetworkEvent)
+
+// NetworkRegistry is a collection of TinyDFS IPs and ports.
+// Every change increases the epoch of the registry. It is safe for
+// concurrent use: reads return snapshots that are never changed, updates
+// replace the list and tuples instead of changing them.
 type NetworkRegistry interface {
 	ToByteArray() ([]byte, error)
 	FromByteArray(data []byte) error
 	ToString() (string, error)
+	GetEpoch() uint64
+	RaiseEpoch(epoch uint64)
 	GetItems() []NetworkTuple
 	GetItemById(id string) (NetworkTuple, int)
 	GetItemByRemoteAddPort(port string) (NetworkTuple, int)
 	AddItem(networkTuple NetworkTuple)
 	RemoveItem(index int)
+	RemoveItemById(id string) bool
+	SetItemLeaving(id string) bool
 	GetNextQueue() NetworkTuple
 	SetQueueUnresponsive(ip string, queuePort string)
 	GetQueueByIpAndPort(ip string, queuePort string) (NetworkTuple, int)
+	RegisterEventHandler(handler NetworkEventHandlerFunc)
 }
 
 type networkregistry struct {
+	Epoch         uint64         `json:"Epoch"`
 	NetworkTuples []NetworkTuple `json:"NetworkTuples"`
+	pathToFile    string
+	handlers      []NetworkEventHandlerFunc
+	lock          sync.RWMutex
 }
 
 // NewNetworkRegistry creates a new instance of network registry
@@ -32,89 +74,245 @@ func NewNetworkRegistry() NetworkRegistry {
 	}
 }
 
+// NewPersistentNetworkRegistry creates a network registry that is saved
+// to the file after every change and loaded from it if the file exists
+func NewPersistentNetworkRegistry(pathToFile string) NetworkRegistry {
+	nr := &networkregistry{
+		NetworkTuples: []NetworkTuple{},
+	}
+	data, err := os.ReadFile(pathToFile)
+	if err == nil {
+		err = nr.FromByteArray(data)
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		logging.AddError("NetworkRegistry not loaded.", pathToFile, err.Error())
+	}
+	nr.pathToFile = pathToFile
+	return nr
+}
+
+// AddItem adds the node or replaces the node with the same ID
 func (nr *networkregistry) AddItem(networkTuple NetworkTuple) {
-	if networkTuple != nil {
-		nr.NetworkTuples = append(nr.NetworkTuples, networkTuple)
+	if networkTuple == nil {
+		return
+	}
+	nr.lock.Lock()
+	tuples := make([]NetworkTuple, 0, len(nr.NetworkTuples)+1)
+	joined := true
+	for _, item := range nr.NetworkTuples {
+		if item.GetId() == networkTuple.GetId() {
+			joined = false
+			continue
+		}
+		tuples = append(tuples, item)
+	}
+	event := nr.update(append(tuples, networkTuple))
+	if !joined {
+		event = nil
 	}
+	nr.lock.Unlock()
+	nr.emit(event, NODE_JOINED, networkTuple)
 }
 
 func (nr *networkregistry) RemoveItem(index int) {
-	nr.NetworkTuples = append(nr.NetworkTuples[:index], nr.NetworkTuples[index+1:]...)
+	nr.lock.Lock()
+	if index < 0 || index >= len(nr.NetworkTuples) {
+		nr.lock.Unlock()
+		return
+	}
+	removed := nr.NetworkTuples[index]
+	tuples := make([]NetworkTuple, 0, len(nr.NetworkTuples))
+	tuples = append(tuples, nr.NetworkTuples[:index]...)
+	event := nr.update(append(tuples, nr.NetworkTuples[index+1:]...))
+	nr.lock.Unlock()
+	nr.emit(event, NODE_LEFT, removed)
+}
+
+// RemoveItemById removes the node, returns false if the node is not registered
+func (nr *networkregistry) RemoveItemById(id string) bool {
+	nr.lock.Lock()
+	var removed NetworkTuple
+	tuples := make([]NetworkTuple, 0, len(nr.NetworkTuples))
+	for _, item := range nr.NetworkTuples {
+		if item.GetId() == id {
+			removed = item
+			continue
+		}
+		tuples = append(tuples, item)
+	}
+	if removed == nil {
+		nr.lock.Unlock()
+		return false
+	}
+	event := nr.update(tuples)
+	nr.lock.Unlock()
+	nr.emit(event, NODE_LEFT, removed)
+	return true
+}
+
+// SetItemLeaving marks the node as leaving, returns false if the node is not registered
+func (nr *networkregistry) SetItemLeaving(id string) bool {
+	nr.lock.Lock()
+	defer nr.lock.Unlock()
+	return nr.replaceItems(func(item NetworkTuple) bool {
+		return item.GetId() == id
+	}, func(item NetworkTuple) {
+		item.SetIsLeaving(true)
+	}, true)
 }
 
 func (nr *networkregistry) SetQueueUnresponsive(ip string, queuePort string) {
-	networkTuple, index := nr.GetQueueByIpAndPort(ip, queuePort)
-	if networkTuple != nil {
-		nr.NetworkTuples[index].SetIsAvailable(false)
+	nr.lock.Lock()
+	defer nr.lock.Unlock()
+	// local observation of a node, not a change of the membership
+	nr.replaceItems(func(item NetworkTuple) bool {
+		return item.GetQueuePort() == queuePort && item.GetIP() == normalizeIp(ip)
+	}, func(item NetworkTuple) {
+		item.SetIsAvailable(false)
+	}, false)
+}
+
+func (nr *networkregistry) GetEpoch() uint64 {
+	nr.lock.RLock()
+	defer nr.lock.RUnlock()
+	return nr.Epoch
+}
+
+// RaiseEpoch moves the epoch forward to at least the given one, it is never lowered
+func (nr *networkregistry) RaiseEpoch(epoch uint64) {
+	nr.lock.Lock()
+	defer nr.lock.Unlock()
+	if epoch <= nr.Epoch {
+		return
 	}
+	nr.Epoch = epoch
+	nr.save()
 }
 
-func (nr *networkregistry) GetItems() []NetworkTuple {
-	sort.Slice(nr.NetworkTuples[:], func(i, j int) bool {
-		return nr.NetworkTuples[i].GetPort() < nr.NetworkTuples[j].GetPort()
+func (nr *networkregistry) RegisterEventHandler(handler NetworkEventHandlerFunc) {
+	nr.lock.Lock()
+	defer nr.lock.Unlock()
+	nr.handlers = append(nr.handlers, handler)
+}
+
+// Publishes the sorted list under a new epoch, callers hold the lock.
+// Returns the event of the change without type and node.
+func (nr *networkregistry) update(tuples []NetworkTuple) *NetworkEvent {
+	sort.SliceStable(tuples, func(i, j int) bool {
+		return tuples[i].GetPort() < tuples[j].GetPort()
 	})
-	return nr.NetworkTuples
+	nr.NetworkTuples = tuples
+	nr.Epoch++
+	nr.save()
+	return &NetworkEvent{Epoch: nr.Epoch}
 }
 
-func (nr *networkregistry) GetItemById(id string) (NetworkTuple, int) {
-	var index int
-	if len(nr.NetworkTuples) == 0 {
-		return nil, index
-	}
-	tuples := nr.GetItems()
-	for i := range tuples {
-		if tuples[i].GetId() == id {
-			return tuples[i], i
+// Replaces the matching tuples by changed copies, callers hold the lock
+func (nr *networkregistry) replaceItems(match func(item NetworkTuple) bool, change func(item NetworkTuple), newEpoch bool) bool {
+	tuples := make([]NetworkTuple, len(nr.NetworkTuples))
+	found := false
+	for i, item := range nr.NetworkTuples {
+		tuples[i] = item
+		if match(item) {
+			tuples[i] = copyTuple(item)
+			change(tuples[i])
+			found = true
 		}
 	}
-	return nil, index
+	if !found {
+		return false
+	}
+	if newEpoch {
+		nr.update(tuples)
+	} else {
+		nr.NetworkTuples = tuples
+		nr.save()
+	}
+	return true
 }
 
-func (nr *networkregistry) GetItemByRemoteAddPort(port string) (NetworkTuple, int) {
-	var index int
-	if len(nr.NetworkTuples) == 0 {
-		return nil, index
+// Calls handlers outside of the lock, so they can use the registry
+func (nr *networkregistry) emit(event *NetworkEvent, eventType string, networkTuples ...NetworkTuple) {
+	if event == nil {
+		return
 	}
-	tuples := nr.GetItems()
-	for i := range tuples {
-		if tuples[i].GetPort() == port {
-			return tuples[i], i
+	nr.lock.RLock()
+	handlers := nr.handlers
+	nr.lock.RUnlock()
+	for _, networkTuple := range networkTuples {
+		for _, handler := range handlers {
+			handler(NetworkEvent{Type: eventType, Node: networkTuple, Epoch: event.Epoch})
 		}
 	}
-	return nil, index
+}
+
+func copyTuple(networkTuple NetworkTuple) NetworkTuple {
+	result := NewNetworkTuple(networkTuple.GetId(),
+		networkTuple.GetIP(),
+		networkTuple.GetPort(),
+		networkTuple.GetQueuePort())
+	result.SetIsAvailable(networkTuple.GetAvailableStatus())
+	result.SetIsLeaving(networkTuple.GetLeavingStatus())
+	return result
+}
+
+// GetItems returns a snapshot of the nodes sorted by port
+func (nr *networkregistry) GetItems() []NetworkTuple {
+	nr.lock.RLock()
+	defer nr.lock.RUnlock()
+	// full slice expression makes appends of callers copy the list
+	return nr.NetworkTuples[:len(nr.NetworkTuples):len(nr.NetworkTuples)]
+}
+
+func (nr *networkregistry) GetItemById(id string) (NetworkTuple, int) {
+	return nr.find(func(item NetworkTuple) bool {
+		return item.GetId() == id
+	})
+}
+
+func (nr *networkregistry) GetItemByRemoteAddPort(port string) (NetworkTuple, int) {
+	return nr.find(func(item NetworkTuple) bool {
+		return item.GetPort() == port
+	})
 }
 
 func (nr *networkregistry) GetQueueByIpAndPort(ip string, queuePort string) (NetworkTuple, int) {
-	var index int
-	if len(nr.NetworkTuples) == 0 {
-		return nil, index
-	}
-	tuples := nr.GetItems()
-	for i := range tuples {
-		if tuples[i].GetQueuePort() == queuePort &&
-			tuples[i].GetIP() == ip {
-			return tuples[i], i
-		}
-	}
-	return nil, index
+	return nr.find(func(item NetworkTuple) bool {
+		return item.GetQueuePort() == queuePort && item.GetIP() == normalizeIp(ip)
+	})
 }
 
 func (nr *networkregistry) GetNextQueue() NetworkTuple {
-	if len(nr.NetworkTuples) == 0 {
-		return nil
-	}
+	networkTuple, _ := nr.find(func(item NetworkTuple) bool {
+		return item.GetAvailableStatus()
+	})
+	return networkTuple
+}
+
+// Returns the first matching tuple of the snapshot and its index
+func (nr *networkregistry) find(match func(item NetworkTuple) bool) (NetworkTuple, int) {
 	tuples := nr.GetItems()
 	for i := range tuples {
-		if tuples[i].GetAvailableStatus() == true {
-			return tuples[i]
+		if match(tuples[i]) {
+			return tuples[i], i
 		}
 	}
-	return nil
+	return nil, 0
 }
 
 // ToByteArray converts to Json string
 func (nr *networkregistry) ToByteArray() ([]byte, error) {
-	result, err := json.Marshal(nr.NetworkTuples)
+	nr.lock.RLock()
+	defer nr.lock.RUnlock()
+	return nr.marshal()
+}
+
+// Callers hold the lock
+func (nr *networkregistry) marshal() ([]byte, error) {
+	result, err := json.Marshal(struct {
+		Epoch         uint64         `json:"Epoch"`
+		NetworkTuples []NetworkTuple `json:"NetworkTuples"`
+	}{nr.Epoch, nr.NetworkTuples})
 
 	if err != nil {
 		logging.AddInfo("NetworkRegistry ToByteArray", err.Error())
@@ -123,33 +321,87 @@ func (nr *networkregistry) ToByteArray() ([]byte, error) {
 	return result, nil
 }
 
-// FromByteArray converts byte array to NetworkRegistry
+// FromByteArray converts byte array to NetworkRegistry. Updates with an
+// older epoch are rejected, nodes that joined or left are reported to handlers.
+// A list of tuples without epoch is accepted as epoch 0.
 func (nr *networkregistry) FromByteArray(data []byte) error {
-	var tuples []networktuple
-	err := json.Unmarshal(data, &tuples)
+	var state struct {
+		Epoch         uint64         `json:"Epoch"`
+		NetworkTuples []networktuple `json:"NetworkTuples"`
+	}
+	var err error
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		err = json.Unmarshal(data, &state.NetworkTuples)
+	} else {
+		err = json.Unmarshal(data, &state)
+	}
 	if err != nil {
 		logging.AddError("NetworkRegistry FromByteArray ", err.Error())
 		return err
 	}
 	//todo: unmarshal doesn't work with interface,
 	// check this out and remove this workaround code...
-	if len(tuples) > 0 {
-		nr.NetworkTuples = []NetworkTuple{}
+	tuples := []NetworkTuple{}
+	for i := range state.NetworkTuples {
+		tuples = append(tuples, copyTuple(&state.NetworkTuples[i]))
 	}
-	for i := range tuples {
-		nr.AddItem(NewNetworkTuple(tuples[i].GetId(),
-			tuples[i].GetIP(),
-			tuples[i].GetPort(),
-			tuples[i].GetQueuePort()))
+	sort.SliceStable(tuples, func(i, j int) bool {
+		return tuples[i].GetPort() < tuples[j].GetPort()
+	})
+
+	nr.lock.Lock()
+	if state.Epoch < nr.Epoch {
+		nr.lock.Unlock()
+		return ErrStaleEpoch
+	}
+	left := make(map[string]NetworkTuple)
+	for _, networkTuple := range nr.NetworkTuples {
+		left[networkTuple.GetId()] = networkTuple
+	}
+	joined := []NetworkTuple{}
+	for _, networkTuple := range tuples {
+		if _, ok := left[networkTuple.GetId()]; ok {
+			delete(left, networkTuple.GetId())
+		} else {
+			joined = append(joined, networkTuple)
+		}
+	}
+	nr.Epoch = state.Epoch
+	nr.NetworkTuples = tuples
+	nr.save()
+	nr.lock.Unlock()
+
+	event := &NetworkEvent{Epoch: state.Epoch}
+	nr.emit(event, NODE_JOINED, joined...)
+	for _, networkTuple := range left {
+		nr.emit(event, NODE_LEFT, networkTuple)
 	}
 	return nil
 }
 
+// Writes the registry to its file if the registry is persistent, callers hold the lock
+func (nr *networkregistry) save() {
+	if nr.pathToFile == "" {
+		return
+	}
+	data, err := nr.marshal()
+	if err != nil {
+		return
+	}
+	tmpPath := nr.pathToFile + ".tmp"
+	err = os.WriteFile(tmpPath, data, 0660)
+	if err == nil {
+		err = os.Rename(tmpPath, nr.pathToFile)
+	}
+	if err != nil {
+		logging.AddError("NetworkRegistry not saved.", err.Error())
+	}
+}
+
 // ToString converts to string
 func (nr *networkregistry) ToString() (string, error) {
-	result, err := json.Marshal(nr.NetworkTuples)
+	result, err := nr.ToByteArray()
 	if err != nil {
-		logging.AddInfo("NetworkRegistry ToString", err.Error())
 		return "", err
 	}
 	return string(result), nil
@@ -1,5 +1,7 @@
 package messaging
 
+import "net"
+
 // NetworkTuple contains IP and port
 type NetworkTuple interface {
 	GetIP() string
@@ -8,20 +10,23 @@ type NetworkTuple interface {
 	GetQueuePort() string
 	GetAvailableStatus() bool
 	SetIsAvailable(bool)
+	GetLeavingStatus() bool
+	SetIsLeaving(bool)
 }
 
 type networktuple struct {
 	IpAddress   string `json:"IpAddress"`
 	Port        string `json:"Port"`
 	Id          string `json:"Id"`
-	QueuePort   string `json:QueuePort`
-	IsAvailable bool   `json:IsAvailable`
+	QueuePort   string `json:"QueuePort"`
+	IsAvailable bool   `json:"IsAvailable"`
+	IsLeaving   bool   `json:"IsLeaving,omitempty"`
 }
 
 // NewNetworkTuple creates a new instance of network tuple
 func NewNetworkTuple(id string, ipAddress string, port string, queuePort string) NetworkTuple {
 	return &networktuple{
-		IpAddress:   ipAddress,
+		IpAddress:   normalizeIp(ipAddress),
 		Port:        port,
 		Id:          id,
 		QueuePort:   queuePort,
@@ -29,6 +34,13 @@ func NewNetworkTuple(id string, ipAddress string, port string, queuePort string)
 	}
 }
 
+// connAckReply introduces a node to the queue it connected to,
+// with the latest registry epoch the node has seen
+type connAckReply struct {
+	networktuple
+	Epoch uint64 `json:"Epoch,omitempty"`
+}
+
 func (nt *networktuple) GetIP() string {
 	return nt.IpAddress
 }
@@ -52,3 +64,20 @@ func (nt *networktuple) GetAvailableStatus() bool {
 func (nt *networktuple) SetIsAvailable(isAvailable bool) {
 	nt.IsAvailable = isAvailable
 }
+
+// Leaving nodes hand off their data and do not get new partitions
+func (nt *networktuple) GetLeavingStatus() bool {
+	return nt.IsLeaving
+}
+
+func (nt *networktuple) SetIsLeaving(isLeaving bool) {
+	nt.IsLeaving = isLeaving
+}
+
+// Same IPv6 address is written in many ways, registry compares the canonical form
+func normalizeIp(ip string) string {
+	if parsed := net.ParseIP(ip); parsed != nil {
+		return parsed.String()
+	}
+	return ip
+}
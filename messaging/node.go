@@ -1,10 +1,20 @@
 package messaging
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"github.com/vlado-github/tinydfs/logging"
-	"net"
+	"github.com/vlado-github/tinydfs/namespace"
 	"github.com/vlado-github/tinydfs/persistance"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"math/rand"
@@ -17,53 +27,210 @@ import (
 type Node interface {
 	Run() error
 	SendMessage(message Message)
+	SendStream(topic string, r io.Reader) (uuid.UUID, error)
 	ConnectToQueue() error
 	CloseConn() error
+	CreateTopic(topic string, partitions int, replicas int)
+	Call(ctx context.Context, nodeID string, method string, request interface{}, response interface{}) error
+	Get(ctx context.Context, topic string, key uuid.UUID) (string, error)
+	Update(ctx context.Context, topic string, key uuid.UUID, text string) error
+	Put(ctx context.Context, topic string, key uuid.UUID, text string, headers map[string]string) error
+	Scan(ctx context.Context, topic string) ([]persistance.Record, error)
+	Delete(ctx context.Context, topic string, key uuid.UUID) error
+	GetStream(ctx context.Context, topic string, key uuid.UUID) (io.ReadCloser, error)
+	Subscribe(topic string, handler MessageHandlerFunc) func()
+	Scrub(ctx context.Context) ScrubReport
+	Snapshot(dest string) (persistance.SnapshotManifest, error)
+	Restore(ctx context.Context, src string) (persistance.SnapshotManifest, error)
+	Decommission(ctx context.Context) error
+	StartDecommission() error
+	GetDecommissionStatus() DecommissionStatus
 
 	GetID() uuid.UUID
 	GetElectionID() int
+	GetPartitionMap() PartitionMap
+	GetNetworkRegistry() NetworkRegistry
+	GetNamespace() namespace.Namespace
 
 	RegisterNodeHandler(HandlerType, NodeHandlerFunc)
 	RegisterQueueHandler(HandlerType, MsgQueueHandlerFunc)
+	RegisterRpcHandler(method string, handler RpcHandlerFunc)
+}
+
+// NodeStatus is a response of the STATUS remote call
+type NodeStatus struct {
+	ID         string
+	ElectionID int
+	Nodes      int
 }
 
 type node struct {
 	id                        uuid.UUID
+	dataDir                   string
 	electionID                int
 	remoteAddressPort         string
 	broadcastQueueConnParams  ConnParams
+	broadcastLock             sync.RWMutex
 	exchangeQueueConnParams   ConnParams
 	conn                      net.Conn
 	fileManager               persistance.FileManager
+	namespace                 namespace.ReplicatedNamespace
 	queue                     MessageQueue
 	onConnectionClosedHandler NodeHandlerFunc
 	onConnectionOpenedHandler NodeHandlerFunc
 	persistanceEnabled        bool
 	networkRegistry           NetworkRegistry
+	partitionMap              PartitionMap
+	rpcClients                map[string]RpcClient
+	rpcLock                   sync.Mutex
+	sendLock                  sync.Mutex
+	subscribers               map[string]map[uuid.UUID]MessageHandlerFunc
+	subscribersLock           sync.Mutex
+	bootstrapping             bool
+	pendingMessages           []Message
+	bootstrapLock             sync.Mutex
+	partitionsReceived        atomic.Bool
+	decommissionStatus        DecommissionStatus
+	decommissionLock          sync.Mutex
+	rebalancer                *rebalancer
+	seeds                     []ConnParams
+	discovery                 *DiscoveryParams
+	bootstrapCluster          bool
+	closed                    chan struct{}
+	closeOnce                 sync.Once
 }
 
 const MaxNumberOfConnAttempts int = 10
 
+// NodeIDFile keeps the ID of a node, so it keeps its identity after a restart
+const NodeIDFile = "__node_id"
+
+// QueueRegistryFile keeps the network registry of the queue a master candidate runs
+const QueueRegistryFile = "__queue_registry"
+
+// ConnRetryInterval is the pause between attempts to connect to the queue
+const ConnRetryInterval = 20 * time.Millisecond
+
+// GarbageCollectionInterval is how often unreferenced blobs are removed
+const GarbageCollectionInterval = time.Minute
+
 // NewNode creates new instance of node
 func NewNode(exchangeQueueConn ConnParams, broadcastQueueConn ConnParams, persistanceEnabled bool) Node {
+	return newNode(exchangeQueueConn, broadcastQueueConn, persistanceEnabled, false)
+}
+
+// NewSeededNode creates a node that learns the broadcast queue from the first
+// answering seed. If bootstrapCluster is set and no seed answers,
+// the node starts a new cluster with itself as the master.
+func NewSeededNode(exchangeQueueConn ConnParams, seeds []ConnParams, bootstrapCluster bool, persistanceEnabled bool) Node {
+	n := newNode(exchangeQueueConn, ConnParams{}, persistanceEnabled, bootstrapCluster)
+	n.seeds = seeds
+	n.bootstrapCluster = bootstrapCluster
+	return n
+}
+
+func newNode(exchangeQueueConn ConnParams, broadcastQueueConn ConnParams, persistanceEnabled bool, masterCandidate bool) *node {
 	rand.Seed(time.Now().Unix())
-	uniqueID := uuid.New()
 	randomID := rand.Int()
-	fm := persistance.NewFileManager(getCurrentDirectory() + "//" + uniqueID.String())
+	dataDir, uniqueID := nodeDataDirectory(exchangeQueueConn)
+	fm := persistance.NewFileManager(dataDir)
 	msgQueue := NewQueue(exchangeQueueConn)
+	networkRegistry := NewNetworkRegistry()
+	if persistanceEnabled {
+		networkRegistry = NewPersistentNetworkRegistry(dataDir + "//" + NetworkRegistryFile)
+		if exchangeQueueConn == broadcastQueueConn || masterCandidate {
+			msgQueue = NewPersistentQueue(exchangeQueueConn, dataDir+"//"+QueueRegistryFile)
+		}
+	}
 
-	return &node{
-		id:                       uniqueID,
-		electionID:               randomID,
-		exchangeQueueConnParams:  exchangeQueueConn,
-		fileManager:              fm,
-		broadcastQueueConnParams: broadcastQueueConn,
-		persistanceEnabled:       persistanceEnabled,
-		queue:                    msgQueue,
+	n := &node{
+		id:                        uniqueID,
+		dataDir:                   dataDir,
+		electionID:                randomID,
+		exchangeQueueConnParams:   exchangeQueueConn,
+		fileManager:               fm,
+		namespace:                 namespace.NewNamespace(dataDir + "//__namespace"),
+		broadcastQueueConnParams:  broadcastQueueConn,
+		persistanceEnabled:        persistanceEnabled,
+		queue:                     msgQueue,
 		onConnectionClosedHandler: NewHandlerFunc(),
 		onConnectionOpenedHandler: NewHandlerFunc(),
-		networkRegistry:           NewNetworkRegistry(),
+		networkRegistry:           networkRegistry,
+		partitionMap:              NewPartitionMap(),
+		rpcClients:                make(map[string]RpcClient),
+		subscribers:               make(map[string]map[uuid.UUID]MessageHandlerFunc),
+		bootstrapping:             true,
+		decommissionStatus:        DecommissionStatus{State: DECOMMISSION_ACTIVE},
+		closed:                    make(chan struct{}),
+	}
+	n.rebalancer = newRebalancer(n, dataDir+"//"+RebalanceStateFile)
+	msgQueue.RegisterHandler(NETWORKCHANGED, func(queue MessageQueue) {
+		n.rebalancer.onNetworkChanged(queue)
+		// joined nodes receive the namespace of the master
+		n.broadcastNamespace()
+	})
+	n.registerRpcHandlers()
+	n.registerBootstrapHandlers()
+	n.registerDecommissionHandlers()
+	n.registerRebalanceHandlers()
+	n.registerClientHandlers()
+	n.registerNamespaceHandlers()
+	n.registerSeedHandlers()
+	return n
+}
+
+// Nodes listening on a fixed address keep their data directory and ID across
+// restarts, nodes on an ephemeral port get a new ones on every start
+func nodeDataDirectory(exchangeQueueConn ConnParams) (string, uuid.UUID) {
+	if exchangeQueueConn.Port == "" || exchangeQueueConn.Port == "0" {
+		id := uuid.New()
+		return getDataDirectory() + "//" + id.String(), id
+	}
+	dataDir := getDataDirectory() + "//" + nodeDirectoryName(exchangeQueueConn)
+	migrateDataDirectory(exchangeQueueConn, dataDir)
+	pathToFile := dataDir + "//" + NodeIDFile
+	data, err := os.ReadFile(pathToFile)
+	if err == nil {
+		if id, err := uuid.Parse(strings.TrimSpace(string(data))); err == nil {
+			return dataDir, id
+		}
+		logging.AddWarning("[Node] Invalid node ID replaced.", pathToFile)
 	}
+	id := uuid.New()
+	if err := os.MkdirAll(dataDir, os.ModePerm); err != nil {
+		logging.AddError("[Node] Data directory not created.", err.Error())
+	} else if err := os.WriteFile(pathToFile, []byte(id.String()), 0660); err != nil {
+		logging.AddError("[Node] Node ID not saved.", err.Error())
+	}
+	return dataDir, id
+}
+
+// Names the data directory after the protocol and the full address, so nodes
+// sharing a port on other interfaces or transports keep separate data
+func nodeDirectoryName(exchangeQueueConn ConnParams) string {
+	name := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-' {
+			return r
+		}
+		return '_'
+	}, exchangeQueueConn.Address())
+	return "node-" + exchangeQueueConn.Protocol + "-" + name
+}
+
+// Moves the data directory of older versions, named after the port only
+func migrateDataDirectory(exchangeQueueConn ConnParams, dataDir string) {
+	legacyDir := getDataDirectory() + "//node-" + strings.TrimSuffix(filepath.Base(exchangeQueueConn.Port), filepath.Ext(exchangeQueueConn.Port))
+	if _, err := os.Stat(dataDir); !errors.Is(err, fs.ErrNotExist) {
+		return
+	}
+	if _, err := os.Stat(legacyDir + "//" + NodeIDFile); err != nil {
+		return
+	}
+	if err := os.Rename(legacyDir, dataDir); err != nil {
+		logging.AddError("[Node] Data directory not migrated.", legacyDir, err.Error())
+		return
+	}
+	logging.AddInfo("[Node] Data directory migrated.", legacyDir, dataDir)
 }
 
 // Returns the Node unique ID
@@ -76,32 +243,93 @@ func (n *node) GetElectionID() int {
 	return n.electionID
 }
 
+// Master node runs the broadcast queue
+func (n *node) isMaster() bool {
+	return n.exchangeQueueConnParams.Address() == n.getBroadcastQueue().Address()
+}
+
+// Returns where the broadcast queue runs, it changes on failover
+func (n *node) getBroadcastQueue() ConnParams {
+	n.broadcastLock.RLock()
+	defer n.broadcastLock.RUnlock()
+	return n.broadcastQueueConnParams
+}
+
+func (n *node) setBroadcastQueue(params ConnParams) {
+	n.broadcastLock.Lock()
+	defer n.broadcastLock.Unlock()
+	n.broadcastQueueConnParams = params
+}
+
+// Returns the partition map of topics
+func (n *node) GetPartitionMap() PartitionMap {
+	return n.partitionMap
+}
+
+// Returns the network registry known to the node
+func (n *node) GetNetworkRegistry() NetworkRegistry {
+	return n.networkRegistry
+}
+
 // If node is master than starts a queue
 // Runs node and connects to the queue
 func (n *node) Run() error {
 	// run exchange queue
 	go n.queue.Run()
 
+	if len(n.seeds) > 0 {
+		if err := n.joinCluster(); err != nil {
+			logging.AddError("[Node] Joining cluster failed.", err.Error())
+			return err
+		}
+	}
+	if n.discovery != nil {
+		if err := n.discoverCluster(); err != nil {
+			logging.AddError("[Node] Discovering cluster failed.", err.Error())
+			return err
+		}
+		go n.announce()
+	}
+
+	if n.persistanceEnabled {
+		go n.collectGarbage()
+		go n.runScrubber()
+	}
+	go n.bootstrap()
+	go n.rebalancer.run()
+
 	// connects to broadcast queue
 	return n.ConnectToQueue()
 }
 
+// Periodically removes blobs of deleted and updated records
+func (n *node) collectGarbage() {
+	ticker := time.NewTicker(GarbageCollectionInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		n.fileManager.CollectGarbage()
+	}
+}
+
 // Connects to queue
 func (n *node) ConnectToQueue() error {
-	protocol := n.broadcastQueueConnParams.Protocol
-	address := n.broadcastQueueConnParams.Ip + ":" + n.broadcastQueueConnParams.Port
+	broadcastQueue := n.getBroadcastQueue()
+	protocol := broadcastQueue.Protocol
+	address := broadcastQueue.Address()
 	if n.conn != nil {
 		n.conn.Close()
 	}
 	numOfAttempts := 0
 	var err error
-	n.conn, err = net.Dial(protocol, address)
+	n.conn, err = Dial(context.Background(), broadcastQueue)
 	numOfAttempts++
 
 	if err != nil {
 		var isConnected = false
 		for numOfAttempts <= MaxNumberOfConnAttempts {
-			n.conn, err = net.Dial(protocol, address)
+			// the queue of the master may still be starting
+			time.Sleep(ConnRetryInterval)
+			n.conn, err = Dial(context.Background(), broadcastQueue)
 			if err == nil {
 				isConnected = true
 				n.onConnectionOpenedHandler(n)
@@ -123,6 +351,8 @@ func (n *node) ConnectToQueue() error {
 
 // Sends message to the queue
 func (n *node) SendMessage(message Message) {
+	n.sendLock.Lock()
+	defer n.sendLock.Unlock()
 	encoder := json.NewEncoder(n.conn)
 	encodeMessage(&message, encoder)
 }
@@ -143,42 +373,140 @@ func (n *node) receiveMessages() {
 				n.onConnectionAcknowledged(message)
 			} else if message.Topic == NETWORK_CHANGED {
 				n.onNetworkChanged(message)
+			} else if message.Topic == PARTITIONS_CHANGED {
+				n.onPartitionsChanged(message)
+			} else if message.Topic == REBALANCE_CHANGED {
+				n.rebalancer.onStateChanged(message)
+			} else if message.Topic == NAMESPACE_CHANGED {
+				n.onNamespaceChanged(message)
 			} else {
-				var guid = uuid.New()
-				var cmd = persistance.Command{Key: guid, Text: string(message.Payload), Topic: message.Topic}
-				n.fileManager.Write(cmd)
+				n.storeMessage(message)
+				n.onFileWritten(message)
+				n.notifySubscribers(message)
 			}
 		}
 	}
 }
 
+// Stores the message, messages received while the node
+// bootstraps are kept until the transfer is finished
+func (n *node) storeMessage(message Message) {
+	n.bootstrapLock.Lock()
+	defer n.bootstrapLock.Unlock()
+	if n.bootstrapping {
+		n.pendingMessages = append(n.pendingMessages, message)
+		return
+	}
+	n.writeMessage(message, false)
+}
+
+// Writes the message, partitioned topics are stored
+// only if node holds a replica of the message partition
+func (n *node) writeMessage(message Message, skipExisting bool) {
+	if err := persistance.ValidateMessageTopic(message.Topic); err != nil {
+		logging.AddWarning("[Node] Message rejected.", err.Error())
+		return
+	}
+	topic := message.Topic
+	if _, ok := n.partitionMap.GetTopic(message.Topic); ok {
+		partition := n.partitionMap.GetPartition(message)
+		if !n.partitionMap.IsReplica(message.Topic, partition, n.GetID().String()) {
+			return
+		}
+		topic = PartitionTopicName(message.Topic, partition)
+	}
+	var key = message.Key
+	if key == uuid.Nil {
+		key = uuid.New()
+	}
+	if skipExisting {
+		if _, err := n.fileManager.Read(persistance.Query{Key: key, Topic: topic}); err == nil {
+			return
+		}
+	}
+	var cmd = persistance.Command{Key: key, Text: string(message.Payload), Topic: topic}
+	if message.PartitionKey != "" {
+		cmd.Headers = map[string]string{PartitionKeyHeader: message.PartitionKey}
+	}
+	n.fileManager.Write(cmd)
+}
+
+// Subscribe calls the handler for every message of the topic
+// broadcast in the cluster. Returned function cancels the subscription.
+func (n *node) Subscribe(topic string, handler MessageHandlerFunc) func() {
+	id := uuid.New()
+	n.subscribersLock.Lock()
+	if n.subscribers[topic] == nil {
+		n.subscribers[topic] = make(map[uuid.UUID]MessageHandlerFunc)
+	}
+	n.subscribers[topic][id] = handler
+	n.subscribersLock.Unlock()
+	return func() {
+		n.subscribersLock.Lock()
+		delete(n.subscribers[topic], id)
+		n.subscribersLock.Unlock()
+	}
+}
+
+func (n *node) notifySubscribers(message Message) {
+	n.subscribersLock.Lock()
+	handlers := make([]MessageHandlerFunc, 0, len(n.subscribers[message.Topic]))
+	for _, handler := range n.subscribers[message.Topic] {
+		handlers = append(handlers, handler)
+	}
+	n.subscribersLock.Unlock()
+	for _, handler := range handlers {
+		handler(message)
+	}
+}
+
+// Asks the queue to create a topic with given number of partitions and replicas
+func (n *node) CreateTopic(topic string, partitions int, replicas int) {
+	spec := TopicSpec{Topic: topic, Partitions: partitions, Replicas: replicas}
+	payload, err := json.Marshal(spec)
+	if err != nil {
+		logging.AddError("Json serialization failed.", err)
+		return
+	}
+	n.SendMessage(Message{Key: uuid.New(), Topic: CREATE_TOPIC, Payload: payload})
+}
+
 // In case that broadcast queue fails, we fetch next queue from the list and connect it
 func (n *node) retryNextQueue() {
-	n.networkRegistry.SetQueueUnresponsive(n.broadcastQueueConnParams.Ip, n.broadcastQueueConnParams.Port)
+	broadcastQueue := n.getBroadcastQueue()
+	n.networkRegistry.SetQueueUnresponsive(broadcastQueue.Ip, broadcastQueue.Port)
 	networkTuple := n.networkRegistry.GetNextQueue()
-	logging.AddTrace("Try to connect to next queue:", networkTuple.GetIP(), networkTuple.GetQueuePort())
-	if networkTuple != nil {
-		n.broadcastQueueConnParams = ConnParams{
-			Ip:       networkTuple.GetIP(),
-			Port:     networkTuple.GetQueuePort(),
-			Protocol: n.broadcastQueueConnParams.Protocol,
-		}
-		n.ConnectToQueue()
+	if networkTuple == nil {
+		logging.AddError("[Node] No other queue is known.")
+		return
 	}
+	logging.AddTrace("Try to connect to next queue:", networkTuple.GetIP(), networkTuple.GetQueuePort())
+	n.setBroadcastQueue(ConnParams{
+		Ip:       networkTuple.GetIP(),
+		Port:     networkTuple.GetQueuePort(),
+		Protocol: broadcastQueue.Protocol,
+	})
+	n.ConnectToQueue()
 }
 
 // Close connection to the master
 func (n *node) CloseConn() error {
+	n.closeOnce.Do(func() { close(n.closed) })
 	n.onConnectionClosedHandler(n)
-	err := n.conn.Close()
+	var err error
+	if n.conn != nil {
+		err = n.conn.Close()
+	}
 	if err != nil {
 		logging.AddError("Close connection on node failed.", err.Error())
 		return err
 	}
 	if n.queue != nil {
-		err := n.queue.Close()
-		logging.AddError("Close message queue connection on node failed.", err.Error())
-		return err
+		err = n.queue.Close()
+		if err != nil {
+			logging.AddError("Close message queue connection on node failed.", err.Error())
+			return err
+		}
 	}
 	return err
 }
@@ -191,9 +519,14 @@ func (n *node) onConnectionAcknowledged(message Message) {
 	}
 	ip, port, _ := net.SplitHostPort(string(message.Payload))
 	logging.AddInfo("[Client] Connected.", ip, port)
+	if n.exchangeQueueConnParams.AdvertiseIp != "" {
+		ip = n.exchangeQueueConnParams.AdvertiseIp
+	}
 	n.remoteAddressPort = port
 	networkTuple := NewNetworkTuple(n.GetID().String(), ip, port, n.exchangeQueueConnParams.Port)
-	payload, err := json.Marshal(networkTuple)
+	// a queue the node failed over to continues after the epoch known to the node
+	reply := connAckReply{networktuple: *networkTuple.(*networktuple), Epoch: n.networkRegistry.GetEpoch()}
+	payload, err := json.Marshal(reply)
 	if err != nil {
 		logging.AddError("Json serialization failed.", err)
 	}
@@ -207,11 +540,100 @@ func (n *node) onNetworkChanged(message Message) {
 		return
 	}
 	err := n.networkRegistry.FromByteArray(message.Payload)
-	if err != nil {
+	if err == ErrStaleEpoch {
+		logging.AddWarning("[Node] Stale network registry ignored.")
+	} else if err != nil {
 		logging.AddError("OnNetworkChanged invalid message format.", err.Error())
 	}
 }
 
+// Queue notifies nodes about partition placement
+func (n *node) onPartitionsChanged(message Message) {
+	if message.Topic != PARTITIONS_CHANGED {
+		return
+	}
+	err := n.partitionMap.FromByteArray(message.Payload)
+	if err != nil {
+		logging.AddError("OnPartitionsChanged invalid message format.", err.Error())
+		return
+	}
+	n.partitionsReceived.Store(true)
+}
+
+// Registers READ, READ_RECORD, UPDATE, PUT, DELETE, SCAN, TOPICS and STATUS remote calls
+func (n *node) registerRpcHandlers() {
+	n.RegisterRpcHandler(RPC_READ, NewRpcHandler(func(ctx context.Context, query persistance.Query) (string, error) {
+		return n.fileManager.Read(query)
+	}))
+	n.RegisterRpcHandler(RPC_READ_RECORD, NewRpcHandler(func(ctx context.Context, query persistance.Query) (persistance.Record, error) {
+		return n.fileManager.ReadRecord(query)
+	}))
+	n.RegisterRpcHandler(RPC_UPDATE, NewRpcHandler(func(ctx context.Context, command persistance.Command) (bool, error) {
+		return true, n.fileManager.Update(command)
+	}))
+	n.RegisterRpcHandler(RPC_PUT, NewRpcHandler(func(ctx context.Context, command persistance.Command) (bool, error) {
+		return true, n.fileManager.Put(command)
+	}))
+	n.RegisterRpcHandler(RPC_DELETE, NewRpcHandler(func(ctx context.Context, command persistance.Command) (bool, error) {
+		return true, n.fileManager.Delete(command)
+	}))
+	n.RegisterRpcHandler(RPC_SCAN, NewRpcHandler(func(ctx context.Context, topic string) ([]persistance.Record, error) {
+		return n.fileManager.Scan(topic)
+	}))
+	n.RegisterRpcHandler(RPC_TOPICS, NewRpcHandler(func(ctx context.Context, _ struct{}) ([]string, error) {
+		return n.fileManager.Topics()
+	}))
+	n.RegisterRpcHandler(RPC_STATUS, NewRpcHandler(func(ctx context.Context, _ struct{}) (NodeStatus, error) {
+		return NodeStatus{
+			ID:         n.GetID().String(),
+			ElectionID: n.GetElectionID(),
+			Nodes:      len(n.networkRegistry.GetItems()),
+		}, nil
+	}))
+}
+
+// Calls remote method on a node from network registry
+func (n *node) Call(ctx context.Context, nodeID string, method string, request interface{}, response interface{}) error {
+	client, err := n.getRpcClient(nodeID)
+	if err != nil {
+		return err
+	}
+	err = client.Call(ctx, method, request, response)
+	if err == ErrRpcClosed {
+		n.rpcLock.Lock()
+		delete(n.rpcClients, nodeID)
+		n.rpcLock.Unlock()
+	}
+	return err
+}
+
+// Returns cached RPC client or connects to the node exchange queue
+func (n *node) getRpcClient(nodeID string) (RpcClient, error) {
+	n.rpcLock.Lock()
+	defer n.rpcLock.Unlock()
+	if client, ok := n.rpcClients[nodeID]; ok {
+		return client, nil
+	}
+	networkTuple, _ := n.networkRegistry.GetItemById(nodeID)
+	if networkTuple == nil {
+		return nil, ErrNodeNotFound
+	}
+	client, err := DialRpc(ConnParams{
+		Ip:       networkTuple.GetIP(),
+		Port:     networkTuple.GetQueuePort(),
+		Protocol: n.exchangeQueueConnParams.Protocol,
+	})
+	if err != nil {
+		return nil, err
+	}
+	n.rpcClients[nodeID] = client
+	return client, nil
+}
+
+func (n *node) RegisterRpcHandler(method string, handler RpcHandlerFunc) {
+	n.queue.RegisterRpcHandler(method, handler)
+}
+
 func (n *node) RegisterNodeHandler(handlerType HandlerType, handlerFunc NodeHandlerFunc) {
 	switch handlerType {
 	case NODECONNCLOSED:
@@ -230,6 +652,7 @@ func (n *node) RegisterNodeHandler(handlerType HandlerType, handlerFunc NodeHand
 	}
 }
 
+// RegisterQueueHandler adds handler of the queue event, it runs after the handlers of the node
 func (n *node) RegisterQueueHandler(handlerType HandlerType, handlerFunc MsgQueueHandlerFunc) {
 	switch handlerType {
 	case NETWORKCHANGED:
@@ -7,3 +7,6 @@ type NodeHandlerFunc func(n Node)
 func NewHandlerFunc() NodeHandlerFunc {
 	return func(n Node) {}
 }
+
+// MessageHandlerFunc represent a callback for received messages.
+type MessageHandlerFunc func(message Message)
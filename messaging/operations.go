@@ -0,0 +1,189 @@
+package messaging
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/vlado-github/tinydfs/persistance"
+)
+
+// ErrNoOwner is returned if no node stores the requested topic
+var ErrNoOwner = errors.New("No node owns the topic")
+
+// ErrNoQuorum is returned if less than a majority of the owners applied a write
+var ErrNoQuorum = errors.New("Write was not applied by a quorum of replicas")
+
+// IsUnavailable reports whether the error is caused by owners that
+// could not be reached, the request may succeed once they are back.
+func IsUnavailable(err error) bool {
+	return errors.Is(err, ErrNoQuorum) || errors.Is(err, ErrNoOwner) || errors.Is(err, ErrRpcClosed) ||
+		errors.Is(err, ErrConnectionRefused) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// Get reads value of the key from a node that owns the topic
+func (n *node) Get(ctx context.Context, topic string, key uuid.UUID) (string, error) {
+	storageTopic, owners := n.getOwners(ctx, topic, key)
+	query := persistance.Query{Key: key, Topic: storageTopic}
+	err := ErrNoOwner
+	for _, nodeID := range owners {
+		var result string
+		if nodeID == n.GetID().String() {
+			result, err = n.fileManager.Read(query)
+		} else {
+			err = n.Call(ctx, nodeID, RPC_READ, query, &result)
+		}
+		if err == nil {
+			return result, nil
+		}
+	}
+	return "", err
+}
+
+// Put writes value and headers of the key to the nodes that own the topic and
+// returns once a quorum of them stored it. The value of an existing key is replaced.
+func (n *node) Put(ctx context.Context, topic string, key uuid.UUID, text string, headers map[string]string) error {
+	if err := persistance.ValidateMessageTopic(topic); err != nil {
+		return err
+	}
+	storageTopic, owners := n.getOwners(ctx, topic, key)
+	if partitionKey := PartitionKeyFromContext(ctx); partitionKey != "" {
+		headers = maps.Clone(headers)
+		if headers == nil {
+			headers = make(map[string]string)
+		}
+		headers[PartitionKeyHeader] = partitionKey
+	}
+	// replicas keep the same timestamp, so they read as the same version
+	command := persistance.Command{Key: key, Topic: storageTopic, Text: text, Headers: headers, Timestamp: time.Now().UTC()}
+	return n.applyOnOwners(owners, func(nodeID string) error {
+		if nodeID == n.GetID().String() {
+			return n.fileManager.Put(command)
+		}
+		return n.Call(ctx, nodeID, RPC_PUT, command, nil)
+	})
+}
+
+// Applies the write on every owner, it succeeds once a majority of them applied it
+func (n *node) applyOnOwners(owners []string, apply func(nodeID string) error) error {
+	if len(owners) == 0 {
+		return ErrNoOwner
+	}
+	applied := 0
+	var err error
+	for _, nodeID := range owners {
+		if nodeErr := apply(nodeID); nodeErr != nil {
+			err = nodeErr
+		} else {
+			applied++
+		}
+	}
+	if applied < len(owners)/2+1 {
+		return fmt.Errorf("%w, %d of %d replicas: %v", ErrNoQuorum, applied, len(owners), err)
+	}
+	return nil
+}
+
+// Update changes value of the key on the nodes that own the topic
+// and returns once a quorum of them applied it.
+func (n *node) Update(ctx context.Context, topic string, key uuid.UUID, text string) error {
+	if err := persistance.ValidateMessageTopic(topic); err != nil {
+		return err
+	}
+	storageTopic, owners := n.getOwners(ctx, topic, key)
+	command := persistance.Command{Key: key, Topic: storageTopic, Text: text, Timestamp: time.Now().UTC()}
+	return n.applyOnOwners(owners, func(nodeID string) error {
+		if nodeID == n.GetID().String() {
+			return n.fileManager.Update(command)
+		}
+		return n.Call(ctx, nodeID, RPC_UPDATE, command, nil)
+	})
+}
+
+// Delete removes the key from the nodes that own the topic
+// and returns once a quorum of them applied it.
+func (n *node) Delete(ctx context.Context, topic string, key uuid.UUID) error {
+	storageTopic, owners := n.getOwners(ctx, topic, key)
+	command := persistance.Command{Key: key, Topic: storageTopic}
+	return n.applyOnOwners(owners, func(nodeID string) error {
+		if nodeID == n.GetID().String() {
+			return n.fileManager.Delete(command)
+		}
+		return n.Call(ctx, nodeID, RPC_DELETE, command, nil)
+	})
+}
+
+// Scan returns all records of the topic. Records of a partitioned
+// topic are collected from one replica of every partition.
+func (n *node) Scan(ctx context.Context, topic string) ([]persistance.Record, error) {
+	tp, ok := n.partitionMap.GetTopic(topic)
+	if !ok {
+		return n.scanFrom(ctx, topic, n.getAllOwners())
+	}
+	records := []persistance.Record{}
+	for p := range tp.Partitions {
+		partitionRecords, err := n.scanFrom(ctx, PartitionTopicName(topic, p), tp.Partitions[p])
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, partitionRecords...)
+	}
+	return records, nil
+}
+
+func (n *node) scanFrom(ctx context.Context, storageTopic string, owners []string) ([]persistance.Record, error) {
+	err := ErrNoOwner
+	for _, nodeID := range owners {
+		var records []persistance.Record
+		if nodeID == n.GetID().String() {
+			records, err = n.fileManager.Scan(storageTopic)
+		} else {
+			err = n.Call(ctx, nodeID, RPC_SCAN, storageTopic, &records)
+		}
+		if err == nil {
+			return records, nil
+		}
+	}
+	return nil, err
+}
+
+// Returns storage topic of the key and IDs of nodes that store it.
+// The partition is selected like on write, by the partition key of
+// the context or by the key. Local node is preferred, if it is one of the owners.
+func (n *node) getOwners(ctx context.Context, topic string, key uuid.UUID) (string, []string) {
+	tp, ok := n.partitionMap.GetTopic(topic)
+	if !ok {
+		return topic, n.getAllOwners()
+	}
+	partition := n.partitionMap.GetPartition(Message{Key: key, Topic: topic, PartitionKey: PartitionKeyFromContext(ctx)})
+	if partition < 0 {
+		return topic, []string{}
+	}
+	return PartitionTopicName(topic, partition), preferLocal(tp.Partitions[partition], n.GetID().String())
+}
+
+// All available nodes store topics that are not partitioned
+func (n *node) getAllOwners() []string {
+	owners := []string{n.GetID().String()}
+	for _, tuple := range n.networkRegistry.GetItems() {
+		if tuple.GetId() != n.GetID().String() && tuple.GetAvailableStatus() {
+			owners = append(owners, tuple.GetId())
+		}
+	}
+	return owners
+}
+
+func preferLocal(nodeIDs []string, localID string) []string {
+	result := make([]string, 0, len(nodeIDs))
+	for _, id := range nodeIDs {
+		if id == localID {
+			result = append([]string{id}, result...)
+		} else {
+			result = append(result, id)
+		}
+	}
+	return result
+}
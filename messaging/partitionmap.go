@@ -0,0 +1,323 @@
+package messaging
+
+import (
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/vlado-github/tinydfs/logging"
+	"github.com/vlado-github/tinydfs/persistance"
+)
+
+// PartitionMap keeps track of topics, their partitions
+// and nodes that store a replica of every partition.
+type PartitionMap interface {
+	ToByteArray() ([]byte, error)
+	FromByteArray(data []byte) error
+	ToString() (string, error)
+	AddTopic(spec TopicSpec, registry NetworkRegistry) (TopicPartitions, error)
+	GetTopic(topic string) (TopicPartitions, bool)
+	GetTopics() []TopicPartitions
+	GetPartition(message Message) int
+	IsReplica(topic string, partition int, nodeID string) bool
+	ReplaceNode(nodeID string, registry NetworkRegistry) int
+	MoveReplica(topic string, partition int, from string, to string) bool
+}
+
+// TopicSpec describes a topic that has to be created.
+type TopicSpec struct {
+	Topic      string `json:"Topic"`
+	Partitions int    `json:"Partitions"`
+	Replicas   int    `json:"Replicas"`
+}
+
+// TopicPartitions holds the placement of all topic partitions.
+// Partitions[i] is the list of node IDs that store partition i.
+type TopicPartitions struct {
+	Topic      string     `json:"Topic"`
+	Replicas   int        `json:"Replicas"`
+	Partitions [][]string `json:"Partitions"`
+}
+
+// partitionmap is safe for concurrent use, readers get copies
+// of the placement that later changes do not touch
+type partitionmap struct {
+	Topics map[string]TopicPartitions `json:"Topics"`
+	lock   sync.RWMutex
+}
+
+// NewPartitionMap creates a new instance of partition map
+func NewPartitionMap() PartitionMap {
+	return &partitionmap{
+		Topics: map[string]TopicPartitions{},
+	}
+}
+
+// PartitionTopicName returns name of the topic file that stores a partition
+func PartitionTopicName(topic string, partition int) string {
+	return topic + persistance.PartitionSeparator + strconv.Itoa(partition)
+}
+
+// ParsePartitionTopicName splits name of a partition file to the topic and partition
+func ParsePartitionTopicName(name string) (string, int, bool) {
+	i := strings.LastIndex(name, persistance.PartitionSeparator)
+	if i < 0 {
+		return name, 0, false
+	}
+	partition, err := strconv.Atoi(name[i+len(persistance.PartitionSeparator):])
+	if err != nil {
+		return name, 0, false
+	}
+	return name[:i], partition, true
+}
+
+// AddTopic places topic partitions on the available nodes of the registry.
+// Replicas of a partition are assigned round-robin, so every node
+// stores roughly the same number of partitions.
+func (pm *partitionmap) AddTopic(spec TopicSpec, registry NetworkRegistry) (TopicPartitions, error) {
+	if spec.Topic == "" || spec.Partitions <= 0 || spec.Replicas <= 0 {
+		return TopicPartitions{}, errors.New("Invalid topic specification")
+	}
+	if err := persistance.ValidateTopic(spec.Topic); err != nil {
+		return TopicPartitions{}, err
+	}
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+	if existing, ok := pm.Topics[spec.Topic]; ok {
+		return copyTopic(existing), nil
+	}
+	var nodeIDs []string
+	for _, tuple := range registry.GetItems() {
+		if tuple.GetAvailableStatus() && !tuple.GetLeavingStatus() {
+			nodeIDs = append(nodeIDs, tuple.GetId())
+		}
+	}
+	if len(nodeIDs) == 0 {
+		return TopicPartitions{}, errors.New("No available nodes for topic partitions")
+	}
+	sort.Strings(nodeIDs)
+	replicas := spec.Replicas
+	if replicas > len(nodeIDs) {
+		replicas = len(nodeIDs)
+	}
+	result := TopicPartitions{
+		Topic:      spec.Topic,
+		Replicas:   replicas,
+		Partitions: make([][]string, spec.Partitions),
+	}
+	for p := 0; p < spec.Partitions; p++ {
+		for r := 0; r < replicas; r++ {
+			result.Partitions[p] = append(result.Partitions[p], nodeIDs[(p+r)%len(nodeIDs)])
+		}
+	}
+	pm.Topics[spec.Topic] = result
+	return copyTopic(result), nil
+}
+
+func (pm *partitionmap) GetTopic(topic string) (TopicPartitions, bool) {
+	pm.lock.RLock()
+	defer pm.lock.RUnlock()
+	result, ok := pm.Topics[topic]
+	return copyTopic(result), ok
+}
+
+func (pm *partitionmap) GetTopics() []TopicPartitions {
+	pm.lock.RLock()
+	defer pm.lock.RUnlock()
+	return pm.sortedTopics()
+}
+
+// Returns copies of all topics sorted by name, the lock has to be held
+func (pm *partitionmap) sortedTopics() []TopicPartitions {
+	result := make([]TopicPartitions, 0, len(pm.Topics))
+	for _, topic := range pm.Topics {
+		result = append(result, copyTopic(topic))
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Topic < result[j].Topic
+	})
+	return result
+}
+
+// GetPartition returns partition of the message. Explicit partition
+// has precedence, otherwise partition key (or message key) is hashed.
+// Returns -1 if topic is not partitioned.
+func (pm *partitionmap) GetPartition(message Message) int {
+	pm.lock.RLock()
+	topic, ok := pm.Topics[message.Topic]
+	pm.lock.RUnlock()
+	if !ok || len(topic.Partitions) == 0 {
+		return -1
+	}
+	if message.Partition != nil {
+		if *message.Partition < 0 || *message.Partition >= len(topic.Partitions) {
+			return -1
+		}
+		return *message.Partition
+	}
+	key := message.PartitionKey
+	if key == "" {
+		key = message.Key.String()
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(len(topic.Partitions)))
+}
+
+func (pm *partitionmap) IsReplica(topic string, partition int, nodeID string) bool {
+	pm.lock.RLock()
+	defer pm.lock.RUnlock()
+	tp, ok := pm.Topics[topic]
+	if !ok || partition < 0 || partition >= len(tp.Partitions) {
+		return false
+	}
+	for _, id := range tp.Partitions[partition] {
+		if id == nodeID {
+			return true
+		}
+	}
+	return false
+}
+
+// ReplaceNode moves replicas of the node to available nodes that do not
+// store the partition yet, the node with the fewest replicas is chosen.
+// Replicas without a candidate stay on the node. Returns number of moved replicas.
+func (pm *partitionmap) ReplaceNode(nodeID string, registry NetworkRegistry) int {
+	load := make(map[string]int)
+	for _, tuple := range registry.GetItems() {
+		if tuple.GetAvailableStatus() && !tuple.GetLeavingStatus() && tuple.GetId() != nodeID {
+			load[tuple.GetId()] = 0
+		}
+	}
+	candidates := make([]string, 0, len(load))
+	for id := range load {
+		candidates = append(candidates, id)
+	}
+	sort.Strings(candidates)
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+	for _, tp := range pm.Topics {
+		for _, replicas := range tp.Partitions {
+			for _, id := range replicas {
+				if _, ok := load[id]; ok {
+					load[id]++
+				}
+			}
+		}
+	}
+	moved := 0
+	for _, topic := range pm.sortedTopics() {
+		changed := false
+		for _, replicas := range topic.Partitions {
+			for i, id := range replicas {
+				if id != nodeID {
+					continue
+				}
+				target := ""
+				for _, candidate := range candidates {
+					if !containsID(replicas, candidate) && (target == "" || load[candidate] < load[target]) {
+						target = candidate
+					}
+				}
+				if target != "" {
+					replicas[i] = target
+					load[target]++
+					moved++
+					changed = true
+				}
+			}
+		}
+		if changed {
+			pm.Topics[topic.Topic] = topic
+		}
+	}
+	return moved
+}
+
+// MoveReplica replaces the replica of a partition on one node by another node.
+// Returns false if the partition has no replica on the node or the target stores it already.
+func (pm *partitionmap) MoveReplica(topic string, partition int, from string, to string) bool {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+	tp, ok := pm.Topics[topic]
+	if !ok || partition < 0 || partition >= len(tp.Partitions) {
+		return false
+	}
+	if containsID(tp.Partitions[partition], to) {
+		return false
+	}
+	tp = copyTopic(tp)
+	replicas := tp.Partitions[partition]
+	for i, id := range replicas {
+		if id == from {
+			replicas[i] = to
+			pm.Topics[topic] = tp
+			return true
+		}
+	}
+	return false
+}
+
+// Copies placement of the topic, so changes of the map do not leak to readers
+func copyTopic(tp TopicPartitions) TopicPartitions {
+	if tp.Partitions == nil {
+		return tp
+	}
+	partitions := make([][]string, len(tp.Partitions))
+	for i, replicas := range tp.Partitions {
+		partitions[i] = append([]string(nil), replicas...)
+	}
+	tp.Partitions = partitions
+	return tp
+}
+
+func containsID(ids []string, id string) bool {
+	for _, item := range ids {
+		if item == id {
+			return true
+		}
+	}
+	return false
+}
+
+// ToByteArray converts to Json string
+func (pm *partitionmap) ToByteArray() ([]byte, error) {
+	pm.lock.RLock()
+	result, err := json.Marshal(pm.Topics)
+	pm.lock.RUnlock()
+	if err != nil {
+		logging.AddInfo("PartitionMap ToByteArray", err.Error())
+		return nil, err
+	}
+	return result, nil
+}
+
+// FromByteArray converts byte array to PartitionMap
+func (pm *partitionmap) FromByteArray(data []byte) error {
+	var topics map[string]TopicPartitions
+	err := json.Unmarshal(data, &topics)
+	if err != nil {
+		logging.AddError("PartitionMap FromByteArray ", err.Error())
+		return err
+	}
+	if topics == nil {
+		topics = map[string]TopicPartitions{}
+	}
+	pm.lock.Lock()
+	pm.Topics = topics
+	pm.lock.Unlock()
+	return nil
+}
+
+// ToString converts to string
+func (pm *partitionmap) ToString() (string, error) {
+	result, err := pm.ToByteArray()
+	if err != nil {
+		return "", err
+	}
+	return string(result), nil
+}
@@ -2,9 +2,57 @@ package messaging
 
 import (
 	"net"
+	"sync"
+	"sync/atomic"
 )
 
-// Pool is a register of all tcp/ip network connections.
+// Pool is a register of all tcp/ip network connections. It is safe for
+// concurrent use: updates copy the map, readers iterate over snapshots
+// that are never changed.
 type Pool struct {
-	conns map[string]net.Conn
+	conns atomic.Pointer[map[string]net.Conn]
+	lock  sync.Mutex
+}
+
+// NewPool creates an empty connection pool
+func NewPool() *Pool {
+	pool := &Pool{}
+	pool.conns.Store(&map[string]net.Conn{})
+	return pool
+}
+
+// Add registers the connection under the key
+func (p *Pool) Add(key string, conn net.Conn) {
+	p.update(func(conns map[string]net.Conn) {
+		conns[key] = conn
+	})
+}
+
+// Remove drops the connection of the key
+func (p *Pool) Remove(key string) {
+	p.update(func(conns map[string]net.Conn) {
+		delete(conns, key)
+	})
+}
+
+// Snapshot returns connections of the pool, the map must not be changed
+func (p *Pool) Snapshot() map[string]net.Conn {
+	return *p.conns.Load()
+}
+
+// Len returns number of connections
+func (p *Pool) Len() int {
+	return len(p.Snapshot())
+}
+
+func (p *Pool) update(change func(conns map[string]net.Conn)) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	current := p.Snapshot()
+	conns := make(map[string]net.Conn, len(current)+1)
+	for key, conn := range current {
+		conns[key] = conn
+	}
+	change(conns)
+	p.conns.Store(&conns)
 }
@@ -0,0 +1,568 @@
+package messaging
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/vlado-github/tinydfs/logging"
+	"github.com/vlado-github/tinydfs/persistance"
+)
+
+const (
+	RPC_REBALANCE_RANGE    string = "REBALANCE_RANGE"
+	RPC_REBALANCE_SYNC     string = "REBALANCE_SYNC"
+	RPC_REBALANCE_CHECKSUM string = "REBALANCE_CHECKSUM"
+)
+
+// States of a partition move
+const (
+	MOVE_PENDING string = "PENDING"
+	MOVE_COPYING string = "COPYING"
+	MOVE_SYNCING string = "SYNCING"
+)
+
+// RebalanceStateFile keeps unfinished moves in the data directory of every node.
+// The master replicates them to all nodes, so they resume after a restart or failover.
+const RebalanceStateFile = "__rebalance"
+
+// RebalanceConcurrency is how many partition moves run at once
+const RebalanceConcurrency = 2
+
+// RebalanceRate limits bytes per second copied by one partition move
+const RebalanceRate = 4 << 20
+
+// RebalanceRetries is how many times a failed move is started again
+const RebalanceRetries = 5
+
+// RebalanceTimeout limits a single attempt of a partition move
+const RebalanceTimeout = 30 * time.Minute
+
+// Failed moves are started again after this delay
+const rebalanceRetryInterval = 5 * time.Second
+
+var ErrReplicaNotFound = errors.New("Partition has no replica on the node")
+
+// Checksum of the empty prefix of a partition file
+var emptyChecksum = func() string {
+	sum := sha256.Sum256(nil)
+	return hex.EncodeToString(sum[:])
+}()
+
+// PartitionMove moves a replica of a partition from one node to another.
+// Data is copied from Source, which is From unless From left the cluster.
+type PartitionMove struct {
+	Topic     string
+	Partition int
+	From      string
+	To        string
+	Source    string
+	State     string
+	Offset    int64
+	Attempts  int
+	Created   time.Time
+	CopiedAt  time.Time `json:",omitzero"`
+	Error     string    `json:",omitempty"`
+}
+
+// RangeRequest asks the target of a move to copy the next range of a partition file
+type RangeRequest struct {
+	SourceID string
+	Topic    string
+	Offset   int64
+}
+
+// RangeProgress is the copied offset and the size of the source file
+type RangeProgress struct {
+	Offset int64
+	Size   int64
+}
+
+// ChecksumRequest asks for the checksum of the first Offset bytes of a partition file
+type ChecksumRequest struct {
+	Topic  string
+	Offset int64
+}
+
+// SyncRequest asks the new owner to apply records written during the copy,
+// Offset is the end of the range copied from the source
+type SyncRequest struct {
+	SourceID string
+	Topic    string
+	Offset   int64
+}
+
+type rebalancer struct {
+	n         *node
+	statePath string
+	view      NetworkRegistry
+	moves     []PartitionMove
+	running   map[string]bool
+	loaded    bool
+	lock      sync.Mutex
+	wake      chan struct{}
+}
+
+func newRebalancer(n *node, statePath string) *rebalancer {
+	return &rebalancer{
+		n:         n,
+		statePath: statePath,
+		view:      NewNetworkRegistry(),
+		running:   make(map[string]bool),
+		wake:      make(chan struct{}, 1),
+	}
+}
+
+// PlanRebalance computes replica moves between the old and new view of the
+// network registry. Replicas on nodes that are not active members anymore move
+// to the least loaded members, then joined nodes take replicas of the most
+// loaded members until every member stores roughly the same number of replicas.
+func PlanRebalance(topics []TopicPartitions, oldView NetworkRegistry, newView NetworkRegistry) []PartitionMove {
+	load := make(map[string]int)
+	for _, tuple := range newView.GetItems() {
+		if tuple.GetAvailableStatus() && !tuple.GetLeavingStatus() {
+			load[tuple.GetId()] = 0
+		}
+	}
+	if len(load) == 0 {
+		return nil
+	}
+	members := make([]string, 0, len(load))
+	for id := range load {
+		members = append(members, id)
+	}
+	sort.Strings(members)
+	placement := make(map[string][][]string)
+	for _, tp := range topics {
+		partitions := make([][]string, len(tp.Partitions))
+		for p, replicas := range tp.Partitions {
+			partitions[p] = append([]string{}, replicas...)
+			for _, id := range replicas {
+				if _, ok := load[id]; ok {
+					load[id]++
+				}
+			}
+		}
+		placement[tp.Topic] = partitions
+	}
+
+	now := time.Now().UTC()
+	moves := []PartitionMove{}
+	moved := make(map[string]bool)
+	move := func(topic string, partition int, from string, to string, source string) {
+		replicas := placement[topic][partition]
+		for i, id := range replicas {
+			if id == from {
+				replicas[i] = to
+			}
+		}
+		if _, ok := load[from]; ok {
+			load[from]--
+		}
+		load[to]++
+		moved[PartitionTopicName(topic, partition)] = true
+		moves = append(moves, PartitionMove{Topic: topic, Partition: partition, From: from, To: to, Source: source, State: MOVE_PENDING, Created: now})
+	}
+	leastLoaded := func(replicas []string) string {
+		target := ""
+		for _, id := range members {
+			if !containsID(replicas, id) && (target == "" || load[id] < load[target]) {
+				target = id
+			}
+		}
+		return target
+	}
+
+	for _, tp := range topics {
+		for p, replicas := range placement[tp.Topic] {
+			for _, id := range tp.Partitions[p] {
+				if _, ok := load[id]; ok {
+					continue
+				}
+				// node that left the registry can not serve its copy
+				source := id
+				if tuple, _ := newView.GetItemById(id); tuple == nil {
+					source = ""
+					for _, replica := range tp.Partitions[p] {
+						if _, ok := load[replica]; ok {
+							source = replica
+							break
+						}
+					}
+				}
+				target := leastLoaded(replicas)
+				if source == "" || target == "" {
+					logging.AddWarning("[Rebalancer] Replica can not be moved.", PartitionTopicName(tp.Topic, p), id)
+					continue
+				}
+				move(tp.Topic, p, id, target, source)
+			}
+		}
+	}
+
+	previous := make(map[string]bool)
+	for _, tuple := range oldView.GetItems() {
+		previous[tuple.GetId()] = true
+	}
+	for _, id := range members {
+		if previous[id] {
+			continue
+		}
+		// joined node takes replicas from the most loaded members
+		for {
+			donors := append([]string{}, members...)
+			sort.SliceStable(donors, func(i, j int) bool {
+				return load[donors[i]] > load[donors[j]]
+			})
+			found := false
+			for _, donor := range donors {
+				if load[donor]-load[id] <= 1 {
+					break
+				}
+				for _, tp := range topics {
+					for p, replicas := range placement[tp.Topic] {
+						if found || moved[PartitionTopicName(tp.Topic, p)] || !containsID(replicas, donor) || containsID(replicas, id) {
+							continue
+						}
+						move(tp.Topic, p, donor, id, donor)
+						found = true
+					}
+				}
+				if found {
+					break
+				}
+			}
+			if !found {
+				break
+			}
+		}
+	}
+	return moves
+}
+
+// Plans moves for the change of the network registry of the master queue
+func (r *rebalancer) onNetworkChanged(queue MessageQueue) {
+	if !r.n.isMaster() {
+		return
+	}
+	view := queue.GetNetworkRegistry()
+	r.lock.Lock()
+	previous := r.view
+	r.view = view
+	r.lock.Unlock()
+	r.add(PlanRebalance(queue.GetPartitionMap().GetTopics(), previous, view))
+}
+
+// Schedules moves, partitions with an unfinished move are skipped
+func (r *rebalancer) add(moves []PartitionMove) {
+	if len(moves) == 0 {
+		return
+	}
+	r.lock.Lock()
+	added := 0
+	for _, move := range moves {
+		if r.indexOf(move.Topic, move.Partition) >= 0 {
+			continue
+		}
+		r.moves = append(r.moves, move)
+		added++
+	}
+	r.save()
+	r.lock.Unlock()
+	logging.AddInfo("[Rebalancer] Scheduled", added, "partition moves.")
+	r.notify()
+}
+
+// Starts moves of the master until all of them are finished
+func (r *rebalancer) run() {
+	ticker := time.NewTicker(rebalanceRetryInterval)
+	defer ticker.Stop()
+	for {
+		if r.n.isMaster() {
+			r.schedule()
+		}
+		select {
+		case <-r.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+func (r *rebalancer) notify() {
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (r *rebalancer) schedule() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if !r.loaded {
+		r.load()
+		r.loaded = true
+	}
+	for _, move := range r.moves {
+		if len(r.running) >= RebalanceConcurrency {
+			return
+		}
+		storageTopic := PartitionTopicName(move.Topic, move.Partition)
+		if r.running[storageTopic] {
+			continue
+		}
+		r.running[storageTopic] = true
+		go r.runMove(move)
+	}
+}
+
+func (r *rebalancer) runMove(move PartitionMove) {
+	err := r.movePartition(&move)
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.running, PartitionTopicName(move.Topic, move.Partition))
+	i := r.indexOf(move.Topic, move.Partition)
+	if i < 0 {
+		return
+	}
+	storageTopic := PartitionTopicName(move.Topic, move.Partition)
+	if err == nil {
+		logging.AddInfo("[Rebalancer] Partition moved.", storageTopic, move.From, move.To)
+		r.moves = append(r.moves[:i], r.moves[i+1:]...)
+	} else if move.Attempts >= RebalanceRetries {
+		logging.AddError("[Rebalancer] Partition not moved.", storageTopic, move.To, err.Error())
+		r.moves = append(r.moves[:i], r.moves[i+1:]...)
+	} else {
+		logging.AddWarning("[Rebalancer] Partition move failed.", storageTopic, move.To, err.Error())
+		move.Attempts++
+		move.Error = err.Error()
+		r.moves[i] = move
+	}
+	r.save()
+	if err == nil {
+		r.notify()
+	}
+}
+
+// Copies the partition file to the new owner in throttled ranges. Once the
+// copy reaches the end of the source file the new owner applies records
+// written during the copy, placement is switched after it acknowledged them.
+// Until then reads are served by the old owners.
+func (r *rebalancer) movePartition(move *PartitionMove) error {
+	ctx, cancel := context.WithTimeout(context.Background(), RebalanceTimeout)
+	defer cancel()
+	if tuple, _ := r.n.queue.GetNetworkRegistry().GetItemById(move.To); tuple == nil {
+		return ErrNodeNotFound
+	}
+	storageTopic := PartitionTopicName(move.Topic, move.Partition)
+	for move.State != MOVE_SYNCING {
+		request := RangeRequest{SourceID: move.Source, Topic: storageTopic, Offset: move.Offset}
+		var progress RangeProgress
+		err := r.n.Call(ctx, move.To, RPC_REBALANCE_RANGE, request, &progress)
+		if err != nil {
+			return err
+		}
+		copied := progress.Offset - move.Offset
+		move.Offset = progress.Offset
+		move.State = MOVE_COPYING
+		if progress.Offset >= progress.Size {
+			move.State = MOVE_SYNCING
+			move.CopiedAt = time.Now().UTC()
+		}
+		r.update(*move)
+		if err := throttle(ctx, copied); err != nil {
+			return err
+		}
+	}
+	if err := r.verifyCopy(ctx, move); err != nil {
+		// the copy starts over with the next attempt
+		move.State = MOVE_PENDING
+		move.Offset = 0
+		r.update(*move)
+		return err
+	}
+	if r.n.queue.GetPartitionMap().IsReplica(move.Topic, move.Partition, move.To) {
+		// placement was switched by an earlier attempt after the sync
+		return nil
+	}
+	request := SyncRequest{SourceID: move.Source, Topic: storageTopic, Offset: move.Offset}
+	var applied int
+	if err := r.n.Call(ctx, move.To, RPC_REBALANCE_SYNC, request, &applied); err != nil {
+		return err
+	}
+	return r.n.queue.MoveReplica(move.Topic, move.Partition, move.From, move.To)
+}
+
+// Compares the copied range of the new owner with the same range of the source
+func (r *rebalancer) verifyCopy(ctx context.Context, move *PartitionMove) error {
+	request := ChecksumRequest{Topic: PartitionTopicName(move.Topic, move.Partition), Offset: move.Offset}
+	var source, copied string
+	if err := r.n.Call(ctx, move.Source, RPC_REBALANCE_CHECKSUM, request, &source); err != nil {
+		return err
+	}
+	if err := r.n.Call(ctx, move.To, RPC_REBALANCE_CHECKSUM, request, &copied); err != nil {
+		return err
+	}
+	if source != copied {
+		return ErrChunkChecksum
+	}
+	return nil
+}
+
+// Waits as long as copying the bytes takes at RebalanceRate
+func throttle(ctx context.Context, bytes int64) error {
+	if bytes <= 0 {
+		return nil
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(time.Duration(bytes) * time.Second / RebalanceRate):
+		return nil
+	}
+}
+
+// Records progress of a running move
+func (r *rebalancer) update(move PartitionMove) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if i := r.indexOf(move.Topic, move.Partition); i >= 0 {
+		r.moves[i] = move
+		r.save()
+	}
+}
+
+func (r *rebalancer) indexOf(topic string, partition int) int {
+	for i, move := range r.moves {
+		if move.Topic == topic && move.Partition == partition {
+			return i
+		}
+	}
+	return -1
+}
+
+// Writes unfinished moves to the state file and replicates them
+// from the master to the other nodes, callers hold the lock
+func (r *rebalancer) save() {
+	payload, err := json.Marshal(r.moves)
+	if err != nil {
+		logging.AddError("[Rebalancer] Json serialization failed.", err.Error())
+		return
+	}
+	r.persist(payload)
+	if r.n.isMaster() {
+		r.n.queue.Broadcast(REBALANCE_CHANGED, payload)
+	}
+}
+
+// Keeps moves replicated by the master, so the node resumes them if it becomes the master
+func (r *rebalancer) onStateChanged(message Message) {
+	if r.n.isMaster() {
+		return
+	}
+	var moves []PartitionMove
+	if err := json.Unmarshal(message.Payload, &moves); err != nil {
+		logging.AddError("OnRebalanceChanged invalid message format.", err.Error())
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.moves = moves
+	r.loaded = true
+	r.persist(message.Payload)
+}
+
+// Replaces the state file, callers hold the lock
+func (r *rebalancer) persist(payload []byte) {
+	tmpPath := r.statePath + ".tmp"
+	err := os.WriteFile(tmpPath, payload, 0660)
+	if err == nil {
+		err = os.Rename(tmpPath, r.statePath)
+	}
+	if err != nil {
+		logging.AddError("[Rebalancer] State not saved.", err.Error())
+	}
+}
+
+// Reads moves left by a previous master, callers hold the lock
+func (r *rebalancer) load() {
+	payload, err := os.ReadFile(r.statePath)
+	if err != nil {
+		return
+	}
+	var moves []PartitionMove
+	err = json.Unmarshal(payload, &moves)
+	if err != nil {
+		logging.AddError("[Rebalancer] Invalid state file.", err.Error())
+		return
+	}
+	for _, move := range moves {
+		if r.indexOf(move.Topic, move.Partition) < 0 {
+			r.moves = append(r.moves, move)
+		}
+	}
+	logging.AddInfo("[Rebalancer] Resuming", len(moves), "partition moves.")
+}
+
+// Registers remote calls used by the new owner of a moved partition
+func (n *node) registerRebalanceHandlers() {
+	n.RegisterRpcHandler(RPC_REBALANCE_RANGE, NewRpcHandler(func(ctx context.Context, request RangeRequest) (RangeProgress, error) {
+		return n.copyRange(ctx, request)
+	}))
+	n.RegisterRpcHandler(RPC_REBALANCE_SYNC, NewRpcHandler(func(ctx context.Context, request SyncRequest) (int, error) {
+		return n.syncPartition(ctx, request)
+	}))
+	n.RegisterRpcHandler(RPC_REBALANCE_CHECKSUM, NewRpcHandler(func(ctx context.Context, request ChecksumRequest) (string, error) {
+		checksum, err := n.fileManager.PrefixChecksum(request.Topic, request.Offset)
+		if errors.Is(err, fs.ErrNotExist) && request.Offset == 0 {
+			// partition without records is copied as an empty file
+			return emptyChecksum, nil
+		}
+		return checksum, err
+	}))
+}
+
+// Copies the next range of the partition file from the source. If the
+// local file is shorter than the offset the copy starts over.
+func (n *node) copyRange(ctx context.Context, request RangeRequest) (RangeProgress, error) {
+	offset := request.Offset
+	if _, size, err := n.fileManager.ReadRange(request.Topic, 0, 0); err != nil || size < offset {
+		offset = 0
+	}
+	chunk, err := n.copyChunk(ctx, request.SourceID, request.Topic, offset)
+	if err != nil {
+		return RangeProgress{}, err
+	}
+	return RangeProgress{Offset: offset + int64(len(chunk.Data)), Size: chunk.Size}, nil
+}
+
+// Applies records the source received after the copy and fetches their blobs
+func (n *node) syncPartition(ctx context.Context, request SyncRequest) (int, error) {
+	var topics []string
+	err := n.Call(ctx, request.SourceID, RPC_TOPICS, struct{}{}, &topics)
+	if err != nil || !containsID(topics, request.Topic) {
+		return 0, err
+	}
+	var remote []persistance.Record
+	err = n.Call(ctx, request.SourceID, RPC_SCAN, request.Topic, &remote)
+	if err != nil {
+		return 0, err
+	}
+	// the source owns the partition until the move, its deletes are applied
+	applied, err := n.mergeRecords(request.Topic, [][]persistance.Record{remote}, request.Offset, 1)
+	if err != nil {
+		return applied, err
+	}
+	err = n.transferBlobs(ctx, topicSource{nodeID: request.SourceID, topic: persistance.TopicSnapshot{Topic: request.Topic}})
+	if err != nil {
+		return applied, err
+	}
+	logging.AddInfo("[Rebalancer] Partition synced.", request.Topic, applied, "changes")
+	return applied, n.fileManager.RebuildBlobRefs()
+}
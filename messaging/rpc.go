@@ -0,0 +1,316 @@
+package messaging
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/vlado-github/tinydfs/logging"
+	"github.com/vlado-github/tinydfs/persistance"
+)
+
+const (
+	RPC_READ        string = "READ"
+	RPC_READ_RECORD string = "READ_RECORD"
+	RPC_UPDATE      string = "UPDATE"
+	RPC_PUT         string = "PUT"
+	RPC_DELETE      string = "DELETE"
+	RPC_SCAN        string = "SCAN"
+	RPC_STATUS      string = "STATUS"
+	RPC_TOPICS      string = "TOPICS"
+)
+
+// DefaultRpcTimeout is used for calls whose context has no deadline
+const DefaultRpcTimeout = 5 * time.Second
+
+// ErrRpcClosed is returned for calls pending on a closed connection
+var ErrRpcClosed = errors.New("RPC connection is closed")
+
+// ErrRpcMethodNotFound is returned if peer has no handler for a method
+var ErrRpcMethodNotFound = errors.New("RPC method not found")
+
+// RpcHandlerFunc handles a request body and returns a response body.
+type RpcHandlerFunc func(ctx context.Context, body []byte) ([]byte, error)
+
+// RpcError is an error returned by the remote handler.
+type RpcError struct {
+	Method  string
+	Message string
+}
+
+func (e *RpcError) Error() string {
+	return "RPC " + e.Method + ": " + e.Message
+}
+
+// Errors that errors.Is still matches after they are returned by a remote handler
+var remoteErrors = []error{persistance.ErrNotFound, ErrNoQuorum, ErrNoOwner}
+
+// Unwrap returns the known error the remote message starts with
+func (e *RpcError) Unwrap() error {
+	for _, err := range remoteErrors {
+		if strings.HasPrefix(e.Message, err.Error()) {
+			return err
+		}
+	}
+	return nil
+}
+
+// RpcClient sends requests over a connection and waits for
+// responses matched by correlation ID.
+type RpcClient interface {
+	Call(ctx context.Context, method string, request interface{}, response interface{}) error
+	Close() error
+}
+
+// rpcEnvelope is a payload of RPC_REQUEST, RPC_RESPONSE and RPC_CANCEL messages
+type rpcEnvelope struct {
+	CorrelationID uuid.UUID
+	Method        string
+	Body          json.RawMessage `json:",omitempty"`
+	Error         string          `json:",omitempty"`
+	TimeoutMs     int64           `json:",omitempty"`
+}
+
+type rpcclient struct {
+	conn    net.Conn
+	encoder *json.Encoder
+	lock    sync.Mutex
+	pending map[uuid.UUID]chan rpcEnvelope
+	closed  bool
+}
+
+// NewRpcHandler adapts a typed function to RpcHandlerFunc
+func NewRpcHandler[Req any, Resp any](fn func(ctx context.Context, request Req) (Resp, error)) RpcHandlerFunc {
+	return func(ctx context.Context, body []byte) ([]byte, error) {
+		var request Req
+		if len(body) > 0 {
+			err := json.Unmarshal(body, &request)
+			if err != nil {
+				return nil, err
+			}
+		}
+		response, err := fn(ctx, request)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(response)
+	}
+}
+
+// DialRpc connects to the exchange queue of a node
+func DialRpc(conn ConnParams) (RpcClient, error) {
+	c, err := Dial(context.Background(), conn)
+	if err != nil {
+		logging.AddError("[Rpc] Error dialing: ", conn.Ip, conn.Port, err.Error())
+		return nil, err
+	}
+	return NewRpcClient(c), nil
+}
+
+// NewRpcClient creates RPC client on top of an open connection
+func NewRpcClient(conn net.Conn) RpcClient {
+	client := &rpcclient{
+		conn:    conn,
+		encoder: json.NewEncoder(conn),
+		pending: make(map[uuid.UUID]chan rpcEnvelope),
+	}
+	go client.receiveResponses()
+	return client
+}
+
+// Call sends request to the remote handler and decodes the
+// response. Call is cancelled when the context is done.
+func (c *rpcclient) Call(ctx context.Context, method string, request interface{}, response interface{}) error {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DefaultRpcTimeout)
+		defer cancel()
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	deadline, _ := ctx.Deadline()
+	envelope := rpcEnvelope{
+		CorrelationID: uuid.New(),
+		Method:        method,
+		Body:          body,
+		TimeoutMs:     time.Until(deadline).Milliseconds(),
+	}
+	reply := make(chan rpcEnvelope, 1)
+
+	c.lock.Lock()
+	if c.closed {
+		c.lock.Unlock()
+		return ErrRpcClosed
+	}
+	c.pending[envelope.CorrelationID] = reply
+	c.lock.Unlock()
+
+	err = c.send(RPC_REQUEST, envelope)
+	if err != nil {
+		c.forget(envelope.CorrelationID)
+		return err
+	}
+
+	select {
+	case result, ok := <-reply:
+		if !ok {
+			return ErrRpcClosed
+		}
+		if result.Error != "" {
+			if result.Error == ErrRpcMethodNotFound.Error() {
+				return ErrRpcMethodNotFound
+			}
+			// the handler shares the deadline of the call and may time out first
+			if result.Error == context.DeadlineExceeded.Error() {
+				return context.DeadlineExceeded
+			}
+			return &RpcError{Method: method, Message: result.Error}
+		}
+		if response != nil && len(result.Body) > 0 {
+			return json.Unmarshal(result.Body, response)
+		}
+		return nil
+	case <-ctx.Done():
+		c.forget(envelope.CorrelationID)
+		c.send(RPC_CANCEL, rpcEnvelope{CorrelationID: envelope.CorrelationID, Method: method})
+		return ctx.Err()
+	}
+}
+
+// Closes the connection and fails all pending calls
+func (c *rpcclient) Close() error {
+	return c.conn.Close()
+}
+
+func (c *rpcclient) send(topic string, envelope rpcEnvelope) error {
+	payload, err := json.Marshal(envelope)
+	if err != nil {
+		return err
+	}
+	message := Message{Key: uuid.New(), Topic: topic, Payload: payload}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return encodeMessage(&message, c.encoder)
+}
+
+func (c *rpcclient) forget(id uuid.UUID) {
+	c.lock.Lock()
+	delete(c.pending, id)
+	c.lock.Unlock()
+}
+
+// Dispatches responses to waiting calls, other messages are ignored
+func (c *rpcclient) receiveResponses() {
+	decoder := json.NewDecoder(c.conn)
+	for {
+		var message Message
+		err := decoder.Decode(&message)
+		if err != nil {
+			break
+		}
+		if message.Topic != RPC_RESPONSE {
+			continue
+		}
+		var envelope rpcEnvelope
+		if json.Unmarshal(message.Payload, &envelope) != nil {
+			logging.AddError("[Rpc] Response has invalid format.")
+			continue
+		}
+		c.lock.Lock()
+		reply, ok := c.pending[envelope.CorrelationID]
+		delete(c.pending, envelope.CorrelationID)
+		c.lock.Unlock()
+		if ok {
+			reply <- envelope
+		}
+	}
+
+	c.lock.Lock()
+	c.closed = true
+	for id, reply := range c.pending {
+		close(reply)
+		delete(c.pending, id)
+	}
+	c.lock.Unlock()
+	c.conn.Close()
+}
+
+// rpcserver dispatches RPC requests to registered handlers
+type rpcserver struct {
+	lock     sync.Mutex
+	handlers map[string]RpcHandlerFunc
+	inflight map[uuid.UUID]context.CancelFunc
+}
+
+func newRpcServer() *rpcserver {
+	return &rpcserver{
+		handlers: make(map[string]RpcHandlerFunc),
+		inflight: make(map[uuid.UUID]context.CancelFunc),
+	}
+}
+
+func (s *rpcserver) register(method string, handler RpcHandlerFunc) {
+	s.lock.Lock()
+	s.handlers[method] = handler
+	s.lock.Unlock()
+}
+
+// Runs the handler of a request and returns a response message
+func (s *rpcserver) handle(message Message) Message {
+	var request rpcEnvelope
+	err := json.Unmarshal(message.Payload, &request)
+	if err != nil {
+		logging.AddError("[Rpc] Request has invalid format.", err.Error())
+	}
+	response := rpcEnvelope{CorrelationID: request.CorrelationID, Method: request.Method}
+
+	s.lock.Lock()
+	handler, ok := s.handlers[request.Method]
+	timeout := DefaultRpcTimeout
+	if request.TimeoutMs > 0 {
+		timeout = time.Duration(request.TimeoutMs) * time.Millisecond
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	s.inflight[request.CorrelationID] = cancel
+	s.lock.Unlock()
+
+	if !ok {
+		response.Error = ErrRpcMethodNotFound.Error()
+	} else {
+		body, err := handler(ctx, request.Body)
+		if err != nil {
+			response.Error = err.Error()
+		} else {
+			response.Body = body
+		}
+	}
+
+	s.lock.Lock()
+	delete(s.inflight, request.CorrelationID)
+	s.lock.Unlock()
+	cancel()
+
+	payload, _ := json.Marshal(response)
+	return Message{Key: uuid.New(), Topic: RPC_RESPONSE, Payload: payload}
+}
+
+// Cancels context of the request in flight
+func (s *rpcserver) cancel(message Message) {
+	var request rpcEnvelope
+	if json.Unmarshal(message.Payload, &request) != nil {
+		return
+	}
+	s.lock.Lock()
+	cancel, ok := s.inflight[request.CorrelationID]
+	s.lock.Unlock()
+	if ok {
+		cancel()
+	}
+}
@@ -0,0 +1,108 @@
+package messaging
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/vlado-github/tinydfs/logging"
+	"github.com/vlado-github/tinydfs/persistance"
+)
+
+// ScrubInterval is how often the node verifies all stored records
+const ScrubInterval = 10 * time.Minute
+
+// ScrubTimeout limits a single pass of the scrubber
+const ScrubTimeout = 5 * time.Minute
+
+// ErrNoHealthyReplica is returned if a corrupted record can not be re-fetched
+var ErrNoHealthyReplica = errors.New("No healthy replica of the record")
+
+// ScrubReport summarizes a pass of the scrubber
+type ScrubReport struct {
+	Topics    int
+	Corrupted []persistance.CorruptRecordError
+	Repaired  int
+}
+
+// Scrub verifies checksums of all records stored by the node.
+// Corrupted records are re-fetched from other replicas of the topic.
+func (n *node) Scrub(ctx context.Context) ScrubReport {
+	report := ScrubReport{Corrupted: []persistance.CorruptRecordError{}}
+	topics, err := n.fileManager.Topics()
+	if err != nil {
+		logging.AddError("[Scrubber] Can not list topics.", err.Error())
+		return report
+	}
+	for _, topic := range topics {
+		corrupted, err := n.fileManager.Verify(topic)
+		if err != nil {
+			logging.AddError("[Scrubber] Can not verify topic.", topic, err.Error())
+			continue
+		}
+		report.Topics++
+		for _, record := range corrupted {
+			logging.AddError("[Scrubber]", record.Error())
+			report.Corrupted = append(report.Corrupted, record)
+			err := n.repairRecord(ctx, record)
+			if err != nil {
+				logging.AddError("[Scrubber] Record not repaired.", record.Key.String(), err.Error())
+				continue
+			}
+			logging.AddInfo("[Scrubber] Record repaired.", record.Topic, record.Key.String())
+			report.Repaired++
+		}
+	}
+	return report
+}
+
+// Periodically scrubs the storage of the node
+func (n *node) runScrubber() {
+	ticker := time.NewTicker(ScrubInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		ctx, cancel := context.WithTimeout(context.Background(), ScrubTimeout)
+		n.Scrub(ctx)
+		cancel()
+	}
+}
+
+// Replaces the corrupted record by the copy of another replica,
+// the copy keeps the timestamp and headers of the replica
+func (n *node) repairRecord(ctx context.Context, record persistance.CorruptRecordError) error {
+	if record.Key == uuid.Nil {
+		return ErrNoHealthyReplica
+	}
+	query := persistance.Query{Key: record.Key, Topic: record.Topic}
+	for _, nodeID := range n.getReplicas(record.Topic) {
+		if nodeID == n.GetID().String() {
+			continue
+		}
+		var replica persistance.Record
+		err := n.Call(ctx, nodeID, RPC_READ_RECORD, query, &replica)
+		if err == nil {
+			return n.fileManager.Update(persistance.Command{
+				Key:       record.Key,
+				Topic:     record.Topic,
+				Text:      replica.Text,
+				Headers:   replica.Headers,
+				Timestamp: replica.Timestamp,
+			})
+		}
+	}
+	return ErrNoHealthyReplica
+}
+
+// Returns IDs of nodes that store the storage topic
+func (n *node) getReplicas(storageTopic string) []string {
+	topic, partition, ok := ParsePartitionTopicName(storageTopic)
+	if !ok {
+		return n.getAllOwners()
+	}
+	tp, ok := n.partitionMap.GetTopic(topic)
+	if !ok || partition >= len(tp.Partitions) {
+		return []string{}
+	}
+	return tp.Partitions[partition]
+}
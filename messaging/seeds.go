@@ -0,0 +1,109 @@
+package messaging
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/vlado-github/tinydfs/logging"
+)
+
+const RPC_SEED string = "SEED"
+
+// MaxNumberOfSeedAttempts is how many times the whole seed list is tried
+const MaxNumberOfSeedAttempts = 5
+
+// SeedRetryInterval is the first backoff between rounds of seeds,
+// it doubles with every round up to MaxSeedRetryInterval
+const SeedRetryInterval = 250 * time.Millisecond
+
+const MaxSeedRetryInterval = 5 * time.Second
+
+var ErrNoSeedAnswered = errors.New("No seed of the cluster answered")
+var ErrNotJoined = errors.New("Node has not joined a cluster yet")
+
+// SeedInfo tells a joining node where the broadcast queue runs
+type SeedInfo struct {
+	Queue    ConnParams
+	IsMaster bool
+	Registry []byte
+}
+
+func (n *node) registerSeedHandlers() {
+	n.RegisterRpcHandler(RPC_SEED, NewRpcHandler(func(ctx context.Context, _ struct{}) (SeedInfo, error) {
+		queue := n.getBroadcastQueue()
+		if queue == (ConnParams{}) {
+			return SeedInfo{}, ErrNotJoined
+		}
+		registry, err := n.networkRegistry.ToByteArray()
+		return SeedInfo{Queue: queue, IsMaster: n.isMaster(), Registry: registry}, err
+	}))
+}
+
+// Tries seeds in order until one of them tells where the broadcast queue runs.
+// When no seed answers a new single-node cluster is started only if
+// the node was created to bootstrap it.
+func (n *node) joinCluster() error {
+	for attempt := 0; attempt < MaxNumberOfSeedAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(seedBackoff(attempt))
+		}
+		for _, seed := range n.seeds {
+			if n.joinThrough(seed) == nil {
+				return nil
+			}
+		}
+	}
+	if !n.bootstrapCluster {
+		return ErrNoSeedAnswered
+	}
+	logging.AddWarning("[Node] No seed answered, bootstrapping a new cluster.")
+	n.setBroadcastQueue(n.exchangeQueueConnParams)
+	return nil
+}
+
+// Learns the broadcast queue and the network registry from the seed
+func (n *node) joinThrough(seed ConnParams) error {
+	info, err := askSeed(seed)
+	if err != nil {
+		logging.AddWarning("[Node] Seed did not answer.", seed.Ip, seed.Port, err.Error())
+		return err
+	}
+	// a node restarted with a newer registry keeps it, the queue continues after its epoch
+	if err := n.networkRegistry.FromByteArray(info.Registry); err != nil {
+		logging.AddWarning("[Node] Network registry of the seed ignored.", err.Error())
+	}
+	queue := info.Queue
+	if info.IsMaster {
+		// the seed may know itself only by a local address
+		queue = seed
+	}
+	n.setBroadcastQueue(queue)
+	logging.AddInfo("[Node] Joined cluster through seed.", seed.Ip, seed.Port)
+	return nil
+}
+
+// Asks the seed for the broadcast queue and the network registry
+func askSeed(seed ConnParams) (SeedInfo, error) {
+	var info SeedInfo
+	client, err := DialRpc(seed)
+	if err != nil {
+		return info, err
+	}
+	defer client.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultRpcTimeout)
+	defer cancel()
+	err = client.Call(ctx, RPC_SEED, struct{}{}, &info)
+	return info, err
+}
+
+// Half of the backoff is random, so nodes started together
+// do not retry at the same time
+func seedBackoff(attempt int) time.Duration {
+	backoff := SeedRetryInterval << (attempt - 1)
+	if backoff > MaxSeedRetryInterval {
+		backoff = MaxSeedRetryInterval
+	}
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
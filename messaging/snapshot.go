@@ -0,0 +1,191 @@
+package messaging
+
+import (
+	"context"
+	"os"
+
+	"github.com/google/uuid"
+	"github.com/vlado-github/tinydfs/logging"
+	"github.com/vlado-github/tinydfs/persistance"
+)
+
+// Snapshot writes a point-in-time copy of the node storage to the tarball
+func (n *node) Snapshot(dest string) (persistance.SnapshotManifest, error) {
+	tmpPath := dest + ".tmp"
+	fileHandle, err := os.Create(tmpPath)
+	if err != nil {
+		logging.AddError("[Node] Can not create a snapshot.", err.Error())
+		return persistance.SnapshotManifest{}, err
+	}
+	manifest, err := n.fileManager.Snapshot(fileHandle)
+	if closeErr := fileHandle.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return manifest, err
+	}
+	logging.AddInfo("[Node] Snapshot created.", dest, len(manifest.Topics), "topics")
+	return manifest, os.Rename(tmpPath, dest)
+}
+
+// Restore rebuilds the node storage from the snapshot and catches up
+// with records written by peers after the snapshot was created
+func (n *node) Restore(ctx context.Context, src string) (persistance.SnapshotManifest, error) {
+	fileHandle, err := os.Open(src)
+	if err != nil {
+		logging.AddError("[Node] Can not open a snapshot.", err.Error())
+		return persistance.SnapshotManifest{}, err
+	}
+	defer fileHandle.Close()
+	manifest, err := n.fileManager.Restore(fileHandle)
+	if err != nil {
+		return manifest, err
+	}
+	n.catchUp(ctx, manifest)
+	return manifest, nil
+}
+
+// Copies changes from peers to topics stored by the node
+func (n *node) catchUp(ctx context.Context, manifest persistance.SnapshotManifest) {
+	// offsets covered by the snapshot, topics created after it cover nothing
+	topics := make(map[string]int64)
+	for _, topic := range manifest.Topics {
+		topics[topic.Topic] = topic.Offset
+	}
+	for _, nodeID := range n.getAllOwners() {
+		if nodeID == n.GetID().String() {
+			continue
+		}
+		var remoteTopics []string
+		if err := n.Call(ctx, nodeID, RPC_TOPICS, struct{}{}, &remoteTopics); err == nil {
+			for _, topic := range remoteTopics {
+				if _, ok := topics[topic]; !ok {
+					topics[topic] = 0
+				}
+			}
+		}
+	}
+	for topic, covered := range topics {
+		if !n.storesTopic(topic) {
+			continue
+		}
+		err := n.catchUpTopic(ctx, topic, covered)
+		if err != nil {
+			logging.AddWarning("[Node] Topic not caught up.", topic, err.Error())
+		}
+	}
+}
+
+// Applies records of the other replicas to the local records restored
+// from the snapshot, i.e. stored before the covered offset. Keys missing
+// on all replicas are deleted only if a quorum of them answered.
+func (n *node) catchUpTopic(ctx context.Context, topic string, covered int64) error {
+	others := 0
+	answers := [][]persistance.Record{}
+	err := ErrNoOwner
+	for _, nodeID := range n.getReplicas(topic) {
+		if nodeID == n.GetID().String() {
+			continue
+		}
+		others++
+		var remote []persistance.Record
+		if callErr := n.Call(ctx, nodeID, RPC_SCAN, topic, &remote); callErr != nil {
+			err = callErr
+			continue
+		}
+		answers = append(answers, remote)
+	}
+	if len(answers) == 0 {
+		return err
+	}
+	applied, err := n.mergeRecords(topic, answers, covered, others/2+1)
+	if err != nil {
+		return err
+	}
+	logging.AddInfo("[Node] Topic caught up.", topic, applied, "changes")
+	return nil
+}
+
+// Applies records of the replicas to the local topic. Local records before
+// the covered offset come from the snapshot: they are replaced by the latest
+// remote version, or deleted if the key is missing on every replica and at
+// least deleteQuorum replicas answered. Records written locally after the
+// restore are kept.
+func (n *node) mergeRecords(topic string, replicas [][]persistance.Record, covered int64, deleteQuorum int) (int, error) {
+	local := make(map[uuid.UUID]persistance.Record)
+	if records, err := n.fileManager.Scan(topic); err == nil {
+		for _, record := range records {
+			local[record.Key] = record
+		}
+	}
+	keys := []uuid.UUID{}
+	latest := make(map[uuid.UUID]persistance.Record)
+	for _, records := range replicas {
+		for _, record := range records {
+			current, ok := latest[record.Key]
+			if !ok {
+				keys = append(keys, record.Key)
+			}
+			if !ok || record.Timestamp.After(current.Timestamp) {
+				latest[record.Key] = record
+			}
+		}
+	}
+	applied := 0
+	var err error
+	for _, key := range keys {
+		record := latest[key]
+		command := persistance.Command{Key: record.Key, Topic: topic, Text: record.Text, Headers: record.Headers, Timestamp: record.Timestamp}
+		current, ok := local[record.Key]
+		delete(local, record.Key)
+		if !ok {
+			err = n.fileManager.Write(command)
+		} else if current.Offset < covered && !sameRecord(current, record) {
+			err = n.fileManager.Update(command)
+		} else {
+			continue
+		}
+		if err != nil {
+			return applied, err
+		}
+		applied++
+	}
+	if len(replicas) < deleteQuorum {
+		return applied, nil
+	}
+	for key, record := range local {
+		if record.Offset >= covered {
+			continue
+		}
+		err = n.fileManager.Delete(persistance.Command{Key: key, Topic: topic})
+		if err != nil {
+			return applied, err
+		}
+		applied++
+	}
+	return applied, nil
+}
+
+// Replicas store the same write with their own timestamps,
+// records are compared by value and headers
+func sameRecord(a persistance.Record, b persistance.Record) bool {
+	if a.Text != b.Text || len(a.Headers) != len(b.Headers) {
+		return false
+	}
+	for name, value := range a.Headers {
+		if b.Headers[name] != value {
+			return false
+		}
+	}
+	return true
+}
+
+func (n *node) storesTopic(storageTopic string) bool {
+	for _, nodeID := range n.getReplicas(storageTopic) {
+		if nodeID == n.GetID().String() {
+			return true
+		}
+	}
+	return false
+}
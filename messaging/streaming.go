@@ -0,0 +1,83 @@
+package messaging
+
+import (
+	"context"
+	"io"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/vlado-github/tinydfs/persistance"
+)
+
+// ChunkSender writes payload to the topic and returns its key
+type ChunkSender func(topic string, payload []byte) (uuid.UUID, error)
+
+// SendStream splits the payload read from r into chunks, sends
+// every chunk as a separate message and finally the manifest that
+// lists the chunks. Returns the key under which manifest is stored.
+func (n *node) SendStream(topic string, r io.Reader) (uuid.UUID, error) {
+	if err := persistance.ValidateTopic(topic); err != nil {
+		return uuid.Nil, err
+	}
+	send := func(topic string, payload []byte) (uuid.UUID, error) {
+		key := uuid.New()
+		n.SendMessage(Message{Key: key, Topic: topic, Payload: payload})
+		return key, nil
+	}
+	manifest, err := SendChunks(topic, r, send)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	text, err := persistance.EncodeManifest(manifest)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	return send(topic, []byte(text))
+}
+
+// GetStream reads value of the key, chunked values are reassembled
+// by fetching chunks one at a time from the owners of the topic
+func (n *node) GetStream(ctx context.Context, topic string, key uuid.UUID) (io.ReadCloser, error) {
+	text, err := n.Get(ctx, topic, key)
+	if err != nil {
+		return nil, err
+	}
+	return NewStreamReader(text, func(chunkKey uuid.UUID) (string, error) {
+		return n.Get(ctx, persistance.ChunkTopicName(topic), chunkKey)
+	}), nil
+}
+
+// SendChunks splits the payload into chunks, sends them to the
+// chunk topic of the topic and returns manifest of sent chunks
+func SendChunks(topic string, r io.Reader, send ChunkSender) (persistance.Manifest, error) {
+	var manifest persistance.Manifest
+	buf := make([]byte, persistance.ChunkSize)
+	for {
+		size, err := io.ReadFull(r, buf)
+		if size > 0 {
+			data := buf[:size]
+			key, sendErr := send(persistance.ChunkTopicName(topic), []byte(persistance.EncodeChunk(data)))
+			if sendErr != nil {
+				return manifest, sendErr
+			}
+			manifest.Chunks = append(manifest.Chunks, persistance.NewChunkRef(key, data))
+			manifest.Size += int64(size)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return manifest, nil
+		}
+		if err != nil {
+			return manifest, err
+		}
+	}
+}
+
+// NewStreamReader returns reader of a value, if the value is
+// a chunk manifest, chunks are fetched with the getter
+func NewStreamReader(text string, get persistance.ChunkGetter) io.ReadCloser {
+	manifest, ok := persistance.ParseManifest(text)
+	if !ok {
+		return io.NopCloser(strings.NewReader(text))
+	}
+	return persistance.NewChunkReader(manifest.Chunks, get)
+}
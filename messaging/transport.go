@@ -0,0 +1,97 @@
+package messaging
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"sync"
+)
+
+// Transport listens for and dials stream connections of a protocol.
+// ConnParams.Protocol selects the transport of a queue.
+type Transport interface {
+	Listen(address string) (net.Listener, error)
+	Dial(ctx context.Context, address string) (net.Conn, error)
+}
+
+// Protocols of the built-in transports
+const (
+	PROTOCOL_TCP    string = "tcp"
+	PROTOCOL_UNIX   string = "unix"
+	PROTOCOL_MEMORY string = "mem"
+)
+
+var ErrUnknownProtocol = errors.New("No transport is registered for the protocol")
+
+var transports = map[string]Transport{
+	PROTOCOL_TCP:    &netTransport{network: "tcp"},
+	"tcp4":          &netTransport{network: "tcp4"},
+	"tcp6":          &netTransport{network: "tcp6"},
+	PROTOCOL_UNIX:   &netTransport{network: "unix"},
+	PROTOCOL_MEMORY: NewMemoryTransport(),
+}
+var transportsLock sync.RWMutex
+
+// RegisterTransport adds or replaces the transport of the protocol
+func RegisterTransport(protocol string, transport Transport) {
+	transportsLock.Lock()
+	defer transportsLock.Unlock()
+	transports[protocol] = transport
+}
+
+// UnregisterTransport removes the transport of the protocol
+func UnregisterTransport(protocol string) {
+	transportsLock.Lock()
+	defer transportsLock.Unlock()
+	delete(transports, protocol)
+}
+
+// GetTransport returns the transport registered for the protocol
+func GetTransport(protocol string) (Transport, error) {
+	transportsLock.RLock()
+	defer transportsLock.RUnlock()
+	transport, ok := transports[protocol]
+	if !ok {
+		return nil, ErrUnknownProtocol
+	}
+	return transport, nil
+}
+
+// Listen opens a listener with the transport of the connection parameters
+func Listen(params ConnParams) (net.Listener, error) {
+	transport, err := GetTransport(params.Protocol)
+	if err != nil {
+		return nil, err
+	}
+	return transport.Listen(params.Address())
+}
+
+// Dial connects with the transport of the connection parameters
+func Dial(ctx context.Context, params ConnParams) (net.Conn, error) {
+	transport, err := GetTransport(params.Protocol)
+	if err != nil {
+		return nil, err
+	}
+	return transport.Dial(ctx, params.Address())
+}
+
+// netTransport uses the operating system network, i.e. tcp and unix sockets
+type netTransport struct {
+	network string
+}
+
+func (t *netTransport) Listen(address string) (net.Listener, error) {
+	if t.network == "unix" {
+		// socket file left behind by a node that did not close its listener
+		if info, err := os.Stat(address); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(address)
+		}
+	}
+	return net.Listen(t.network, address)
+}
+
+func (t *netTransport) Dial(ctx context.Context, address string) (net.Conn, error) {
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, t.network, address)
+}
@@ -7,6 +7,9 @@ import (
 	"path/filepath"
 )
 
+// DataDirEnv overrides the directory that keeps data directories of nodes
+const DataDirEnv = "TINYDFS_DATA_DIR"
+
 func decodeMessage(message *Message, dec *json.Decoder) error {
 	err := dec.Decode(&message)
 	if err != nil {
@@ -33,3 +36,10 @@ func getCurrentDirectory() string {
 	}
 	return pathToDir
 }
+
+func getDataDirectory() string {
+	if dir := os.Getenv(DataDirEnv); dir != "" {
+		return dir
+	}
+	return getCurrentDirectory()
+}
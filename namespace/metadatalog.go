@@ -0,0 +1,110 @@
+package namespace
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/vlado-github/tinydfs/logging"
+)
+
+// MetadataLogName is the file of namespace changes in the data directory
+const MetadataLogName = "namespace.log"
+
+const (
+	opCreate  string = "CREATE"
+	opRename  string = "RENAME"
+	opSetSize string = "SET_SIZE"
+	opRemove  string = "REMOVE"
+)
+
+// logEntry is a single change of the namespace
+type logEntry struct {
+	Op      string
+	Path    string
+	NewPath string    `json:",omitempty"`
+	Size    int64     `json:",omitempty"`
+	ModTime time.Time `json:",omitempty"`
+	Info    *FileInfo `json:",omitempty"`
+}
+
+// metadataLog appends changes as JSON lines, the namespace
+// is rebuilt by replaying them in order
+type metadataLog struct {
+	path    string
+	file    *os.File
+	encoder *json.Encoder
+	lock    sync.Mutex
+}
+
+func openMetadataLog(pathDir string, replay func(entry logEntry)) (*metadataLog, error) {
+	err := os.MkdirAll(pathDir, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	logPath := path.Join(pathDir, MetadataLogName)
+	f, err := os.OpenFile(logPath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0660)
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry logEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// torn write of the last entry before a crash
+			logging.AddWarning("Namespace: Skipping invalid metadata log entry.", err.Error())
+			continue
+		}
+		replay(entry)
+	}
+	return &metadataLog{path: logPath, file: f, encoder: json.NewEncoder(f)}, scanner.Err()
+}
+
+// Append writes the entry and flushes it to the disk
+func (l *metadataLog) Append(entry logEntry) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if err := l.encoder.Encode(entry); err != nil {
+		return err
+	}
+	return l.file.Sync()
+}
+
+// Replace writes the entries to a new log and swaps it with the current one
+func (l *metadataLog) Replace(entries []logEntry) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	tmpPath := l.path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0660)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(f)
+	for _, entry := range entries {
+		if err = encoder.Encode(entry); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, l.path)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	l.file.Close()
+	l.file = f
+	l.encoder = encoder
+	return nil
+}
+
+func (l *metadataLog) Close() error {
+	return l.file.Close()
+}
@@ -0,0 +1,368 @@
+package namespace
+
+import (
+	"encoding/json"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/vlado-github/tinydfs/logging"
+)
+
+// FileInfo describes a file or directory of the namespace
+type FileInfo struct {
+	Path     string
+	Name     string
+	IsDir    bool
+	Size     int64
+	ModTime  time.Time
+	Owner    string
+	Replicas int
+	Topic    string `json:",omitempty"`
+}
+
+// Namespace is a tree of directories and files, similar to the GFS master.
+// Content of a file is stored in its topic, so renaming a file
+// does not move any data.
+type Namespace interface {
+	Mkdir(p string, owner string) (FileInfo, error)
+	Create(p string, owner string, replicas int) (FileInfo, error)
+	Stat(p string) (FileInfo, error)
+	List(p string) ([]FileInfo, error)
+	Rename(oldPath string, newPath string) error
+	Move(p string, dir string) error
+	SetSize(p string, size int64) error
+	Remove(p string) error
+	Close() error
+}
+
+// ReplicatedNamespace is the namespace kept by a node, the master
+// sends its state to other nodes so they can take over after failover
+type ReplicatedNamespace interface {
+	Namespace
+	FindTopic(topic string) (FileInfo, bool)
+	ToByteArray() ([]byte, error)
+	FromByteArray(payload []byte) error
+}
+
+type namespace struct {
+	entries map[string]FileInfo
+	topics  map[string]string
+	log     *metadataLog
+	lock    sync.RWMutex
+}
+
+// Creates instance of Namespace, the tree is restored from
+// the metadata log in the directory
+func NewNamespace(pathDir string) ReplicatedNamespace {
+	ns := &namespace{
+		entries: map[string]FileInfo{
+			Root: {Path: Root, Name: Root, IsDir: true, ModTime: time.Now().UTC()},
+		},
+		topics: make(map[string]string),
+	}
+	log, err := openMetadataLog(pathDir, func(entry logEntry) {
+		ns.apply(entry)
+	})
+	if err != nil {
+		logging.AddError("Namespace: Can not open metadata log.", err.Error())
+	}
+	ns.log = log
+	return ns
+}
+
+// Mkdir creates a directory, its parent must exist
+func (ns *namespace) Mkdir(p string, owner string) (FileInfo, error) {
+	return ns.create(p, FileInfo{IsDir: true, Owner: owner})
+}
+
+// Create adds an empty file stored in a new topic
+func (ns *namespace) Create(p string, owner string, replicas int) (FileInfo, error) {
+	return ns.create(p, FileInfo{Owner: owner, Replicas: replicas, Topic: "file-" + uuid.New().String()})
+}
+
+func (ns *namespace) create(p string, info FileInfo) (FileInfo, error) {
+	p, err := CleanPath(p)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	ns.lock.Lock()
+	defer ns.lock.Unlock()
+	if _, ok := ns.entries[p]; ok {
+		return FileInfo{}, ErrExists
+	}
+	if err := ns.checkParent(p); err != nil {
+		return FileInfo{}, err
+	}
+	info.Path = p
+	info.Name = path.Base(p)
+	info.ModTime = time.Now().UTC()
+	entry := logEntry{Op: opCreate, Path: p, Info: &info}
+	if err := ns.commit(entry); err != nil {
+		return FileInfo{}, err
+	}
+	return info, nil
+}
+
+// Stat returns metadata of the file or directory
+func (ns *namespace) Stat(p string) (FileInfo, error) {
+	p, err := CleanPath(p)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	ns.lock.RLock()
+	defer ns.lock.RUnlock()
+	info, ok := ns.entries[p]
+	if !ok {
+		return FileInfo{}, ErrNotFound
+	}
+	return info, nil
+}
+
+// List returns the content of a directory sorted by name
+func (ns *namespace) List(p string) ([]FileInfo, error) {
+	p, err := CleanPath(p)
+	if err != nil {
+		return nil, err
+	}
+	ns.lock.RLock()
+	defer ns.lock.RUnlock()
+	dir, ok := ns.entries[p]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if !dir.IsDir {
+		return nil, ErrNotDir
+	}
+	infos := []FileInfo{}
+	for entryPath, info := range ns.entries {
+		if entryPath != Root && path.Dir(entryPath) == p {
+			infos = append(infos, info)
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+	return infos, nil
+}
+
+// Rename changes the path of a file or directory with all its content
+func (ns *namespace) Rename(oldPath string, newPath string) error {
+	oldPath, err := CleanPath(oldPath)
+	if err != nil {
+		return err
+	}
+	newPath, err = CleanPath(newPath)
+	if err != nil {
+		return err
+	}
+	if oldPath == Root || isInside(newPath, oldPath) {
+		return ErrInvalidPath
+	}
+	ns.lock.Lock()
+	defer ns.lock.Unlock()
+	if _, ok := ns.entries[oldPath]; !ok {
+		return ErrNotFound
+	}
+	if _, ok := ns.entries[newPath]; ok {
+		return ErrExists
+	}
+	if err := ns.checkParent(newPath); err != nil {
+		return err
+	}
+	return ns.commit(logEntry{Op: opRename, Path: oldPath, NewPath: newPath, ModTime: time.Now().UTC()})
+}
+
+// Move places the file or directory into another directory
+func (ns *namespace) Move(p string, dir string) error {
+	p, err := CleanPath(p)
+	if err != nil {
+		return err
+	}
+	dir, err = CleanPath(dir)
+	if err != nil {
+		return err
+	}
+	return ns.Rename(p, path.Join(dir, path.Base(p)))
+}
+
+// SetSize records the size of the file content
+func (ns *namespace) SetSize(p string, size int64) error {
+	p, err := CleanPath(p)
+	if err != nil {
+		return err
+	}
+	ns.lock.Lock()
+	defer ns.lock.Unlock()
+	info, ok := ns.entries[p]
+	if !ok {
+		return ErrNotFound
+	}
+	if info.IsDir {
+		return ErrIsDir
+	}
+	return ns.commit(logEntry{Op: opSetSize, Path: p, Size: size, ModTime: time.Now().UTC()})
+}
+
+// Remove deletes a file or an empty directory
+func (ns *namespace) Remove(p string) error {
+	p, err := CleanPath(p)
+	if err != nil {
+		return err
+	}
+	if p == Root {
+		return ErrInvalidPath
+	}
+	ns.lock.Lock()
+	defer ns.lock.Unlock()
+	info, ok := ns.entries[p]
+	if !ok {
+		return ErrNotFound
+	}
+	if info.IsDir {
+		for entryPath := range ns.entries {
+			if isInside(entryPath, p) && entryPath != p {
+				return ErrNotEmpty
+			}
+		}
+	}
+	return ns.commit(logEntry{Op: opRemove, Path: p})
+}
+
+// FindTopic returns the file whose content is stored in the topic
+func (ns *namespace) FindTopic(topic string) (FileInfo, bool) {
+	ns.lock.RLock()
+	defer ns.lock.RUnlock()
+	p, ok := ns.topics[topic]
+	if !ok {
+		return FileInfo{}, false
+	}
+	info, ok := ns.entries[p]
+	return info, ok
+}
+
+// ToByteArray serializes all entries of the namespace
+func (ns *namespace) ToByteArray() ([]byte, error) {
+	ns.lock.RLock()
+	defer ns.lock.RUnlock()
+	infos := make([]FileInfo, 0, len(ns.entries))
+	for _, info := range ns.entries {
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Path < infos[j].Path
+	})
+	return json.Marshal(infos)
+}
+
+// FromByteArray replaces the namespace with entries serialized
+// by ToByteArray, the metadata log is rewritten with them
+func (ns *namespace) FromByteArray(payload []byte) error {
+	var infos []FileInfo
+	if err := json.Unmarshal(payload, &infos); err != nil {
+		return err
+	}
+	entries := make([]logEntry, 0, len(infos))
+	for i := range infos {
+		p, err := CleanPath(infos[i].Path)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, logEntry{Op: opCreate, Path: p, Info: &infos[i]})
+	}
+	ns.lock.Lock()
+	defer ns.lock.Unlock()
+	if ns.log != nil {
+		if err := ns.log.Replace(entries); err != nil {
+			logging.AddError("Namespace: Can not write metadata log.", err.Error())
+			return err
+		}
+	}
+	ns.entries = make(map[string]FileInfo, len(entries))
+	ns.topics = make(map[string]string)
+	for _, entry := range entries {
+		ns.apply(entry)
+	}
+	return nil
+}
+
+func (ns *namespace) Close() error {
+	if ns.log == nil {
+		return nil
+	}
+	return ns.log.Close()
+}
+
+func (ns *namespace) checkParent(p string) error {
+	parent, ok := ns.entries[path.Dir(p)]
+	if !ok {
+		return ErrNotFound
+	}
+	if !parent.IsDir {
+		return ErrNotDir
+	}
+	return nil
+}
+
+// Writes the change to the metadata log before it becomes visible
+func (ns *namespace) commit(entry logEntry) error {
+	if ns.log != nil {
+		if err := ns.log.Append(entry); err != nil {
+			logging.AddError("Namespace: Can not write metadata log.", err.Error())
+			return err
+		}
+	}
+	ns.apply(entry)
+	return nil
+}
+
+func (ns *namespace) apply(entry logEntry) {
+	switch entry.Op {
+	case opCreate:
+		if entry.Info != nil {
+			ns.entries[entry.Path] = *entry.Info
+			if entry.Info.Topic != "" {
+				ns.topics[entry.Info.Topic] = entry.Path
+			}
+		}
+	case opRename:
+		moved := []FileInfo{}
+		for entryPath, info := range ns.entries {
+			if isInside(entryPath, entry.Path) {
+				moved = append(moved, info)
+				delete(ns.entries, entryPath)
+			}
+		}
+		for _, info := range moved {
+			entryPath := info.Path
+			info.Path = entry.NewPath + strings.TrimPrefix(entryPath, entry.Path)
+			info.Name = path.Base(info.Path)
+			if entryPath == entry.Path {
+				info.ModTime = entry.ModTime
+			}
+			ns.entries[info.Path] = info
+			if info.Topic != "" {
+				ns.topics[info.Topic] = info.Path
+			}
+		}
+	case opSetSize:
+		if info, ok := ns.entries[entry.Path]; ok {
+			info.Size = entry.Size
+			info.ModTime = entry.ModTime
+			ns.entries[entry.Path] = info
+		}
+	case opRemove:
+		if info, ok := ns.entries[entry.Path]; ok && info.Topic != "" {
+			delete(ns.topics, info.Topic)
+		}
+		delete(ns.entries, entry.Path)
+	}
+}
+
+// Checks if the path is the directory or is inside of it
+func isInside(p string, dir string) bool {
+	return p == dir || strings.HasPrefix(p, strings.TrimSuffix(dir, "/")+"/")
+}
@@ -0,0 +1,124 @@
+package namespace
+
+import (
+	"testing"
+)
+
+func TestCleanPath(t *testing.T) {
+	valid := map[string]string{
+		"/":             "/",
+		"docs":          "/docs",
+		"/docs//a/./b/": "/docs/a/b",
+		"/docs/a/../b":  "/docs/b",
+	}
+	for p, expected := range valid {
+		result, err := CleanPath(p)
+		if err != nil || result != expected {
+			t.Error(p, result, err)
+		}
+	}
+	for _, p := range []string{"", "..", "/../etc", "/a/../../etc", "/a\x00b", "/a\nb"} {
+		if _, err := CleanPath(p); err != ErrInvalidPath {
+			t.Error(p, err)
+		}
+	}
+}
+
+func TestNamespace_Operations(t *testing.T) {
+	ns := NewNamespace(t.TempDir())
+	defer ns.Close()
+
+	if _, err := ns.Mkdir("/docs", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ns.Create("/docs/missing/a.txt", "alice", 2); err != ErrNotFound {
+		t.Error(err)
+	}
+	file, err := ns.Create("/docs/a.txt", "alice", 2)
+	if err != nil || file.Topic == "" || file.Replicas != 2 {
+		t.Fatal(file, err)
+	}
+	if _, err := ns.Create("/docs/a.txt", "bob", 1); err != ErrExists {
+		t.Error(err)
+	}
+	if err := ns.SetSize("/docs/a.txt", 42); err != nil {
+		t.Error(err)
+	}
+	if _, err := ns.Mkdir("/archive", "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ns.Move("/docs/a.txt", "/archive"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ns.Rename("/archive", "/archive/inner"); err != ErrInvalidPath {
+		t.Error(err)
+	}
+	if err := ns.Rename("/archive", "/old"); err != nil {
+		t.Fatal(err)
+	}
+	moved, err := ns.Stat("/old/a.txt")
+	if err != nil || moved.Size != 42 || moved.Topic != file.Topic || moved.Name != "a.txt" {
+		t.Error(moved, err)
+	}
+	if err := ns.Remove("/old"); err != ErrNotEmpty {
+		t.Error(err)
+	}
+	list, err := ns.List("/")
+	if err != nil || len(list) != 2 || list[0].Name != "docs" || list[1].Name != "old" {
+		t.Error(list, err)
+	}
+	if _, err := ns.List("/old/a.txt"); err != ErrNotDir {
+		t.Error(err)
+	}
+}
+
+func TestNamespace_Replay(t *testing.T) {
+	dir := t.TempDir()
+	ns := NewNamespace(dir)
+	ns.Mkdir("/a", "alice")
+	ns.Create("/a/file", "alice", 1)
+	ns.Rename("/a", "/b")
+	ns.Mkdir("/c", "alice")
+	ns.Remove("/c")
+	ns.Close()
+
+	restored := NewNamespace(dir)
+	defer restored.Close()
+	if _, err := restored.Stat("/b/file"); err != nil {
+		t.Error(err)
+	}
+	for _, p := range []string{"/a", "/c"} {
+		if _, err := restored.Stat(p); err != ErrNotFound {
+			t.Error(p, err)
+		}
+	}
+}
+
+func TestNamespace_ByteArray(t *testing.T) {
+	ns := NewNamespace(t.TempDir())
+	defer ns.Close()
+	ns.Mkdir("/a", "alice")
+	file, _ := ns.Create("/a/file", "alice", 2)
+	ns.SetSize("/a/file", 7)
+	payload, err := ns.ToByteArray()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	replica := NewNamespace(dir)
+	replica.Mkdir("/stale", "bob")
+	if err := replica.FromByteArray(payload); err != nil {
+		t.Fatal(err)
+	}
+	replica.Close()
+	restored := NewNamespace(dir)
+	defer restored.Close()
+	if _, err := restored.Stat("/stale"); err != ErrNotFound {
+		t.Error(err)
+	}
+	info, ok := restored.FindTopic(file.Topic)
+	if !ok || info.Path != "/a/file" || info.Size != 7 || info.Replicas != 2 {
+		t.Error(info, ok)
+	}
+}
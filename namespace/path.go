@@ -0,0 +1,75 @@
+package namespace
+
+import (
+	"errors"
+	"path"
+	"strings"
+)
+
+// MaxNameLength is the longest name of a file or directory
+const MaxNameLength = 255
+
+// MaxPathLength is the longest full path
+const MaxPathLength = 4096
+
+// Root is the path of the top directory
+const Root = "/"
+
+var ErrInvalidPath = errors.New("Invalid path")
+var ErrNotFound = errors.New("No such file or directory")
+var ErrExists = errors.New("File exists")
+var ErrNotDir = errors.New("Not a directory")
+var ErrIsDir = errors.New("Is a directory")
+var ErrNotEmpty = errors.New("Directory not empty")
+
+var knownErrors = []error{ErrInvalidPath, ErrNotFound, ErrExists, ErrNotDir, ErrIsDir, ErrNotEmpty}
+
+// KnownError returns the namespace error with the message,
+// so errors keep their identity after crossing the network
+func KnownError(message string) error {
+	for _, err := range knownErrors {
+		if strings.HasSuffix(message, err.Error()) {
+			return err
+		}
+	}
+	return nil
+}
+
+// CleanPath validates the path and returns its normalized form.
+// Relative paths start at the root, paths leaving the root are rejected.
+func CleanPath(p string) (string, error) {
+	if p == "" || len(p) > MaxPathLength {
+		return "", ErrInvalidPath
+	}
+	depth := 0
+	for _, name := range strings.Split(p, "/") {
+		switch name {
+		case "", ".":
+			continue
+		case "..":
+			depth--
+			if depth < 0 {
+				return "", ErrInvalidPath
+			}
+			continue
+		}
+		if !isValidName(name) {
+			return "", ErrInvalidPath
+		}
+		depth++
+	}
+	return path.Clean(Root + p), nil
+}
+
+// Names are free text except control characters
+func isValidName(name string) bool {
+	if len(name) > MaxNameLength {
+		return false
+	}
+	for _, r := range name {
+		if r < 0x20 || r == 0x7f {
+			return false
+		}
+	}
+	return true
+}
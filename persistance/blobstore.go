@@ -0,0 +1,260 @@
+package persistance
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/vlado-github/tinydfs/logging"
+)
+
+// BlobDirName is the directory of the content-addressed chunks
+const BlobDirName = "__blobs"
+
+// DedupThreshold is the smallest record text stored in the blob store,
+// shorter texts are cheaper to keep inline than to reference
+const DedupThreshold = 1024
+
+// refsFileName is the log of reference changes, a line is either a count
+// "<hash>:<count>" written on compaction or a change "+<hash>" / "-<hash>"
+const refsFileName = "refs"
+
+var ErrBlobNotFound = errors.New("Blob not found")
+var ErrBlobCorrupted = errors.New("Blob content does not match its hash")
+
+// BlobStore keeps chunks addressed by their SHA-256 hash.
+// Every chunk is stored once and counts the records referencing it.
+type BlobStore interface {
+	Put(data []byte) (string, error)
+	Get(hash string) ([]byte, error)
+	Release(hash string) error
+	RefCount(hash string) int
+	SetRefs(refs map[string]int) error
+	GC() (int, error)
+}
+
+type blobStore struct {
+	pathToDir string
+	refs      map[string]int
+	refsFile  *os.File
+	lock      sync.Mutex
+}
+
+// Creates instance of BlobStore, reference counts are loaded from the disk
+func NewBlobStore(pathDir string) BlobStore {
+	pathToDir := path.Clean(pathDir)
+	err := os.MkdirAll(pathToDir, os.ModePerm)
+	if err != nil {
+		logging.AddError("Persistance: Can not create a directory.", err.Error())
+	}
+	bs := &blobStore{
+		pathToDir: pathToDir,
+		refs:      make(map[string]int),
+	}
+	bs.loadRefs()
+	// changes appended before the restart are compacted into counts
+	bs.saveRefs()
+	return bs
+}
+
+// BlobHash returns the address of the data
+func BlobHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Put stores the data unless it is already present
+// and adds a reference to it
+func (bs *blobStore) Put(data []byte) (string, error) {
+	hash := BlobHash(data)
+	bs.lock.Lock()
+	defer bs.lock.Unlock()
+	pathToFile := bs.blobPath(hash)
+	if _, err := os.Stat(pathToFile); os.IsNotExist(err) {
+		err = writeFileAtomic(pathToFile, data)
+		if err != nil {
+			logging.AddError("Persistance: Can not write a blob.", hash, err.Error())
+			return "", err
+		}
+	}
+	bs.refs[hash]++
+	return hash, bs.appendRef('+', hash)
+}
+
+// Get reads the data of the hash and verifies it
+func (bs *blobStore) Get(hash string) ([]byte, error) {
+	if !isBlobHash(hash) {
+		return nil, ErrBlobNotFound
+	}
+	data, err := os.ReadFile(bs.blobPath(hash))
+	if os.IsNotExist(err) {
+		return nil, ErrBlobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if BlobHash(data) != hash {
+		logging.AddError("Persistance: Blob corrupted.", hash)
+		return nil, ErrBlobCorrupted
+	}
+	return data, nil
+}
+
+// Release removes a reference to the hash, unreferenced
+// blobs are kept until the next GC
+func (bs *blobStore) Release(hash string) error {
+	bs.lock.Lock()
+	defer bs.lock.Unlock()
+	if bs.refs[hash] == 0 {
+		return ErrBlobNotFound
+	}
+	bs.refs[hash]--
+	return bs.appendRef('-', hash)
+}
+
+// RefCount returns the number of references to the hash
+func (bs *blobStore) RefCount(hash string) int {
+	bs.lock.Lock()
+	defer bs.lock.Unlock()
+	return bs.refs[hash]
+}
+
+// SetRefs replaces all reference counts, e.g. after they are rebuilt from records
+func (bs *blobStore) SetRefs(refs map[string]int) error {
+	bs.lock.Lock()
+	defer bs.lock.Unlock()
+	bs.refs = make(map[string]int, len(refs))
+	for hash, count := range refs {
+		bs.refs[hash] = count
+	}
+	return bs.saveRefs()
+}
+
+// GC deletes blobs without references and returns their count
+func (bs *blobStore) GC() (int, error) {
+	bs.lock.Lock()
+	defer bs.lock.Unlock()
+	removed := 0
+	err := filepath.WalkDir(bs.pathToDir, func(pathToFile string, entry os.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		hash := entry.Name()
+		if !isBlobHash(hash) || bs.refs[hash] > 0 {
+			return nil
+		}
+		if err := os.Remove(pathToFile); err != nil {
+			return err
+		}
+		delete(bs.refs, hash)
+		removed++
+		return nil
+	})
+	if err != nil {
+		logging.AddError("Persistance: Blob garbage collection failed.", err.Error())
+		return removed, err
+	}
+	if removed > 0 {
+		logging.AddInfo("Persistance: Blob garbage collection removed", removed, "blobs.")
+	}
+	return removed, bs.saveRefs()
+}
+
+// Blobs are spread over subdirectories by the first byte of the hash
+func (bs *blobStore) blobPath(hash string) string {
+	return path.Join(bs.pathToDir, hash[:2], hash)
+}
+
+func (bs *blobStore) loadRefs() {
+	fileHandle, err := os.Open(path.Join(bs.pathToDir, refsFileName))
+	if err != nil {
+		return
+	}
+	defer fileHandle.Close()
+	scanner := bufio.NewScanner(fileHandle)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "+") && isBlobHash(line[1:]) {
+			bs.refs[line[1:]]++
+			continue
+		}
+		if strings.HasPrefix(line, "-") && isBlobHash(line[1:]) {
+			if bs.refs[line[1:]] > 0 {
+				bs.refs[line[1:]]--
+			}
+			continue
+		}
+		result := strings.SplitN(line, ":", 2)
+		if len(result) != 2 {
+			continue
+		}
+		count, err := strconv.Atoi(result[1])
+		if err == nil && isBlobHash(result[0]) {
+			bs.refs[result[0]] = count
+		}
+	}
+}
+
+// Appends a change of the reference count, callers hold the lock
+func (bs *blobStore) appendRef(change byte, hash string) error {
+	if bs.refsFile == nil {
+		return bs.saveRefs()
+	}
+	_, err := bs.refsFile.WriteString(string(change) + hash + "\n")
+	if err != nil {
+		logging.AddError("Persistance: Can not save blob references.", err.Error())
+	}
+	return err
+}
+
+// Rewrites the log with the current counts and reopens it for appending
+func (bs *blobStore) saveRefs() error {
+	var builder strings.Builder
+	for hash, count := range bs.refs {
+		fmt.Fprintf(&builder, "%s:%d\n", hash, count)
+	}
+	pathToFile := path.Join(bs.pathToDir, refsFileName)
+	err := writeFileAtomic(pathToFile, []byte(builder.String()))
+	if err != nil {
+		logging.AddError("Persistance: Can not save blob references.", err.Error())
+		return err
+	}
+	if bs.refsFile != nil {
+		bs.refsFile.Close()
+	}
+	bs.refsFile, err = os.OpenFile(pathToFile, os.O_WRONLY|os.O_APPEND, 0660)
+	if err != nil {
+		logging.AddError("Persistance: Can not open blob references.", err.Error())
+	}
+	return err
+}
+
+// Writes to a temporary file first, so readers never see partial content
+func writeFileAtomic(pathToFile string, data []byte) error {
+	err := os.MkdirAll(path.Dir(pathToFile), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	tmpPath := pathToFile + ".tmp"
+	err = os.WriteFile(tmpPath, data, 0660)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, pathToFile)
+}
+
+func isBlobHash(hash string) bool {
+	if len(hash) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(hash)
+	return err == nil
+}
@@ -0,0 +1,132 @@
+package persistance
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"io"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// ChunkSize is the size of a chunk large payloads are split into
+const ChunkSize = 32 * 1024
+
+// ChunkTopicPrefix is a prefix of topics that store chunks of a topic
+const ChunkTopicPrefix = "__chunks_"
+
+// manifestMarker starts text of records that are chunk manifests
+const manifestMarker = "\x1emanifest:"
+
+// ErrChunkCorrupted is returned if chunk does not match its checksum
+var ErrChunkCorrupted = errors.New("Chunk checksum mismatch")
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// ChunkRef is a reference from manifest to a stored chunk
+type ChunkRef struct {
+	Key      uuid.UUID
+	Size     int
+	Checksum uint32
+}
+
+// Manifest lists chunks of a payload in sequence
+type Manifest struct {
+	Size   int64
+	Chunks []ChunkRef
+}
+
+// ChunkTopicName returns name of the topic that stores chunks of the topic
+func ChunkTopicName(topic string) string {
+	return ChunkTopicPrefix + topic
+}
+
+// NewChunkRef creates reference of the chunk with CRC32C checksum
+func NewChunkRef(key uuid.UUID, data []byte) ChunkRef {
+	return ChunkRef{Key: key, Size: len(data), Checksum: crc32.Checksum(data, castagnoli)}
+}
+
+// EncodeChunk converts chunk data to text of a single line record
+func EncodeChunk(data []byte) string {
+	return base64.StdEncoding.EncodeToString(data)
+}
+
+// DecodeChunk converts record text to chunk data and verifies the checksum
+func DecodeChunk(text string, ref ChunkRef) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(text)
+	if err != nil {
+		return nil, ErrChunkCorrupted
+	}
+	if len(data) != ref.Size || crc32.Checksum(data, castagnoli) != ref.Checksum {
+		return nil, ErrChunkCorrupted
+	}
+	return data, nil
+}
+
+// EncodeManifest converts manifest to record text
+func EncodeManifest(m Manifest) (string, error) {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+	return manifestMarker + string(data), nil
+}
+
+// ParseManifest returns manifest if the record text is one
+func ParseManifest(text string) (Manifest, bool) {
+	var m Manifest
+	if !strings.HasPrefix(text, manifestMarker) {
+		return m, false
+	}
+	if json.Unmarshal([]byte(text[len(manifestMarker):]), &m) != nil {
+		return m, false
+	}
+	return m, true
+}
+
+// ChunkGetter returns record text of a chunk
+type ChunkGetter func(key uuid.UUID) (string, error)
+
+type chunkReader struct {
+	chunks []ChunkRef
+	get    ChunkGetter
+	buf    []byte
+	err    error
+}
+
+// NewChunkReader reassembles chunks in sequence. Chunks are
+// fetched one at a time, when the previous one is consumed.
+func NewChunkReader(chunks []ChunkRef, get ChunkGetter) io.ReadCloser {
+	return &chunkReader{chunks: chunks, get: get}
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if len(r.chunks) == 0 {
+			return 0, io.EOF
+		}
+		ref := r.chunks[0]
+		r.chunks = r.chunks[1:]
+		text, err := r.get(ref.Key)
+		if err == nil {
+			r.buf, err = DecodeChunk(text, ref)
+		}
+		if err != nil {
+			r.err = err
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *chunkReader) Close() error {
+	r.chunks = nil
+	r.buf = nil
+	return nil
+}
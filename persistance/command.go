@@ -1,9 +1,16 @@
 package persistance
 
-import "github.com/google/uuid"
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
 
 type Command struct {
-	Key   uuid.UUID
-	Topic string
-	Text  string
+	Key     uuid.UUID
+	Topic   string
+	Text    string
+	Headers map[string]string `json:",omitempty"`
+	// Timestamp keeps the time of a copied record, zero means now
+	Timestamp time.Time `json:",omitzero"`
 }
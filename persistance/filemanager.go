@@ -1,32 +1,57 @@
 package persistance
 
 import (
-	"bufio"
-	"bytes"
 	"errors"
-	"fmt"
+	"io"
 	"io/ioutil"
 	"github.com/vlado-github/tinydfs/logging"
 	"os"
 	"path"
 	"strings"
 	"sync"
+	"time"
+
+	"github.com/google/uuid"
 )
 
+// ErrNotFound is returned if the topic has no live record of the key
+var ErrNotFound = errors.New("Item not found")
+
 type FileManager interface {
 	Write(command Command) error
 	Update(command Command) error
+	Put(command Command) error
+	Delete(command Command) error
 	Read(query Query) (string, error)
+	ReadRecord(query Query) (Record, error)
 	ReadFile(topic string) ([]byte, error)
+	Scan(topic string) ([]Record, error)
+	ReadStream(query Query) (io.ReadCloser, error)
+	CollectGarbage() (int, error)
+	Verify(topic string) ([]CorruptRecordError, error)
+	Topics() ([]string, error)
+	Snapshot(w io.Writer) (SnapshotManifest, error)
+	Restore(r io.Reader) (SnapshotManifest, error)
+	Manifest() ([]TopicSnapshot, error)
+	PrefixChecksum(topic string, offset int64) (string, error)
+	ReadRange(topic string, offset int64, length int) ([]byte, int64, error)
+	AppendRange(topic string, offset int64, data []byte) error
+	MissingBlobs(topic string) ([]string, error)
+	RebuildBlobRefs() error
+	Blobs() BlobStore
 	//Close() error
 }
 
 type fileManager struct {
 	pathToDir string
+	blobs     BlobStore
+	gcLock    sync.Mutex
 }
 
+// MaxRecordSize is the longest record that can be read back
+const MaxRecordSize = 16 * 1024 * 1024
+
 var mutex = &sync.Mutex{}
-var pos int64
 
 // Creates instance of FileManager
 func NewFileManager(pathDir string) FileManager {
@@ -36,105 +61,150 @@ func NewFileManager(pathDir string) FileManager {
 		logging.AddError("Persistance: Can not create a directory.", err.Error())
 	}
 
-	return &fileManager{
+	fm := &fileManager{
 		pathToDir: pathToDir,
+		blobs:     NewBlobStore(path.Join(pathToDir, BlobDirName)),
 	}
+	fm.recoverRestore()
+	return fm
 }
 
+// Write appends a new version of the key, blobs of the replaced version are released as by Put
 func (fm *fileManager) Write(command Command) error {
+	return fm.Put(command)
+}
+
+// Update appends a new version of the key, the latest version is read
+func (fm *fileManager) Update(command Command) error {
+	pathToFile, err := fm.topicPath(command.Topic)
+	if err != nil {
+		return err
+	}
 	mutex.Lock()
 	defer mutex.Unlock()
-	pathToFile := path.Clean(path.Join(fm.pathToDir, command.Topic))
-	f, err := createOrAppendFile(pathToFile)
-	defer f.Close()
-	w := bufio.NewWriter(f)
-	size, err := fmt.Fprint(w, command.Key.String()+":"+command.Text)
+	state, err := readTopicState(pathToFile, command.Key)
 	if err != nil {
-		logging.AddError("Persistance: Write to file failed.", size, err.Error())
+		return err
 	}
-	w.Flush()
-	return err
+	old, ok := state.latest[command.Key]
+	// corrupted record is replaced as well, so replicas can repair it
+	if !ok || old.record.Flags&FlagDeleted != 0 {
+		err = ErrNotFound
+		logging.AddError(err.Error())
+		return err
+	}
+	err = fm.appendRecord(pathToFile, command)
+	if err != nil {
+		return err
+	}
+	fm.releaseValue(old.record)
+	return nil
 }
 
-func (fm *fileManager) Update(command Command) error {
+// Put appends a new version of the key whether it exists or not. The check
+// and the append hold the lock, so concurrent puts never duplicate the key.
+func (fm *fileManager) Put(command Command) error {
+	pathToFile, err := fm.topicPath(command.Topic)
+	if err != nil {
+		return err
+	}
 	mutex.Lock()
 	defer mutex.Unlock()
-	pathToFile := path.Clean(path.Join(fm.pathToDir, command.Topic))
-	fileHandle, _ := os.OpenFile(pathToFile, os.O_RDWR, 0777)
-	defer fileHandle.Close()
-	scanner := bufio.NewScanner(fileHandle)
-	splitFunc := newSplitFunc()
-	scanner.Split(splitFunc)
-	for scanner.Scan() {
-		oldBytesText := scanner.Bytes()
-		text := string(oldBytesText)
-		if strings.Contains(text, command.Key.String()) {
-			newText := command.Key.String() + ":" + command.Text + "\n"
-			newBytesText := []byte(newText)
-			diff := len(oldBytesText) - len(newBytesText)
-			// fits the message size - performs replacement
-			if diff >= 0 {
-				var additional string
-				for i := 0; i <= diff; i++ {
-					additional += " "
-				}
-				newBytesText = []byte(command.Key.String() + ":" + command.Text + additional + "\n")
-				newBytesText = bytes.Replace(oldBytesText, oldBytesText, newBytesText, -1)
-				fileHandle.Seek(0, 0)
-				n, err := fileHandle.WriteAt(newBytesText, pos-int64(len(oldBytesText)))
-				if err != nil {
-					logging.AddError("Update failed. Writen bytes: ", n, err.Error())
-					return err
-				}
-			} else {
-				// new message larger than old one - delete and append
-				var emptyLine string
-				for i := 0; i < len(oldBytesText); i++ {
-					emptyLine += " "
-				}
-				emptyLineBytes := []byte(emptyLine)
-				fileHandle.Seek(0, 0)
-				n, errDelete := fileHandle.WriteAt(emptyLineBytes, pos-int64(len(oldBytesText)))
-				if errDelete != nil {
-					logging.AddError("Update failed. Writen bytes: ", n, errDelete.Error())
-					return errDelete
-				}
-				fileHandle.Seek(0, 2) //EOF
-				n, errAppend := fileHandle.WriteString(newText)
-				if errAppend != nil {
-					logging.AddError("Update failed. Writen bytes: ", n, errAppend.Error())
-					return errAppend
-				}
-			}
+	state, err := readTopicState(pathToFile, command.Key)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	err = fm.appendRecord(pathToFile, command)
+	if err != nil {
+		return err
+	}
+	if old, ok := state.latest[command.Key]; ok && old.record.Flags&FlagDeleted == 0 {
+		fm.releaseValue(old.record)
+	}
+	return nil
+}
 
-			return nil
-		}
+// Delete appends a tombstone of the key
+func (fm *fileManager) Delete(command Command) error {
+	pathToFile, err := fm.topicPath(command.Topic)
+	if err != nil {
+		return err
 	}
-	err := errors.New("Item not found")
-	logging.AddError(err.Error())
-	return err
+	mutex.Lock()
+	defer mutex.Unlock()
+	state, err := readTopicState(pathToFile, command.Key)
+	if err != nil {
+		logging.AddError("Persistance: Can not open a file.", err.Error())
+		return err
+	}
+	old, ok := state.latest[command.Key]
+	if !ok || old.record.Flags&FlagDeleted != 0 {
+		err = ErrNotFound
+		logging.AddError(err.Error())
+		return err
+	}
+	tombstone := storedRecord{Flags: FlagDeleted, Timestamp: time.Now(), Key: command.Key}
+	err = appendToFile(pathToFile, encodeRecord(tombstone))
+	if err != nil {
+		logging.AddError("Delete failed.", err.Error())
+		return err
+	}
+	fm.releaseValue(old.record)
+	return nil
 }
 
 func (fm *fileManager) Read(query Query) (string, error) {
-	pathToFile := path.Clean(path.Join(fm.pathToDir, query.Topic))
-	fileHandle, _ := os.Open(pathToFile)
-	defer fileHandle.Close()
-	scanner := bufio.NewScanner(fileHandle)
-	for scanner.Scan() {
-		text := scanner.Text()
-		if strings.Contains(text, query.Key.String()) {
-			result := strings.SplitN(text, ":", 2)
-			if len(result) == 2 {
-				return result[1], nil
-			}
-		}
+	record, err := fm.ReadRecord(query)
+	return record.Text, err
+}
+
+// ReadRecord returns the latest version of the key with its timestamp and headers
+func (fm *fileManager) ReadRecord(query Query) (Record, error) {
+	pathToFile, err := fm.topicPath(query.Topic)
+	if err != nil {
+		return Record{}, err
+	}
+	state, err := readTopicState(pathToFile, query.Key)
+	if err != nil && !os.IsNotExist(err) {
+		return Record{}, err
+	}
+	latest, ok := state.latest[query.Key]
+	if !ok || latest.record.Flags&FlagDeleted != 0 {
+		return Record{}, ErrNotFound
+	}
+	if latest.corrupted {
+		err = &CorruptRecordError{Topic: query.Topic, Key: query.Key, Offset: latest.offset}
+		logging.AddError("Persistance:", err.Error())
+		return Record{}, err
+	}
+	text, err := fm.loadValue(latest.record)
+	if err != nil {
+		return Record{}, err
 	}
-	err := errors.New("Item not found")
-	return "", err
+	return Record{Key: query.Key, Text: text, Timestamp: latest.record.Timestamp, Headers: latest.record.Headers, Offset: latest.offset}, nil
+}
+
+// ReadStream reads value of the key, values stored as chunk
+// manifest are reassembled from chunks of the topic
+func (fm *fileManager) ReadStream(query Query) (io.ReadCloser, error) {
+	text, err := fm.Read(query)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := ParseManifest(text)
+	if !ok {
+		return io.NopCloser(strings.NewReader(text)), nil
+	}
+	return NewChunkReader(m.Chunks, func(key uuid.UUID) (string, error) {
+		return fm.Read(Query{Key: key, Topic: ChunkTopicName(query.Topic)})
+	}), nil
 }
 
 func (fm *fileManager) ReadFile(topic string) ([]byte, error) {
-	pathToFile := path.Clean(path.Join(fm.pathToDir, topic))
+	pathToFile, err := fm.topicPath(topic)
+	if err != nil {
+		return nil, err
+	}
 	byteArray, err := ioutil.ReadFile(pathToFile)
 	if err != nil {
 		if err != nil {
@@ -144,18 +214,264 @@ func (fm *fileManager) ReadFile(topic string) ([]byte, error) {
 	return byteArray, err
 }
 
-func newSplitFunc() bufio.SplitFunc {
-	var n int64
-	return func(data []byte, atEOF bool) (advance int, token []byte, err error) {
-		advance, token, err = bufio.ScanLines(data, atEOF)
-		if err == nil && (atEOF || advance > len(token)) {
-			// We found the end of a line
-			pos = n + int64(len(token))
-			token = append(([]byte)(nil), token...)
+// Scan returns the latest version of all keys of the topic
+// in the order the keys were first written
+func (fm *fileManager) Scan(topic string) ([]Record, error) {
+	pathToFile, err := fm.topicPath(topic)
+	if err != nil {
+		return nil, err
+	}
+	state, err := readTopicState(pathToFile, uuid.Nil)
+	if err != nil {
+		logging.AddError("Persistance: Can not read a file.", err.Error())
+		return nil, err
+	}
+	for _, offset := range state.unknown {
+		logging.AddError("Persistance:", (&CorruptRecordError{Topic: topic, Offset: offset}).Error())
+	}
+	records := []Record{}
+	for _, key := range state.keys {
+		latest := state.latest[key]
+		if latest.corrupted {
+			err = &CorruptRecordError{Topic: topic, Key: key, Offset: latest.offset}
+			logging.AddError("Persistance:", err.Error())
+			return nil, err
+		}
+		if latest.record.Flags&FlagDeleted != 0 {
+			continue
+		}
+		text, err := fm.loadValue(latest.record)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, Record{Key: key, Text: text, Timestamp: latest.record.Timestamp, Headers: latest.record.Headers, Offset: latest.offset})
+	}
+	return records, nil
+}
+
+// Verify checks all records of the topic and returns the corrupted ones,
+// that were not replaced by a newer version of the key
+func (fm *fileManager) Verify(topic string) ([]CorruptRecordError, error) {
+	pathToFile, err := fm.topicPath(topic)
+	if err != nil {
+		return nil, err
+	}
+	state, err := readTopicState(pathToFile, uuid.Nil)
+	if err != nil {
+		return nil, err
+	}
+	corrupted := []CorruptRecordError{}
+	for _, offset := range state.unknown {
+		corrupted = append(corrupted, CorruptRecordError{Topic: topic, Offset: offset})
+	}
+	for _, key := range state.keys {
+		latest := state.latest[key]
+		err := error(nil)
+		if !latest.corrupted {
+			_, err = fm.loadValue(latest.record)
+		}
+		if latest.corrupted || err != nil {
+			corrupted = append(corrupted, CorruptRecordError{Topic: topic, Key: key, Offset: latest.offset})
+		}
+	}
+	return corrupted, nil
+}
+
+// Topics returns names of all topics stored in the directory
+func (fm *fileManager) Topics() ([]string, error) {
+	entries, err := os.ReadDir(fm.pathToDir)
+	if err != nil {
+		return nil, err
+	}
+	topics := []string{}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		// internal files have names that are not valid topics
+		if topic, err := TopicFromFileName(entry.Name()); err == nil {
+			topics = append(topics, topic)
+		}
+	}
+	return topics, nil
+}
+
+// Returns path of the topic file, topic names are validated
+// so they can not point outside of the directory
+func (fm *fileManager) topicPath(topic string) (string, error) {
+	err := ValidateStorageTopic(topic)
+	if err != nil {
+		logging.AddError("Persistance: Topic rejected.", err.Error())
+		return "", err
+	}
+	return path.Join(fm.pathToDir, TopicFileName(topic)), nil
+}
+
+// CollectGarbage removes blobs no longer referenced by any record
+func (fm *fileManager) CollectGarbage() (int, error) {
+	fm.gcLock.Lock()
+	defer fm.gcLock.Unlock()
+	return fm.blobs.GC()
+}
+
+// Encodes the command and appends it to the topic file
+func (fm *fileManager) appendRecord(pathToFile string, command Command) error {
+	if err := validateHeaders(command.Headers); err != nil {
+		return err
+	}
+	// records appended to a text file would be lost by the migration
+	if isText, _ := isTextTopicFile(pathToFile); isText {
+		return ErrLegacyFormat
+	}
+	value, flags, err := fm.storeText(command.Text)
+	if err != nil {
+		return err
+	}
+	timestamp := command.Timestamp
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+	record := storedRecord{Flags: flags, Timestamp: timestamp, Key: command.Key, Headers: command.Headers, Value: value}
+	encoded := encodeRecord(record)
+	if len(encoded)-recordHeaderSize-recordChecksumSize > MaxRecordSize {
+		// the reader would skip the record as corrupted
+		fm.releaseValue(record)
+		return ErrRecordTooLarge
+	}
+	err = appendToFile(pathToFile, encoded)
+	if err != nil {
+		logging.AddError("Persistance: Write to file failed.", err.Error())
+		fm.releaseValue(record)
+	}
+	return err
+}
+
+// Texts above DedupThreshold are split into chunks kept in the blob store,
+// the record stores only the hashes of the chunks
+func (fm *fileManager) storeText(text string) ([]byte, uint8, error) {
+	if len(text) < DedupThreshold {
+		return []byte(text), 0, nil
+	}
+	hashes := []string{}
+	for offset := 0; offset < len(text); offset += ChunkSize {
+		end := offset + ChunkSize
+		if end > len(text) {
+			end = len(text)
+		}
+		hash, err := fm.blobs.Put([]byte(text[offset:end]))
+		if err != nil {
+			fm.releaseValue(storedRecord{Flags: FlagBlobRef, Value: []byte(strings.Join(hashes, ","))})
+			return nil, 0, err
+		}
+		hashes = append(hashes, hash)
+	}
+	return []byte(strings.Join(hashes, ",")), FlagBlobRef, nil
+}
+
+// Returns text of the record, chunks of blob references are reassembled
+func (fm *fileManager) loadValue(record storedRecord) (string, error) {
+	if record.Flags&FlagBlobRef == 0 {
+		return string(record.Value), nil
+	}
+	var builder strings.Builder
+	for _, hash := range strings.Split(string(record.Value), ",") {
+		data, err := fm.blobs.Get(hash)
+		if err != nil {
+			return "", err
 		}
-		n += int64(advance)
+		builder.Write(data)
+	}
+	return builder.String(), nil
+}
+
+// Drops references of the record to its chunks
+func (fm *fileManager) releaseValue(record storedRecord) {
+	if record.Flags&FlagBlobRef == 0 {
 		return
 	}
+	for _, hash := range strings.Split(string(record.Value), ",") {
+		if hash != "" {
+			fm.blobs.Release(hash)
+		}
+	}
+}
+
+// keyState is the latest version of a key in a topic file
+type keyState struct {
+	record    storedRecord
+	offset    int64
+	corrupted bool
+}
+
+// topicState is the content of a topic file after replaying its records
+type topicState struct {
+	// keys in the order they were first written
+	keys   []uuid.UUID
+	latest map[uuid.UUID]keyState
+	// offsets of corrupted records without a readable key
+	unknown []int64
+}
+
+// Returns reference counts of blobs held by live records
+func (state topicState) blobRefs() map[string]int {
+	refs := make(map[string]int)
+	for _, latest := range state.latest {
+		if latest.corrupted || latest.record.Flags&FlagBlobRef == 0 || latest.record.Flags&FlagDeleted != 0 {
+			continue
+		}
+		for _, hash := range strings.Split(string(latest.record.Value), ",") {
+			if hash != "" {
+				refs[hash]++
+			}
+		}
+	}
+	return refs
+}
+
+// Replays records of the topic file. If the key is set,
+// only records of the key are kept.
+func readTopicState(pathToFile string, key uuid.UUID) (topicState, error) {
+	fileHandle, err := os.Open(pathToFile)
+	if err != nil {
+		return topicState{keys: []uuid.UUID{}, latest: make(map[uuid.UUID]keyState), unknown: []int64{}}, err
+	}
+	defer fileHandle.Close()
+	return readState(fileHandle, key)
+}
+
+func readState(file io.ReaderAt, key uuid.UUID) (topicState, error) {
+	state := topicState{keys: []uuid.UUID{}, latest: make(map[uuid.UUID]keyState), unknown: []int64{}}
+	reader := newRecordReader(file)
+	for {
+		record, offset, err := reader.Next()
+		if err == io.EOF {
+			return state, nil
+		}
+		if err == ErrLegacyFormat {
+			return state, err
+		}
+		if err != nil && record.Key == uuid.Nil {
+			state.unknown = append(state.unknown, offset)
+			continue
+		}
+		if key != uuid.Nil && record.Key != key {
+			continue
+		}
+		if _, ok := state.latest[record.Key]; !ok {
+			state.keys = append(state.keys, record.Key)
+		}
+		state.latest[record.Key] = keyState{record: record, offset: offset, corrupted: err != nil}
+	}
+}
+
+func appendToFile(pathToFile string, data []byte) error {
+	f, err := createOrAppendFile(pathToFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(data)
+	return err
 }
 
 func createOrAppendFile(pathToFile string) (*os.File, error) {
@@ -0,0 +1,205 @@
+package persistance
+
+import (
+	"bufio"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/vlado-github/tinydfs/logging"
+)
+
+// Prefix of blob references in text topic files
+const legacyBlobMarker = "\x1eblob:"
+
+const legacyKeyLength = 36
+const legacyChecksumLength = 8
+
+// Every record of the text format starts with its key and a colon. Records
+// may be merged into one line when an update lost the line break.
+var legacyRecordStart = regexp.MustCompile(`[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}:`)
+
+// MigrateDirectory converts all text topic files of the directory to
+// the binary record format. Files are renamed to their encoded topic
+// names. Returns the number of migrated files.
+func MigrateDirectory(pathDir string) (int, error) {
+	entries, err := os.ReadDir(pathDir)
+	if err != nil {
+		return 0, err
+	}
+	migrated := 0
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		topic, err := TopicFromFileName(entry.Name())
+		if err != nil {
+			continue
+		}
+		pathToFile := path.Join(pathDir, entry.Name())
+		isText, err := isTextTopicFile(pathToFile)
+		if err != nil || !isText {
+			continue
+		}
+		err = migrateTopicFile(pathToFile, path.Join(pathDir, TopicFileName(topic)))
+		if err != nil {
+			logging.AddError("Persistance: Migration failed.", entry.Name(), err.Error())
+			return migrated, err
+		}
+		logging.AddInfo("Persistance: Topic migrated.", topic)
+		migrated++
+	}
+	return migrated, nil
+}
+
+func isTextTopicFile(pathToFile string) (bool, error) {
+	f, err := os.Open(pathToFile)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	return isLegacyFile(f), nil
+}
+
+// Text topic files have a line starting with a key, the first line
+// may be blank when its record was updated or deleted
+func isLegacyFile(file io.ReaderAt) bool {
+	magic := make([]byte, 2)
+	if n, _ := file.ReadAt(magic, 0); n == 2 && hasMagic(magic) {
+		return false
+	}
+	scanner := bufio.NewScanner(io.NewSectionReader(file, 0, math.MaxInt64))
+	scanner.Buffer(make([]byte, 0, bufio.MaxScanTokenSize), MaxRecordSize)
+	for scanner.Scan() {
+		if start := legacyRecordStart.FindIndex(scanner.Bytes()); start != nil && start[0] == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Rewrites records of the text file as binary records. The new file
+// replaces the old one only after it was completely written.
+func migrateTopicFile(pathToFile string, pathToNewFile string) error {
+	source, err := os.Open(pathToFile)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	info, err := source.Stat()
+	if err != nil {
+		return err
+	}
+	tmpPath := pathToNewFile + ".migrating"
+	target, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0660)
+	if err != nil {
+		return err
+	}
+	err = convertTextRecords(source, target, info.ModTime())
+	if closeErr := target.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	err = os.Rename(tmpPath, pathToNewFile)
+	if err != nil {
+		return err
+	}
+	if pathToNewFile != pathToFile {
+		return os.Remove(pathToFile)
+	}
+	return nil
+}
+
+func convertTextRecords(r io.Reader, w io.Writer, timestamp time.Time) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, bufio.MaxScanTokenSize), MaxRecordSize)
+	line := 0
+	for scanner.Scan() {
+		line++
+		for _, text := range splitLegacyLine(scanner.Text()) {
+			record, ok := parseLegacyLine(text)
+			if !ok {
+				if strings.TrimSpace(text) != "" {
+					logging.AddWarning("Persistance: Skipping invalid text record.", line)
+				}
+				continue
+			}
+			record.Timestamp = timestamp
+			if _, err := w.Write(encodeRecord(record)); err != nil {
+				return err
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// Splits a line at keys of merged records, e.g. "<k1>:hello<k2>:world".
+// Only records of the first text format were appended without a line
+// break, a line that ends with its checksum is a single record even if
+// the text contains a key.
+func splitLegacyLine(line string) []string {
+	if _, ok := legacyChecksumEnd(line); ok {
+		return []string{line}
+	}
+	starts := legacyRecordStart.FindAllStringIndex(line, -1)
+	if len(starts) == 0 {
+		return []string{line}
+	}
+	result := make([]string, 0, len(starts)+1)
+	if starts[0][0] > 0 {
+		result = append(result, line[:starts[0][0]])
+	}
+	for i, start := range starts {
+		end := len(line)
+		if i+1 < len(starts) {
+			end = starts[i+1][0]
+		}
+		result = append(result, line[start[0]:end])
+	}
+	return result
+}
+
+// Returns end of the text, if the line ends with checksum of the key and text
+func legacyChecksumEnd(line string) (int, bool) {
+	line = strings.TrimRight(line, " ")
+	end := len(line) - legacyChecksumLength - 1
+	if end <= legacyKeyLength || line[legacyKeyLength] != ':' || line[end] != ':' {
+		return 0, false
+	}
+	checksum := fmt.Sprintf("%08x", crc32.Checksum([]byte(line[:end]), castagnoli))
+	return end, line[end+1:] == checksum
+}
+
+// Parses a line of the text format, with or without the trailing
+// checksum. Blank lines are left by deleted records.
+func parseLegacyLine(line string) (storedRecord, bool) {
+	// padding is left by in-place updates
+	line = strings.TrimRight(line, " ")
+	if len(line) <= legacyKeyLength || line[legacyKeyLength] != ':' {
+		return storedRecord{}, false
+	}
+	key, err := uuid.Parse(line[:legacyKeyLength])
+	if err != nil {
+		return storedRecord{}, false
+	}
+	text := line[legacyKeyLength+1:]
+	if end, ok := legacyChecksumEnd(line); ok {
+		text = line[legacyKeyLength+1 : end]
+	}
+	record := storedRecord{Key: key, Value: []byte(text)}
+	if strings.HasPrefix(text, legacyBlobMarker) {
+		record.Flags = FlagBlobRef
+		record.Value = []byte(strings.TrimPrefix(text, legacyBlobMarker))
+	}
+	return record, true
+}
@@ -1,10 +1,16 @@
 package persistance
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
 	"os"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"testing"
 
@@ -193,3 +199,408 @@ func cleanUp() {
 		fmt.Println(err.Error())
 	}
 }
+
+func TestFileManager_Scan(t *testing.T) {
+	key := uuid.New()
+	cmd := Command{
+		Key:   key,
+		Text:  "This is testing message for persistance: scan.",
+		Topic: topic,
+	}
+	err := fm.Write(cmd)
+	if err != nil {
+		t.Fail()
+	}
+	records, err := fm.Scan(topic)
+	if err != nil || len(records) == 0 {
+		t.Fail()
+	}
+	last := records[len(records)-1]
+	if last.Key != key || last.Text != cmd.Text {
+		t.Fail()
+	}
+}
+
+func TestFileManager_Delete(t *testing.T) {
+	key := uuid.New()
+	cmd := Command{
+		Key:   key,
+		Text:  "This is testing message for persistance: delete.",
+		Topic: topic,
+	}
+	err := fm.Write(cmd)
+	if err != nil {
+		t.Fail()
+	}
+	err = fm.Delete(cmd)
+	if err != nil {
+		t.Fail()
+	}
+	query := Query{
+		Key:   key,
+		Topic: topic,
+	}
+	_, err = fm.Read(query)
+	if err == nil {
+		t.Fail()
+	}
+}
+
+func TestFileManager_ReadStream(t *testing.T) {
+	data := bytes.Repeat([]byte("chunked payload "), ChunkSize/8)
+	manifest := Manifest{Size: int64(len(data))}
+	for offset := 0; offset < len(data); offset += ChunkSize {
+		end := offset + ChunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		key := uuid.New()
+		err := fm.Write(Command{Key: key, Topic: ChunkTopicName(topic), Text: EncodeChunk(data[offset:end])})
+		if err != nil {
+			t.Fail()
+		}
+		manifest.Chunks = append(manifest.Chunks, NewChunkRef(key, data[offset:end]))
+	}
+	text, err := EncodeManifest(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := uuid.New()
+	fm.Write(Command{Key: key, Topic: topic, Text: text})
+
+	reader, err := fm.ReadStream(Query{Key: key, Topic: topic})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := io.ReadAll(reader)
+	if err != nil || !bytes.Equal(result, data) {
+		t.Fail()
+	}
+	os.Remove(path.Join(pathToDir, ChunkTopicName(topic)))
+}
+
+func TestDecodeChunk_Corrupted(t *testing.T) {
+	ref := NewChunkRef(uuid.New(), []byte("original"))
+	_, err := DecodeChunk(EncodeChunk([]byte("modified")), ref)
+	if err != ErrChunkCorrupted {
+		t.Fail()
+	}
+}
+
+func TestFileManager_Deduplication(t *testing.T) {
+	dedupFm := NewFileManager(t.TempDir())
+	text := strings.Repeat("artifact ", DedupThreshold)
+	first, second := uuid.New(), uuid.New()
+	dedupFm.Write(Command{Key: first, Topic: topic, Text: text})
+	dedupFm.Write(Command{Key: second, Topic: topic, Text: text})
+
+	blobs := dedupFm.(*fileManager).blobs
+	hash := BlobHash([]byte(text))
+	if blobs.RefCount(hash) != 2 {
+		t.Fatal(blobs.RefCount(hash))
+	}
+	result, err := dedupFm.Read(Query{Key: second, Topic: topic})
+	if err != nil || result != text {
+		t.Fail()
+	}
+
+	dedupFm.Delete(Command{Key: first, Topic: topic})
+	if removed, _ := dedupFm.CollectGarbage(); removed != 0 {
+		t.Fail()
+	}
+	dedupFm.Delete(Command{Key: second, Topic: topic})
+	if removed, _ := dedupFm.CollectGarbage(); removed != 1 {
+		t.Fail()
+	}
+	if _, err := blobs.Get(hash); err != ErrBlobNotFound {
+		t.Fail()
+	}
+}
+
+func TestFileManager_OverwriteReleasesBlobs(t *testing.T) {
+	overwriteFm := NewFileManager(t.TempDir())
+	key := uuid.New()
+	first := strings.Repeat("first ", DedupThreshold)
+	second := strings.Repeat("second ", DedupThreshold)
+	overwriteFm.Write(Command{Key: key, Topic: topic, Text: first})
+	overwriteFm.Write(Command{Key: key, Topic: topic, Text: second})
+
+	if removed, _ := overwriteFm.CollectGarbage(); removed != 1 {
+		t.Error(removed)
+	}
+	blobs := overwriteFm.(*fileManager).blobs
+	if _, err := blobs.Get(BlobHash([]byte(first))); err != ErrBlobNotFound {
+		t.Error(err)
+	}
+	if result, err := overwriteFm.Read(Query{Key: key, Topic: topic}); err != nil || result != second {
+		t.Error(err)
+	}
+}
+
+func TestBlobStore_RefsLog(t *testing.T) {
+	dir := t.TempDir()
+	blobs := NewBlobStore(dir)
+	first, _ := blobs.Put([]byte("first"))
+	blobs.Put([]byte("first"))
+	second, _ := blobs.Put([]byte("second"))
+	blobs.Release(first)
+	blobs.Release(second)
+
+	data, err := os.ReadFile(path.Join(dir, refsFileName))
+	if err != nil || strings.Count(string(data), "\n") != 5 {
+		t.Fatal(string(data), err)
+	}
+	restored := NewBlobStore(dir)
+	if restored.RefCount(first) != 1 || restored.RefCount(second) != 0 {
+		t.Error(restored.RefCount(first), restored.RefCount(second))
+	}
+}
+
+func TestValidateTopic(t *testing.T) {
+	for _, name := range []string{"sport", "Sport.News_2024-01", strings.Repeat("a", MaxTopicLength)} {
+		if err := ValidateTopic(name); err != nil {
+			t.Error(name, err)
+		}
+	}
+	for _, name := range []string{"", ".", "..", "../etc", "a/b", "a\\b", "a\x00b", "a#1", strings.Repeat("a", MaxTopicLength+1)} {
+		if err := ValidateTopic(name); !errors.Is(err, ErrInvalidTopic) {
+			t.Error(name, err)
+		}
+	}
+	if err := ValidateTopic("__internal"); !errors.Is(err, ErrReservedTopic) {
+		t.Error(err)
+	}
+	if err := ValidateStorageTopic(ChunkTopicName("sport") + "#3"); err != nil {
+		t.Error(err)
+	}
+	if err := ValidateStorageTopic("sport#-1"); !errors.Is(err, ErrInvalidTopic) {
+		t.Error(err)
+	}
+}
+
+func TestTopicFileName(t *testing.T) {
+	expected := map[string]string{
+		"sport":      "sport",
+		"Sport":      "%53port",
+		"con":        "%63on",
+		"Aux.txt":    "%41ux.txt",
+		"console":    "console",
+		".hidden.":   "%2Ehidden%2E",
+		"sport#2":    "sport%232",
+		"__chunks_a": "__chunks_a",
+	}
+	for topic, fileName := range expected {
+		if TopicFileName(topic) != fileName {
+			t.Error(topic, TopicFileName(topic))
+		}
+		decoded, err := TopicFromFileName(fileName)
+		if err != nil || decoded != topic {
+			t.Error(fileName, decoded, err)
+		}
+	}
+}
+
+func TestFileManager_RejectsTraversal(t *testing.T) {
+	err := fm.Write(Command{Key: uuid.New(), Topic: "../escaped", Text: "text"})
+	if !errors.Is(err, ErrInvalidTopic) {
+		t.Error(err)
+	}
+	if _, err := os.Stat(path.Join(pathToDir, "..", "escaped")); !os.IsNotExist(err) {
+		t.Error("File written outside of the directory")
+	}
+	if _, err := fm.Read(Query{Key: uuid.New(), Topic: "/etc/passwd"}); !errors.Is(err, ErrInvalidTopic) {
+		t.Error(err)
+	}
+}
+
+func TestFileManager_Checksum(t *testing.T) {
+	dir := t.TempDir()
+	checkedFm := NewFileManager(dir)
+	healthy, damaged := uuid.New(), uuid.New()
+	checkedFm.Write(Command{Key: healthy, Topic: topic, Text: "trailing spaces  "})
+	checkedFm.Write(Command{Key: damaged, Topic: topic, Text: "original text"})
+
+	pathToFile := path.Join(dir, topic)
+	content, _ := os.ReadFile(pathToFile)
+	os.WriteFile(pathToFile, bytes.Replace(content, []byte("original"), []byte("origina1"), 1), 0660)
+
+	if text, err := checkedFm.Read(Query{Key: healthy, Topic: topic}); err != nil || text != "trailing spaces  " {
+		t.Error(text, err)
+	}
+	_, err := checkedFm.Read(Query{Key: damaged, Topic: topic})
+	var corrupted *CorruptRecordError
+	if !errors.As(err, &corrupted) || corrupted.Key != damaged || corrupted.Offset == 0 {
+		t.Fatal(err)
+	}
+	report, err := checkedFm.Verify(topic)
+	if err != nil || len(report) != 1 || report[0].Key != damaged {
+		t.Fatal(report, err)
+	}
+
+	checkedFm.Update(Command{Key: damaged, Topic: topic, Text: "original text"})
+	if report, _ := checkedFm.Verify(topic); len(report) != 0 {
+		t.Error(report)
+	}
+	if topics, _ := checkedFm.Topics(); len(topics) != 1 || topics[0] != topic {
+		t.Error(topics)
+	}
+}
+
+func TestFileManager_Framing(t *testing.T) {
+	framedFm := NewFileManager(t.TempDir())
+	key := uuid.New()
+	text := "first line\nsecond: line\x00\n"
+	framedFm.Write(Command{Key: key, Topic: topic, Text: text, Headers: map[string]string{"source": "test"}})
+	records, err := framedFm.Scan(topic)
+	if err != nil || len(records) != 1 || records[0].Text != text || records[0].Headers["source"] != "test" {
+		t.Fatal(records, err)
+	}
+	if records[0].Timestamp.IsZero() {
+		t.Error("Timestamp not stored")
+	}
+}
+
+func TestFileManager_SizeLimits(t *testing.T) {
+	limitedFm := NewFileManager(t.TempDir())
+	long := strings.Repeat("h", math.MaxUint16+1)
+	err := limitedFm.Write(Command{Key: uuid.New(), Topic: topic, Text: "text", Headers: map[string]string{"source": long}})
+	if !errors.Is(err, ErrHeaderTooLarge) {
+		t.Error(err)
+	}
+	headers := map[string]string{}
+	for i := 0; i*math.MaxUint16 <= MaxRecordSize; i++ {
+		headers[strconv.Itoa(i)] = long[1:]
+	}
+	err = limitedFm.Write(Command{Key: uuid.New(), Topic: topic, Text: "text", Headers: headers})
+	if !errors.Is(err, ErrRecordTooLarge) {
+		t.Error(err)
+	}
+	if records, _ := limitedFm.Scan(topic); len(records) != 0 {
+		t.Error(records)
+	}
+}
+
+func TestMigrateDirectory(t *testing.T) {
+	dir := t.TempDir()
+	plain, checked, deleted, merged, quoting := uuid.New(), uuid.New(), uuid.New(), uuid.New(), uuid.New()
+	checkedLine := checked.String() + ":checked text"
+	// text of a checksummed record may contain a key
+	quotingLine := quoting.String() + ":see " + plain.String() + ":plain text"
+	// the blanked first line is left by a deleted record
+	content := strings.Repeat(" ", len(deleted.String())+8) + "\n" +
+		plain.String() + ":plain text   " + merged.String() + ":merged text\n" +
+		fmt.Sprintf("%s:%08x\n", checkedLine, crc32.Checksum([]byte(checkedLine), castagnoli)) +
+		fmt.Sprintf("%s:%08x\n", quotingLine, crc32.Checksum([]byte(quotingLine), castagnoli))
+	os.WriteFile(path.Join(dir, "Sport"), []byte(content), 0660)
+	os.WriteFile(path.Join(dir, "news"), []byte(content), 0660)
+
+	migratedFm := NewFileManager(dir)
+	if _, err := migratedFm.Scan("news"); !errors.Is(err, ErrLegacyFormat) {
+		t.Fatal(err)
+	}
+	if err := migratedFm.Write(Command{Key: uuid.New(), Topic: "news", Text: "lost"}); !errors.Is(err, ErrLegacyFormat) {
+		t.Error("Write to text file", err)
+	}
+	if data, _ := os.ReadFile(path.Join(dir, "news")); string(data) != content {
+		t.Error("Text file changed before migration")
+	}
+	migrated, err := MigrateDirectory(dir)
+	if err != nil || migrated != 2 {
+		t.Fatal(migrated, err)
+	}
+	if _, err := os.Stat(path.Join(dir, "Sport")); !os.IsNotExist(err) {
+		t.Error("Text file was not replaced")
+	}
+	if text, err := migratedFm.Read(Query{Key: plain, Topic: "Sport"}); err != nil || text != "plain text" {
+		t.Error(text, err)
+	}
+	if text, err := migratedFm.Read(Query{Key: checked, Topic: "Sport"}); err != nil || text != "checked text" {
+		t.Error(text, err)
+	}
+	if text, err := migratedFm.Read(Query{Key: merged, Topic: "Sport"}); err != nil || text != "merged text" {
+		t.Error(text, err)
+	}
+	if text, err := migratedFm.Read(Query{Key: quoting, Topic: "Sport"}); err != nil || text != "see "+plain.String()+":plain text" {
+		t.Error(text, err)
+	}
+	if text, err := migratedFm.Read(Query{Key: plain, Topic: "Sport"}); err != nil || text != "plain text" {
+		t.Error("Record split at a key in the text", text, err)
+	}
+	if migrated, _ := MigrateDirectory(dir); migrated != 0 {
+		t.Error("Binary file migrated again")
+	}
+}
+
+func TestFileManager_SnapshotRestore(t *testing.T) {
+	snapshotFm := NewFileManager(t.TempDir())
+	kept, deleted, large := uuid.New(), uuid.New(), uuid.New()
+	largeText := strings.Repeat("snapshot ", DedupThreshold)
+	snapshotFm.Write(Command{Key: kept, Topic: topic, Text: "kept"})
+	snapshotFm.Write(Command{Key: deleted, Topic: topic, Text: "deleted later"})
+	snapshotFm.Write(Command{Key: large, Topic: "large", Text: largeText})
+
+	var buffer bytes.Buffer
+	manifest, err := snapshotFm.Snapshot(&buffer)
+	if err != nil || len(manifest.Topics) != 2 || manifest.Blobs != 1 {
+		t.Fatal(manifest, err)
+	}
+	snapshotFm.Delete(Command{Key: deleted, Topic: topic})
+	snapshotFm.Delete(Command{Key: large, Topic: "large"})
+	snapshotFm.CollectGarbage()
+	snapshotFm.Write(Command{Key: uuid.New(), Topic: "after", Text: "written after"})
+
+	restored, err := snapshotFm.Restore(bytes.NewReader(buffer.Bytes()))
+	if err != nil || !restored.CreatedAt.Equal(manifest.CreatedAt) {
+		t.Fatal(restored, err)
+	}
+	if text, err := snapshotFm.Read(Query{Key: deleted, Topic: topic}); err != nil || text != "deleted later" {
+		t.Error(text, err)
+	}
+	if text, err := snapshotFm.Read(Query{Key: large, Topic: "large"}); err != nil || text != largeText {
+		t.Error(err)
+	}
+	if topics, _ := snapshotFm.Topics(); len(topics) != 2 {
+		t.Error(topics)
+	}
+	if snapshotFm.(*fileManager).blobs.RefCount(BlobHash([]byte(largeText))) != 1 {
+		t.Error("Blob references not rebuilt")
+	}
+
+	damaged := bytes.Replace(buffer.Bytes(), []byte("kept"), []byte("kepd"), 1)
+	if _, err := snapshotFm.Restore(bytes.NewReader(damaged)); !errors.Is(err, ErrInvalidSnapshot) {
+		t.Error(err)
+	}
+	if refs := snapshotFm.(*fileManager).blobs.RefCount(BlobHash([]byte(largeText))); refs != 1 {
+		t.Error("Blob of the failed restore still referenced", refs)
+	}
+}
+
+func TestFileManager_RestoreFinishedAfterCrash(t *testing.T) {
+	dir := path.Join(t.TempDir(), "data")
+	crashedFm := NewFileManager(dir)
+	key := uuid.New()
+	crashedFm.Write(Command{Key: key, Topic: topic, Text: "restored"})
+	content, err := crashedFm.ReadFile(topic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crashedFm.Update(Command{Key: key, Topic: topic, Text: "replaced"})
+	crashedFm.Write(Command{Key: uuid.New(), Topic: "after", Text: "not in snapshot"})
+
+	// crash after the restore was committed, before topic files were swapped
+	stagingDir := dir + ".restore"
+	os.MkdirAll(stagingDir, os.ModePerm)
+	os.WriteFile(path.Join(stagingDir, TopicFileName(topic)), content, 0660)
+	os.WriteFile(path.Join(stagingDir, restoreCommitFile), []byte(`["`+topic+`"]`), 0660)
+
+	recoveredFm := NewFileManager(dir)
+	if text, err := recoveredFm.Read(Query{Key: key, Topic: topic}); err != nil || text != "restored" {
+		t.Error(text, err)
+	}
+	if topics, _ := recoveredFm.Topics(); len(topics) != 1 {
+		t.Error(topics)
+	}
+	if _, err := os.Stat(stagingDir); !os.IsNotExist(err) {
+		t.Error(err)
+	}
+}
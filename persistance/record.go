@@ -0,0 +1,37 @@
+package persistance
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type Record struct {
+	Key       uuid.UUID
+	Text      string
+	Timestamp time.Time         `json:",omitzero"`
+	Headers   map[string]string `json:",omitempty"`
+	// Offset of the latest version in the local topic file
+	Offset int64 `json:"-"`
+}
+
+// ErrRecordCorrupted is returned for records that do not match their checksum
+var ErrRecordCorrupted = errors.New("Record is corrupted")
+
+// CorruptRecordError describes a stored record that failed verification.
+// Key is uuid.Nil if the key itself is not readable.
+type CorruptRecordError struct {
+	Topic  string
+	Key    uuid.UUID
+	Offset int64
+}
+
+func (e *CorruptRecordError) Error() string {
+	return fmt.Sprintf("%s: topic %s, key %s, offset %d", ErrRecordCorrupted.Error(), e.Topic, e.Key.String(), e.Offset)
+}
+
+func (e *CorruptRecordError) Unwrap() error {
+	return ErrRecordCorrupted
+}
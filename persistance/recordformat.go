@@ -0,0 +1,220 @@
+package persistance
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// RecordFormatVersion is the version written to new records
+const RecordFormatVersion uint8 = 1
+
+// Record flags
+const (
+	// FlagDeleted marks a tombstone of a deleted key
+	FlagDeleted uint8 = 1 << iota
+	// FlagBlobRef marks a value that lists hashes of blob store chunks
+	FlagBlobRef
+)
+
+// Every record starts with the magic, so a reader can find
+// the next record after a corrupted one
+var recordMagic = [2]byte{0xd5, 0x5d}
+
+// Record layout, integers are big endian:
+//
+//	magic     [2]byte
+//	version   uint8
+//	flags     uint8
+//	length    uint32 length of the body
+//	body:
+//	  timestamp int64 unix nanoseconds
+//	  key       [16]byte
+//	  headers   uint16 count, then uint16 length prefixed names and values
+//	  value     rest of the body
+//	checksum  uint32 CRC32C of version, flags, length and body
+const recordHeaderSize = 8
+const recordChecksumSize = 4
+const minBodySize = 8 + 16 + 2
+
+var ErrLegacyFormat = errors.New("Topic file has the text format, it has to be migrated")
+var ErrHeaderTooLarge = errors.New("Header name or value is longer than 65535 bytes")
+var ErrRecordTooLarge = errors.New("Record is larger than MaxRecordSize")
+
+var errFraming = errors.New("Invalid record framing")
+
+// storedRecord is a record as it is kept in a topic file
+type storedRecord struct {
+	Flags     uint8
+	Timestamp time.Time
+	Key       uuid.UUID
+	Headers   map[string]string
+	Value     []byte
+}
+
+func encodeRecord(record storedRecord) []byte {
+	body := &bytes.Buffer{}
+	binary.Write(body, binary.BigEndian, record.Timestamp.UnixNano())
+	body.Write(record.Key[:])
+	names := make([]string, 0, len(record.Headers))
+	for name := range record.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	binary.Write(body, binary.BigEndian, uint16(len(names)))
+	for _, name := range names {
+		writeShortString(body, name)
+		writeShortString(body, record.Headers[name])
+	}
+	body.Write(record.Value)
+
+	buffer := make([]byte, recordHeaderSize, recordHeaderSize+body.Len()+recordChecksumSize)
+	copy(buffer, recordMagic[:])
+	buffer[2] = RecordFormatVersion
+	buffer[3] = record.Flags
+	binary.BigEndian.PutUint32(buffer[4:], uint32(body.Len()))
+	buffer = append(buffer, body.Bytes()...)
+	checksum := crc32.Checksum(buffer[2:], castagnoli)
+	return binary.BigEndian.AppendUint32(buffer, checksum)
+}
+
+// Names and values of headers are stored with uint16 lengths
+func validateHeaders(headers map[string]string) error {
+	for name, value := range headers {
+		if len(name) > math.MaxUint16 || len(value) > math.MaxUint16 {
+			return ErrHeaderTooLarge
+		}
+	}
+	return nil
+}
+
+func writeShortString(w *bytes.Buffer, value string) {
+	binary.Write(w, binary.BigEndian, uint16(len(value)))
+	w.WriteString(value)
+}
+
+func decodeBody(flags uint8, body []byte) (storedRecord, error) {
+	if len(body) < minBodySize {
+		return storedRecord{}, errFraming
+	}
+	record := storedRecord{Flags: flags}
+	record.Timestamp = time.Unix(0, int64(binary.BigEndian.Uint64(body))).UTC()
+	copy(record.Key[:], body[8:24])
+	count := int(binary.BigEndian.Uint16(body[24:]))
+	offset := minBodySize
+	readShortString := func() (string, bool) {
+		if offset+2 > len(body) {
+			return "", false
+		}
+		size := int(binary.BigEndian.Uint16(body[offset:]))
+		offset += 2
+		if offset+size > len(body) {
+			return "", false
+		}
+		value := string(body[offset : offset+size])
+		offset += size
+		return value, true
+	}
+	if count > 0 {
+		record.Headers = make(map[string]string, count)
+	}
+	for i := 0; i < count; i++ {
+		name, okName := readShortString()
+		value, okValue := readShortString()
+		if !okName || !okValue {
+			return storedRecord{}, errFraming
+		}
+		record.Headers[name] = value
+	}
+	record.Value = body[offset:]
+	return record, nil
+}
+
+// recordReader iterates records of a topic file. Corrupted records
+// are returned as errors with their offset and reading continues
+// with the next record.
+type recordReader struct {
+	file   io.ReaderAt
+	offset int64
+}
+
+func newRecordReader(file io.ReaderAt) *recordReader {
+	return &recordReader{file: file}
+}
+
+// Next returns the record and its offset. Corrupted records return
+// ErrRecordCorrupted with the key if it is readable, io.EOF ends the file.
+func (rr *recordReader) Next() (storedRecord, int64, error) {
+	start := rr.offset
+	header := make([]byte, recordHeaderSize)
+	n, _ := rr.file.ReadAt(header, start)
+	if n == 0 {
+		return storedRecord{}, start, io.EOF
+	}
+	if start == 0 && !hasMagic(header) && isLegacyFile(rr.file) {
+		return storedRecord{}, start, ErrLegacyFormat
+	}
+	if n < recordHeaderSize || !hasMagic(header) {
+		rr.resync(start + 1)
+		return storedRecord{}, start, ErrRecordCorrupted
+	}
+	length := int(binary.BigEndian.Uint32(header[4:]))
+	if length > MaxRecordSize || length < minBodySize {
+		rr.resync(start + 1)
+		return storedRecord{}, start, ErrRecordCorrupted
+	}
+	size := recordHeaderSize + length + recordChecksumSize
+	buffer := make([]byte, size)
+	copy(buffer, header)
+	n, _ = rr.file.ReadAt(buffer[recordHeaderSize:], start+recordHeaderSize)
+	if n < size-recordHeaderSize {
+		// torn write at the end of the file
+		rr.resync(start + 1)
+		return storedRecord{}, start, ErrRecordCorrupted
+	}
+	body := buffer[recordHeaderSize : size-recordChecksumSize]
+	checksum := binary.BigEndian.Uint32(buffer[size-recordChecksumSize:])
+	record, err := decodeBody(buffer[3], body)
+	if err != nil || crc32.Checksum(buffer[2:size-recordChecksumSize], castagnoli) != checksum {
+		// length is trusted only if the next record starts right after
+		next := make([]byte, 2)
+		n, _ = rr.file.ReadAt(next, start+int64(size))
+		if n == 0 || n == 2 && hasMagic(next) {
+			rr.offset = start + int64(size)
+		} else {
+			rr.resync(start + 1)
+		}
+		return storedRecord{Key: record.Key}, start, ErrRecordCorrupted
+	}
+	rr.offset = start + int64(size)
+	return record, start, nil
+}
+
+// Moves to the next record magic at or after the offset
+func (rr *recordReader) resync(offset int64) {
+	buffer := make([]byte, 64*1024)
+	for {
+		n, err := rr.file.ReadAt(buffer, offset)
+		if i := bytes.Index(buffer[:n], recordMagic[:]); i >= 0 {
+			rr.offset = offset + int64(i)
+			return
+		}
+		if err != nil || n < 2 {
+			rr.offset = offset + int64(n)
+			return
+		}
+		// magic may be split by the end of the buffer
+		offset += int64(n - 1)
+	}
+}
+
+func hasMagic(b []byte) bool {
+	return b[0] == recordMagic[0] && b[1] == recordMagic[1]
+}
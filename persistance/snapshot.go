@@ -0,0 +1,339 @@
+package persistance
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/vlado-github/tinydfs/logging"
+)
+
+// SnapshotVersion is the version of the snapshot layout
+const SnapshotVersion = 1
+
+const manifestEntry = "manifest.json"
+const topicsEntryPrefix = "topics/"
+const blobsEntryPrefix = "blobs/"
+
+// restoreCommitFile in the staging directory lists the restored topics,
+// once it is written the restore is finished even after a crash
+const restoreCommitFile = "COMMITTED"
+
+var ErrInvalidSnapshot = errors.New("Invalid snapshot")
+
+// SnapshotManifest describes the content of a snapshot
+type SnapshotManifest struct {
+	Version   int
+	CreatedAt time.Time
+	Topics    []TopicSnapshot
+	Blobs     int
+}
+
+// TopicSnapshot is a topic file covered by a snapshot up to the offset
+type TopicSnapshot struct {
+	Topic    string
+	Offset   int64
+	Checksum string
+}
+
+// Snapshot writes a tarball of all topic files and the blobs they reference.
+// Writes are frozen only while the sizes of topic files are recorded,
+// topic files are append-only so their prefixes do not change afterwards.
+func (fm *fileManager) Snapshot(w io.Writer) (SnapshotManifest, error) {
+	// referenced blobs must not be collected before they are copied
+	fm.gcLock.Lock()
+	defer fm.gcLock.Unlock()
+
+	manifest := SnapshotManifest{Version: SnapshotVersion}
+	var err error
+	manifest.Topics, manifest.CreatedAt, err = fm.topicOffsets()
+	if err != nil {
+		logging.AddError("Persistance: Snapshot failed.", err.Error())
+		return manifest, err
+	}
+
+	tw := tar.NewWriter(w)
+	blobs := make(map[string]bool)
+	for i := range manifest.Topics {
+		err = fm.snapshotTopic(tw, &manifest.Topics[i], blobs)
+		if err != nil {
+			logging.AddError("Persistance: Snapshot failed.", manifest.Topics[i].Topic, err.Error())
+			return manifest, err
+		}
+	}
+	hashes := make([]string, 0, len(blobs))
+	for hash := range blobs {
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+	for _, hash := range hashes {
+		data, err := fm.blobs.Get(hash)
+		if err != nil {
+			logging.AddError("Persistance: Snapshot failed.", hash, err.Error())
+			return manifest, err
+		}
+		err = writeTarEntry(tw, blobsEntryPrefix+hash, data)
+		if err != nil {
+			return manifest, err
+		}
+	}
+	manifest.Blobs = len(hashes)
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return manifest, err
+	}
+	err = writeTarEntry(tw, manifestEntry, data)
+	if err != nil {
+		return manifest, err
+	}
+	return manifest, tw.Close()
+}
+
+// Copies the topic file up to the offset and collects blobs of its live records
+func (fm *fileManager) snapshotTopic(tw *tar.Writer, topic *TopicSnapshot, blobs map[string]bool) error {
+	fileHandle, err := os.Open(path.Join(fm.pathToDir, TopicFileName(topic.Topic)))
+	if err != nil {
+		return err
+	}
+	defer fileHandle.Close()
+	section := io.NewSectionReader(fileHandle, 0, topic.Offset)
+	state, err := readState(section, uuid.Nil)
+	if err != nil {
+		return err
+	}
+	for hash := range state.blobRefs() {
+		blobs[hash] = true
+	}
+	err = tw.WriteHeader(&tar.Header{
+		Name:    topicsEntryPrefix + TopicFileName(topic.Topic),
+		Mode:    0660,
+		Size:    topic.Offset,
+		ModTime: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tw, hash), io.NewSectionReader(fileHandle, 0, topic.Offset))
+	topic.Checksum = hex.EncodeToString(hash.Sum(nil))
+	return err
+}
+
+// Restore replaces all topic files by the content of the snapshot.
+// The snapshot is verified in a staging directory, which is then committed
+// and swapped with the topic files. A restore interrupted after the commit
+// is finished when the FileManager is created again.
+func (fm *fileManager) Restore(r io.Reader) (SnapshotManifest, error) {
+	var manifest SnapshotManifest
+	stagingDir := fm.restoreStagingDir()
+	os.RemoveAll(stagingDir)
+	err := os.MkdirAll(stagingDir, os.ModePerm)
+	if err != nil {
+		return manifest, err
+	}
+
+	checksums, hasManifest, err := fm.extractSnapshot(tar.NewReader(r), stagingDir, &manifest)
+	if err == nil {
+		err = verifyManifest(manifest, hasManifest, checksums)
+	}
+	if err != nil {
+		mutex.Lock()
+		fm.abortRestore(stagingDir)
+		mutex.Unlock()
+		logging.AddError("Persistance: Restore failed.", err.Error())
+		return manifest, err
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	topics := make([]string, 0, len(manifest.Topics))
+	for _, topic := range manifest.Topics {
+		topics = append(topics, topic.Topic)
+	}
+	payload, err := json.Marshal(topics)
+	if err == nil {
+		err = writeFileAtomic(path.Join(stagingDir, restoreCommitFile), payload)
+	}
+	if err != nil {
+		fm.abortRestore(stagingDir)
+		return manifest, err
+	}
+	err = fm.swapRestoredTopics(stagingDir)
+	if err != nil {
+		logging.AddError("Persistance: Restore not finished.", err.Error())
+		return manifest, err
+	}
+	logging.AddInfo("Persistance: Snapshot restored.", len(manifest.Topics), "topics")
+	return manifest, fm.rebuildRefs()
+}
+
+// Removes the staging directory of a failed restore. Blobs of the snapshot
+// were counted as they were extracted, so references are rebuilt from the
+// live topics and unused blobs are left to the garbage collection.
+// Callers hold the mutex.
+func (fm *fileManager) abortRestore(stagingDir string) {
+	os.RemoveAll(stagingDir)
+	if err := fm.rebuildRefs(); err != nil {
+		logging.AddError("Persistance: Blob references not rebuilt.", err.Error())
+	}
+}
+
+func (fm *fileManager) restoreStagingDir() string {
+	return fm.pathToDir + ".restore"
+}
+
+// Finishes a committed restore, uncommitted staging directories are removed
+func (fm *fileManager) recoverRestore() {
+	stagingDir := fm.restoreStagingDir()
+	if _, err := os.Stat(path.Join(stagingDir, restoreCommitFile)); err != nil {
+		os.RemoveAll(stagingDir)
+		return
+	}
+	err := fm.swapRestoredTopics(stagingDir)
+	if err == nil {
+		err = fm.rebuildRefs()
+	}
+	if err != nil {
+		logging.AddError("Persistance: Restore not finished.", err.Error())
+		return
+	}
+	logging.AddInfo("Persistance: Interrupted restore finished.")
+}
+
+// Replaces topic files by the committed ones of the staging directory
+// and removes topics that are not part of the snapshot. Files are
+// renamed one by one, so the swap can be repeated after a crash.
+func (fm *fileManager) swapRestoredTopics(stagingDir string) error {
+	payload, err := os.ReadFile(path.Join(stagingDir, restoreCommitFile))
+	if err != nil {
+		return err
+	}
+	var restored []string
+	if err := json.Unmarshal(payload, &restored); err != nil {
+		return err
+	}
+	keep := make(map[string]bool, len(restored))
+	for _, topic := range restored {
+		fileName := TopicFileName(topic)
+		err = os.Rename(path.Join(stagingDir, fileName), path.Join(fm.pathToDir, fileName))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		keep[topic] = true
+	}
+	topics, err := fm.Topics()
+	if err != nil {
+		return err
+	}
+	for _, topic := range topics {
+		if keep[topic] {
+			continue
+		}
+		err = os.Remove(path.Join(fm.pathToDir, TopicFileName(topic)))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.RemoveAll(stagingDir)
+}
+
+// Writes topic files to the staging directory and blobs to the blob store.
+// Returns checksums of the extracted topic files.
+func (fm *fileManager) extractSnapshot(tr *tar.Reader, stagingDir string, manifest *SnapshotManifest) (map[string]TopicSnapshot, bool, error) {
+	checksums := make(map[string]TopicSnapshot)
+	hasManifest := false
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return checksums, hasManifest, nil
+		}
+		if err != nil {
+			return checksums, hasManifest, err
+		}
+		switch {
+		case header.Name == manifestEntry:
+			err = json.NewDecoder(tr).Decode(manifest)
+			hasManifest = true
+		case strings.HasPrefix(header.Name, topicsEntryPrefix):
+			var topic TopicSnapshot
+			topic, err = extractTopic(tr, stagingDir, strings.TrimPrefix(header.Name, topicsEntryPrefix))
+			checksums[topic.Topic] = topic
+		case strings.HasPrefix(header.Name, blobsEntryPrefix):
+			err = fm.extractBlob(tr, strings.TrimPrefix(header.Name, blobsEntryPrefix))
+		default:
+			err = fmt.Errorf("%w: unexpected entry %q", ErrInvalidSnapshot, header.Name)
+		}
+		if err != nil {
+			return checksums, hasManifest, err
+		}
+	}
+}
+
+func extractTopic(r io.Reader, stagingDir string, fileName string) (TopicSnapshot, error) {
+	topic, err := TopicFromFileName(fileName)
+	if err != nil {
+		return TopicSnapshot{}, fmt.Errorf("%w: %s", ErrInvalidSnapshot, err.Error())
+	}
+	fileHandle, err := os.Create(path.Join(stagingDir, TopicFileName(topic)))
+	if err != nil {
+		return TopicSnapshot{}, err
+	}
+	defer fileHandle.Close()
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(fileHandle, hash), r)
+	return TopicSnapshot{Topic: topic, Offset: size, Checksum: hex.EncodeToString(hash.Sum(nil))}, err
+}
+
+func (fm *fileManager) extractBlob(r io.Reader, hash string) error {
+	if !isBlobHash(hash) {
+		return fmt.Errorf("%w: invalid blob %q", ErrInvalidSnapshot, hash)
+	}
+	data, err := io.ReadAll(io.LimitReader(r, MaxRecordSize))
+	if err != nil {
+		return err
+	}
+	if BlobHash(data) != hash {
+		return ErrBlobCorrupted
+	}
+	// reference counts are rebuilt after topic files are restored
+	_, err = fm.blobs.Put(data)
+	return err
+}
+
+// Every topic of the manifest has to be extracted with the same checksum
+func verifyManifest(manifest SnapshotManifest, hasManifest bool, checksums map[string]TopicSnapshot) error {
+	if !hasManifest {
+		return fmt.Errorf("%w: manifest is missing", ErrInvalidSnapshot)
+	}
+	if manifest.Version != SnapshotVersion {
+		return fmt.Errorf("%w: unsupported version %d", ErrInvalidSnapshot, manifest.Version)
+	}
+	if len(manifest.Topics) != len(checksums) {
+		return fmt.Errorf("%w: topics do not match the manifest", ErrInvalidSnapshot)
+	}
+	for _, topic := range manifest.Topics {
+		if checksums[topic.Topic] != topic {
+			return fmt.Errorf("%w: topic %s does not match the manifest", ErrInvalidSnapshot, topic.Topic)
+		}
+	}
+	return nil
+}
+
+func writeTarEntry(tw *tar.Writer, name string, data []byte) error {
+	err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0660, Size: int64(len(data)), ModTime: time.Now()})
+	if err != nil {
+		return err
+	}
+	_, err = tw.Write(data)
+	return err
+}
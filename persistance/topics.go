@@ -0,0 +1,141 @@
+package persistance
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// MaxTopicLength is the longest name of a topic
+const MaxTopicLength = 200
+
+// ReservedTopicPrefix starts names of internal topics,
+// clients can not write to them directly
+const ReservedTopicPrefix = "__"
+
+// PartitionSeparator separates a topic and its partition in storage names
+const PartitionSeparator = "#"
+
+var ErrInvalidTopic = errors.New("Invalid topic name")
+var ErrReservedTopic = errors.New("Topic name is reserved")
+
+// TopicError describes why a topic name was rejected
+type TopicError struct {
+	Topic  string
+	Reason string
+	Err    error
+}
+
+func (e *TopicError) Error() string {
+	return fmt.Sprintf("%s %q: %s", e.Err.Error(), e.Topic, e.Reason)
+}
+
+func (e *TopicError) Unwrap() error {
+	return e.Err
+}
+
+// Internal topics allowed to be stored, followed by a user topic name
+var internalTopicPrefixes = []string{ChunkTopicPrefix}
+
+// Device names reserved by Windows regardless of the extension
+var windowsReservedNames = map[string]bool{
+	"con": true, "prn": true, "aux": true, "nul": true,
+	"com1": true, "com2": true, "com3": true, "com4": true, "com5": true,
+	"com6": true, "com7": true, "com8": true, "com9": true,
+	"lpt1": true, "lpt2": true, "lpt3": true, "lpt4": true, "lpt5": true,
+	"lpt6": true, "lpt7": true, "lpt8": true, "lpt9": true,
+}
+
+// ValidateTopic checks name of a topic written by clients.
+// Names are 1 to MaxTopicLength of letters, digits, '.', '_' and '-',
+// names starting with ReservedTopicPrefix are rejected.
+func ValidateTopic(topic string) error {
+	if topic == "" || len(topic) > MaxTopicLength {
+		return &TopicError{Topic: topic, Reason: "length must be 1 to " + strconv.Itoa(MaxTopicLength), Err: ErrInvalidTopic}
+	}
+	if topic == "." || topic == ".." {
+		return &TopicError{Topic: topic, Reason: "dot names are not allowed", Err: ErrInvalidTopic}
+	}
+	for _, r := range topic {
+		if !isTopicRune(r) {
+			return &TopicError{Topic: topic, Reason: fmt.Sprintf("character %q is not allowed", r), Err: ErrInvalidTopic}
+		}
+	}
+	if strings.HasPrefix(topic, ReservedTopicPrefix) {
+		return &TopicError{Topic: topic, Reason: "prefix " + ReservedTopicPrefix + " is reserved for internal topics", Err: ErrReservedTopic}
+	}
+	return nil
+}
+
+// ValidateMessageTopic accepts client topics and internal topics
+// derived from them, e.g. chunks of a stream
+func ValidateMessageTopic(topic string) error {
+	for _, prefix := range internalTopicPrefixes {
+		if strings.HasPrefix(topic, prefix) {
+			return ValidateTopic(strings.TrimPrefix(topic, prefix))
+		}
+	}
+	return ValidateTopic(topic)
+}
+
+// ValidateStorageTopic accepts message topics optionally
+// followed by the partition number
+func ValidateStorageTopic(topic string) error {
+	if i := strings.LastIndex(topic, PartitionSeparator); i >= 0 {
+		partition, err := strconv.Atoi(topic[i+1:])
+		if err != nil || partition < 0 || strconv.Itoa(partition) != topic[i+1:] {
+			return &TopicError{Topic: topic, Reason: "invalid partition", Err: ErrInvalidTopic}
+		}
+		topic = topic[:i]
+	}
+	return ValidateMessageTopic(topic)
+}
+
+// TopicFileName maps a valid storage topic to a file name safe on all
+// platforms. Upper case letters and special characters are escaped as
+// %XX, so names differing only in case do not share a file on
+// case-insensitive file systems, as are the first character of
+// Windows device names and a leading or trailing dot.
+func TopicFileName(topic string) string {
+	var builder strings.Builder
+	base := strings.ToLower(strings.SplitN(topic, ".", 2)[0])
+	for i := 0; i < len(topic); i++ {
+		c := topic[i]
+		escape := !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '_' || c == '-' || c == '.')
+		escape = escape || c == '.' && (i == 0 || i == len(topic)-1)
+		escape = escape || i == 0 && windowsReservedNames[base]
+		if escape {
+			fmt.Fprintf(&builder, "%%%02X", c)
+		} else {
+			builder.WriteByte(c)
+		}
+	}
+	return builder.String()
+}
+
+// TopicFromFileName reverses TopicFileName
+func TopicFromFileName(fileName string) (string, error) {
+	var builder strings.Builder
+	for i := 0; i < len(fileName); i++ {
+		if fileName[i] != '%' {
+			builder.WriteByte(fileName[i])
+			continue
+		}
+		if i+2 >= len(fileName) {
+			return "", ErrInvalidTopic
+		}
+		c, err := strconv.ParseUint(fileName[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", ErrInvalidTopic
+		}
+		builder.WriteByte(byte(c))
+		i += 2
+	}
+	topic := builder.String()
+	return topic, ValidateStorageTopic(topic)
+}
+
+func isTopicRune(r rune) bool {
+	return r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '_' || r == '-'
+}
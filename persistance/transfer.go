@@ -0,0 +1,191 @@
+package persistance
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/vlado-github/tinydfs/logging"
+)
+
+var ErrOffsetMismatch = errors.New("Offset is beyond the end of the topic file")
+
+// Manifest lists all topic files with their current size
+// and the SHA-256 checksum of their content up to that size
+func (fm *fileManager) Manifest() ([]TopicSnapshot, error) {
+	topics, _, err := fm.topicOffsets()
+	if err != nil {
+		return nil, err
+	}
+	for i := range topics {
+		topics[i].Checksum, err = fm.PrefixChecksum(topics[i].Topic, topics[i].Offset)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return topics, nil
+}
+
+// PrefixChecksum returns the SHA-256 checksum of the topic file up to the offset
+func (fm *fileManager) PrefixChecksum(topic string, offset int64) (string, error) {
+	pathToFile, err := fm.topicPath(topic)
+	if err != nil {
+		return "", err
+	}
+	fileHandle, err := os.Open(pathToFile)
+	if err != nil {
+		return "", err
+	}
+	defer fileHandle.Close()
+	hash := sha256.New()
+	n, err := io.Copy(hash, io.NewSectionReader(fileHandle, 0, offset))
+	if err != nil {
+		return "", err
+	}
+	if n != offset {
+		return "", ErrOffsetMismatch
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// ReadRange returns up to length bytes of the topic file from the offset
+// and the size of the file. Only whole appends are read.
+func (fm *fileManager) ReadRange(topic string, offset int64, length int) ([]byte, int64, error) {
+	pathToFile, err := fm.topicPath(topic)
+	if err != nil {
+		return nil, 0, err
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	fileHandle, err := os.Open(pathToFile)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer fileHandle.Close()
+	info, err := fileHandle.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+	size := info.Size()
+	if offset > size {
+		return nil, size, ErrOffsetMismatch
+	}
+	if remaining := size - offset; int64(length) > remaining {
+		length = int(remaining)
+	}
+	data := make([]byte, length)
+	_, err = fileHandle.ReadAt(data, offset)
+	if err != nil && err != io.EOF {
+		return nil, size, err
+	}
+	return data, size, nil
+}
+
+// AppendRange writes bytes copied from another topic file at the offset.
+// Content after the offset is dropped, so a transfer can be restarted.
+// Blob references are not counted until RebuildBlobRefs is called.
+func (fm *fileManager) AppendRange(topic string, offset int64, data []byte) error {
+	pathToFile, err := fm.topicPath(topic)
+	if err != nil {
+		return err
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	fileHandle, err := os.OpenFile(pathToFile, os.O_RDWR|os.O_CREATE, 0660)
+	if err != nil {
+		logging.AddError("Persistance: Can not open a file.", err.Error())
+		return err
+	}
+	defer fileHandle.Close()
+	info, err := fileHandle.Stat()
+	if err != nil {
+		return err
+	}
+	if offset > info.Size() {
+		return ErrOffsetMismatch
+	}
+	if offset < info.Size() {
+		err = fileHandle.Truncate(offset)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = fileHandle.WriteAt(data, offset)
+	return err
+}
+
+// MissingBlobs returns hashes referenced by live records of the topic
+// that are not in the blob store
+func (fm *fileManager) MissingBlobs(topic string) ([]string, error) {
+	pathToFile, err := fm.topicPath(topic)
+	if err != nil {
+		return nil, err
+	}
+	state, err := readTopicState(pathToFile, uuid.Nil)
+	if err != nil {
+		return nil, err
+	}
+	missing := []string{}
+	for hash := range state.blobRefs() {
+		if _, err := fm.blobs.Get(hash); err != nil {
+			missing = append(missing, hash)
+		}
+	}
+	return missing, nil
+}
+
+// Blobs returns the blob store of the topic files
+func (fm *fileManager) Blobs() BlobStore {
+	return fm.blobs
+}
+
+// RebuildBlobRefs counts references of live records of all topics
+func (fm *fileManager) RebuildBlobRefs() error {
+	mutex.Lock()
+	defer mutex.Unlock()
+	return fm.rebuildRefs()
+}
+
+// Replaces reference counts by the references of live records,
+// callers hold the mutex
+func (fm *fileManager) rebuildRefs() error {
+	topics, err := fm.Topics()
+	if err != nil {
+		return err
+	}
+	refs := make(map[string]int)
+	for _, topic := range topics {
+		state, err := readTopicState(path.Join(fm.pathToDir, TopicFileName(topic)), uuid.Nil)
+		if err != nil {
+			return err
+		}
+		for hash, count := range state.blobRefs() {
+			refs[hash] += count
+		}
+	}
+	return fm.blobs.SetRefs(refs)
+}
+
+// Records sizes of all topic files while writes are frozen
+func (fm *fileManager) topicOffsets() ([]TopicSnapshot, time.Time, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	offsets := []TopicSnapshot{}
+	topics, err := fm.Topics()
+	if err != nil {
+		return offsets, time.Time{}, err
+	}
+	for _, topic := range topics {
+		info, err := os.Stat(path.Join(fm.pathToDir, TopicFileName(topic)))
+		if err != nil {
+			return offsets, time.Time{}, err
+		}
+		offsets = append(offsets, TopicSnapshot{Topic: topic, Offset: info.Size()})
+	}
+	return offsets, time.Now().UTC(), nil
+}
@@ -0,0 +1,344 @@
+package respgateway
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/vlado-github/tinydfs/persistance"
+)
+
+// Redis keys that are not UUIDs are mapped to name based UUIDs of this namespace
+var keyNamespace = uuid.MustParse("6f1d3c8e-0d6b-4b8e-9a55-2f3a1c7d9e40")
+
+// Headers of records written by the gateway
+const (
+	// keyHeader keeps the Redis key name a record was written with
+	keyHeader string = "resp-key"
+	// streamIDHeader keeps the ID of a stream entry
+	streamIDHeader string = "stream-id"
+)
+
+func (s *server) execute(ctx context.Context, w *writer, name string, args []string) {
+	switch name {
+	case "PING":
+		if len(args) > 0 {
+			w.bulk(args[0])
+		} else {
+			w.simple("PONG")
+		}
+	case "QUIT":
+		w.simple("OK")
+	case "COMMAND":
+		w.array(0)
+	case "SELECT":
+		w.simple("OK")
+	case "SET":
+		s.set(ctx, w, args)
+	case "GET":
+		s.get(ctx, w, args)
+	case "DEL":
+		s.del(ctx, w, args)
+	case "KEYS":
+		s.keys(ctx, w, args)
+	case "XADD":
+		s.xadd(ctx, w, args)
+	case "XRANGE":
+		s.xrange(ctx, w, args)
+	case "INFO":
+		s.info(w)
+	default:
+		w.error("ERR unknown command '" + strings.ToLower(name) + "'")
+	}
+}
+
+// SET topic:key value
+func (s *server) set(ctx context.Context, w *writer, args []string) {
+	if len(args) != 2 {
+		w.error("ERR wrong number of arguments for 'set' command")
+		return
+	}
+	topic, key, ok := parseKey(w, args[0])
+	if !ok {
+		return
+	}
+	_, name, _ := strings.Cut(args[0], ":")
+	err := s.backend.Put(ctx, topic, key, args[1], map[string]string{keyHeader: name})
+	if err != nil {
+		w.error("ERR " + err.Error())
+		return
+	}
+	w.simple("OK")
+}
+
+// GET topic:key
+func (s *server) get(ctx context.Context, w *writer, args []string) {
+	if len(args) != 1 {
+		w.error("ERR wrong number of arguments for 'get' command")
+		return
+	}
+	topic, key, ok := parseKey(w, args[0])
+	if !ok {
+		return
+	}
+	value, err := s.backend.Get(ctx, topic, key)
+	if err != nil {
+		w.null()
+		return
+	}
+	w.bulk(value)
+}
+
+// DEL topic:key [topic:key ...]
+func (s *server) del(ctx context.Context, w *writer, args []string) {
+	if len(args) == 0 {
+		w.error("ERR wrong number of arguments for 'del' command")
+		return
+	}
+	deleted := 0
+	for _, arg := range args {
+		topic, key, ok := parseKey(w, arg)
+		if !ok {
+			return
+		}
+		if s.backend.Delete(ctx, topic, key) == nil {
+			deleted++
+		}
+	}
+	w.integer(deleted)
+}
+
+// KEYS topic:pattern returns keys of the topic with the names they were set with,
+// keys written by other APIs are returned as topic:<uuid>
+func (s *server) keys(ctx context.Context, w *writer, args []string) {
+	if len(args) != 1 {
+		w.error("ERR wrong number of arguments for 'keys' command")
+		return
+	}
+	topic, pattern, found := strings.Cut(args[0], ":")
+	if !found || topic == "" || strings.ContainsAny(topic, "*?[") {
+		w.error("ERR KEYS pattern must start with a topic, e.g. 'sport:*'")
+		return
+	}
+	if !validTopic(w, topic) {
+		return
+	}
+	records, err := s.backend.Scan(ctx, topic)
+	if err != nil {
+		w.array(0)
+		return
+	}
+	result := []string{}
+	for _, record := range records {
+		name, ok := record.Headers[keyHeader]
+		if !ok {
+			name = record.Key.String()
+		}
+		if matched, _ := path.Match(pattern, name); matched {
+			result = append(result, topic+":"+name)
+		}
+	}
+	w.bulkArray(result)
+}
+
+// XADD topic * field value [field value ...]
+// Entry IDs are milliseconds of the write and a sequence number, e.g. 1718000000000-0.
+func (s *server) xadd(ctx context.Context, w *writer, args []string) {
+	if len(args) < 4 || len(args)%2 != 0 {
+		w.error("ERR wrong number of arguments for 'xadd' command")
+		return
+	}
+	if args[1] != "*" {
+		w.error("ERR only auto generated IDs are supported, use '*'")
+		return
+	}
+	if !validTopic(w, args[0]) {
+		return
+	}
+	payload, err := json.Marshal(args[2:])
+	if err != nil {
+		w.error("ERR " + err.Error())
+		return
+	}
+	id := s.nextStreamID()
+	err = s.backend.Put(ctx, args[0], uuid.New(), string(payload), map[string]string{streamIDHeader: id.String()})
+	if err != nil {
+		w.error("ERR " + err.Error())
+		return
+	}
+	w.bulk(id.String())
+}
+
+// XRANGE topic start end [COUNT count]
+func (s *server) xrange(ctx context.Context, w *writer, args []string) {
+	if len(args) != 3 && len(args) != 5 {
+		w.error("ERR wrong number of arguments for 'xrange' command")
+		return
+	}
+	if !validTopic(w, args[0]) {
+		return
+	}
+	start, errStart := parseStreamID(args[1], false)
+	end, errEnd := parseStreamID(args[2], true)
+	if errStart != nil || errEnd != nil {
+		w.error("ERR Invalid stream ID specified as stream command argument")
+		return
+	}
+	count := math.MaxInt
+	if len(args) == 5 {
+		var err error
+		count, err = strconv.Atoi(args[4])
+		if strings.ToUpper(args[3]) != "COUNT" || err != nil || count < 0 {
+			w.error("ERR syntax error")
+			return
+		}
+	}
+	records, err := s.backend.Scan(ctx, args[0])
+	if err != nil {
+		w.array(0)
+		return
+	}
+	entries := []streamEntry{}
+	for _, record := range records {
+		id := recordStreamID(record)
+		if !id.less(start) && !end.less(id) {
+			entries = append(entries, streamEntry{id: id, record: record})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].id.less(entries[j].id)
+	})
+	if len(entries) > count {
+		entries = entries[:count]
+	}
+	w.array(len(entries))
+	for _, entry := range entries {
+		var fields []string
+		if json.Unmarshal([]byte(entry.record.Text), &fields) != nil || len(fields)%2 != 0 {
+			// records written by other APIs are plain text
+			fields = []string{"value", entry.record.Text}
+		}
+		w.array(2)
+		w.bulk(entry.id.String())
+		w.bulkArray(fields)
+	}
+}
+
+func (s *server) info(w *writer) {
+	nodes := s.backend.GetNetworkRegistry().GetItems()
+	available := 0
+	for _, node := range nodes {
+		if node.GetAvailableStatus() {
+			available++
+		}
+	}
+	var b strings.Builder
+	b.WriteString("# Server\r\n")
+	b.WriteString("redis_version:7.0.0\r\n")
+	b.WriteString("server_name:tinydfs\r\n")
+	b.WriteString("# Cluster\r\n")
+	b.WriteString("cluster_nodes:" + strconv.Itoa(len(nodes)) + "\r\n")
+	b.WriteString("cluster_nodes_available:" + strconv.Itoa(available) + "\r\n")
+	w.bulk(b.String())
+}
+
+// Splits topic:key and maps the key to UUID
+func parseKey(w *writer, value string) (string, uuid.UUID, bool) {
+	topic, name, found := strings.Cut(value, ":")
+	if !found || topic == "" || name == "" {
+		w.error("ERR key must have format 'topic:key'")
+		return "", uuid.Nil, false
+	}
+	if !validTopic(w, topic) {
+		return "", uuid.Nil, false
+	}
+	key, err := uuid.Parse(name)
+	if err != nil {
+		key = uuid.NewSHA1(keyNamespace, []byte(name))
+	}
+	return topic, key, true
+}
+
+func validTopic(w *writer, topic string) bool {
+	err := persistance.ValidateTopic(topic)
+	if err != nil {
+		w.error("ERR " + err.Error())
+		return false
+	}
+	return true
+}
+
+// streamID identifies a stream entry by milliseconds and a sequence number
+type streamID struct {
+	ms  uint64
+	seq uint64
+}
+
+type streamEntry struct {
+	id     streamID
+	record persistance.Record
+}
+
+func (id streamID) String() string {
+	return fmt.Sprintf("%d-%d", id.ms, id.seq)
+}
+
+func (id streamID) less(other streamID) bool {
+	return id.ms < other.ms || id.ms == other.ms && id.seq < other.seq
+}
+
+// Returns an ID greater than all IDs returned before
+func (s *server) nextStreamID() streamID {
+	now := uint64(time.Now().UnixMilli())
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if now > s.lastID.ms {
+		s.lastID = streamID{ms: now}
+	} else {
+		s.lastID.seq++
+	}
+	return s.lastID
+}
+
+// Records written by other APIs get the ID of their timestamp
+func recordStreamID(record persistance.Record) streamID {
+	if value, ok := record.Headers[streamIDHeader]; ok {
+		if id, err := parseStreamID(value, false); err == nil {
+			return id
+		}
+	}
+	return streamID{ms: uint64(record.Timestamp.UnixMilli())}
+}
+
+// Parses stream ID N-M or N and special IDs '-' and '+'.
+// The missing sequence of N is the first one of a start and the last one of an end.
+func parseStreamID(value string, end bool) (streamID, error) {
+	switch value {
+	case "-":
+		return streamID{}, nil
+	case "+":
+		return streamID{ms: math.MaxUint64, seq: math.MaxUint64}, nil
+	}
+	ms, seq, found := strings.Cut(value, "-")
+	id := streamID{}
+	var err error
+	id.ms, err = strconv.ParseUint(ms, 10, 64)
+	if err != nil {
+		return id, err
+	}
+	if !found {
+		if end {
+			id.seq = math.MaxUint64
+		}
+		return id, nil
+	}
+	id.seq, err = strconv.ParseUint(seq, 10, 64)
+	return id, err
+}
@@ -0,0 +1,124 @@
+package respgateway
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// MaxBulkSize limits size of a single bulk string of a request
+const MaxBulkSize = 1 << 20
+
+// MaxArgs limits number of bulk strings in a request array
+const MaxArgs = 1 << 16
+
+// MaxLineSize limits an inline command and headers of a request
+const MaxLineSize = 64 << 10
+
+var errProtocol = errors.New("ERR Protocol error")
+var errArrayLength = fmt.Errorf("%w: invalid multibulk length", errProtocol)
+var errBulkLength = fmt.Errorf("%w: invalid bulk length", errProtocol)
+var errLineTooLong = fmt.Errorf("%w: too big inline request", errProtocol)
+
+// Reads a command sent either as RESP array of bulk strings,
+// as redis-cli and client libraries do, or as an inline command.
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return []string{}, nil
+	}
+	if line[0] != '*' {
+		return strings.Fields(line), nil
+	}
+	count, err := strconv.Atoi(line[1:])
+	if err != nil || count < 0 || count > MaxArgs {
+		return nil, errArrayLength
+	}
+	// arguments are read before they are allocated
+	args := make([]string, 0, min(count, 16))
+	for i := 0; i < count; i++ {
+		line, err = readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, errProtocol
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 || size > MaxBulkSize {
+			return nil, errBulkLength
+		}
+		buf := make([]byte, size+2)
+		_, err = io.ReadFull(r, buf)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, string(buf[:size]))
+	}
+	return args, nil
+}
+
+// Reads a line of at most MaxLineSize bytes
+func readLine(r *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if len(line)+len(chunk) > MaxLineSize {
+			return "", errLineTooLong
+		}
+		line = append(line, chunk...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(line), "\r\n"), nil
+	}
+}
+
+// writer encodes RESP2 replies
+type writer struct {
+	w *bufio.Writer
+}
+
+func (w *writer) simple(s string) {
+	w.w.WriteString("+" + s + "\r\n")
+}
+
+func (w *writer) error(s string) {
+	w.w.WriteString("-" + s + "\r\n")
+}
+
+func (w *writer) integer(n int) {
+	w.w.WriteString(":" + strconv.Itoa(n) + "\r\n")
+}
+
+func (w *writer) bulk(s string) {
+	w.w.WriteString("$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n")
+}
+
+func (w *writer) null() {
+	w.w.WriteString("$-1\r\n")
+}
+
+func (w *writer) array(n int) {
+	w.w.WriteString("*" + strconv.Itoa(n) + "\r\n")
+}
+
+func (w *writer) bulkArray(values []string) {
+	w.array(len(values))
+	for _, value := range values {
+		w.bulk(value)
+	}
+}
+
+func (w *writer) flush() error {
+	return w.w.Flush()
+}
@@ -0,0 +1,177 @@
+package respgateway
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/vlado-github/tinydfs/internal/gatewaytest"
+)
+
+type redisClient struct {
+	conn    net.Conn
+	r       *bufio.Reader
+	backend *gatewaytest.Backend
+}
+
+func connect(t *testing.T) *redisClient {
+	b := gatewaytest.NewQueuedBackend(t)
+	client, conn := net.Pipe()
+	go NewServer(b).ServeConn(conn)
+	t.Cleanup(func() { client.Close() })
+	return &redisClient{conn: client, r: bufio.NewReader(client), backend: b}
+}
+
+// Sends command as RESP array and returns the raw reply
+func (c *redisClient) do(t *testing.T, args ...string) string {
+	var b strings.Builder
+	b.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		b.WriteString("$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n")
+	}
+	go c.conn.Write([]byte(b.String()))
+	return c.readReply(t)
+}
+
+func (c *redisClient) readReply(t *testing.T) string {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	switch line[0] {
+	case '$':
+		if line == "$-1\r\n" {
+			return line
+		}
+		size, _ := strconv.Atoi(line[1 : len(line)-2])
+		value := make([]byte, size+2)
+		io.ReadFull(c.r, value)
+		return line + string(value)
+	case '*':
+		n, _ := strconv.Atoi(line[1 : len(line)-2])
+		for i := 0; i < n; i++ {
+			line += c.readReply(t)
+		}
+	}
+	return line
+}
+
+func TestReadCommand_Limits(t *testing.T) {
+	for _, request := range []string{
+		"*" + strconv.Itoa(MaxArgs+1) + "\r\n",
+		"*99999999999999999999999\r\n",
+		"*-2\r\n",
+		"*1\r\n$" + strconv.Itoa(MaxBulkSize+1) + "\r\n",
+		"*1\r\n$-5\r\n",
+		strings.Repeat("a", MaxLineSize+1) + "\r\n",
+		"*1\r\n$" + strings.Repeat("1", MaxLineSize) + "\r\n",
+	} {
+		_, err := readCommand(bufio.NewReader(strings.NewReader(request)))
+		if !errors.Is(err, errProtocol) {
+			t.Error(request[:min(len(request), 32)], err)
+		}
+	}
+	args, err := readCommand(bufio.NewReader(strings.NewReader("SET key " + strings.Repeat("v", MaxLineSize/2) + "\r\n")))
+	if err != nil || len(args) != 3 {
+		t.Error(len(args), err)
+	}
+}
+
+func TestServer_OversizeRequest(t *testing.T) {
+	c := connect(t)
+	go c.conn.Write([]byte("*" + strconv.Itoa(MaxArgs+1) + "\r\n"))
+	if reply := c.readReply(t); reply != "-"+errArrayLength.Error()+"\r\n" {
+		t.Error(reply)
+	}
+}
+
+func TestServer_Ping(t *testing.T) {
+	c := connect(t)
+	if reply := c.do(t, "PING"); reply != "+PONG\r\n" {
+		t.Fatal(reply)
+	}
+	go c.conn.Write([]byte("PING hello\r\n"))
+	if reply := c.readReply(t); reply != "$5\r\nhello\r\n" {
+		t.Fatal(reply)
+	}
+}
+
+func TestServer_SetGetDel(t *testing.T) {
+	c := connect(t)
+	if reply := c.do(t, "SET", "sport:match", "We're watching a match."); reply != "+OK\r\n" {
+		t.Fatal(reply)
+	}
+	if reply := c.do(t, "GET", "sport:match"); reply != "$23\r\nWe're watching a match.\r\n" {
+		t.Fatal(reply)
+	}
+	if reply := c.do(t, "SET", "sport:match", "Goal!"); reply != "+OK\r\n" {
+		t.Fatal(reply)
+	}
+	if reply := c.do(t, "GET", "sport:match"); reply != "$5\r\nGoal!\r\n" {
+		t.Fatal(reply)
+	}
+	if reply := c.do(t, "KEYS", "sport:*"); reply != "*1\r\n$11\r\nsport:match\r\n" {
+		t.Fatal(reply)
+	}
+	if reply := c.do(t, "DEL", "sport:match"); reply != ":1\r\n" {
+		t.Fatal(reply)
+	}
+	if reply := c.do(t, "GET", "sport:match"); reply != "$-1\r\n" {
+		t.Fatal(reply)
+	}
+	if reply := c.do(t, "GET", "nokey"); !strings.HasPrefix(reply, "-ERR") {
+		t.Fatal(reply)
+	}
+}
+
+// Returns the value of a bulk string reply
+func bulkValue(reply string) string {
+	_, value, _ := strings.Cut(reply, "\r\n")
+	return strings.TrimSuffix(value, "\r\n")
+}
+
+func TestServer_Streams(t *testing.T) {
+	c := connect(t)
+	first := bulkValue(c.do(t, "XADD", "news", "*", "title", "first"))
+	second := bulkValue(c.do(t, "XADD", "news", "*", "title", "second"))
+	third := bulkValue(c.do(t, "XADD", "news", "*", "title", "third"))
+	firstID, _ := parseStreamID(first, false)
+	secondID, _ := parseStreamID(second, false)
+	if !firstID.less(secondID) {
+		t.Fatal(first, second)
+	}
+	reply := c.do(t, "XRANGE", "news", second, second)
+	if reply != "*1\r\n*2\r\n$"+strconv.Itoa(len(second))+"\r\n"+second+"\r\n*2\r\n$5\r\ntitle\r\n$6\r\nsecond\r\n" {
+		t.Fatal(reply)
+	}
+	reply = c.do(t, "XRANGE", "news", "-", "+", "COUNT", "1")
+	if !strings.HasPrefix(reply, "*1\r\n*2\r\n$"+strconv.Itoa(len(first))+"\r\n"+first+"\r\n") {
+		t.Fatal(reply)
+	}
+
+	// IDs of entries do not shift when an entry is removed
+	records, err := c.backend.Scan(context.Background(), "news")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.backend.Delete(context.Background(), "news", records[0].Key)
+	reply = c.do(t, "XRANGE", "news", "-", "+")
+	if !strings.HasPrefix(reply, "*2\r\n*2\r\n$"+strconv.Itoa(len(second))+"\r\n"+second+"\r\n") || !strings.Contains(reply, third) {
+		t.Fatal(reply)
+	}
+}
+
+func TestServer_Info(t *testing.T) {
+	c := connect(t)
+	if reply := c.do(t, "INFO"); !strings.Contains(reply, "cluster_nodes:1") {
+		t.Fatal(reply)
+	}
+	if reply := c.do(t, "FLUSHALL"); !strings.HasPrefix(reply, "-ERR unknown command") {
+		t.Fatal(reply)
+	}
+}
@@ -0,0 +1,100 @@
+package respgateway
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/vlado-github/tinydfs/logging"
+	"github.com/vlado-github/tinydfs/messaging"
+	"github.com/vlado-github/tinydfs/persistance"
+)
+
+// Backend is the part of messaging.Node used by the gateway.
+type Backend interface {
+	Get(ctx context.Context, topic string, key uuid.UUID) (string, error)
+	Put(ctx context.Context, topic string, key uuid.UUID, text string, headers map[string]string) error
+	Delete(ctx context.Context, topic string, key uuid.UUID) error
+	Scan(ctx context.Context, topic string) ([]persistance.Record, error)
+	GetNetworkRegistry() messaging.NetworkRegistry
+}
+
+// RequestTimeout limits duration of a single command
+const RequestTimeout = 5 * time.Second
+
+// Server serves Redis clients
+type Server interface {
+	Serve(l net.Listener) error
+	ServeConn(conn net.Conn)
+}
+
+type server struct {
+	backend Backend
+	// last stream entry ID, IDs grow for all streams of the gateway
+	lock   sync.Mutex
+	lastID streamID
+}
+
+// NewServer creates RESP server on top of the backend
+func NewServer(backend Backend) Server {
+	return &server{backend: backend}
+}
+
+// ListenAndServe starts the RESP server on the address
+func ListenAndServe(address string, backend Backend) error {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		logging.AddError("[Resp] Error listening:", err.Error())
+		return err
+	}
+	logging.AddInfo("[Resp] Listening on " + address)
+	return NewServer(backend).Serve(l)
+}
+
+// Serve accepts connections until the listener is closed
+func (s *server) Serve(l net.Listener) error {
+	defer l.Close()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.ServeConn(conn)
+	}
+}
+
+// ServeConn handles commands of a single client
+func (s *server) ServeConn(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	w := &writer{w: bufio.NewWriter(conn)}
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			if errors.Is(err, errProtocol) {
+				w.error(err.Error())
+				w.flush()
+			} else if err != io.EOF {
+				w.error(errProtocol.Error())
+				w.flush()
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		name := strings.ToUpper(args[0])
+		ctx, cancel := context.WithTimeout(context.Background(), RequestTimeout)
+		s.execute(ctx, w, name, args[1:])
+		cancel()
+		if w.flush() != nil || name == "QUIT" {
+			return
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package s3gateway
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var errChunkFormat = errors.New("Invalid aws-chunked encoding")
+
+// Returns body of the request, payload sent by AWS SDKs
+// with aws-chunked content encoding is decoded
+func requestBody(r *http.Request) (io.Reader, error) {
+	if strings.Contains(r.Header.Get("Content-Encoding"), "aws-chunked") ||
+		strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		return &chunkedReader{r: bufio.NewReader(r.Body)}, nil
+	}
+	return r.Body, nil
+}
+
+// chunkedReader decodes '<hex size>[;extensions]\r\n<data>\r\n'
+// chunks until the zero sized chunk, trailers are skipped
+type chunkedReader struct {
+	r         *bufio.Reader
+	remaining int64
+	done      bool
+}
+
+func (c *chunkedReader) Read(p []byte) (int, error) {
+	if c.done {
+		return 0, io.EOF
+	}
+	if c.remaining == 0 {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			return 0, errChunkFormat
+		}
+		sizeText, _, _ := strings.Cut(strings.TrimSpace(line), ";")
+		size, err := strconv.ParseInt(sizeText, 16, 64)
+		if err != nil || size < 0 {
+			return 0, errChunkFormat
+		}
+		if size == 0 {
+			c.done = true
+			return 0, io.EOF
+		}
+		c.remaining = size
+	}
+	if int64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.r.Read(p)
+	c.remaining -= int64(n)
+	if c.remaining == 0 && err == nil {
+		// chunk data is followed by CRLF
+		if _, err := c.r.Discard(2); err != nil {
+			return n, errChunkFormat
+		}
+	}
+	if err == io.EOF {
+		err = errChunkFormat
+	}
+	return n, err
+}
@@ -0,0 +1,138 @@
+package s3gateway
+
+import (
+	"encoding/hex"
+	"encoding/xml"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// upload is a multipart upload in progress. Uploads are kept in
+// memory of the node that serves them, parts are stored as chunks.
+type upload struct {
+	bucket string
+	key    string
+	parts  map[int]*blob
+}
+
+func (s *server) createMultipartUpload(w http.ResponseWriter, r *http.Request) {
+	bucket, key := r.PathValue("bucket"), r.PathValue("key")
+	id := uuid.New().String()
+	s.lock.Lock()
+	s.uploads[id] = &upload{bucket: bucket, key: key, parts: make(map[int]*blob)}
+	s.lock.Unlock()
+	writeXML(w, http.StatusOK, initiateMultipartUploadResult{Bucket: bucket, Key: key, UploadId: id})
+}
+
+func (s *server) uploadPart(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	number, err := strconv.Atoi(query.Get("partNumber"))
+	if err != nil || number < 1 || number > 10000 {
+		writeError(w, http.StatusBadRequest, "InvalidArgument", "Invalid part number")
+		return
+	}
+	u, ok := s.getUpload(w, r)
+	if !ok {
+		return
+	}
+	body, err := requestBody(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "InvalidRequest", err.Error())
+		return
+	}
+	part, err := s.writeChunks(r.Context(), u.bucket, body)
+	if err != nil {
+		writeBackendError(w, err)
+		return
+	}
+	s.lock.Lock()
+	old := u.parts[number]
+	u.parts[number] = part
+	s.lock.Unlock()
+	if old != nil {
+		s.deleteChunks(r.Context(), u.bucket, old.chunks)
+	}
+	w.Header().Set("ETag", quote(hex.EncodeToString(part.md5)))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *server) completeMultipartUpload(w http.ResponseWriter, r *http.Request) {
+	u, ok := s.getUpload(w, r)
+	if !ok {
+		return
+	}
+	var request completeMultipartUpload
+	err := xml.NewDecoder(r.Body).Decode(&request)
+	if err != nil || len(request.Parts) == 0 {
+		writeError(w, http.StatusBadRequest, "MalformedXML", "The XML you provided was not well-formed.")
+		return
+	}
+
+	s.lock.Lock()
+	var blobs []*blob
+	used := map[int]bool{}
+	chunks := 0
+	previous := 0
+	for _, part := range request.Parts {
+		b, found := u.parts[part.PartNumber]
+		if !found || part.PartNumber <= previous ||
+			strings.Trim(part.ETag, `"`) != hex.EncodeToString(b.md5) {
+			s.lock.Unlock()
+			writeError(w, http.StatusBadRequest, "InvalidPart", "One or more of the specified parts could not be found.")
+			return
+		}
+		previous = part.PartNumber
+		used[part.PartNumber] = true
+		chunks += len(b.chunks)
+		blobs = append(blobs, b)
+	}
+	if chunks > MaxChunks {
+		s.lock.Unlock()
+		writeError(w, http.StatusBadRequest, "EntityTooLarge", errTooLarge.Error())
+		return
+	}
+	delete(s.uploads, r.URL.Query().Get("uploadId"))
+	s.lock.Unlock()
+
+	// parts that are not listed are discarded
+	for number, part := range u.parts {
+		if !used[number] {
+			s.deleteChunks(r.Context(), u.bucket, part.chunks)
+		}
+	}
+	m := newManifest(u.key, "", blobs)
+	err = s.saveManifest(r.Context(), u.bucket, m)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
+	writeXML(w, http.StatusOK, completeMultipartUploadResult{Bucket: u.bucket, Key: u.key, ETag: m.ETag})
+}
+
+func (s *server) abortMultipartUpload(w http.ResponseWriter, r *http.Request) {
+	u, ok := s.getUpload(w, r)
+	if !ok {
+		return
+	}
+	s.lock.Lock()
+	delete(s.uploads, r.URL.Query().Get("uploadId"))
+	s.lock.Unlock()
+	for _, part := range u.parts {
+		s.deleteChunks(r.Context(), u.bucket, part.chunks)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *server) getUpload(w http.ResponseWriter, r *http.Request) (*upload, bool) {
+	s.lock.Lock()
+	u, ok := s.uploads[r.URL.Query().Get("uploadId")]
+	s.lock.Unlock()
+	if !ok || u.bucket != r.PathValue("bucket") || u.key != r.PathValue("key") {
+		writeError(w, http.StatusNotFound, "NoSuchUpload", "The specified multipart upload does not exist.")
+		return nil, false
+	}
+	return u, true
+}
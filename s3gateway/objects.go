@@ -0,0 +1,301 @@
+package s3gateway
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/vlado-github/tinydfs/messaging"
+	"github.com/vlado-github/tinydfs/persistance"
+)
+
+// MaxChunks limits the number of chunks in a manifest,
+// so that the manifest fits into persistance.MaxRecordSize
+const MaxChunks = 10000
+
+// MaxObjectSize is the largest object the gateway stores
+const MaxObjectSize = MaxChunks * persistance.ChunkSize
+
+// Object names are mapped to name based UUIDs of this namespace
+var objectNamespace = uuid.MustParse("1c0bd2a4-5e3f-4d4c-8f0e-7b2a9d6c3e51")
+
+var errTooLarge = errors.New("Object is larger than the maximum allowed size")
+
+// manifest is a record of the bucket topic describing an object
+type manifest struct {
+	Key          string
+	Size         int64
+	ETag         string
+	ContentType  string `json:",omitempty"`
+	LastModified time.Time
+	Chunks       []persistance.ChunkRef
+}
+
+// blob is a sequence of chunks written by one request
+type blob struct {
+	chunks []persistance.ChunkRef
+	size   int64
+	md5    []byte
+}
+
+func objectID(key string) uuid.UUID {
+	return uuid.NewSHA1(objectNamespace, []byte(key))
+}
+
+// Creates manifest of blobs, ETag of several blobs
+// is computed the way S3 does for multipart uploads
+func newManifest(key string, contentType string, blobs []*blob) *manifest {
+	m := &manifest{Key: key, ContentType: contentType, LastModified: time.Now().UTC().Truncate(time.Second)}
+	digests := md5.New()
+	for _, b := range blobs {
+		m.Chunks = append(m.Chunks, b.chunks...)
+		m.Size += b.size
+		digests.Write(b.md5)
+	}
+	if len(blobs) == 1 {
+		m.ETag = quote(hex.EncodeToString(blobs[0].md5))
+	} else {
+		m.ETag = quote(hex.EncodeToString(digests.Sum(nil)) + "-" + strconv.Itoa(len(blobs)))
+	}
+	return m
+}
+
+// Splits the body to chunks and writes them to a quorum of their owners
+func (s *server) writeChunks(ctx context.Context, bucket string, body io.Reader) (*blob, error) {
+	hash := md5.New()
+	send := func(topic string, payload []byte) (uuid.UUID, error) {
+		key := uuid.New()
+		return key, s.backend.Put(ctx, topic, key, string(payload), nil)
+	}
+	limited := io.LimitReader(io.TeeReader(body, hash), MaxObjectSize+1)
+	m, err := messaging.SendChunks(bucket, limited, send)
+	if err == nil && m.Size > MaxObjectSize {
+		err = errTooLarge
+	}
+	if err != nil {
+		s.deleteChunks(ctx, bucket, m.Chunks)
+		return nil, err
+	}
+	return &blob{chunks: m.Chunks, size: m.Size, md5: hash.Sum(nil)}, nil
+}
+
+// Writes error of a write to the backend, unreachable owners are
+// reported as unavailable, so clients retry the request later
+func writeBackendError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errTooLarge):
+		writeError(w, http.StatusBadRequest, "EntityTooLarge", err.Error())
+	case messaging.IsUnavailable(err):
+		writeError(w, http.StatusServiceUnavailable, "ServiceUnavailable", err.Error())
+	default:
+		writeError(w, http.StatusInternalServerError, "InternalError", err.Error())
+	}
+}
+
+func (s *server) deleteChunks(ctx context.Context, bucket string, chunks []persistance.ChunkRef) {
+	for _, chunk := range chunks {
+		s.backend.Delete(ctx, persistance.ChunkTopicName(bucket), chunk.Key)
+	}
+}
+
+func (s *server) getManifest(ctx context.Context, bucket string, key string) (*manifest, error) {
+	text, err := s.backend.Get(ctx, bucket, objectID(key))
+	if err != nil {
+		return nil, err
+	}
+	var m manifest
+	err = json.Unmarshal([]byte(text), &m)
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// Returns the lock serializing writes of the object
+func (s *server) objectLock(bucket string, key string) *sync.Mutex {
+	hash := fnv.New32a()
+	hash.Write([]byte(bucket + "/" + key))
+	return &s.objectLocks[hash.Sum32()%uint32(len(s.objectLocks))]
+}
+
+// Writes the manifest under the key derived from the object name,
+// so concurrent writes of an object replace one record.
+// Chunks of a replaced object are deleted.
+func (s *server) saveManifest(ctx context.Context, bucket string, m *manifest) error {
+	text, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	lock := s.objectLock(bucket, m.Key)
+	lock.Lock()
+	defer lock.Unlock()
+	old, oldErr := s.getManifest(ctx, bucket, m.Key)
+	err = s.backend.Put(ctx, bucket, objectID(m.Key), string(text), nil)
+	if err != nil {
+		return err
+	}
+	if oldErr == nil {
+		s.deleteChunks(ctx, bucket, old.Chunks)
+	}
+	return nil
+}
+
+func (s *server) getObject(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Has("uploadId") {
+		writeError(w, http.StatusNotImplemented, "NotImplemented", "ListParts is not supported")
+		return
+	}
+	bucket := r.PathValue("bucket")
+	m, ok := s.writeObjectHeaders(w, r)
+	if !ok {
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	reader := persistance.NewChunkReader(m.Chunks, func(key uuid.UUID) (string, error) {
+		return s.backend.Get(r.Context(), persistance.ChunkTopicName(bucket), key)
+	})
+	defer reader.Close()
+	// headers are sent already, on a missing or corrupted
+	// chunk the client sees a short body
+	io.Copy(w, reader)
+}
+
+func (s *server) headObject(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.writeObjectHeaders(w, r); ok {
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func (s *server) writeObjectHeaders(w http.ResponseWriter, r *http.Request) (*manifest, bool) {
+	m, err := s.getManifest(r.Context(), r.PathValue("bucket"), r.PathValue("key"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+		return nil, false
+	}
+	w.Header().Set("Content-Length", strconv.FormatInt(m.Size, 10))
+	w.Header().Set("ETag", m.ETag)
+	w.Header().Set("Last-Modified", m.LastModified.Format(http.TimeFormat))
+	if m.ContentType != "" {
+		w.Header().Set("Content-Type", m.ContentType)
+	} else {
+		w.Header().Set("Content-Type", "application/octet-stream")
+	}
+	return m, true
+}
+
+func (s *server) deleteObject(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Has("uploadId") {
+		s.abortMultipartUpload(w, r)
+		return
+	}
+	bucket, key := r.PathValue("bucket"), r.PathValue("key")
+	lock := s.objectLock(bucket, key)
+	lock.Lock()
+	defer lock.Unlock()
+	m, err := s.getManifest(r.Context(), bucket, key)
+	if err == nil {
+		s.backend.Delete(r.Context(), bucket, objectID(key))
+		s.deleteChunks(r.Context(), bucket, m.Chunks)
+	}
+	// deleting a missing object is not an error in S3
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *server) listObjects(w http.ResponseWriter, r *http.Request) {
+	bucket := r.PathValue("bucket")
+	query := r.URL.Query()
+	if query.Has("uploads") {
+		writeError(w, http.StatusNotImplemented, "NotImplemented", "ListMultipartUploads is not supported")
+		return
+	}
+	prefix := query.Get("prefix")
+	delimiter := query.Get("delimiter")
+	maxKeys := 1000
+	if value := query.Get("max-keys"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			writeError(w, http.StatusBadRequest, "InvalidArgument", "Invalid max-keys")
+			return
+		}
+		maxKeys = n
+	}
+	startAfter := query.Get("start-after")
+	if token := query.Get("continuation-token"); token != "" {
+		decoded, err := base64.StdEncoding.DecodeString(token)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "InvalidArgument", "Invalid continuation token")
+			return
+		}
+		startAfter = string(decoded)
+	}
+
+	var manifests []manifest
+	records, _ := s.backend.Scan(r.Context(), bucket)
+	for _, record := range records {
+		var m manifest
+		if json.Unmarshal([]byte(record.Text), &m) == nil && m.Key != "" {
+			manifests = append(manifests, m)
+		}
+	}
+	sort.Slice(manifests, func(i, j int) bool { return manifests[i].Key < manifests[j].Key })
+
+	result := listBucketResult{
+		Name:              bucket,
+		Prefix:            prefix,
+		Delimiter:         delimiter,
+		MaxKeys:           maxKeys,
+		StartAfter:        query.Get("start-after"),
+		ContinuationToken: query.Get("continuation-token"),
+	}
+	seenPrefixes := map[string]bool{}
+	last := ""
+	for _, m := range manifests {
+		if !strings.HasPrefix(m.Key, prefix) || m.Key <= startAfter {
+			continue
+		}
+		if result.KeyCount >= maxKeys {
+			result.IsTruncated = true
+			result.NextContinuationToken = base64.StdEncoding.EncodeToString([]byte(last))
+			break
+		}
+		if delimiter != "" {
+			if i := strings.Index(m.Key[len(prefix):], delimiter); i >= 0 {
+				commonPrefix := m.Key[:len(prefix)+i+len(delimiter)]
+				if !seenPrefixes[commonPrefix] {
+					seenPrefixes[commonPrefix] = true
+					result.CommonPrefixes = append(result.CommonPrefixes, commonPrefixXML{Prefix: commonPrefix})
+					result.KeyCount++
+				}
+				last = m.Key
+				continue
+			}
+		}
+		result.Contents = append(result.Contents, objectXML{
+			Key:          m.Key,
+			LastModified: m.LastModified.Format(time.RFC3339),
+			ETag:         m.ETag,
+			Size:         m.Size,
+			StorageClass: "STANDARD",
+		})
+		result.KeyCount++
+		last = m.Key
+	}
+	writeXML(w, http.StatusOK, result)
+}
+
+func quote(etag string) string {
+	return fmt.Sprintf("%q", etag)
+}
@@ -0,0 +1,262 @@
+package s3gateway
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/vlado-github/tinydfs/internal/gatewaytest"
+	"github.com/vlado-github/tinydfs/messaging"
+	"github.com/vlado-github/tinydfs/persistance"
+)
+
+// Creates AWS SDK client pointed at the gateway
+func newClient(t *testing.T) *s3.Client {
+	return newBackendClient(t, gatewaytest.NewQueuedBackend(t))
+}
+
+func newBackendClient(t *testing.T, b *gatewaytest.Backend) *s3.Client {
+	server := httptest.NewServer(NewHandler(b))
+	t.Cleanup(server.Close)
+	return s3.New(s3.Options{
+		Region:       "us-east-1",
+		BaseEndpoint: aws.String(server.URL),
+		UsePathStyle: true,
+		Credentials:  credentials.NewStaticCredentialsProvider("tinydfs", "tinydfs", ""),
+	})
+}
+
+func randomBytes(t *testing.T, size int) []byte {
+	data := make([]byte, size)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func getObject(t *testing.T, c *s3.Client, bucket string, key string) []byte {
+	out, err := c.GetObject(context.Background(), &s3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Body.Close()
+	data, err := io.ReadAll(out.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestGateway_WriteErrors(t *testing.T) {
+	b := gatewaytest.NewBackend(t)
+	handler := NewHandler(b)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/photos/big?uploads", nil))
+	var initiated initiateMultipartUploadResult
+	if err := xml.NewDecoder(recorder.Body).Decode(&initiated); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		err    error
+		status int
+		code   string
+	}{
+		{fmt.Errorf("%w, 1 of 3 replicas", messaging.ErrNoQuorum), http.StatusServiceUnavailable, "ServiceUnavailable"},
+		{errors.New("disk failed"), http.StatusInternalServerError, "InternalError"},
+	}
+	for _, c := range cases {
+		b.Fail(c.err)
+		for _, target := range []string{"/photos/cat.png", "/photos/big?partNumber=1&uploadId=" + initiated.UploadId} {
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPut, target, strings.NewReader("image")))
+			var response errorResponse
+			xml.NewDecoder(recorder.Body).Decode(&response)
+			if recorder.Code != c.status || response.Code != c.code {
+				t.Error(target, c.err, recorder.Code, response.Code)
+			}
+		}
+	}
+}
+
+func TestGateway_PutGetDeleteObject(t *testing.T) {
+	c := newClient(t)
+	ctx := context.Background()
+	data := randomBytes(t, 3*persistance.ChunkSize+100)
+
+	_, err := c.CreateBucket(ctx, &s3.CreateBucketInput{Bucket: aws.String("artifacts")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String("artifacts"),
+		Key:    aws.String("builds/app.bin"),
+		Body:   bytes.NewReader(data),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(getObject(t, c, "artifacts", "builds/app.bin"), data) {
+		t.Fatal("object content differs")
+	}
+
+	// overwrite with smaller object
+	_, err = c.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String("artifacts"),
+		Key:    aws.String("builds/app.bin"),
+		Body:   bytes.NewReader([]byte("small")),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(getObject(t, c, "artifacts", "builds/app.bin")) != "small" {
+		t.Fatal("object not replaced")
+	}
+
+	_, err = c.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: aws.String("artifacts"), Key: aws.String("builds/app.bin")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String("artifacts"), Key: aws.String("builds/app.bin")})
+	var noSuchKey *types.NoSuchKey
+	if err == nil || !errors.As(err, &noSuchKey) {
+		t.Fatal(err)
+	}
+}
+
+func TestGateway_ConcurrentPutObject(t *testing.T) {
+	b := gatewaytest.NewQueuedBackend(t)
+	c := newBackendClient(t, b)
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := c.PutObject(ctx, &s3.PutObjectInput{
+				Bucket: aws.String("backups"),
+				Key:    aws.String("db.dump"),
+				Body:   bytes.NewReader(randomBytes(t, 2*persistance.ChunkSize)),
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	manifests, err := b.Scan(ctx, "backups")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifests) != 1 {
+		t.Fatal("expected one manifest, got", len(manifests))
+	}
+	chunks, err := b.Scan(ctx, persistance.ChunkTopicName("backups"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) != 2 {
+		t.Fatal("chunks of replaced objects are left:", len(chunks))
+	}
+	if len(getObject(t, c, "backups", "db.dump")) != 2*persistance.ChunkSize {
+		t.Fatal("object content differs")
+	}
+}
+
+func TestGateway_ListObjectsV2(t *testing.T) {
+	c := newClient(t)
+	ctx := context.Background()
+	for _, key := range []string{"logs/a.txt", "logs/b.txt", "logs/2024/c.txt", "readme.md"} {
+		_, err := c.PutObject(ctx, &s3.PutObjectInput{Bucket: aws.String("files"), Key: aws.String(key), Body: bytes.NewReader([]byte(key))})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	out, err := c.ListObjectsV2(ctx, &s3.ListObjectsV2Input{Bucket: aws.String("files"), Prefix: aws.String("logs/"), Delimiter: aws.String("/")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out.Contents) != 2 || *out.Contents[0].Key != "logs/a.txt" || len(out.CommonPrefixes) != 1 || *out.CommonPrefixes[0].Prefix != "logs/2024/" {
+		t.Fatal(out.Contents, out.CommonPrefixes)
+	}
+
+	var keys []string
+	paginator := s3.NewListObjectsV2Paginator(c, &s3.ListObjectsV2Input{Bucket: aws.String("files"), MaxKeys: aws.Int32(3)})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, object := range page.Contents {
+			keys = append(keys, *object.Key)
+		}
+	}
+	if len(keys) != 4 || keys[3] != "readme.md" {
+		t.Fatal(keys)
+	}
+}
+
+func TestGateway_MultipartUpload(t *testing.T) {
+	c := newClient(t)
+	ctx := context.Background()
+	first := randomBytes(t, persistance.ChunkSize+1)
+	second := randomBytes(t, 10)
+
+	upload, err := c.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{Bucket: aws.String("media"), Key: aws.String("video.mp4")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var parts []types.CompletedPart
+	for i, data := range [][]byte{first, second} {
+		part, err := c.UploadPart(ctx, &s3.UploadPartInput{
+			Bucket:     aws.String("media"),
+			Key:        aws.String("video.mp4"),
+			UploadId:   upload.UploadId,
+			PartNumber: aws.Int32(int32(i + 1)),
+			Body:       bytes.NewReader(data),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts = append(parts, types.CompletedPart{ETag: part.ETag, PartNumber: aws.Int32(int32(i + 1))})
+	}
+	out, err := c.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String("media"),
+		Key:             aws.String("video.mp4"),
+		UploadId:        upload.UploadId,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasSuffix([]byte(*out.ETag), []byte(`-2"`)) {
+		t.Fatal(*out.ETag)
+	}
+	if !bytes.Equal(getObject(t, c, "media", "video.mp4"), append(first, second...)) {
+		t.Fatal("object content differs")
+	}
+
+	aborted, err := c.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{Bucket: aws.String("media"), Key: aws.String("tmp")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{Bucket: aws.String("media"), Key: aws.String("tmp"), UploadId: aborted.UploadId})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,115 @@
+package s3gateway
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/vlado-github/tinydfs/logging"
+	"github.com/vlado-github/tinydfs/persistance"
+)
+
+// Backend is the part of messaging.Node used by the gateway.
+type Backend interface {
+	Get(ctx context.Context, topic string, key uuid.UUID) (string, error)
+	Put(ctx context.Context, topic string, key uuid.UUID, text string, headers map[string]string) error
+	Delete(ctx context.Context, topic string, key uuid.UUID) error
+	Scan(ctx context.Context, topic string) ([]persistance.Record, error)
+}
+
+type server struct {
+	backend Backend
+	lock    sync.Mutex
+	uploads map[string]*upload
+	// writes of an object are serialized, so the replaced manifest is known
+	objectLocks [64]sync.Mutex
+}
+
+// NewHandler creates HTTP handler of the S3 compatible API.
+// Only path-style requests are supported, request signatures are not verified.
+func NewHandler(backend Backend) http.Handler {
+	s := &server{backend: backend, uploads: make(map[string]*upload)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("PUT /{bucket}", s.createBucket)
+	mux.HandleFunc("HEAD /{bucket}", s.headBucket)
+	mux.HandleFunc("GET /{bucket}", s.listObjects)
+	mux.HandleFunc("PUT /{bucket}/{key...}", s.putObject)
+	mux.HandleFunc("GET /{bucket}/{key...}", s.getObject)
+	mux.HandleFunc("HEAD /{bucket}/{key...}", s.headObject)
+	mux.HandleFunc("DELETE /{bucket}/{key...}", s.deleteObject)
+	mux.HandleFunc("POST /{bucket}/{key...}", s.postObject)
+	return validBuckets(mux)
+}
+
+// Rejects buckets that are not valid topic names before routing
+func validBuckets(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bucket, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+		if bucket != "" {
+			if err := persistance.ValidateTopic(bucket); err != nil {
+				writeError(w, http.StatusBadRequest, "InvalidBucketName", err.Error())
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ListenAndServe starts the S3 compatible API on the address
+func ListenAndServe(address string, backend Backend) error {
+	logging.AddInfo("[S3] Listening on " + address)
+	err := http.ListenAndServe(address, NewHandler(backend))
+	if err != nil {
+		logging.AddError("[S3] Error listening:", err.Error())
+	}
+	return err
+}
+
+// Buckets are topics, which are created on the first write
+func (s *server) createBucket(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *server) headBucket(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *server) putObject(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Has("uploadId") {
+		s.uploadPart(w, r)
+		return
+	}
+	bucket, key := r.PathValue("bucket"), r.PathValue("key")
+	body, err := requestBody(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "InvalidRequest", err.Error())
+		return
+	}
+	object, err := s.writeChunks(r.Context(), bucket, body)
+	if err != nil {
+		writeBackendError(w, err)
+		return
+	}
+	m := newManifest(key, r.Header.Get("Content-Type"), []*blob{object})
+	err = s.saveManifest(r.Context(), bucket, m)
+	if err != nil {
+		s.deleteChunks(r.Context(), bucket, object.chunks)
+		writeBackendError(w, err)
+		return
+	}
+	w.Header().Set("ETag", m.ETag)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *server) postObject(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Has("uploads") {
+		s.createMultipartUpload(w, r)
+	} else if query.Has("uploadId") {
+		s.completeMultipartUpload(w, r)
+	} else {
+		writeError(w, http.StatusNotImplemented, "NotImplemented", "POST object is not supported")
+	}
+}
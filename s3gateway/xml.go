@@ -0,0 +1,93 @@
+package s3gateway
+
+import (
+	"encoding/xml"
+	"net/http"
+
+	"github.com/vlado-github/tinydfs/logging"
+)
+
+const s3Namespace = "http://s3.amazonaws.com/doc/2006-03-01/"
+
+type errorResponse struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string
+	Message string
+}
+
+type listBucketResult struct {
+	XMLName               xml.Name `xml:"ListBucketResult"`
+	Xmlns                 string   `xml:"xmlns,attr"`
+	Name                  string
+	Prefix                string
+	Delimiter             string `xml:",omitempty"`
+	MaxKeys               int
+	KeyCount              int
+	IsTruncated           bool
+	StartAfter            string `xml:",omitempty"`
+	ContinuationToken     string `xml:",omitempty"`
+	NextContinuationToken string `xml:",omitempty"`
+	Contents              []objectXML
+	CommonPrefixes        []commonPrefixXML
+}
+
+type objectXML struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int64
+	StorageClass string
+}
+
+type commonPrefixXML struct {
+	Prefix string
+}
+
+type initiateMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Bucket   string
+	Key      string
+	UploadId string
+}
+
+type completeMultipartUpload struct {
+	XMLName xml.Name `xml:"CompleteMultipartUpload"`
+	Parts   []struct {
+		PartNumber int
+		ETag       string
+	} `xml:"Part"`
+}
+
+type completeMultipartUploadResult struct {
+	XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+	Xmlns   string   `xml:"xmlns,attr"`
+	Bucket  string
+	Key     string
+	ETag    string
+}
+
+func writeXML(w http.ResponseWriter, status int, body interface{}) {
+	switch v := body.(type) {
+	case listBucketResult:
+		v.Xmlns = s3Namespace
+		body = v
+	case initiateMultipartUploadResult:
+		v.Xmlns = s3Namespace
+		body = v
+	case completeMultipartUploadResult:
+		v.Xmlns = s3Namespace
+		body = v
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	w.Write([]byte(xml.Header))
+	err := xml.NewEncoder(w).Encode(body)
+	if err != nil {
+		logging.AddError("[S3] Encoding response failed.", err.Error())
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, code string, message string) {
+	writeXML(w, status, errorResponse{Code: code, Message: message})
+}
@@ -3,8 +3,11 @@ package main
 import (
 	"fmt"
 	"strconv"
+	"time"
 
 	"github.com/vlado-github/tinydfs/messaging"
+	"github.com/vlado-github/tinydfs/namespace"
+	"github.com/vlado-github/tinydfs/persistance"
 )
 
 func printWelcome() {
@@ -33,5 +36,46 @@ func printInfo(n messaging.Node) {
 
 func printHelp() {
 	fmt.Println("-listen or -l This arg is required, followed by port number for exchange queue")
-	fmt.Println("-connect or -c This arg is required, followed by IP and port of broadcast queue")
+	fmt.Println("-connect or -c This arg, -seeds or -discover is required, followed by IP and port of broadcast queue")
+	fmt.Println("-seeds or -s Comma separated host:port contact points, tried in order until one answers")
+	fmt.Println("-discover or -d UDP multicast group (or broadcast address) where members announce themselves, e.g. 239.255.42.99:9999")
+	fmt.Println("-cluster This arg is optional, followed by cluster ID announced with -discover")
+	fmt.Println("-bind This arg is optional, followed by IP, interface name or CIDR the exchange queue and gateways listen on, default is the device IP and all interfaces for gateways")
+	fmt.Println("-advertise This arg is optional, followed by IP, interface name or CIDR other nodes connect to")
+	fmt.Println("-transport This arg is optional, tcp (default) or unix, with unix ports are socket files and -bind their directory")
+	fmt.Println("-data This arg is optional, followed by the directory that keeps data of nodes, default is the directory of the binary")
+	fmt.Println("-bootstrap Starts a new single-node cluster when no seed answers or no member is discovered")
+	fmt.Println("-http This arg is optional, followed by port number for REST API")
+	fmt.Println("-grpc This arg is optional, followed by port number for gRPC API")
+	fmt.Println("-resp This arg is optional, followed by port number for Redis protocol")
+	fmt.Println("-s3 This arg is optional, followed by port number for S3 compatible API")
+	fmt.Println("-admin This arg is optional, followed by port number for the admin API listening on localhost")
+	fmt.Println("-migrate Converts text topic files of the directory to the binary record format")
+}
+
+func printCommands() {
+	fmt.Println("<topic>#<text> Writes text to the topic and prints its key")
+	fmt.Println("get <topic> <key> Reads value of the key")
+	fmt.Println("update <topic> <key> <text> Changes value of the key")
+	fmt.Println("scan <topic> Lists all records of the topic")
+	fmt.Println("ls [dir], mkdir <dir>, touch <file>, stat <path>, mv <old> <new>, rm <path> Manage files and directories")
+	fmt.Println("snapshot <file> Writes a backup of the node storage, restore <file> Rebuilds the storage from it")
+	fmt.Println("decommission Hands off topics of the node to other members and leaves the cluster")
+}
+
+func printRecords(records []persistance.Record) {
+	for _, record := range records {
+		fmt.Println(record.Key.String() + ": " + record.Text)
+	}
+	fmt.Println(">>> Records: " + strconv.Itoa(len(records)))
+}
+
+func printFileInfos(infos []namespace.FileInfo) {
+	for _, info := range infos {
+		kind := "-"
+		if info.IsDir {
+			kind = "d"
+		}
+		fmt.Printf("%s %10d %s %s %s\n", kind, info.Size, info.ModTime.Format(time.RFC3339), info.Owner, info.Path)
+	}
 }
@@ -2,99 +2,468 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"fmt"
+	"net"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/vlado-github/tinydfs/grpcgateway"
+	"github.com/vlado-github/tinydfs/httpgateway"
 	"github.com/vlado-github/tinydfs/logging"
 	"github.com/vlado-github/tinydfs/messaging"
+	"github.com/vlado-github/tinydfs/namespace"
+	"github.com/vlado-github/tinydfs/persistance"
+	"github.com/vlado-github/tinydfs/respgateway"
+	"github.com/vlado-github/tinydfs/s3gateway"
 	"github.com/vlado-github/tinydfs/utils"
 
 	"github.com/google/uuid"
 )
 
+const requestTimeout = 5 * time.Second
+
+// catching up with peers scans every topic of the node
+const restoreTimeout = time.Minute
+
 func main() {
 	defer close()
 
 	// verbose output of logging to console is enabled
 	logging.SetConfiguration(logging.ALL, "../bin/log")
 
-	var params = getParams()
-	if isValid(params) {
+	var config = getConfig()
+	if isValid(config) {
 		// start a node
 		printWelcome()
-		var n = startNode(params[0], params[1], params[2])
+		var n = startNode(config)
 		printInfo(n)
+		host := gatewayHost(config)
+		if config.httpPort != "" {
+			go httpgateway.ListenAndServe(net.JoinHostPort(host, config.httpPort), n)
+		}
+		if config.grpcPort != "" {
+			go grpcgateway.ListenAndServe(net.JoinHostPort(host, config.grpcPort), n)
+		}
+		if config.respPort != "" {
+			go respgateway.ListenAndServe(net.JoinHostPort(host, config.respPort), n)
+		}
+		if config.s3Port != "" {
+			go s3gateway.ListenAndServe(net.JoinHostPort(host, config.s3Port), n)
+		}
+		if config.adminPort != "" {
+			// admin API is reachable only from the host of the node
+			go httpgateway.ListenAndServeAdmin(net.JoinHostPort("localhost", config.adminPort), n)
+		}
 		// run application
 		runApp(n)
 	}
 }
 
-func getParams() []string {
-	params := make([]string, 3)
+// nodeConfig holds the command line arguments of a node
+type nodeConfig struct {
+	listenPort string
+	// broadcast queue of the -connect argument
+	queueIP   string
+	queuePort string
+	httpPort  string
+	grpcPort  string
+	respPort  string
+	s3Port    string
+	seeds     string
+	bootstrap bool
+	discover  string
+	clusterID string
+	bind      string
+	advertise string
+	transport string
+	dataDir   string
+	adminPort string
+}
+
+func getConfig() nodeConfig {
+	var config nodeConfig
 	if len(os.Args) > 1 {
 		arg0 := os.Args[1]
 		if arg0 == "-help" || arg0 == "-h" {
 			printHelp()
-		} else {
+		} else if arg0 == "-migrate" && len(os.Args) > 2 {
+			runMigrate(os.Args[2])
+		} else if len(os.Args) > 4 {
 			arg1 := os.Args[2]
 			arg2 := os.Args[3]
 			arg3 := os.Args[4]
-			arg4 := os.Args[5]
 			if (arg0 == "-listen" || arg0 == "-l") && arg1 != "" {
-				params[0] = arg1
+				config.listenPort = arg1
 			}
-			if (arg2 == "-connect" || arg2 == "-c") && arg3 != "" && arg4 != "" {
-				params[1] = arg3
-				params[2] = arg4
+			// optional arguments follow the value of the mode
+			optional := 5
+			if (arg2 == "-seeds" || arg2 == "-s") && arg3 != "" {
+				config.seeds = arg3
+			} else if (arg2 == "-discover" || arg2 == "-d") && arg3 != "" {
+				config.discover = arg3
+			} else if (arg2 == "-connect" || arg2 == "-c") && arg3 != "" && len(os.Args) > 5 && os.Args[5] != "" {
+				config.queueIP = arg3
+				config.queuePort = os.Args[5]
+				optional = 6
+			}
+			for i := optional; i < len(os.Args); i++ {
+				if os.Args[i] == "-bootstrap" {
+					config.bootstrap = true
+					continue
+				}
+				if i+1 >= len(os.Args) {
+					break
+				}
+				switch os.Args[i] {
+				case "-http":
+					config.httpPort = os.Args[i+1]
+				case "-grpc":
+					config.grpcPort = os.Args[i+1]
+				case "-resp":
+					config.respPort = os.Args[i+1]
+				case "-s3":
+					config.s3Port = os.Args[i+1]
+				case "-cluster":
+					config.clusterID = os.Args[i+1]
+				case "-bind":
+					config.bind = os.Args[i+1]
+				case "-advertise":
+					config.advertise = os.Args[i+1]
+				case "-transport":
+					config.transport = os.Args[i+1]
+				case "-data":
+					config.dataDir = os.Args[i+1]
+				case "-admin":
+					config.adminPort = os.Args[i+1]
+				}
+				i++
 			}
 		}
 	}
-	return params
+	return config
+}
+
+func isValid(config nodeConfig) bool {
+	return config.listenPort != "" && ((config.queueIP != "" && config.queuePort != "") || config.seeds != "" || config.discover != "")
 }
 
-func isValid(params []string) bool {
-	if len(params) > 0 && params[0] != "" && params[1] != "" && params[2] != "" {
-		return true
+func (config nodeConfig) protocol() string {
+	if config.transport != "" {
+		return config.transport
 	}
-	return false
+	return messaging.PROTOCOL_TCP
 }
 
-func startNode(port string, broadcastQueueIP string, broadcastQueuePort string) messaging.Node {
-	var deviceIP, err = utils.GetDeviceIpAddress()
+// Gateways listen on the bind address of the node, or on all
+// interfaces when there is none. Unix sockets bind a directory.
+func gatewayHost(config nodeConfig) string {
+	if config.bind == "" || config.protocol() == messaging.PROTOCOL_UNIX {
+		return ""
+	}
+	host, err := utils.ResolveIpAddress(config.bind)
 	if err != nil {
+		logging.AddError("Error: Bind address not found.", config.bind, err.Error())
+		os.Exit(1)
+	}
+	return host
+}
+
+func startNode(config nodeConfig) messaging.Node {
+	if config.dataDir != "" {
+		os.Setenv(messaging.DataDirEnv, config.dataDir)
+	}
+	protocol := config.protocol()
+	if _, err := messaging.GetTransport(protocol); err != nil {
+		logging.AddError("Error: Invalid transport. Hint: '-transport tcp' or '-transport unix'", protocol)
+		os.Exit(1)
+	}
+	var bindIP, err = resolveIpAddress(protocol, config.bind)
+	if err != nil && config.bind != "" {
+		logging.AddError("Error: Bind address not found.", config.bind, err.Error())
+		os.Exit(1)
+	} else if err != nil {
 		logging.AddWarning("Warning: Device IP not found.'")
-		deviceIP = "localhost"
+		bindIP = "localhost"
 	}
-	var connParams = messaging.ConnParams{
-		Ip:       deviceIP,
-		Port:     port,
-		Protocol: "tcp",
+	var advertiseIP string
+	if config.advertise != "" {
+		advertiseIP, err = resolveIpAddress(protocol, config.advertise)
+		if err != nil {
+			logging.AddError("Error: Advertise address not found.", config.advertise, err.Error())
+			os.Exit(1)
+		}
 	}
-	logging.AddTrace(broadcastQueueIP, broadcastQueuePort)
-	var broadcastConnParams = messaging.ConnParams{
-		Ip:       broadcastQueueIP,
-		Port:     broadcastQueuePort,
-		Protocol: "tcp",
+	var connParams = messaging.ConnParams{
+		Ip:          bindIP,
+		Port:        config.listenPort,
+		Protocol:    protocol,
+		AdvertiseIp: advertiseIP,
 	}
 
-	var n = messaging.NewNode(connParams, broadcastConnParams, true)
-	n.Run()
+	var n messaging.Node
+	if config.seeds != "" {
+		seeds, err := parseSeeds(config.seeds, protocol)
+		if err != nil {
+			logging.AddError("Error: Invalid seed list. Hint: '-seeds 10.0.0.1:3333,10.0.0.2:3333'", err.Error())
+			os.Exit(1)
+		}
+		n = messaging.NewSeededNode(connParams, seeds, config.bootstrap, true)
+	} else if config.discover != "" {
+		discovery := messaging.DiscoveryParams{Group: config.discover, ClusterID: config.clusterID}
+		n = messaging.NewDiscoveringNode(connParams, discovery, config.bootstrap, true)
+	} else {
+		logging.AddTrace(config.queueIP, config.queuePort)
+		var broadcastConnParams = messaging.ConnParams{
+			Ip:       config.queueIP,
+			Port:     config.queuePort,
+			Protocol: protocol,
+		}
+		n = messaging.NewNode(connParams, broadcastConnParams, true)
+	}
+	if err := n.Run(); err != nil {
+		logging.AddError("Error: Node not started.", err.Error())
+		os.Exit(1)
+	}
 	return n
 }
 
+// Unix sockets take the directory of the socket file as it is
+func resolveIpAddress(protocol string, selector string) (string, error) {
+	if protocol == messaging.PROTOCOL_UNIX {
+		return selector, nil
+	}
+	return utils.ResolveIpAddress(selector)
+}
+
+// Parses comma separated host:port contact points
+func parseSeeds(list string, protocol string) ([]messaging.ConnParams, error) {
+	var seeds []messaging.ConnParams
+	for _, address := range strings.Split(list, ",") {
+		host, port, err := net.SplitHostPort(strings.TrimSpace(address))
+		if err != nil {
+			return nil, err
+		}
+		seeds = append(seeds, messaging.ConnParams{Ip: host, Port: port, Protocol: protocol})
+	}
+	return seeds, nil
+}
+
+func runMigrate(pathDir string) {
+	migrated, err := persistance.MigrateDirectory(pathDir)
+	if err != nil {
+		fmt.Println("Migration failed:", err.Error())
+	}
+	fmt.Println(">>> Migrated topics: " + strconv.Itoa(migrated))
+}
+
 func runApp(n messaging.Node) {
+	printCommands()
+	reader := bufio.NewReader(os.Stdin)
 	for {
-		reader := bufio.NewReader(os.Stdin)
-		fmt.Print("Enter topic#text:")
-		text, _ := reader.ReadString('\n')
-		msgArgs := strings.Split(text, "#")
-		if len(msgArgs) != 2 {
-			logging.AddError("Error: Invalid input. Hint: 'sport#We're watching a match.'")
-		} else {
-			var message = messaging.Message{Key: uuid.New(), Topic: msgArgs[0], Payload: []byte(msgArgs[1])}
-			n.SendMessage(message)
+		fmt.Print("Enter topic#text or command:")
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		text := strings.TrimSpace(line)
+		args := strings.Fields(text)
+		if len(args) == 0 {
+			continue
 		}
+		switch args[0] {
+		case "get":
+			runGet(n, args)
+		case "update":
+			runUpdate(n, line)
+		case "scan":
+			runScan(n, args)
+		case "ls", "mkdir", "touch", "stat", "mv", "rm":
+			runNamespace(n, args)
+		case "snapshot":
+			runSnapshot(n, args)
+		case "restore":
+			runRestore(n, args)
+		case "decommission":
+			if runDecommission(n) {
+				return
+			}
+		default:
+			runWrite(n, text)
+		}
+	}
+}
+
+func runWrite(n messaging.Node, text string) {
+	msgArgs := strings.SplitN(text, "#", 2)
+	if len(msgArgs) != 2 {
+		logging.AddError("Error: Invalid input. Hint: 'sport#We're watching a match.'")
+		return
+	}
+	if err := persistance.ValidateTopic(msgArgs[0]); err != nil {
+		logging.AddError("Error: " + err.Error())
+		return
+	}
+	var message = messaging.Message{Key: uuid.New(), Topic: msgArgs[0], Payload: []byte(msgArgs[1])}
+	n.SendMessage(message)
+	fmt.Println(">>> Key: " + message.Key.String())
+}
+
+func runGet(n messaging.Node, args []string) {
+	if len(args) != 3 {
+		logging.AddError("Error: Invalid input. Hint: 'get <topic> <key>'")
+		return
+	}
+	key, err := uuid.Parse(args[2])
+	if err != nil {
+		logging.AddError("Error: Invalid key.", err.Error())
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	value, err := n.Get(ctx, args[1], key)
+	if err != nil {
+		logging.AddError("Error: Get failed.", err.Error())
+		return
+	}
+	fmt.Println(value)
+}
+
+func runUpdate(n messaging.Node, line string) {
+	args := strings.Fields(line)
+	if len(args) < 4 {
+		logging.AddError("Error: Invalid input. Hint: 'update <topic> <key> <text>'")
+		return
+	}
+	key, err := uuid.Parse(args[2])
+	if err != nil {
+		logging.AddError("Error: Invalid key.", err.Error())
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	err = n.Update(ctx, args[1], key, updateText(line))
+	if err != nil {
+		logging.AddError("Error: Update failed.", err.Error())
+		return
+	}
+	fmt.Println(">>> Updated.")
+}
+
+// Returns the text of an update command as it was typed,
+// i.e. the rest of the line after the key and one separator
+func updateText(line string) string {
+	rest := line
+	for i := 0; i < 3; i++ {
+		rest = strings.TrimLeft(rest, " \t")
+		end := strings.IndexAny(rest, " \t")
+		if end < 0 {
+			return ""
+		}
+		rest = rest[end:]
+	}
+	return rest[1:]
+}
+
+func runScan(n messaging.Node, args []string) {
+	if len(args) != 2 {
+		logging.AddError("Error: Invalid input. Hint: 'scan <topic>'")
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	records, err := n.Scan(ctx, args[1])
+	if err != nil {
+		logging.AddError("Error: Scan failed.", err.Error())
+		return
+	}
+	printRecords(records)
+}
+
+func runSnapshot(n messaging.Node, args []string) {
+	if len(args) != 2 {
+		logging.AddError("Error: Invalid input. Hint: 'snapshot <file>'")
+		return
+	}
+	manifest, err := n.Snapshot(args[1])
+	if err != nil {
+		logging.AddError("Error: Snapshot failed.", err.Error())
+		return
+	}
+	fmt.Println(">>> Snapshot topics: " + strconv.Itoa(len(manifest.Topics)))
+}
+
+func runRestore(n messaging.Node, args []string) {
+	if len(args) != 2 {
+		logging.AddError("Error: Invalid input. Hint: 'restore <file>'")
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), restoreTimeout)
+	defer cancel()
+	manifest, err := n.Restore(ctx, args[1])
+	if err != nil {
+		logging.AddError("Error: Restore failed.", err.Error())
+		return
+	}
+	fmt.Println(">>> Restored snapshot of " + manifest.CreatedAt.Format(time.RFC3339))
+}
+
+// Returns true when the node left the cluster
+func runDecommission(n messaging.Node) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), messaging.DecommissionTimeout)
+	defer cancel()
+	err := n.Decommission(ctx)
+	status := n.GetDecommissionStatus()
+	if err != nil {
+		logging.AddError("Error: Decommission failed.", err.Error())
+		return false
+	}
+	fmt.Println(">>> Handed off topics: " + strconv.Itoa(status.HandedOff) + "/" + strconv.Itoa(status.Topics))
+	return true
+}
+
+func runNamespace(n messaging.Node, args []string) {
+	ns := n.GetNamespace()
+	owner := n.GetID().String()
+	var err error
+	switch {
+	case args[0] == "ls" && len(args) <= 2:
+		dir := namespace.Root
+		if len(args) == 2 {
+			dir = args[1]
+		}
+		var infos []namespace.FileInfo
+		infos, err = ns.List(dir)
+		if err == nil {
+			printFileInfos(infos)
+		}
+	case args[0] == "mkdir" && len(args) == 2:
+		_, err = ns.Mkdir(args[1], owner)
+	case args[0] == "touch" && len(args) == 2:
+		var info namespace.FileInfo
+		info, err = ns.Create(args[1], owner, 1)
+		if err == nil {
+			fmt.Println(">>> Topic: " + info.Topic)
+		}
+	case args[0] == "stat" && len(args) == 2:
+		var info namespace.FileInfo
+		info, err = ns.Stat(args[1])
+		if err == nil {
+			printFileInfos([]namespace.FileInfo{info})
+		}
+	case args[0] == "mv" && len(args) == 3:
+		err = ns.Rename(args[1], args[2])
+	case args[0] == "rm" && len(args) == 2:
+		err = ns.Remove(args[1])
+	default:
+		logging.AddError("Error: Invalid input. Hint: 'ls [dir]', 'mkdir <dir>', 'touch <file>', 'stat <path>', 'mv <old> <new>', 'rm <path>'")
+		return
+	}
+	if err != nil {
+		logging.AddError("Error: "+args[0]+" failed.", err.Error())
 	}
 }
 
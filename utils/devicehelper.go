@@ -1,25 +1,69 @@
 package utils
 
 import (
+	"errors"
 	"github.com/vlado-github/tinydfs/logging"
 	"net"
 )
 
-// GetDeviceIpAddress returns current IP address of the device
+var ErrAddressNotFound = errors.New("No IP address matches the interface or network")
+
+// GetDeviceIpAddress returns the first non-loopback IPv4 address of the device,
+// or its first global IPv6 address if the device has no IPv4 address
 func GetDeviceIpAddress() (string, error) {
-	ipAddress := ""
-	addrs, err := net.InterfaceAddrs()
+	return ResolveIpAddress("")
+}
+
+// ResolveIpAddress returns the IP address selected by an IP, an interface
+// name (e.g. eth0) or a CIDR (e.g. 10.0.0.0/8, fd00::/8). IPv4 addresses of
+// an interface are preferred, link-local IPv6 addresses are skipped.
+func ResolveIpAddress(selector string) (string, error) {
+	if ip := net.ParseIP(selector); ip != nil {
+		return ip.String(), nil
+	}
+	var network *net.IPNet
+	if selector != "" {
+		if _, ipNet, err := net.ParseCIDR(selector); err == nil {
+			network = ipNet
+		}
+	}
+
+	interfaces, err := net.Interfaces()
 	if err != nil {
 		logging.AddError("Retrieving host's IP address failed.", err.Error())
+		return "", err
 	}
-
-	for _, a := range addrs {
-		if ipnet, ok := a.(*net.IPNet); ok && !ipnet.IP.IsLoopback() {
+	ipv6 := ""
+	for _, ifi := range interfaces {
+		if ifi.Flags&net.FlagUp == 0 {
+			continue
+		}
+		byName := selector != "" && network == nil
+		if byName && ifi.Name != selector {
+			continue
+		}
+		addrs, err := ifi.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			ipnet, ok := a.(*net.IPNet)
+			if !ok || ipnet.IP.IsLinkLocalUnicast() || (!byName && ipnet.IP.IsLoopback()) {
+				continue
+			}
+			if network != nil && !network.Contains(ipnet.IP) {
+				continue
+			}
 			if ipnet.IP.To4() != nil {
-				ipAddress = ipnet.IP.String()
+				return ipnet.IP.String(), nil
+			}
+			if ipv6 == "" {
+				ipv6 = ipnet.IP.String()
 			}
 		}
 	}
-
-	return ipAddress, err
+	if ipv6 != "" {
+		return ipv6, nil
+	}
+	return "", ErrAddressNotFound
 }